@@ -177,15 +177,21 @@ CREATE TABLE IF NOT EXISTS `user` (
   `character` enum('Rabbit','Hedgehog','Squirrel','Cat') NOT NULL DEFAULT 'Rabbit' COMMENT 'user appearance',
   `gems` int(10) unsigned NOT NULL DEFAULT '0' COMMENT 'gems count',
   `trust_points` int(10) unsigned NOT NULL DEFAULT '20' COMMENT 'trust points count',
+  `skill_rating` int(10) unsigned NOT NULL DEFAULT '1500' COMMENT 'skill rating (Elo)',
   `last_enemy` bigint(20) unsigned DEFAULT NULL COMMENT 'last enemy user_id',
   `agent_info` varchar(64) NOT NULL DEFAULT '' COMMENT 'agent information (version, platform, language, etc.)',
   `last_login` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'last login time',
   PRIMARY KEY (`user_id`),
-  UNIQUE KEY `name` (`name`)
+  UNIQUE KEY `name` (`name`),
+  KEY `skill_rating` (`skill_rating`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='user table';
 
 -- Data exporting was unselected.
 
+-- Migration of an existing database to 1.4.0 (this script drops the database, so run this statement instead):
+-- ALTER TABLE `user` ADD COLUMN `skill_rating` int(10) unsigned NOT NULL DEFAULT '1500' COMMENT 'skill rating (Elo)'
+--   AFTER `trust_points`, ADD KEY `skill_rating` (`skill_rating`);
+
 
 -- Dumping structure for table rush.user_ability
 DROP TABLE IF EXISTS `user_ability`;
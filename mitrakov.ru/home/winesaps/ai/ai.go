@@ -4,7 +4,7 @@ import "sync"
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 
 // Path of AI movement (e.g. path [0, 1, 2, 3] means that AI goes 3 steps right from the left-top corner)
-type pathT []byte
+type pathT []uint16
 
 // Ai is a component that represents AI actor. One instance is for one user enemy.
 // This component is independent.
@@ -16,10 +16,11 @@ type Ai struct {
     curTool      byte
     curPath      pathT
     graph        *Graph
-    xyFunc       func() byte
-    bewareFunc   func(byte) bool // check if the AI should beware of a node with a given index 
-    resources    map[byte]bool   // xy -> resourceExists
-    tools        map[byte]byte   // xy -> toolID
+    xyFunc       func() uint16
+    bewareFunc   func(uint16) bool // check if the AI should beware of a node with a given index 
+    resources    map[uint16]bool   // xy -> resourceExists
+    tools        map[uint16]byte   // xy -> toolID
+    rnd          *Rand
 }
 
 // min distance to a node we beware of
@@ -30,8 +31,11 @@ const fleeSteps = 6
 // NewAi creates a new Ai. Please do not create a Ai directly.
 // "xyFunc" - function to locate an AI actor on the battle field in case of reset
 // "bewareFunc" - function to determine if AI should be scared of a cell with given coordinates
-func NewAi(xyFunc func() byte, bewareFunc func(byte) bool) *Ai {
-    return &Ai{xyFunc: xyFunc, bewareFunc: bewareFunc, resources: make(map[byte]bool), tools: make(map[byte]byte)}
+// "rnd" - random generator
+func NewAi(xyFunc func() uint16, bewareFunc func(uint16) bool, rnd *Rand) *Ai {
+    Assert(rnd)
+    return &Ai{xyFunc: xyFunc, bewareFunc: bewareFunc, resources: make(map[uint16]bool),
+        tools: make(map[uint16]byte), rnd: rnd}
 }
 
 // Init initializes AI with a given graph
@@ -41,7 +45,7 @@ func (ai *Ai) Init(graph *Graph) {
     ai.delayedPause = 0
     ai.toolDelay = 0
     ai.curTool = 0
-    ai.curPath = make([]byte, 0)
+    ai.curPath = make(pathT, 0)
     ai.graph = graph
     ai.Unlock()
 }
@@ -49,14 +53,14 @@ func (ai *Ai) Init(graph *Graph) {
 // Reset clears current path of the AI
 func (ai *Ai) Reset() {
     ai.Lock()
-    ai.curPath = make([]byte, 0)
+    ai.curPath = make(pathT, 0)
     ai.Unlock()
 }
 
 // SetResource sets or unsets the resource in a given graph node
 // "idx" - graph node number
 // "value" - TRUE to set the resourse, and FALSE to unset one
-func (ai *Ai) SetResource(idx byte, value bool) {
+func (ai *Ai) SetResource(idx uint16, value bool) {
     Assert(ai.resources)
     ai.Lock()
     ai.resources[idx] = value
@@ -66,7 +70,7 @@ func (ai *Ai) SetResource(idx byte, value bool) {
 // SetTool sets or unsets the tool in a given graph node
 // "idx" - graph node number
 // "value" - TRUE to set the tool, and FALSE to unset one
-func (ai *Ai) SetTool(idx byte, value byte) {
+func (ai *Ai) SetTool(idx uint16, value byte) {
     Assert(ai.tools)
     ai.Lock()
     ai.tools[idx] = value
@@ -99,14 +103,14 @@ func (ai *Ai) SetDelayedPauseSteps(steps uint8) {
 
 // Step performs a single step of AI
 // nolint: gocyclo
-func (ai *Ai) Step() (idxFrom, idxTo byte, useTool bool, err *Error) {
+func (ai *Ai) Step() (idxFrom, idxTo uint16, useTool bool, err *Error) {
     ai.Lock()
     defer ai.Unlock()
     
     if ai.graph != nil {
         // if we don't know where we are
         if len(ai.curPath) == 0 {
-            ai.curPath = []byte{ai.xyFunc()}
+            ai.curPath = pathT{ai.xyFunc()}
         }
         // check delayed pause
         if len(ai.curPath) == 1 && ai.delayedPause > 0 {
@@ -115,11 +119,11 @@ func (ai *Ai) Step() (idxFrom, idxTo byte, useTool bool, err *Error) {
         }
         // there is no current goal: let's find it
         if len(ai.curPath) == 1 {
-            ai.curPath = ai.graph.traverse(ai.curPath[0], ai.resources, false, 0xFF, 0xFF)
+            ai.curPath = ai.graph.traverse(ai.rnd, ai.curPath[0], ai.resources, false, nowhere, 0xFF)
         }
         // still no current goal? Maybe dangers block the way? So let's find path taking dangers into account
         if len(ai.curPath) == 1 {
-            dangerPath := ai.graph.traverse(ai.curPath[0], ai.resources, true, 0xFF, 0xFF)
+            dangerPath := ai.graph.traverse(ai.rnd, ai.curPath[0], ai.resources, true, nowhere, 0xFF)
             
             if len(dangerPath) > 1 {
                 // find danger type and danger index in the path
@@ -143,7 +147,8 @@ func (ai *Ai) Step() (idxFrom, idxTo byte, useTool bool, err *Error) {
                 } else {
                     for k, v := range ai.tools {
                         if v == danger {
-                            toolPath := ai.graph.traverse(ai.curPath[0], map[byte]bool{k: true}, false, 0xFF, 0xFF)
+                            toolPath := ai.graph.traverse(ai.rnd, ai.curPath[0], map[uint16]bool{k: true}, false,
+                                nowhere, 0xFF)
                             if len(toolPath) > 1 {
                                 ai.curPath = toolPath
                                 break
@@ -157,7 +162,7 @@ func (ai *Ai) Step() (idxFrom, idxTo byte, useTool bool, err *Error) {
         // do we beware of someone?
         if ok, bewareIdx := ai.isBeware(); ok {
             ai.pause = 0
-            ai.curPath = ai.graph.traverse(ai.curPath[0], ai.resources, false, bewareIdx, fleeSteps)
+            ai.curPath = ai.graph.traverse(ai.rnd, ai.curPath[0], ai.resources, false, bewareIdx, fleeSteps)
         }
         
         // move
@@ -185,12 +190,12 @@ func (ai *Ai) Step() (idxFrom, idxTo byte, useTool bool, err *Error) {
 }
 
 // isBeware checks whether the AI is afraid of any node within the limits of "bewareDistance" steps
-// Returns (true, index_of_node) if yes, and (false, 255) if not
-func (ai *Ai) isBeware() (res bool, idx byte) {
+// Returns (true, index_of_node) if yes, and (false, 0xFFFF) if not
+func (ai *Ai) isBeware() (res bool, idx uint16) {
     for i:=1; i<=bewareDistance; i++ {
         if len(ai.curPath) > i && ai.bewareFunc(ai.curPath[i]) {
             return true, ai.curPath[i]
         }
     }
-    return false, 0xFF
+    return false, nowhere
 }
@@ -3,12 +3,11 @@ package ai
 import "fmt"
 import "bytes"
 import "strconv"
-import "math/rand"
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 
 // NodeT represents a single graph node
 type NodeT struct {
-    n byte
+    n uint16
     colored bool
     danger  byte
     arcs [4]*NodeT
@@ -16,13 +15,21 @@ type NodeT struct {
 
 // Graph structure represents a graph: set of nodes connected with set of arcs
 type Graph struct {
-    nodes [256]*NodeT
+    nodes []*NodeT
+}
+
+// nowhere is a number of a non-existing node (see "except" parameter of traverse())
+const nowhere = 0xFFFF
+
+// NewGraph creates a new empty Graph with a given count of nodes. Please do not create a Graph directly.
+func NewGraph(size int) *Graph {
+    return &Graph{nodes: make([]*NodeT, size)}
 }
 
 // AddNode adds a node with number "n" to the graph. "danger" parameter indicates what resource should be used to
 // eliminate the danger.
 // Pass 0 if the node is not dangerous
-func (graph *Graph) AddNode(n byte, danger byte) {
+func (graph *Graph) AddNode(n uint16, danger byte) {
     node := new(NodeT)
     node.n = n
     node.danger = danger
@@ -34,7 +41,7 @@ func (graph *Graph) AddNode(n byte, danger byte) {
 // 1 = right
 // 2 = up
 // 3 = down
-func (graph *Graph) AddArc(n, direction, pointsTo byte) {
+func (graph *Graph) AddArc(n uint16, direction byte, pointsTo uint16) {
     node := graph.nodes[n]
     Assert(node)
     if 0 <= direction && direction < byte(len(node.arcs)) {
@@ -43,8 +50,33 @@ func (graph *Graph) AddArc(n, direction, pointsTo byte) {
 }
 
 // GetNode returns a node by its number
-func (graph Graph) GetNode(n byte) *NodeT {
-    return graph.nodes[n]
+func (graph Graph) GetNode(n uint16) *NodeT {
+    if int(n) < len(graph.nodes) {
+        return graph.nodes[n]
+    }
+    return nil
+}
+
+// Reachable returns numbers of all the nodes that can be reached from a node with a given number, including itself
+// (dangerous nodes are also considered as reachable)
+// "from" - start node number
+func (graph *Graph) Reachable(from uint16) map[uint16]bool {
+    res := make(map[uint16]bool)
+    if start := graph.GetNode(from); start != nil {
+        queue := []*NodeT{start}
+        res[from] = true
+        for len(queue) > 0 {
+            node := queue[0]
+            queue = queue[1:]
+            for _, next := range node.arcs {
+                if next != nil && !res[next.n] {
+                    res[next.n] = true
+                    queue = append(queue, next)
+                }
+            }
+        }
+    }
+    return res
 }
 
 // String represents a graph in details
@@ -90,21 +122,26 @@ func (node NodeT) String() string {
 }
 
 // traverse recursively traverses a graph trying to find out at least 1 resource, represented by "resources" map.
-// Returns a full path found, represented as a byte array of node numbers (inclusively).
+// Returns a full path found, represented as an array of node numbers (inclusively).
+// "rnd" - random generator
 // "idx" - start point
 // "resources" - resources map (xy -> resource_exists)
 // "findDanger" - whether to take dangerous cells into account (default is false)
-// "except" - AI should avoid a node with number "except" (pass 0xFF if it's not required)
+// "except" - AI should avoid a node with number "except" (pass 0xFFFF if it's not required)
 // "maxLen" - restricts the total path length (default is 0xFF)
 // nolint: gocyclo
-func (graph *Graph) traverse(idx byte, resources map[byte]bool, findDanger bool, except, maxLen byte) (result []byte) {
-    Assert(resources)
+func (graph *Graph) traverse(rnd *Rand, idx uint16, resources map[uint16]bool, findDanger bool, except uint16,
+    maxLen byte) (result pathT) {
+    Assert(rnd, resources)
     
     // declare traverse recursive function
-    var f func(*NodeT, []byte) (bool, []byte)
-    f = func (node *NodeT, path []byte) (bool, []byte) {
+    var f func(*NodeT, pathT) (bool, pathT)
+    f = func (node *NodeT, path pathT) (bool, pathT) {
         if node == nil { // it may happen after sudden teleporting; just move 1 step left or right to recover AI state
-            return true, []byte{idx, Ternary(rand.Intn(2) == 0, idx + 1, idx - 1)}
+            if rnd.Intn(2) == 0 {
+                return true, pathT{idx, idx + 1}
+            }
+            return true, pathT{idx, idx - 1}
         }
         
         // append new index to path
@@ -135,7 +172,7 @@ func (graph *Graph) traverse(idx byte, resources map[byte]bool, findDanger bool,
         }
         // shuffling (see stackoverflow.com/questions/12264789)
         for i:=0; i<variantsCnt; i++ {
-            j := rand.Intn(i+1)
+            j := rnd.Intn(i+1)
             variants[i], variants[j] = variants[j], variants[i]
         }
         // fall in recursion
@@ -148,7 +185,7 @@ func (graph *Graph) traverse(idx byte, resources map[byte]bool, findDanger bool,
     }
     
     // start traversing
-    _, result = f(graph.nodes[idx], make([]byte, 0))
+    _, result = f(graph.GetNode(idx), make(pathT, 0))
     
     // clean up our graph after usage
     for _, node := range graph.nodes {
@@ -1,11 +1,9 @@
 // Copyright 2017-2018 Artem Mitrakov. All rights reserved.
-package main
+package ai
 
 import "log"
 import "sync"
 import "time"
-import "math/rand"
-import . "mitrakov.ru/home/winesaps/ai"       // nolint
 import . "mitrakov.ru/home/winesaps/sid"      // nolint
 import . "mitrakov.ru/home/winesaps/utils"    // nolint
 import . "mitrakov.ru/home/winesaps/battle"   // nolint
@@ -16,16 +14,22 @@ type aiInfoT struct {
     ai          *Ai
     myChar      byte
     myNumber    byte
+    aggressor   bool
+    strength    byte // 0-100, where 50 is a standard AI (see setScore()) (1.4.0+)
     totalScore1 byte
     totalScore2 byte
-    objects     map[byte]byte
+    objects     map[byte]uint16 // object number -> xy
+    width       int             // battlefield width (since 1.4.0 it may differ from level to level)
+    wide        bool            // TRUE if xy in messages takes 2 bytes (see battle.IsWide())
+    paused      bool            // TRUE while the battle is paused by disconnection of the opponent (1.4.0+)
+    rnd         *Rand
 }
 
 // An AiManager is a single entity to control the lifecycle of all AI players.
 // This component is "dependent"
 type AiManager struct {
     sync.RWMutex
-    controller    *Controller
+    controller    IController
     battleManager IBattleManager
     ais           map[Sid]*aiInfoT
     stop          chan bool
@@ -38,15 +42,33 @@ const minHandicap = 15
 // maxRandHandicap is a max random parameter to be added to minHandicap
 const maxRandHandicap = 10
 
+// Server API codes of the messages which AI players react on (see Server API Doc)
+const (
+    cmdFullState     = 16
+    cmdStateChanged  = 23
+    cmdScoreChanged  = 24
+    cmdEffectChanged = 25
+    cmdThingTaken    = 27
+    cmdFinished      = 29
+    cmdBattlePaused  = 50
+    cmdBattleResumed = 51
+)
+
 // NewAiManager creates a new instance of AiManager. Please do not create an AiManager directly.
-// "controller" - event handler
+// "controller" - event handler (may be NULL, but then SetController() must be called before the first AI is added)
 // "battleMgr" - reference to an IBattleManager
-func NewAiManager(controller *Controller, battleMgr IBattleManager) *AiManager {
+// "clock" - time source for AI steps (should be the same as for the IBattleManager)
+func NewAiManager(controller IController, battleMgr IBattleManager, clock Clock) *AiManager {
+    Assert(clock)
     mgr := &AiManager{controller: controller, battleManager: battleMgr, ais: make(map[Sid]*aiInfoT)}
-    mgr.stop = RunDaemon("ai", tickDelay, func() {
+    mgr.stop = clock.RunDaemon("ai", tickDelay, func() {
         mgr.RLock()
         for sid, info := range mgr.ais {
             mgr.RUnlock()
+            if info.isPaused() {
+                mgr.RLock()
+                continue
+            }
             idxFrom, idxTo, useThing, err := info.ai.Step()
             if err == nil {
                 if useThing {
@@ -66,70 +88,96 @@ func NewAiManager(controller *Controller, battleMgr IBattleManager) *AiManager {
     return mgr
 }
 
-// setController sets a NON-NULL controller for AiManager
-func (mgr *AiManager) setController(controller *Controller) {
+// SetController sets a NON-NULL controller for AiManager
+func (mgr *AiManager) SetController(controller IController) {
     Assert(controller)
     mgr.controller = controller
 }
 
-// addNewAi creates a new AI player and maps a given sid to that AI
-func (mgr *AiManager) addNewAi(sid Sid, character byte) {
-    Assert(mgr.ais, mgr.battleManager)
+// AddNewAi creates a new AI player and maps a given sid to that AI
+// "sid" - Session ID of the AI
+// "character" - character of the AI
+// "aggressor" - TRUE if the AI plays for the Aggressor (Actor1), FALSE for the Defender (Actor2)
+// "strength" - strength of the AI: 0-100, where 0 is the weakest AI, 50 is a standard one, and 100 never plays softly
+// "rnd" - random generator for the AI (should be derived from the battle seed to make the battle reproducible)
+func (mgr *AiManager) AddNewAi(sid Sid, character byte, aggressor bool, strength byte, rnd *Rand) {
+    Assert(mgr.ais, mgr.battleManager, rnd)
 
-    f := func() byte {
-        xy, err := mgr.battleManager.GetActorXy(sid, false)
+    f := func() uint16 {
+        xy, err := mgr.battleManager.GetActorXy(sid, aggressor)
         Check(err)
         return xy
     }
-    g := func(xy byte) bool {
+    g := func(xy uint16) bool {
         res, err := mgr.battleManager.WolfExists(sid, xy)
         Check(err)
         return res
     }
     mgr.Lock()
-    mgr.ais[sid] = &aiInfoT{ai: NewAi(f, g), myChar: character, objects: make(map[byte]byte)}
+    mgr.ais[sid] = &aiInfoT{ai: NewAi(f, g, rnd.Fork()), myChar: character, aggressor: aggressor,
+        strength: byte(Min(uint(strength), 100)), objects: make(map[byte]uint16), width: Width, rnd: rnd}
     mgr.Unlock()
 }
 
-// removeAi removes AI player by a given sid
-func (mgr *AiManager) removeAi(sid Sid) {
+// RestartAi prepares an existing AI player for a new battle (e.g. a rematch): the AI keeps its character, side and
+// strength, but forgets everything about the previous battle; returns FALSE if the AI is not found
+// "sid" - Session ID of the AI
+// "rnd" - random generator for the AI (should be derived from the battle seed to make the battle reproducible)
+func (mgr *AiManager) RestartAi(sid Sid, rnd *Rand) bool {
+    if aiInfo, ok := mgr.getAiInfo(sid); ok {
+        mgr.AddNewAi(sid, aiInfo.myChar, aiInfo.aggressor, aiInfo.strength, rnd)
+        return true
+    }
+    return false
+}
+
+// RemoveAi removes AI player by a given sid
+func (mgr *AiManager) RemoveAi(sid Sid) {
     Assert(mgr.ais)
     mgr.Lock()
     delete(mgr.ais, sid)
     mgr.Unlock()
 }
 
-// handleEvent handles all events from a given box, addressed to an AI player with a given sid
+// HandleEvent handles all events from a given box, addressed to an AI player with a given sid
 // nolint: gocyclo
-func (mgr *AiManager) handleEvent(sid Sid, box *MailBox) *MailBox {
+func (mgr *AiManager) HandleEvent(sid Sid, box *MailBox) *MailBox {
     Assert(box)
     for _, msg := range box.Pick(sid) {
         if len(msg) > 0 {
-            switch cmd(msg[0]) {
-                case fullState:
+            switch msg[0] {
+                case cmdFullState:
                     if len(msg) > 1 {
                         mgr.setFullState(sid, msg[1:])
                     }
-                case stateChanged:
-                    if len(msg) > 4 {
-                        mgr.stateChanged(sid, msg[1], msg[3], msg[4] == 1) // msg[2] (objID) not used
+                case cmdStateChanged:
+                    xySize := TernaryInt(mgr.isWide(sid), 2, 1)
+                    if len(msg) > 3+xySize { // msg[2] (objID) not used
+                        mgr.stateChanged(sid, msg[1], GetXy(msg[3:], xySize == 2), msg[3+xySize] == 1)
                     }
-                case thingTaken:
+                case cmdThingTaken:
                     if len(msg) > 2 {
                         mgr.setThing(sid, msg[1], msg[2])
                     }
-                case effectChanged:
+                case cmdEffectChanged:
                     if len(msg) > 3 {
                         mgr.setEffect(sid, msg[1], msg[2] == 1, msg[3])
                     }
-                case scoreChanged:
+                case cmdScoreChanged:
                     if len(msg) > 2 {
                         mgr.setScore(sid, msg[1], msg[2])
                     }
-                case finished:
+                case cmdFinished:
                     if len(msg) > 4 {
                         mgr.setTotalScore(sid, msg[3], msg[4])
                     }
+                    if len(msg) > 1 && msg[1] == 1 { // game over: stay idle until a rematch (or removal)
+                        if aiInfo, ok := mgr.getAiInfo(sid); ok {
+                            mgr.RestartAi(sid, aiInfo.rnd.Fork())
+                        }
+                    }
+                case cmdBattlePaused, cmdBattleResumed:
+                    mgr.setPaused(sid, msg[0] == cmdBattlePaused)
             }
         }
     }
@@ -146,26 +194,43 @@ func (mgr *AiManager) getAiInfo(sid Sid) (info *aiInfoT, ok bool) {
     return
 }
 
-// close shuts AiManager down
-func (mgr *AiManager) close() {
+// isWide checks whether xy takes 2 bytes in the messages addressed to an AI player with a given sid
+func (mgr *AiManager) isWide(sid Sid) bool {
+    if aiInfo, ok := mgr.getAiInfo(sid); ok {
+        aiInfo.RLock()
+        defer aiInfo.RUnlock()
+        return aiInfo.wide
+    }
+    return false
+}
+
+// Close shuts AiManager down
+func (mgr *AiManager) Close() {
     Assert(mgr.stop)
     mgr.stop <- true
 }
 
 // move is a handler for MOVE command
-func (mgr *AiManager) move(sid Sid, indexFrom, indexTo byte) {
+func (mgr *AiManager) move(sid Sid, indexFrom, indexTo uint16) {
     Assert(mgr.battleManager, mgr.controller)
 
+    width := Width
+    if aiInfo, ok := mgr.getAiInfo(sid); ok {
+        aiInfo.RLock()
+        width = aiInfo.width
+        aiInfo.RUnlock()
+    }
+
     // calculate the direction
     dir := byte(0)
     delta := int(indexTo) - int(indexFrom)
-    if delta == Width {
+    if delta == width {
         dir = 0
-    } else if delta == -Width {
+    } else if delta == -width {
         dir = 2
-    } else if delta%Width == 1 {
+    } else if delta%width == 1 {
         dir = 4
-    } else if delta%Width == -1 || delta%Width == Width-1 {
+    } else if delta%width == -1 || delta%width == width-1 {
         dir = 1
     } else {
         log.Println("ERROR: Incorrect AI delta! from = ", indexFrom, "; to = ", indexTo)
@@ -176,23 +241,47 @@ func (mgr *AiManager) move(sid Sid, indexFrom, indexTo byte) {
     mgr.controller.Event(mgr.battleManager.Move(sid, dir))
 }
 
+// setPaused is a handler for BATTLE PAUSED and BATTLE RESUMED commands: a paused AI stays idle
+func (mgr *AiManager) setPaused(sid Sid, paused bool) {
+    if aiInfo, ok := mgr.getAiInfo(sid); ok {
+        aiInfo.Lock()
+        aiInfo.paused = paused
+        aiInfo.Unlock()
+    }
+}
+
+// isPaused checks whether the battle of the AI player is paused
+func (info *aiInfoT) isPaused() bool {
+    info.RLock()
+    defer info.RUnlock()
+    return info.paused
+}
+
 // setFullState is a handler for FULL STATE command
 // nolint: gocyclo
 func (mgr *AiManager) setFullState(sid Sid, state []byte) {
     if aiInfo, ok := mgr.getAiInfo(sid); ok {
-        graph := parseLevel(state, aiInfo.myChar)
+        graph := ParseLevel(state, aiInfo.myChar)
         aiInfo.ai.Init(graph)
+        width, height, offset := ParseHeader(state)
+        aiInfo.Lock()
+        aiInfo.width, aiInfo.wide = width, IsWide(width, height)
+        aiInfo.Unlock()
         curObjNum := byte(0)
-        for i := byte(0); i < Width*Height; i++ {
+        for i := uint16(0); int(i) < width*height && offset+int(i) < len(state); i++ {
             aiInfo.ai.SetResource(i, false)
             aiInfo.ai.SetTool(i, 0)
-            obj := state[i] & 0x3F
+            obj := state[offset+int(i)] & 0x3F
             switch obj {
+            case 0x04:
+                fallthrough
             case 0x05:
                 curObjNum++
-                aiInfo.Lock()
-                aiInfo.myNumber = curObjNum
-                aiInfo.Unlock()
+                if (obj == 0x04) == aiInfo.aggressor { // 0x04 is Actor1 (Aggressor), 0x05 is Actor2 (Defender)
+                    aiInfo.Lock()
+                    aiInfo.myNumber = curObjNum
+                    aiInfo.Unlock()
+                }
             case 0x10:
                 fallthrough
             case 0x11:
@@ -229,8 +318,6 @@ func (mgr *AiManager) setFullState(sid Sid, state []byte) {
                 aiInfo.objects[curObjNum] = i
                 aiInfo.ai.SetTool(i, obj)
                 aiInfo.Unlock()
-            case 0x04:
-                fallthrough
             case 0x06:
                 fallthrough
             case 0x0F:
@@ -239,6 +326,10 @@ func (mgr *AiManager) setFullState(sid Sid, state []byte) {
                 fallthrough
             case 0x17:
                 fallthrough
+            case 0x18:
+                fallthrough
+            case 0x19:
+                fallthrough
             case 0x28:
                 fallthrough
             case 0x29:
@@ -262,11 +353,11 @@ func (mgr *AiManager) setFullState(sid Sid, state []byte) {
 }
 
 // stateChanged is a handler for STATE CHANGED command
-func (mgr *AiManager) stateChanged(sid Sid, objNum, xy byte, reset bool) {
+func (mgr *AiManager) stateChanged(sid Sid, objNum byte, xy uint16, reset bool) {
     if aiInfo, ok := mgr.getAiInfo(sid); ok {
         aiInfo.RLock()
         actorRestarted := objNum == aiInfo.myNumber && reset
-        objRemoved := xy == 0xFF
+        objRemoved := xy == nowhere
         if actorRestarted {
             aiInfo.ai.Reset()
         } else if objRemoved {
@@ -305,8 +396,9 @@ func (mgr *AiManager) setEffect(sid Sid, effect byte, added bool, number byte) {
 func (mgr *AiManager) setScore(sid Sid, score1, score2 byte) {
     if aiInfo, ok := mgr.getAiInfo(sid); ok {
         if isHandicapNeeded(aiInfo, score1, score2) {
-            steps := uint8(rand.Intn(maxRandHandicap)) + minHandicap // delay AI for several steps
-            aiInfo.ai.SetDelayedPauseSteps(steps)
+            steps := aiInfo.rnd.Intn(maxRandHandicap) + minHandicap // delay AI for several steps
+            steps = steps * (100 - int(aiInfo.strength)) / 50         // the stronger AI, the shorter delay
+            aiInfo.ai.SetDelayedPauseSteps(uint8(steps))
         }
     }
 }
@@ -318,16 +410,23 @@ func (mgr *AiManager) setTotalScore(sid Sid, score1, score2 byte) {
     }
 }
 
-// parseLevel converts a level (expressed as bytearray) into a Graph data structure
+// ParseLevel converts a level (expressed as bytearray) into a Graph data structure; food which is poison for a given
+// character is marked as dangerous (pass 0 to ignore poison)
 // nolint: gocyclo
-func parseLevel(data []byte, character byte) *Graph {
-    Assert(data)
+func ParseLevel(level []byte, character byte) *Graph {
+    Assert(level)
     
-    res := new(Graph)
+    width, height, offset := ParseHeader(level)
+    size := width * height
+    data := level[offset:]
+    if len(data) < size { // incorrect level: make an empty graph
+        return NewGraph(0)
+    }
+    res := NewGraph(size)
     // nodes
-    for i:=0; i<Height; i++ {
-        for j:=0; j<Width; j++ {
-            idx := byte(i*Width+j)
+    for i:=0; i<height; i++ {
+        for j:=0; j<width; j++ {
+            idx := uint16(i*width+j)
             bottom := data[idx] >> 6
             obj := data[idx] & 0x3F
             if bottom > 0 || obj == 12 {                 // bottom non-empty (or rope exists)
@@ -346,48 +445,49 @@ func parseLevel(data []byte, character byte) *Graph {
         }
     }
     // arcs
-    for i:=0; i<Height; i++ {
-        for j:=0; j<Width; j++ {
-            idx := byte(i*Width+j)
+    w := uint16(width)
+    for i:=0; i<height; i++ {
+        for j:=0; j<width; j++ {
+            idx := uint16(i*width+j)
             node := res.GetNode(idx)
             if node != nil {
                 bottom := data[idx] >> 6
                 obj := data[idx] & 0x3F
                 // left arc
-                if idx % Width != 0 {
+                if idx % w != 0 {
                     bottomLeft := data[idx-1] >> 6
                     objLeft := data[idx-1] & 0x3F
                     if objLeft != 1 && objLeft != 3 {                    // not block, not water
                         fromBlockToDais := bottom == 1 && bottomLeft == 2
                         if !fromBlockToDais || obj == 11 {               // obj==11 is Stair
                             res.AddArc(idx, 0, idx-1)
-                            for k:=1; node.GetNext(0) == nil && int(idx)+k*Width-1 < len(data); k++ { // k must be int!
-                                res.AddArc(idx, 0, idx+byte(k)*Width-1)
+                            for k:=1; node.GetNext(0) == nil && int(idx)+k*width-1 < size; k++ { // k must be int!
+                                res.AddArc(idx, 0, idx+uint16(k)*w-1)
                             }
                         }
                     }
                 }
                 // right arc
-                if (idx+1) % Width != 0 {
+                if (idx+1) % w != 0 {
                     bottomRight := data[idx+1] >> 6
                     objRight := data[idx+1] & 0x3F
                     if objRight != 1 && objRight != 3 {                     // right object not block, not water
                         fromBlockToDais := bottom == 1 && bottomRight == 2
                         if !fromBlockToDais || obj == 11 {                  // obj==11 is Stair
                             res.AddArc(idx, 1, idx+1)
-                            for k:=1; node.GetNext(1) == nil && int(idx)+k*Width+1 < len(data); k++ { // k must be int!
-                                res.AddArc(idx, 1, idx+byte(k)*Width+1)
+                            for k:=1; node.GetNext(1) == nil && int(idx)+k*width+1 < size; k++ { // k must be int!
+                                res.AddArc(idx, 1, idx+uint16(k)*w+1)
                             }
                         }
                     }
                 }
                 // up arc
-                if idx-Width >= 0 && (obj == 10 || obj == 12) { // LadderBottom or RopeLine
-                    res.AddArc(idx, 2, idx-Width)
+                if idx >= w && (obj == 10 || obj == 12) { // LadderBottom or RopeLine
+                    res.AddArc(idx, 2, idx-w)
                 }
                 // down arc
-                if int(idx+Width) < len(data) && obj == 9 {     // LadderTop
-                    res.AddArc(idx, 3, idx+Width)
+                if int(idx+w) < size && obj == 9 {        // LadderTop
+                    res.AddArc(idx, 3, idx+w)
                 }
             }
         }
@@ -0,0 +1,230 @@
+package main
+
+import "os"
+import "log"
+import "sync"
+import "time"
+import "io/ioutil"
+import "encoding/json"
+import . "mitrakov.ru/home/winesaps/sid"   // nolint
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// AntiCheat is a server-side validator of the movement rate of actors. Every actor has a movement budget (a token
+// bucket), refilled by server time at the rate an actor can really walk; a move beyond the budget is rejected.
+// Note that the moves are timed on receipt, and a transport may deliver several moves at once (SwUDP releases the
+// messages in order, a client may batch the commands), so short intervals alone are fine while the budget lasts; but a
+// move beyond the budget that follows the previous one faster than any client could send it is considered an
+// impossible sequence (e.g. a speed hack or a replayed packet stream).
+// Each violation increases the suspicion score of the user (the score fades out with time); as soon as the score
+// reaches the threshold, the policy is applied: the user is logged, flagged for review (the list of flagged users is
+// stored in a JSON file; it is written by the daemon, so that the moves never wait for disk I/O) or forced to give up
+// the battle.
+// This component is independent.
+type AntiCheat struct {
+    sync.Mutex
+    rate        float64       // moves per second an actor can make in a long run
+    burst       float64       // max count of moves an actor can make at once (e.g. after standing still)
+    minInterval time.Duration // min interval between 2 moves; a shorter one beyond the budget is impossible
+    threshold   uint          // suspicion score to apply the policy
+    policy      cheatPolicy
+    flagFile    string
+    budgets     map[Sid]*budgetT
+    suspicion   map[string]uint      // user name -> suspicion score
+    flagged     map[string]time.Time // user name -> time when the user was flagged
+    dirty       bool                 // list of flagged users is changed, but not saved yet
+    fileMutex   sync.Mutex           // to prevent the daemon and close() from writing the file simultaneously
+    now         func() time.Time     // clock (may be replaced in tests)
+    stop        chan bool
+}
+
+// budgetT is a movement budget of a single actor
+type budgetT struct {
+    moves     float64
+    timestamp time.Time
+}
+
+// policy to apply to the users with high suspicion score
+type cheatPolicy byte
+
+// possible policies
+const (
+    policyLog cheatPolicy = iota
+    policyFlag
+    policyForfeit
+)
+
+// suspicion points for violations
+const (
+    overBudgetPoints = 1 // a move beyond the budget
+    impossiblePoints = 3 // a move beyond the budget right after the previous one (see "minInterval")
+)
+
+// interval to fade out suspicion scores (by 1 point), to remove outdated budgets and to save the flagged users
+const cheatFadePeriod = 10 * time.Second
+
+// parseCheatPolicy converts a given string (e.g. from the INI-file) to a policy: "log", "flag" or "forfeit"
+func parseCheatPolicy(s string) (cheatPolicy, bool) {
+    policy, ok := map[string]cheatPolicy{"log": policyLog, "flag": policyFlag, "forfeit": policyForfeit}[s]
+    return policy, ok
+}
+
+// NewAntiCheat creates a new instance of AntiCheat. Please do not create an AntiCheat directly.
+// "rate" - moves per second an actor can make in a long run
+// "burst" - max count of moves an actor can make at once
+// "minInterval" - min interval between 2 moves (shorter intervals beyond the budget are considered impossible)
+// "threshold" - suspicion score to apply the policy
+// "policy" - policy to apply to suspected users
+// "flagFile" - path to a file to persist the list of flagged users (pass "" to keep it in memory only)
+func NewAntiCheat(rate, burst float64, minInterval time.Duration, threshold uint, policy cheatPolicy,
+    flagFile string) (*AntiCheat, *Error) {
+    cheat := &AntiCheat{rate: rate, burst: burst, minInterval: minInterval, threshold: threshold, policy: policy,
+        flagFile: flagFile, budgets: make(map[Sid]*budgetT), suspicion: make(map[string]uint),
+        flagged: make(map[string]time.Time), now: time.Now}
+    err := cheat.load()
+    cheat.stop = RunDaemon("anticheat", cheatFadePeriod, cheat.cleanUp)
+    return cheat, err
+}
+
+// checkMove spends 1 move from the budget of a given actor; returns the count of suspicion points of the move (0 for a
+// fair move), and error if the move must be rejected
+// "sid" - Session ID of a user who moves the actor
+func (cheat *AntiCheat) checkMove(sid Sid) (points uint, err *Error) {
+    cheat.Lock()
+    defer cheat.Unlock()
+
+    now := cheat.now()
+    budget, found := cheat.budgets[sid]
+    if !found {
+        budget = &budgetT{cheat.burst, now}
+        cheat.budgets[sid] = budget
+    }
+    tooFast := found && now.Sub(budget.timestamp) < cheat.minInterval
+    budget.moves += now.Sub(budget.timestamp).Seconds() * cheat.rate
+    if budget.moves > cheat.burst {
+        budget.moves = cheat.burst
+    }
+    budget.timestamp = now
+    if budget.moves < 1 {
+        if tooFast {
+            points += impossiblePoints
+        }
+        return points + overBudgetPoints, NewErr(cheat, 140, "Movement budget exceeded (sid=%d)", sid)
+    }
+    budget.moves--
+    return points, nil
+}
+
+// suspect adds suspicion points to a given user; returns the policy to apply, and TRUE if the score has reached the
+// threshold (the score is reset in this case)
+// "name" - user name
+// "points" - suspicion points
+func (cheat *AntiCheat) suspect(name string, points uint) (cheatPolicy, bool) {
+    cheat.Lock()
+    defer cheat.Unlock()
+
+    cheat.suspicion[name] += points
+    if cheat.suspicion[name] < cheat.threshold {
+        return cheat.policy, false
+    }
+    log.Printf("WARNING! Suspicious movement rate: user %s (policy %d)\n", name, cheat.policy)
+    delete(cheat.suspicion, name)
+    if cheat.policy >= policyFlag {
+        if _, ok := cheat.flagged[name]; !ok {
+            cheat.flagged[name] = cheat.now()
+            cheat.dirty = true
+        }
+    }
+    return cheat.policy, true
+}
+
+// getFlagged returns all the flagged users along with the time when they were flagged
+func (cheat *AntiCheat) getFlagged() map[string]time.Time {
+    cheat.Lock()
+    defer cheat.Unlock()
+
+    res := make(map[string]time.Time)
+    for k, v := range cheat.flagged {
+        res[k] = v
+    }
+    return res
+}
+
+// unflag removes a given user from the list of flagged users; returns FALSE if the user hasn't been flagged
+// "name" - user name
+func (cheat *AntiCheat) unflag(name string) (ok bool, err *Error) {
+    cheat.Lock()
+    defer cheat.Unlock()
+
+    if _, ok = cheat.flagged[name]; ok {
+        delete(cheat.flagged, name)
+        cheat.dirty = true
+    }
+    return
+}
+
+// close shuts AntiCheat down and releases all seized resources; unsaved changes of the flagged list are flushed
+func (cheat *AntiCheat) close() {
+    Assert(cheat.stop)
+    cheat.stop <- true
+    Check(cheat.save())
+}
+
+// cleanUp fades out the suspicion scores, removes outdated budgets (a budget is full again after "cheatFadePeriod"
+// anyway) and saves the list of flagged users if it's changed
+func (cheat *AntiCheat) cleanUp() {
+    cheat.Lock()
+
+    for k, v := range cheat.suspicion {
+        if v > 1 {
+            cheat.suspicion[k] = v - 1
+        } else {
+            delete(cheat.suspicion, k)
+        }
+    }
+    for k, v := range cheat.budgets {
+        if cheat.now().Sub(v.timestamp) > cheatFadePeriod {
+            delete(cheat.budgets, k)
+        }
+    }
+    cheat.Unlock()
+
+    Check(cheat.save())
+}
+
+// load reads the list of flagged users from the file (if the file doesn't exist, it is NOT an error)
+func (cheat *AntiCheat) load() *Error {
+    if cheat.flagFile != "" {
+        data, err := ioutil.ReadFile(cheat.flagFile)
+        if err == nil {
+            err = json.Unmarshal(data, &cheat.flagged)
+            log.Printf("%d flagged users loaded\n", len(cheat.flagged))
+        } else if os.IsNotExist(err) {
+            err = nil
+        }
+        return NewErrFromError(cheat, 141, err)
+    }
+    return nil
+}
+
+// save writes the list of flagged users to the file, if the list is changed. Note that a caller must NOT hold the lock
+func (cheat *AntiCheat) save() *Error {
+    if cheat.flagFile != "" {
+        cheat.fileMutex.Lock() // must be acquired first, so that an older copy never overwrites a newer one
+        defer cheat.fileMutex.Unlock()
+
+        cheat.Lock()
+        if !cheat.dirty {
+            cheat.Unlock()
+            return nil
+        }
+        cheat.dirty = false
+        data, err := json.Marshal(cheat.flagged)
+        cheat.Unlock()
+
+        if err == nil {
+            err = WriteFileAtomic(cheat.flagFile, data)
+        }
+        return NewErrFromError(cheat, 142, err)
+    }
+    return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import "os"
+import "time"
+import "testing"
+import "io/ioutil"
+import "path/filepath"
+
+// TestCheckMove checks that batched moves are tolerated while the budget lasts, and fast moves beyond the budget are
+// considered impossible
+func TestCheckMove(t *testing.T) {
+    cheat, err := NewAntiCheat(8, 5, 20*time.Millisecond, 30, policyLog, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cheat.close()
+    now := time.Now()
+    cheat.now = func() time.Time { return now }
+
+    tests := []struct {
+        step     time.Duration
+        points   uint
+        rejected bool
+    }{
+        {0, 0, false}, {0, 0, false}, {0, 0, false}, {0, 0, false}, {0, 0, false}, // a batch within the burst
+        {0, overBudgetPoints + impossiblePoints, true},
+        {200 * time.Millisecond, 0, false}, // the budget is refilled
+        {0, overBudgetPoints + impossiblePoints, true},
+        {100 * time.Millisecond, 0, false},
+        {30 * time.Millisecond, overBudgetPoints, true}, // the budget is still empty, but the interval is possible
+    }
+    for i, test := range tests {
+        now = now.Add(test.step)
+        points, err := cheat.checkMove(1)
+        if points != test.points || (err != nil) != test.rejected {
+            t.Errorf("%d: checkMove() = %d, %v; expected %d, rejected = %v", i, points, err, test.points,
+                test.rejected)
+        }
+    }
+}
+
+// TestFlagFile checks that flagged users are saved by the daemon (not on the move), and loaded on the next start
+func TestFlagFile(t *testing.T) {
+    dir, er := ioutil.TempDir("", "anticheat")
+    if er != nil {
+        t.Fatal(er)
+    }
+    defer os.RemoveAll(dir)
+    flagFile := filepath.Join(dir, "flagged.json")
+
+    cheat, err := NewAntiCheat(8, 5, 20*time.Millisecond, 3, policyFlag, flagFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, applied := cheat.suspect("Alice", impossiblePoints); !applied {
+        t.Errorf("Policy is not applied")
+    }
+    if _, er = os.Stat(flagFile); !os.IsNotExist(er) {
+        t.Errorf("File is written before cleanUp(): %v", er)
+    }
+    cheat.cleanUp()
+    cheat.close()
+
+    cheat, err = NewAntiCheat(8, 5, 20*time.Millisecond, 3, policyFlag, flagFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer cheat.close()
+    if _, ok := cheat.getFlagged()["Alice"]; !ok || len(cheat.getFlagged()) != 1 {
+        t.Errorf("Incorrect flagged users: %v", cheat.getFlagged())
+    }
+}
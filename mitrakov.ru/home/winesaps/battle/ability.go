@@ -1,5 +1,9 @@
 package battle
 
+import "sync"
+import "time"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
 // Swagga is a non-consumable ability: an actor just can put it on and take advantage of it all the time
 type Swagga int
 
@@ -15,135 +19,137 @@ const (
     Sunglasses
 )
 
-// Skill is a consumable ability: an actor can convert it into a thing (the Skill will disappear until next round)
+// Skill is a consumable ability: an actor can convert it into a thing (the Skill will disappear as soon as all its
+// charges are spent, until next round)
 type Skill interface {
     getID() byte
     isUsed() bool
     apply(objNum byte) Thing
 }
 
+// ability kind
+type abilityKind byte
 
-// Miner can produce a MineThing (0x21)
-type Miner struct {
-    used bool
-}
-
-// getID return ID of the Skill
-func (*Miner) getID() byte {
-    return 0x21
-}
-
-// isUsed returns whether this Skill is already used or still available
-func (miner *Miner) isUsed() bool {
-    return miner.used
-}
+// ability kinds
+const (
+    KindSwagga abilityKind = iota // non-consumable ability (see Swagga)
+    KindSkill                     // consumable ability (see Skill)
+    KindPack                      // purchasable product that doesn't affect battles (e.g. SpPack2)
+)
 
-// apply converts the Skill into a Thing
-// "objNum" - unique object number on the battlefield
-func (miner *Miner) apply(objNum byte) Thing {
-    if miner.used {
-        return nil
+// AbilityInfo is an entry of the ability registry; it declares everything the battle system needs to know about a
+// purchasable ability, so that adding a new ability means an entry in the registry (see RegisterAbility()) plus a row
+// in "ability" DB table (1.4.0+)
+type AbilityInfo struct {
+    ID         byte
+    Name       string                  // the same as "ability.name" in DB
+    Kind       abilityKind
+    Thing      func(objNum byte) Thing // produces a Thing for a Skill (NULL for other kinds)
+    Charges    byte                    // how many times a Skill may be used per round
+    Cooldown   time.Duration           // min interval between 2 usages of a Skill
+    Characters []byte                  // characters that can equip the ability (empty means "all the characters")
+}
+
+// abilities is the ability registry (ID -> AbilityInfo)
+var abilities = make(map[byte]*AbilityInfo)
+// abilitiesLock is a locker for the ability registry
+var abilitiesLock sync.RWMutex
+
+func init() {
+    for _, info := range []*AbilityInfo{
+        {ID: byte(Snorkel), Name: "Snorkel", Kind: KindSwagga},
+        {ID: byte(ClimbingShoes), Name: "ClimbingShoes", Kind: KindSwagga},
+        {ID: byte(SouthWester), Name: "SouthWester", Kind: KindSwagga},
+        {ID: byte(VoodooMask), Name: "VoodooMask", Kind: KindSwagga},
+        {ID: byte(SapperShoes), Name: "SapperShoes", Kind: KindSwagga},
+        {ID: byte(Sunglasses), Name: "Sunglasses", Kind: KindSwagga},
+        {ID: 0x12, Name: "SpPack2", Kind: KindPack},
+        {ID: 0x21, Name: "Miner", Kind: KindSkill, Charges: 1, Thing: func(num byte) Thing {
+            return newMineThing(num, nil)
+        }},
+        {ID: 0x22, Name: "Builder", Kind: KindSkill, Charges: 1, Thing: func(num byte) Thing {
+            return newBeamThing(num, nil)
+        }},
+        {ID: 0x23, Name: "Shaman", Kind: KindSkill, Charges: 1, Thing: func(num byte) Thing {
+            return newAntidoteThing(num, nil)
+        }},
+        {ID: 0x24, Name: "Grenadier", Kind: KindSkill, Charges: 1, Thing: func(num byte) Thing {
+            return newFlashbangThing(num, nil)
+        }},
+        {ID: 0x25, Name: "TeleportMan", Kind: KindSkill, Charges: 1, Thing: func(num byte) Thing {
+            return newTeleportThing(num, nil)
+        }},
+    } {
+        Check(RegisterAbility(info))
     }
-    miner.used = true
-    return newMineThing(objNum, nil)
-}
-
-// Builder can produce a BeamThing (0x22)
-type Builder struct {
-    used bool
 }
 
-// getID return ID of the Skill
-func (*Builder) getID() byte {
-    return 0x22
-}
+// RegisterAbility adds a new ability to the registry; returns error if the ability is inconsistent, or an ability
+// with the same ID has been already registered
+// "info" - ability description
+func RegisterAbility(info *AbilityInfo) *Error {
+    Assert(info)
 
-// isUsed returns whether this Skill is already used or still available
-func (bld *Builder) isUsed() bool {
-    return bld.used
-}
-
-// apply converts the Skill into a Thing
-// "objNum" - unique object number on the battlefield
-func (bld *Builder) apply(objNum byte) Thing {
-    if bld.used {
-        return nil
+    if info.Kind == KindSkill && (info.Thing == nil || info.Charges == 0) {
+        return NewErr(info, 124, "Skill must produce a Thing at least once (id=%d)", info.ID)
     }
-    bld.used = true
-    return newBeamThing(objNum, nil)
-}
-
-// Shaman can produce a AntidoteThing (0x23)
-type Shaman struct {
-    used bool
-}
-
-// getID return ID of the Skill
-func (*Shaman) getID() byte {
-    return 0x23
-}
-
-// isUsed returns whether this Skill is already used or still available
-func (shaman *Shaman) isUsed() bool {
-    return shaman.used
-}
-
-// apply converts the Skill into a Thing
-// "objNum" - unique object number on the battlefield
-func (shaman *Shaman) apply(objNum byte) Thing {
-    if shaman.used {
-        return nil
+    abilitiesLock.Lock()
+    defer abilitiesLock.Unlock()
+    if _, ok := abilities[info.ID]; ok {
+        return NewErr(info, 125, "Ability already registered (id=%d)", info.ID)
     }
-    shaman.used = true
-    return newAntidoteThing(objNum, nil)
+    abilities[info.ID] = info
+    return nil
 }
 
-// Grenadier can produce a FlashbangThing (0x24)
-type Grenadier struct {
-    used bool
-}
-
-// getID return ID of the Skill
-func (*Grenadier) getID() byte {
-    return 0x24
+// GetAbility returns an ability from the registry by a given ID
+func GetAbility(id byte) (*AbilityInfo, bool) {
+    abilitiesLock.RLock()
+    defer abilitiesLock.RUnlock()
+    info, ok := abilities[id]
+    return info, ok
 }
 
-// isUsed returns whether this Skill is already used or still available
-func (grenadier *Grenadier) isUsed() bool {
-    return grenadier.used
+// canEquip checks whether a given character can equip the ability
+func (info *AbilityInfo) canEquip(character byte) bool {
+    for _, c := range info.Characters {
+        if c == character {
+            return true
+        }
+    }
+    return len(info.Characters) == 0
 }
 
-// apply converts the Skill into a Thing
-// "objNum" - unique object number on the battlefield
-func (grenadier *Grenadier) apply(objNum byte) Thing {
-    if grenadier.used {
-        return nil
-    }
-    grenadier.used = true
-    return newFlashbangThing(objNum, nil)
+// skillT is an implementation of Skill, described by an entry of the ability registry
+type skillT struct {
+    info     *AbilityInfo
+    charges  byte
+    lastUsed time.Time
 }
 
-// TeleportMan can produce a TeleportThing (0x25)
-type TeleportMan struct {
-    used bool
+// newSkill creates a new Skill from a given entry of the ability registry
+func newSkill(info *AbilityInfo) Skill {
+    Assert(info)
+    return &skillT{info, info.Charges, time.Time{}}
 }
 
 // getID return ID of the Skill
-func (*TeleportMan) getID() byte {
-    return 0x25
+func (skill *skillT) getID() byte {
+    return skill.info.ID
 }
 
-// isUsed returns whether this Skill is already used or still available
-func (man *TeleportMan) isUsed() bool {
-    return man.used
+// isUsed returns whether all the charges of this Skill are already spent
+func (skill *skillT) isUsed() bool {
+    return skill.charges == 0
 }
 
-// apply converts the Skill into a Thing
+// apply converts the Skill into a Thing; returns NULL if all the charges are spent, or the cooldown is not over yet
 // "objNum" - unique object number on the battlefield
-func (man *TeleportMan) apply(objNum byte) Thing {
-    if man.used {
+func (skill *skillT) apply(objNum byte) Thing {
+    if skill.charges == 0 || time.Since(skill.lastUsed) < skill.info.Cooldown {
         return nil
     }
-    man.used = true
-    return newTeleportThing(objNum, nil)
+    skill.charges--
+    skill.lastUsed = time.Now()
+    return skill.info.Thing(objNum)
 }
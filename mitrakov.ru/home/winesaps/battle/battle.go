@@ -1,20 +1,33 @@
 package battle
 
+import "log"
 import "sync"
+import "time"
 import "runtime"
+import "encoding/binary"
+import crand "crypto/rand"
 import . "mitrakov.ru/home/winesaps/sid"   // nolint
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 
 // Battle is a struct that represents a single battle
 type Battle struct {
     sync.RWMutex
+    id            uint64
     battleManager IBattleManager
     detractor1    *Detractor
     detractor2    *Detractor
+    mate1         *Detractor // teammate of detractor1 (NULL for ordinary battles) (1.4.0+)
+    mate2         *Detractor // teammate of detractor2 (NULL for ordinary battles) (1.4.0+)
     curRound      *Round
-    wins          byte
+    mode          *GameMode
     quick         bool
     levelnames    []string
+    levels        [][]byte // level data captured on the battle start, so that level reloads don't affect the battle
+    bigMaps       bool // TRUE if any level of the battle has a header (see HasHeader()) (1.4.0+)
+    spectators    map[Sid]bool
+    replay        *Replay
+    rnd           *Rand       // root random generator; every round forks its own one from it
+    disconnected  map[Sid]int // disconnected participants -> count of periods since disconnection (1.4.0+)
 }
 
 // newBattle creates a new instance of Battle. Please do not create a Battle directly.
@@ -22,23 +35,40 @@ type Battle struct {
 // "defender" - Defender Session ID
 // "aggressorChar" - character of Aggressor (Rabbit, Hedgehog, Squirrel or Cat)
 // "defenderChar" - character of Defender (Rabbit, Hedgehog, Squirrel or Cat)
-// "levelnames" - array of level names (ensure that the length is enough! E.g. for wins = 3 this array.size should be 5)
-// "wins" - count of round wins to win the battle
+// "levelnames" - array of level names (ensure that the length is enough, see GameMode.GetRoundsMax())
+// "mode" - game mode (rules of the battle)
 // "quickBattle" - TRUE for quick battles; this argument DOES NOT affect the battle and only propagated to callbacks
 // "aggressorAbilities" - skills and swaggas of Aggressor
 // "defenderAbilities" - skills and swaggas of Defender
+// "mate1" - teammate of Aggressor (NULL for ordinary battles)
+// "mate2" - teammate of Defender (NULL for ordinary battles)
+// "seed" - seed for random generators (the same seed and the same input give the same battle)
 // "battleMgr" - reference to IBattleManager
-func newBattle(aggressor, defender Sid, aggressorChar, defenderChar byte, levelnames []string, wins byte,
-    quickBattle bool, aggressorAbilities, defenderAbilities []byte, battleMgr IBattleManager) (*Battle, *Error) {
+func newBattle(aggressor, defender Sid, aggressorChar, defenderChar byte, levelnames []string,
+    mode *GameMode, quickBattle bool, aggressorAbilities, defenderAbilities []byte, mate1, mate2 *Detractor, seed int64,
+    battleMgr IBattleManager) (*Battle, *Error) {
+
+    Assert(mode)
 
     if len(levelnames) > 0 {
         detractor1 := newDetractor(aggressor, aggressorChar, aggressorAbilities)
         detractor2 := newDetractor(defender, defenderChar, defenderAbilities)
-        skills1, swaggas1 := extractAbilities(aggressorAbilities)
-        skills2, swaggas2 := extractAbilities(defenderAbilities)
-        round, err := newRound(aggressor, defender, aggressorChar, defenderChar, 0, levelnames[0], skills1,
-            skills2, swaggas1, swaggas2, battleMgr)
-        res := &Battle{sync.RWMutex{}, battleMgr, detractor1, detractor2, round, wins, quickBattle, levelnames}
+        skills1, swaggas1 := extractAbilities(aggressorAbilities, aggressorChar)
+        skills2, swaggas2 := extractAbilities(defenderAbilities, defenderChar)
+        levels := getLevels(battleMgr, levelnames)
+        rnd := NewRand(seed)
+        round, err := newRound(aggressor, defender, aggressorChar, defenderChar, 0, levelnames[0], levels[0], skills1,
+            skills2, swaggas1, swaggas2, mate1, mate2, mode, rnd.Fork(), battleMgr)
+        id := newBattleID()
+        bigMaps := hasHeaderLevels(levels)
+        res := &Battle{sync.RWMutex{}, id, battleMgr, detractor1, detractor2, mate1, mate2, round, mode, quickBattle,
+            levelnames, levels, bigMaps, make(map[Sid]bool), newReplay(bigMaps), rnd, make(map[Sid]int)}
+        if mate1 != nil && mate2 != nil {
+            log.Println("Battle", id, "started:", aggressor, "+", mate1.sid, "vs.", defender, "+", mate2.sid, "seed:",
+                seed)
+        } else {
+            log.Println("Battle", id, "started:", aggressor, "vs.", defender, "seed:", seed)
+        }
         battleMgr.IncBattleRefs()
         runtime.SetFinalizer(res, func(*Battle) {battleMgr.DecBattleRefs()})
         return res, err
@@ -46,35 +76,56 @@ func newBattle(aggressor, defender Sid, aggressorChar, defenderChar byte, leveln
     return nil, NewErr(&Battle{}, 110, "Empty levels list")
 }
 
-// extractAbilities takes a list of all abilities and splits them into 2 groups: skills and swaggas
-// nolint: gocyclo
-func extractAbilities(abilities []byte) (skills []Skill, swaggas []Swagga) {
-    for _, ability := range abilities {
-        switch Swagga(ability) {
-        case Snorkel:
-            fallthrough
-        case ClimbingShoes:
-            fallthrough
-        case SouthWester:
-            fallthrough
-        case VoodooMask:
-            fallthrough
-        case SapperShoes:
-            fallthrough
-        case Sunglasses:
-            swaggas = append(swaggas, Swagga(ability))
+// newBattleID generates a random battle ID; it is unique enough to be a key for replays, and it cannot be guessed, so
+// that only the participants (who receive "BATTLE INFO" event) may request a replay of the battle
+func newBattleID() uint64 {
+    var buf [8]byte
+    if _, err := crand.Read(buf[:]); err != nil {
+        return uint64(time.Now().UnixNano()) // fallback: unique, but predictable
+    }
+    return binary.BigEndian.Uint64(buf[:])
+}
+
+// getLevels returns raw bytearrays of given levels (NULL for the levels that have not been found); the arrays are
+// never modified by FileReader (a reload replaces them), so they may be used during the whole battle
+// "battleMgr" - reference to IBattleManager
+// "levelnames" - array of level names
+func getLevels(battleMgr IBattleManager, levelnames []string) [][]byte {
+    reader := battleMgr.getFileReader()
+    Assert(reader)
+    res := make([][]byte, len(levelnames))
+    for i, levelname := range levelnames {
+        res[i], _ = reader.GetByName(levelname)
+    }
+    return res
+}
+
+// hasHeaderLevels checks whether any of given levels has a header (see HasHeader()), so that only the clients
+// supporting big maps may watch the battle or its replay
+// "levels" - array of level raw bytearrays
+func hasHeaderLevels(levels [][]byte) bool {
+    for _, level := range levels {
+        if HasHeader(level) {
+            return true
         }
-        switch ability {
-        case 0x21:
-            skills = append(skills, new(Miner))
-        case 0x22:
-            skills = append(skills, new(Builder))
-        case 0x23:
-            skills = append(skills, new(Shaman))
-        case 0x24:
-            skills = append(skills, new(Grenadier))
-        case 0x25:
-            skills = append(skills, new(TeleportMan))
+    }
+    return false
+}
+
+// extractAbilities takes a list of all abilities and splits them into 2 groups: skills and swaggas; since 1.4.0 the
+// abilities are looked up in the registry (see RegisterAbility()), and the ones that the character cannot equip are
+// skipped
+// "abilities" - list of ability IDs
+// "character" - character of the owner (Rabbit, Hedgehog, Squirrel or Cat)
+func extractAbilities(abilities []byte, character byte) (skills []Skill, swaggas []Swagga) {
+    for _, ability := range abilities {
+        if info, ok := GetAbility(ability); ok && info.canEquip(character) {
+            switch info.Kind {
+            case KindSwagga:
+                swaggas = append(swaggas, Swagga(ability))
+            case KindSkill:
+                skills = append(skills, newSkill(info))
+            }
         }
     }
     return
@@ -99,7 +150,7 @@ func (battle *Battle) checkBattle(winnerSid Sid) (finished bool, err *Error) {
     default:
         err = NewErr(battle, 110, "Incorrect winner sid %d", winnerSid)
     }
-    if battle.detractor1.score >= battle.wins || battle.detractor2.score >= battle.wins {
+    if battle.detractor1.score >= battle.mode.Wins || battle.detractor2.score >= battle.mode.Wins {
         finished = true
     }
     return
@@ -120,11 +171,12 @@ func (battle *Battle) nextRound() (round *Round, err *Error) {
         // get parameters from within battle
         detractor1 := battle.detractor1
         detractor2 := battle.detractor2
-        skills1, swaggas1 := extractAbilities(detractor1.abilities) // see note below
-        skills2, swaggas2 := extractAbilities(detractor2.abilities) // see note below
+        skills1, swaggas1 := extractAbilities(detractor1.abilities, detractor1.character) // see note below
+        skills2, swaggas2 := extractAbilities(detractor2.abilities, detractor2.character) // see note below
         // create a new round
         round, err = newRound(detractor1.sid, detractor2.sid, detractor1.character, detractor2.character, number,
-            levelname, skills1, skills2, swaggas1, swaggas2, battle.battleManager)
+            levelname, battle.levels[number], skills1, skills2, swaggas1, swaggas2, battle.mate1, battle.mate2,
+            battle.mode, battle.rnd.Fork(), battle.battleManager)
         if err == nil {
             battle.Lock()
             battle.curRound = round
@@ -141,24 +193,124 @@ func (battle *Battle) nextRound() (round *Round, err *Error) {
     // eventually I've chosen the second way.
 }
 
-// getEnemy returns an opponent of a given detractor (expressed by its Session ID)
+// getEnemy returns an opponent of a given detractor (expressed by its Session ID); for team battles it returns the
+// leader of the enemy team (i.e. either detractor1 or detractor2)
 func (battle *Battle) getEnemy(mySid Sid) (*Detractor, bool) {
     Assert(battle.detractor1, battle.detractor2)
 
-    if battle.detractor1.sid == mySid {
-        return battle.detractor2, true
+    if leader, ok := battle.getLeader(mySid); ok {
+        if leader == battle.detractor1 {
+            return battle.detractor2, true
+        }
+        return battle.detractor1, true
     }
-    if battle.detractor2.sid == mySid {
+    return nil, false
+}
+
+// getLeader returns a leader of the team of a given detractor (expressed by its Session ID), i.e. either detractor1 or
+// detractor2; for ordinary battles it returns the detractor itself
+func (battle *Battle) getLeader(sid Sid) (*Detractor, bool) {
+    Assert(battle.detractor1, battle.detractor2)
+
+    if battle.detractor1.sid == sid || (battle.mate1 != nil && battle.mate1.sid == sid) {
         return battle.detractor1, true
     }
+    if battle.detractor2.sid == sid || (battle.mate2 != nil && battle.mate2.sid == sid) {
+        return battle.detractor2, true
+    }
     return nil, false
 }
 
+// getParticipants returns Session IDs of all the participants of the battle (2 for ordinary battles, and 4 for team
+// battles); the leaders go first
+func (battle *Battle) getParticipants() []Sid {
+    Assert(battle.detractor1, battle.detractor2)
+
+    res := []Sid{battle.detractor1.sid, battle.detractor2.sid}
+    if battle.mate1 != nil && battle.mate2 != nil {
+        res = append(res, battle.mate1.sid, battle.mate2.sid)
+    }
+    return res
+}
+
+// addSpectator subscribes a user with a given Session ID to the events of the battle (read-only)
+func (battle *Battle) addSpectator(sid Sid) {
+    battle.Lock()
+    battle.spectators[sid] = true
+    battle.Unlock()
+}
+
+// removeSpectator unsubscribes a user with a given Session ID from the events of the battle
+func (battle *Battle) removeSpectator(sid Sid) {
+    battle.Lock()
+    delete(battle.spectators, sid)
+    battle.Unlock()
+}
+
+// getSpectators returns Session IDs of all the spectators of the battle
+func (battle *Battle) getSpectators() []Sid {
+    battle.RLock()
+    defer battle.RUnlock()
+    res := make([]Sid, 0, len(battle.spectators))
+    for sid := range battle.spectators {
+        res = append(res, sid)
+    }
+    return res
+}
+
+// disconnect marks a participant with a given Session ID as disconnected; returns FALSE if the participant has been
+// already marked, and "paused" = TRUE if the battle must be paused (i.e. nobody has been disconnected before)
+func (battle *Battle) disconnect(sid Sid) (added, paused bool) {
+    battle.Lock()
+    defer battle.Unlock()
+    if _, ok := battle.disconnected[sid]; !ok {
+        paused = len(battle.disconnected) == 0
+        battle.disconnected[sid] = 0
+        return true, paused
+    }
+    return false, false
+}
+
+// reconnect removes a disconnection mark of a participant with a given Session ID; returns FALSE if the participant
+// hasn't been marked, and "resumed" = TRUE if the battle must be resumed (i.e. all the participants are back)
+func (battle *Battle) reconnect(sid Sid) (removed, resumed bool) {
+    battle.Lock()
+    defer battle.Unlock()
+    if _, ok := battle.disconnected[sid]; ok {
+        delete(battle.disconnected, sid)
+        return true, len(battle.disconnected) == 0
+    }
+    return false, false
+}
+
+// isPaused checks whether the battle is paused, i.e. any of participants is disconnected
+func (battle *Battle) isPaused() bool {
+    battle.RLock()
+    defer battle.RUnlock()
+    return len(battle.disconnected) > 0
+}
+
+// checkDisconnected increases the counters of the disconnected participants and returns Session IDs of those who have
+// been disconnected for more than a given count of periods
+// "maxPeriods" - grace period, expressed in periods (see "period")
+func (battle *Battle) checkDisconnected(maxPeriods int) (expired []Sid) {
+    battle.Lock()
+    defer battle.Unlock()
+    for sid, periods := range battle.disconnected {
+        if periods >= maxPeriods {
+            expired = append(expired, sid)
+        } else {
+            battle.disconnected[sid] = periods + 1
+        }
+    }
+    return
+}
+
 // stop shuts the battle down and releases all the seized resources
 func (battle *Battle) stop() {
     round := battle.getRound()
     Assert(round)
-    round.stop <- true
+    round.stopTimer()
     
     Assert(battle.battleManager, battle.detractor1, battle.detractor2)
     env := battle.battleManager.getEnvironment()
@@ -12,19 +12,30 @@ import "mitrakov.ru/home/winesaps/filereader"
 // IBattleManager is an interface for all battle management operations
 type IBattleManager interface {
     SetController(controller IController)
-    Attack(aggressor, defender Sid, aggressorName, defenderName string) (*MailBox, *Error)
+    Attack(aggressor, defender Sid, aggressorName, defenderName string, mode *GameMode) (*MailBox, *Error)
     Accept(aggressor, defender Sid, char1, char2 byte, aggAbilities, defAbilities []byte, levelnames []string, 
-        wins byte, quickBattle, removeCall bool) (*MailBox, *Error)
+        mode *GameMode, quickBattle, removeCall bool, seed int64) (*MailBox, *Error)
+    AcceptTeam(aggressor, defender, mate1, mate2 Sid, char1, char2, char3, char4 byte, abilities1, abilities2,
+        abilities3, abilities4 []byte, levelnames []string, mode *GameMode, quickBattle bool, seed int64) (*MailBox,
+        *Error)
+    Rematch(sid Sid) (enemySid Sid, mode *GameMode, ready bool, box *MailBox, err *Error)
+    AcceptRematch(sid Sid, levelnames []string, seed int64) (*MailBox, *Error)
     Reject(aggressor, defender Sid, cowardName string) (*MailBox, *Error)
     CancelCall(aggressor Sid) (*MailBox, *Error)
     Move(sid Sid, direction byte) (*MailBox, *Error)
     UseThing(Sid) (*MailBox, *Error)
     UseSkill(sid Sid, skillID byte) (*MailBox, *Error)
     GiveUp(Sid) (enemySid Sid, box *MailBox, e *Error)
-    GetActorXy(sid Sid, actor1 bool) (byte, *Error)
-    WolfExists(sid Sid, xy byte) (bool, *Error)
+    Pause(sid Sid) (*MailBox, *Error)
+    Resume(sid Sid) (*MailBox, *Error)
+    GetActorXy(sid Sid, actor1 bool) (uint16, *Error)
+    WolfExists(sid Sid, xy uint16) (bool, *Error)
     GetFieldRaw(sid Sid) (raw []byte, e *Error)
     GetMovablesDump(sid Sid) (dump []byte, e *Error)
+    GetBattles() (aggressors, defenders []Sid)
+    GetReplay(id uint64, bigMaps bool) ([]ReplayEvent, *Error)
+    Watch(spectator, participant Sid, bigMaps bool) (*MailBox, *Error)
+    Unwatch(spectator Sid) *Error
     GetBattlesCount() uint
     GetBattlesCountTotal() uint32
     IncBattleRefs()
@@ -41,11 +52,12 @@ type IBattleManager interface {
     onEvent(box *MailBox, err *Error)
     getFileReader() *filereader.FileReader
     getEnvironment() *Environment
+    getClock() Clock
     getBattle(sid Sid) (*Battle, bool)
-    objChanged(sid Sid, objNum, objID, xy byte, reset bool, box *MailBox) *Error
+    objChanged(sid Sid, objNum, objID byte, xy uint16, wide, reset bool, box *MailBox) *Error
     foodEaten(sid Sid, box *MailBox) *Error
     thingTaken(sid Sid, thing Thing, box *MailBox) *Error
-    objAppended(sid Sid, object IObject, box *MailBox) *Error
+    objAppended(sid Sid, object IObject, wide bool, box *MailBox) *Error
     roundFinished(winnerSid Sid, box *MailBox) *Error
     eatenByWolf(sid Sid, actor Actor, box *MailBox) *Error
     hurt(sid Sid, cause hurtCause, box *MailBox) *Error
@@ -60,22 +72,29 @@ type IPacker interface {
     PackStopCallMissed(aggressorName string) []byte
     PackStopCallExpired(defenderName string) []byte
     PackFullState(state []byte) []byte
+    PackRestoreState(dump []byte) []byte
     PackRoundInfo(sid, aggressor Sid, roundNum, timeSec, char1, char2, myLives, enemyLives byte, fname string) []byte
+    PackTeamInfo(actorID, mateChar byte) []byte
     PackAbilityList(abilities []byte) []byte
-    PackStateChanged(objNum, objID, xy byte, reset bool) []byte
+    PackStateChanged(objNum, objID byte, xy uint16, wide, reset bool) []byte
     PackScoreChanged(score1, score2 byte) []byte
     PackEffectChanged(effID byte, added bool, objNumber byte) []byte
     PackWound(sid, woundSid Sid, cause, myLives, enemyLives byte) []byte
     PackThingTaken(sid, ownerSid Sid, thingID byte) []byte
-    PackObjectAppended(id, objNum, xy byte) []byte
+    PackObjectAppended(id, objNum byte, xy uint16, wide bool) []byte
     PackRoundFinished(sid, winnerSid Sid, totalScore1, totalScore2 byte) []byte
     PackGameOver(sid, winnerSid Sid, totalScore1, totalScore2 byte, reward uint32) []byte
+    PackRematchOffered() []byte
+    PackBattlePaused(graceSec byte) []byte
+    PackBattleResumed() []byte
+    PackBattleInfo(id uint64) []byte
 }
 
 // IController contains methods for IBattleManager callbacks
 type IController interface {
     Event(*MailBox, *Error)
     GameOver(winnerSid, loserSid Sid, score1, score2 byte, quickBattle bool, box *MailBox) (reward uint32, err *Error)
+    RematchExpired(sid1, sid2 Sid)
 }
 
 // callT is a structure that is temporarily created while an Aggressor is trying to challenge a Defender.
@@ -86,6 +105,20 @@ type callT struct {
     aggressorName string
     defenderName  string
     calls         int
+    maxCalls      int // see GameMode.MaxCalls (1.4.0+)
+}
+
+// rematchT is a structure that is temporarily created after an ordinary battle (1 vs. 1) is over, so that the
+// participants could start a new battle with the same characters and abilities (1.4.0+).
+// by default the life cycle of "rematchT" is about 10 sec. (see "rematchPeriods")
+type rematchT struct {
+    detractor1 *Detractor // Aggressor of the finished battle
+    detractor2 *Detractor // Defender of the finished battle
+    mode       *GameMode
+    quick      bool
+    votes      map[Sid]bool
+    periods    int
+    accepting  bool // TRUE while AcceptRematch() is starting a new battle (the offer must not expire)
 }
 
 // BatManager is an implementation of IBattleManager.
@@ -98,7 +131,12 @@ type BatManager struct /* implements IBattleManager */ {
     packer       IPacker
     controller   IController
     battles      map[Sid]*Battle
+    spectators   map[Sid]*Battle
     activeCalls  map[Sid]*callT
+    rematches    map[Sid]*rematchT // both participants refer to the same rematchT
+    replayDir    string
+    gracePeriods int   // how many periods a disconnected participant has to come back (0 means "no pauses")
+    clock        Clock // time source for all the battles, rounds and the Environment (1.4.0+)
     stop         chan bool
     battlesCount   uint32
     battleRefsUp   uint32
@@ -113,8 +151,8 @@ type BatManager struct /* implements IBattleManager */ {
 
 // period is an interval during which a BattleManager checks up incoming calls
 const period = time.Second
-// maxCalls is a maximum count of calls, so that total awaiting time for an Aggressor is (maxCalls * period)
-const maxCalls = 20
+// rematchPeriods is how many periods the participants of a finished battle have to agree to a rematch
+const rematchPeriods = 10
 
 // hurt cause
 type hurtCause byte
@@ -146,20 +184,29 @@ const (
 // "reader" - file reader
 // "packer" - reference to IPacker implementation
 // "ctrl" - reference to IController implementation
-func NewBattleManager(reader *filereader.FileReader, packer IPacker, ctrl IController) IBattleManager {
-    Assert(reader)
+// "replayDir" - directory to store battle replays (pass "" to disable recording)
+// "grace" - time a disconnected participant has to come back till a forfeit (pass 0 to disable pauses, see Pause())
+// "clock" - time source (e.g. RealClock; simulations may use VirtualClock)
+func NewBattleManager(reader *filereader.FileReader, packer IPacker, ctrl IController, replayDir string,
+    grace time.Duration, clock Clock) IBattleManager {
+    Assert(reader, clock)
 
     battleMgr := new(BatManager)
     battleMgr.fileReader = reader
-    battleMgr.environment = newEnvironment(battleMgr)
+    battleMgr.clock = clock
+    battleMgr.environment = newEnvironment(battleMgr, clock)
     battleMgr.packer = packer
     battleMgr.controller = ctrl
+    battleMgr.replayDir = replayDir
+    battleMgr.gracePeriods = int(grace / period)
     battleMgr.battles = make(map[Sid]*Battle)
+    battleMgr.spectators = make(map[Sid]*Battle)
     battleMgr.activeCalls = make(map[Sid]*callT)
-    battleMgr.stop = RunDaemon("battle", period, func() {
+    battleMgr.rematches = make(map[Sid]*rematchT)
+    battleMgr.stop = clock.RunDaemon("battle", period, func() {
         battleMgr.Lock() // here we use full loop WLock() to protect algorithm (not only activeCalls map)
         for k, v := range battleMgr.activeCalls {
-            if v.calls >= maxCalls {
+            if v.calls >= v.maxCalls { // total awaiting time for an Aggressor is (maxCalls * period)
                 delete(battleMgr.activeCalls, k) // it is safe: stackoverflow.com/questions/23229975
                 box := NewMailBox()
                 box.Put(v.defender, packer.PackStopCallMissed(v.aggressorName))
@@ -169,7 +216,21 @@ func NewBattleManager(reader *filereader.FileReader, packer IPacker, ctrl IContr
                 v.calls++
             }
         }
+        expired := battleMgr.expireRematches()
+        var cowards []Sid
+        for sid, battle := range battleMgr.battles {
+            if sid == battle.detractor1.sid {
+                cowards = append(cowards, battle.checkDisconnected(battleMgr.gracePeriods)...)
+            }
+        }
         battleMgr.Unlock()
+        for _, offer := range expired { // "RematchExpired" may take time, so let's call it outside the lock
+            battleMgr.controller.RematchExpired(offer.detractor1.sid, offer.detractor2.sid)
+        }
+        for _, sid := range cowards { // grace period is over: the disconnected participant loses the battle
+            _, box, err := battleMgr.GiveUp(sid)
+            battleMgr.controller.Event(box, err)
+        }
     })
 
     return battleMgr
@@ -193,6 +254,11 @@ func (battleMgr *BatManager) getEnvironment() *Environment {
     return battleMgr.environment
 }
 
+// getClock returns a time source assosiated with this IBattleManager
+func (battleMgr *BatManager) getClock() Clock {
+    return battleMgr.clock
+}
+
 // getBattle returns a battle by a given Session ID of one of its participants.
 // You can specify any Session ID of either an Aggressor or a Defender
 func (battleMgr *BatManager) getBattle(sid Sid) (battle *Battle, ok bool) {
@@ -215,14 +281,17 @@ func (battleMgr *BatManager) SetController(controller IController) {
 // "defender" - defender Session ID
 // "aggressorName" - aggressor name
 // "defenderName" - defender name
-func (battleMgr *BatManager) Attack(aggressor, defender Sid, aggressorName, defenderName string) (*MailBox, *Error) {
-    Assert(battleMgr.activeCalls)
+// "mode" - game mode (only "MaxCalls" matters here)
+func (battleMgr *BatManager) Attack(aggressor, defender Sid, aggressorName, defenderName string,
+    mode *GameMode) (*MailBox, *Error) {
+    Assert(battleMgr.activeCalls, mode)
     box := NewMailBox()
 
     ok, err := battleMgr.areAvailable(aggressor, defender)
     if ok {
         battleMgr.Lock()
-        battleMgr.activeCalls[aggressor] = &callT{aggressor, defender, aggressorName, defenderName, 0}
+        battleMgr.activeCalls[aggressor] = &callT{aggressor, defender, aggressorName, defenderName, 0,
+            int(mode.MaxCalls)}
         battleMgr.Unlock()
             
         box.Put(defender, battleMgr.packer.PackCall(aggressor, aggressorName))
@@ -239,12 +308,13 @@ func (battleMgr *BatManager) Attack(aggressor, defender Sid, aggressorName, defe
 // "char2" - character of Defender (Rabbit, Hedgehog, Squirrel or Cat)
 // "aggAbilities" - skills and swaggas of Aggressor
 // "defAbilities" - skills and swaggas of Defender
-// "levelnames" - array of level names (ensure that the length is enough! E.g. for wins = 3 this array.size should be 5)
-// "wins" - count of round wins to win the battle
+// "levelnames" - array of level names (ensure that the length is enough, see GameMode.GetRoundsMax())
+// "mode" - game mode (rules of the battle)
 // "quickBattle" - TRUE for quick battles; this argument does not affect the underlying battle system
 // "removeCall" - TRUE to remove call (for PvP battles)
+// "seed" - seed for the random generators of the battle (the same seed and the same input give the same battle)
 func (battleMgr *BatManager) Accept(aggressor, defender Sid, char1, char2 byte, aggAbilities, defAbilities []byte, 
-    levelnames []string, wins byte, quickBattle, removeCall bool) (box *MailBox, err *Error) {
+    levelnames []string, mode *GameMode, quickBattle, removeCall bool, seed int64) (box *MailBox, err *Error) {
     Assert(battleMgr.controller)
     box = NewMailBox()
 
@@ -255,9 +325,11 @@ func (battleMgr *BatManager) Accept(aggressor, defender Sid, char1, char2 byte,
         var ok bool
         if ok, err = battleMgr.areAvailable(aggressor, defender); ok {
             var battle *Battle
-            battle, err = newBattle(aggressor, defender, char1, char2, levelnames, wins, quickBattle, 
-                aggAbilities, defAbilities, battleMgr)
+            battle, err = newBattle(aggressor, defender, char1, char2, levelnames, mode, quickBattle, 
+                aggAbilities, defAbilities, nil, nil, seed, battleMgr)
             if err == nil {
+                battleMgr.Unwatch(aggressor) // nolint (participants cannot be spectators at the same time)
+                battleMgr.Unwatch(defender)  // nolint
                 battleMgr.Lock()
                 battleMgr.battles[aggressor] = battle
                 battleMgr.battles[defender] = battle
@@ -270,6 +342,138 @@ func (battleMgr *BatManager) Accept(aggressor, defender Sid, char1, char2 byte,
     return
 }
 
+// AcceptTeam starts a team battle (2 vs. 2): the Aggressor and "mate1" against the Defender and "mate2". There are no
+// calls for team battles (the teams are formed by a matchmaker), so this method doesn't check calls.
+// The levels must contain Actor3 and Actor4 for the teammates (see IsTeamLevel()).
+// "aggressor" - Aggressor Session ID (leader of the 1-st team)
+// "defender" - Defender Session ID (leader of the 2-nd team)
+// "mate1" - Session ID of Aggressor's teammate
+// "mate2" - Session ID of Defender's teammate
+// "char1", "char2", "char3", "char4" - characters of Aggressor, Defender, mate1 and mate2 respectively
+// "abilities1", "abilities2", "abilities3", "abilities4" - skills and swaggas of Aggressor, Defender, mate1 and mate2
+// "levelnames" - array of level names (ensure that the length is enough, see GameMode.GetRoundsMax())
+// "mode" - game mode (rules of the battle)
+// "quickBattle" - TRUE for quick battles; this argument does not affect the underlying battle system
+// "seed" - seed for the random generators of the battle (the same seed and the same input give the same battle)
+func (battleMgr *BatManager) AcceptTeam(aggressor, defender, mate1, mate2 Sid, char1, char2, char3, char4 byte,
+    abilities1, abilities2, abilities3, abilities4 []byte, levelnames []string, mode *GameMode, quickBattle bool,
+    seed int64) (box *MailBox, err *Error) {
+    Assert(battleMgr.controller)
+    box = NewMailBox()
+
+    if mate1 == aggressor || mate1 == defender || mate2 == aggressor || mate2 == defender {
+        return box, NewErr(battleMgr, 105, "Team members must be different (%d, %d, %d, %d)", aggressor, mate1,
+            defender, mate2)
+    }
+    var ok bool
+    if ok, err = battleMgr.areAvailable(aggressor, defender); ok {
+        if ok, err = battleMgr.areAvailable(mate1, mate2); ok {
+            var battle *Battle
+            team1 := newDetractor(mate1, char3, abilities3)
+            team2 := newDetractor(mate2, char4, abilities4)
+            battle, err = newBattle(aggressor, defender, char1, char2, levelnames, mode, quickBattle, abilities1,
+                abilities2, team1, team2, seed, battleMgr)
+            if err == nil {
+                battleMgr.Lock()
+                for _, sid := range battle.getParticipants() {
+                    battleMgr.battles[sid] = battle
+                }
+                battleMgr.Unlock()
+                for _, sid := range battle.getParticipants() {
+                    battleMgr.Unwatch(sid) // nolint (participants cannot be spectators at the same time)
+                }
+                atomic.AddUint32(&battleMgr.battlesCount, 1)
+                err = battleMgr.startRound(battle.getRound(), box)
+            }
+        }
+    }
+    return
+}
+
+// Rematch registers the will of a participant of a finished battle to fight again against the same opponent (the
+// opponent receives a notification); the rematch is ready when both participants have agreed, and then the caller must
+// choose new levels and call AcceptRematch(). Rematches are available only for ordinary battles (1 vs. 1), and only
+// for a short time after the battle is over (see "rematchPeriods").
+// "sid" - Session ID of a participant of a finished battle
+func (battleMgr *BatManager) Rematch(sid Sid) (enemySid Sid, mode *GameMode, ready bool, box *MailBox, err *Error) {
+    Assert(battleMgr.rematches)
+    box = NewMailBox()
+
+    battleMgr.Lock()
+    defer battleMgr.Unlock()
+    offer, ok := battleMgr.rematches[sid]
+    if !ok {
+        return 0, nil, false, box, NewErr(battleMgr, 106, "Rematch not found: sid=%d", sid)
+    }
+    enemySid = offer.detractor1.sid
+    if enemySid == sid {
+        enemySid = offer.detractor2.sid
+    }
+    if offer.mode.Name == TrainingModeName {
+        return enemySid, nil, false, box, NewErr(battleMgr, 107, "Rematch is not allowed for training: sid=%d", sid)
+    }
+    if offer.votes[sid] && offer.votes[enemySid] {
+        return enemySid, nil, false, box, NewErr(battleMgr, 108, "Rematch already accepted: sid=%d", sid)
+    }
+    offer.votes[sid] = true
+    if !offer.votes[enemySid] {
+        box.Put(enemySid, battleMgr.packer.PackRematchOffered())
+    }
+    return enemySid, offer.mode, offer.votes[enemySid], box, nil
+}
+
+// AcceptRematch starts a new battle for the participants of a finished battle after both of them have agreed to a
+// rematch (see Rematch()). The Aggressor and the Defender keep their roles, characters and abilities, whilst the
+// levels are new. The offer is removed only if the battle has started; otherwise it expires as usual, so that
+// IController.RematchExpired() is called anyway (e.g. to remove AI players).
+// "sid" - Session ID of any of the participants
+// "levelnames" - array of level names (ensure that the length is enough, see GameMode.GetRoundsMax())
+// "seed" - seed for the random generators of the battle (the same seed and the same input give the same battle)
+func (battleMgr *BatManager) AcceptRematch(sid Sid, levelnames []string, seed int64) (box *MailBox, err *Error) {
+    Assert(battleMgr.rematches)
+    box = NewMailBox()
+
+    battleMgr.Lock()
+    offer, ok := battleMgr.rematches[sid]
+    if ok && offer.votes[offer.detractor1.sid] && offer.votes[offer.detractor2.sid] && !offer.accepting {
+        offer.accepting = true
+    } else {
+        ok = false
+    }
+    battleMgr.Unlock()
+    if !ok {
+        return box, NewErr(battleMgr, 109, "Rematch not ready: sid=%d", sid)
+    }
+
+    started := false
+    d1, d2 := offer.detractor1, offer.detractor2
+    if ok, err = battleMgr.areAvailable(d1.sid, d2.sid); ok {
+        var battle *Battle
+        battle, err = newBattle(d1.sid, d2.sid, d1.character, d2.character, levelnames, offer.mode, offer.quick,
+            d1.abilities, d2.abilities, nil, nil, seed, battleMgr)
+        if err == nil {
+            battleMgr.Unwatch(d1.sid) // nolint (participants cannot be spectators at the same time)
+            battleMgr.Unwatch(d2.sid) // nolint
+            battleMgr.Lock()
+            battleMgr.battles[d1.sid] = battle
+            battleMgr.battles[d2.sid] = battle
+            battleMgr.Unlock()
+            atomic.AddUint32(&battleMgr.battlesCount, 1)
+            started = true
+            err = battleMgr.startRound(battle.getRound(), box)
+        }
+    }
+
+    battleMgr.Lock()
+    if started {
+        battleMgr.deleteRematch(offer)
+    } else {
+        offer.accepting = false // the offer will expire (see expireRematches())
+    }
+    battleMgr.Unlock()
+    return
+}
+
 // Reject discards the Defender's will to fight against the Aggressor that had initiated the attack by calling "Attack"
 // method some time ago. Aggressor will give the corresponding notification.
 // "aggressor" - Aggressor Session ID
@@ -303,6 +507,9 @@ func (battleMgr *BatManager) CancelCall(aggressor Sid) (*MailBox, *Error) {
 func (battleMgr *BatManager) Move(sid Sid, direction byte) (*MailBox, *Error) {
     box := NewMailBox()
     if battle, ok := battleMgr.getBattle(sid); ok {
+        if battle.isPaused() {
+            return box, NewErr(battleMgr, 82, "Battle is paused: sid=%d", sid)
+        }
         round := battle.getRound()
         Assert(round)
         return box, round.move(sid, moveDirection(direction), box)
@@ -315,12 +522,17 @@ func (battleMgr *BatManager) Move(sid Sid, direction byte) (*MailBox, *Error) {
 func (battleMgr *BatManager) UseThing(sid Sid) (*MailBox, *Error) {
     box := NewMailBox()
     if battle, ok := battleMgr.getBattle(sid); ok {
+        if battle.isPaused() {
+            return box, NewErr(battleMgr, 82, "Battle is paused: sid=%d", sid)
+        }
         round := battle.getRound()
         Assert(round)
         err := round.useThing(sid, box)
         if err == nil {
-            box.Put(battle.detractor1.sid, battleMgr.packer.PackThingTaken(battle.detractor1.sid, sid, 0))
-            box.Put(battle.detractor2.sid, battleMgr.packer.PackThingTaken(battle.detractor2.sid, sid, 0))
+            for _, p := range battle.getParticipants() {
+                box.Put(p, battleMgr.packer.PackThingTaken(p, sid, 0))
+            }
+            battleMgr.putObservers(battle, battleMgr.packer.PackThingTaken(battle.detractor1.sid, sid, 0), box)
         }
         return box, err
     }
@@ -332,14 +544,20 @@ func (battleMgr *BatManager) UseThing(sid Sid) (*MailBox, *Error) {
 func (battleMgr *BatManager) UseSkill(sid Sid, skillID byte) (*MailBox, *Error) {
     box := NewMailBox()
     if battle, ok := battleMgr.getBattle(sid); ok {
+        if battle.isPaused() {
+            return box, NewErr(battleMgr, 82, "Battle is paused: sid=%d", sid)
+        }
         round := battle.getRound()
         Assert(round)
         thing, err := round.useSkill(sid, skillID, box)
         if err == nil {
             if thing != nil { // thing may be NULL (in case skill produced nothing)
                 thingID := thing.getID()
-                box.Put(battle.detractor1.sid, battleMgr.packer.PackThingTaken(battle.detractor1.sid, sid, thingID))
-                box.Put(battle.detractor2.sid, battleMgr.packer.PackThingTaken(battle.detractor2.sid, sid, thingID))
+                for _, p := range battle.getParticipants() {
+                    box.Put(p, battleMgr.packer.PackThingTaken(p, sid, thingID))
+                }
+                battleMgr.putObservers(battle, battleMgr.packer.PackThingTaken(battle.detractor1.sid, sid, thingID),
+                    box)
             }
             var abilities []byte
             abilities, err = round.getCurrentAbilities(sid)
@@ -358,7 +576,7 @@ func (battleMgr *BatManager) GiveUp(sid Sid) (Sid, *MailBox, *Error) {
     box := NewMailBox()
     if battle, ok := battleMgr.getBattle(sid); ok {
         if enemy, ok := battle.getEnemy(sid); ok {
-            enemy.score = battle.wins - 1
+            enemy.score = battle.mode.Wins - 1
             return enemy.sid, box, battleMgr.roundFinished(enemy.sid, box)
         }
         return 0, box, NewErr(battleMgr, 58, "Enemy not found: sid=%d", sid)
@@ -366,10 +584,67 @@ func (battleMgr *BatManager) GiveUp(sid Sid) (Sid, *MailBox, *Error) {
     return 0, box, NewErr(battleMgr, 59, "Battle not found: sid=%d", sid)
 }
 
+// Pause is called when a participant with a given Session ID has lost the connection: the round timer and the
+// Environment of the battlefield are paused, and the other participants are notified. If the participant doesn't come
+// back (see Resume()) during the grace period, he/she gives up the battle.
+// Pauses may be disabled (see NewBattleManager()), then this method does nothing.
+// @since 1.4.0
+// "sid" - Session ID of a disconnected participant
+func (battleMgr *BatManager) Pause(sid Sid) (*MailBox, *Error) {
+    Assert(battleMgr.environment)
+    box := NewMailBox()
+    if battle, ok := battleMgr.getBattle(sid); ok {
+        if battleMgr.gracePeriods == 0 {
+            return box, nil
+        }
+        if added, paused := battle.disconnect(sid); added {
+            if paused {
+                battle.getRound().pause()
+                battleMgr.environment.setPaused(battle.detractor1.sid, true)
+            }
+            graceSec := byte(Min(uint(time.Duration(battleMgr.gracePeriods)*period/time.Second), 255))
+            msg := battleMgr.packer.PackBattlePaused(graceSec)
+            for _, p := range battle.getParticipants() {
+                if p != sid {
+                    box.Put(p, msg)
+                }
+            }
+            battleMgr.putObservers(battle, msg, box)
+        }
+        return box, nil
+    }
+    return box, NewErr(battleMgr, 80, "Battle not found: sid=%d", sid)
+}
+
+// Resume is called when a participant with a given Session ID has come back after Pause() (e.g. requested FULL STATE
+// or RESTORE STATE); as soon as all the disconnected participants are back, the battle is resumed, and the other
+// participants are notified. If the participant hasn't been disconnected, this method does nothing.
+// @since 1.4.0
+// "sid" - Session ID of a reconnected participant
+func (battleMgr *BatManager) Resume(sid Sid) (*MailBox, *Error) {
+    Assert(battleMgr.environment)
+    box := NewMailBox()
+    if battle, ok := battleMgr.getBattle(sid); ok {
+        if removed, resumed := battle.reconnect(sid); removed && resumed {
+            battle.getRound().resume()
+            battleMgr.environment.setPaused(battle.detractor1.sid, false)
+            msg := battleMgr.packer.PackBattleResumed()
+            for _, p := range battle.getParticipants() {
+                if p != sid {
+                    box.Put(p, msg)
+                }
+            }
+            battleMgr.putObservers(battle, msg, box)
+        }
+        return box, nil
+    }
+    return box, NewErr(battleMgr, 81, "Battle not found: sid=%d", sid)
+}
+
 // GetActorXy returns a position of an actor on the battlefield.
 // Specify "actor1" = TRUE for Actor1, and "actor1" = FALSE for Actor2.
 // Session ID is needed only to lookup the battle and may be a SID of any participants.
-func (battleMgr *BatManager) GetActorXy(sid Sid, actor1 bool) (byte, *Error) {
+func (battleMgr *BatManager) GetActorXy(sid Sid, actor1 bool) (uint16, *Error) {
     field, err := battleMgr.getCurrentField(sid)
     if err == nil {
         var actor Actor
@@ -382,14 +657,14 @@ func (battleMgr *BatManager) GetActorXy(sid Sid, actor1 bool) (byte, *Error) {
         if ok {
             return actor.getCell().xy, nil
         }
-        return 0xFF, NewErr(battleMgr, 54, "Actor not found: sid=%d", sid)
+        return nowhere, NewErr(battleMgr, 54, "Actor not found: sid=%d", sid)
     }
-    return 0xFF, err
+    return nowhere, err
 }
 
 // WolfExists checks whether a wolf is located in a given position.
 // Session ID is needed only to lookup the battle and may be a SID of any participants.
-func (battleMgr *BatManager) WolfExists(sid Sid, xy byte) (bool, *Error) {
+func (battleMgr *BatManager) WolfExists(sid Sid, xy uint16) (bool, *Error) {
     field, err := battleMgr.getCurrentField(sid)
     if err == nil {
         var cell *Cell
@@ -423,11 +698,104 @@ func (battleMgr *BatManager) GetMovablesDump(sid Sid) (dump []byte, e *Error) {
     return []byte{}, err
 }
 
+// GetBattles returns Session IDs of the participants of all current battles; the i-th aggressor fights against the i-th
+// defender
+func (battleMgr *BatManager) GetBattles() (aggressors, defenders []Sid) {
+    battleMgr.RLock()
+    defer battleMgr.RUnlock()
+    for sid, battle := range battleMgr.battles {
+        if sid == battle.detractor1.sid {
+            aggressors = append(aggressors, battle.detractor1.sid)
+            defenders = append(defenders, battle.detractor2.sid)
+        }
+    }
+    return
+}
+
+// Watch subscribes a spectator to a current battle of a given participant. Since now the spectator receives all the
+// events of the battle (from the Aggressor's point of view), except for ABILITY LIST, till the battle is over or
+// Unwatch() is called. A spectator may watch only one battle.
+// "spectator" - spectator's Session ID
+// "participant" - Session ID of any of participants of the battle
+// "bigMaps" - TRUE if the spectator's client supports levels with a header (see HasHeader())
+func (battleMgr *BatManager) Watch(spectator, participant Sid, bigMaps bool) (*MailBox, *Error) {
+    box := NewMailBox()
+    if _, ok := battleMgr.getBattle(spectator); ok {
+        return box, NewErr(battleMgr, 96, "Spectator is busy (%d)", spectator)
+    }
+    battleMgr.Unwatch(spectator) // nolint (leave the previous battle, if any)
+
+    battleMgr.Lock()
+    battle, ok := battleMgr.battles[participant]
+    if ok && battle.bigMaps && !bigMaps {
+        battleMgr.Unlock()
+        return box, NewErr(battleMgr, 99, "Spectator %d doesn't support big maps", spectator)
+    }
+    if ok {
+        battleMgr.spectators[spectator] = battle
+        battle.addSpectator(spectator)
+    }
+    battleMgr.Unlock()
+
+    if ok {
+        round := battle.getRound()
+        Assert(round, round.field, round.player1, round.player2, round.player1.actor, round.player2.actor)
+        sid1 := round.player1.sid
+        char1, char2 := round.player1.actor.getCharacter(), round.player2.actor.getCharacter()
+        lives1, lives2 := round.getLives()
+        score1, score2 := round.getScores()
+        fname := strings.TrimSuffix(round.levelName, filepath.Ext(round.levelName))
+        t := round.getTimeLeft()
+        box.Put(spectator, battleMgr.packer.PackRoundInfo(sid1, sid1, round.number, t, char1, char2, lives1, lives2,
+            fname))
+        // initial layout, then all the objects moved, appended or removed since the round start (like RESTORE STATE)
+        box.Put(spectator, battleMgr.packer.PackFullState(round.field.raw))
+        box.Put(spectator, battleMgr.packer.PackRestoreState(round.field.dumpMovables()))
+        box.Put(spectator, battleMgr.packer.PackScoreChanged(score1, score2))
+        return box, nil
+    }
+    return box, NewErr(battleMgr, 97, "Battle not found: sid=%d", participant)
+}
+
+// Unwatch unsubscribes a spectator from the battle he/she is watching
+// "spectator" - spectator's Session ID
+func (battleMgr *BatManager) Unwatch(spectator Sid) *Error {
+    battleMgr.Lock()
+    battle, ok := battleMgr.spectators[spectator]
+    delete(battleMgr.spectators, spectator)
+    battleMgr.Unlock()
+    if ok {
+        battle.removeSpectator(spectator)
+        return nil
+    }
+    return NewErr(battleMgr, 98, "Spectator not found: sid=%d", spectator)
+}
+
+// GetReplay returns all the recorded events of a finished battle with a given ID
+// "id" - battle ID (see "BATTLE INFO" event)
+// "bigMaps" - TRUE if the client supports levels with a header (see HasHeader())
+func (battleMgr *BatManager) GetReplay(id uint64, bigMaps bool) ([]ReplayEvent, *Error) {
+    if battleMgr.replayDir != "" {
+        events, needBigMaps, err := loadReplay(battleMgr.replayDir, id)
+        if err == nil && needBigMaps && !bigMaps {
+            return nil, NewErr(battleMgr, 126, "Replay %d requires big maps support", id)
+        }
+        return events, err
+    }
+    return nil, NewErr(battleMgr, 103, "Replays are disabled")
+}
+
 // GetBattlesCount returns current count of battles
 func (battleMgr *BatManager) GetBattlesCount() uint {
     battleMgr.RLock()
     defer battleMgr.RUnlock()
-    return uint(len(battleMgr.battles)/2) // len(map) is thread-safe but Data Race may occur
+    res := uint(0)
+    for sid, battle := range battleMgr.battles { // a battle has either 2 or 4 participants (see AcceptTeam())
+        if sid == battle.detractor1.sid {
+            res++
+        }
+    }
+    return res
 }
 
 // GetBattlesCountTotal returns total count of battles since App startup
@@ -503,14 +871,17 @@ func (battleMgr *BatManager) Close() {
 // "sid" - Session ID of any of participants
 // "objNum" - global object number on the battlefield
 // "objID" - object ID
-// "xy" - new location (0-255)
+// "xy" - new location (0xFFFF if the object is removed from the battlefield)
+// "wide" - TRUE if xy takes 2 bytes (see IsWide())
 // "reset" - TRUE, if location has been changed instantaneously (wounded, teleportation, etc.), FALSE otherwise
 // "box" - MailBox to accumulate messages
-func (battleMgr *BatManager) objChanged(sid Sid, objNum, objID, xy byte, reset bool, box *MailBox) *Error {
+func (battleMgr *BatManager) objChanged(sid Sid, objNum, objID byte, xy uint16, wide, reset bool, box *MailBox) *Error {
     // @mitrakov (2017-07-20): objID is added only for additional checking on client-side
     if battle, ok := battleMgr.getBattle(sid); ok {
-        box.Put(battle.detractor1.sid, battleMgr.packer.PackStateChanged(objNum, objID, xy, reset))
-        box.Put(battle.detractor2.sid, battleMgr.packer.PackStateChanged(objNum, objID, xy, reset))
+        for _, p := range battle.getParticipants() {
+            box.Put(p, battleMgr.packer.PackStateChanged(objNum, objID, xy, wide, reset))
+        }
+        battleMgr.putObservers(battle, battleMgr.packer.PackStateChanged(objNum, objID, xy, wide, reset), box)
         return nil
     }
     return NewErr(battleMgr, 60, "Battle not found: sid=%d", sid)
@@ -521,23 +892,28 @@ func (battleMgr *BatManager) objChanged(sid Sid, objNum, objID, xy byte, reset b
 // Session ID is needed only to lookup the battle and may be a SID of any participants.
 // "sid" - Session ID of any of participants
 // "object" - new object appended
+// "wide" - TRUE if xy takes 2 bytes (see IsWide())
 // "box" - MailBox to accumulate messages
-func (battleMgr *BatManager) objAppended(sid Sid, object IObject, box *MailBox) *Error {
+func (battleMgr *BatManager) objAppended(sid Sid, object IObject, wide bool, box *MailBox) *Error {
     Assert(object)
     if battle, ok := battleMgr.getBattle(sid); ok {
-        xy := byte(0xFF)             // if an actor possesses the object, then its xy = 0xFF
+        xy := uint16(nowhere)        // if an actor possesses the object, then its xy = 0xFF (0xFFFF for wide fields)
         if object.getCell() != nil { // else the object is located on the field
             xy = object.getCell().xy // don't use 'Ternary' here (it causes NullPointerException)
         }
         // send
-        box.Put(battle.detractor1.sid, battleMgr.packer.PackObjectAppended(object.getID(), object.getNum(), xy))
-        box.Put(battle.detractor2.sid, battleMgr.packer.PackObjectAppended(object.getID(), object.getNum(), xy))
+        id, num := object.getID(), object.getNum()
+        for _, p := range battle.getParticipants() {
+            box.Put(p, battleMgr.packer.PackObjectAppended(id, num, xy, wide))
+        }
+        battleMgr.putObservers(battle, battleMgr.packer.PackObjectAppended(id, num, xy, wide), box)
         return nil
     }
     return NewErr(battleMgr, 65, "Battle not found: sid=%d", sid)
 }
 
 // foodEaten is a callback on "Food eaten by actor" event.
+// In team battles the score is shared by the teammates (i.e. the clients receive the scores of the teams)
 // "sid" - Session ID of actor who ate food
 // "box" - MailBox to accumulate messages
 func (battleMgr *BatManager) foodEaten(sid Sid, box *MailBox) *Error {
@@ -546,8 +922,11 @@ func (battleMgr *BatManager) foodEaten(sid Sid, box *MailBox) *Error {
         Assert(round)
         if player, ok := round.getPlayerBySid(sid); ok {
             player.score++
-            box.Put(battle.detractor1.sid, battleMgr.packer.PackScoreChanged(round.player1.score, round.player2.score))
-            box.Put(battle.detractor2.sid, battleMgr.packer.PackScoreChanged(round.player1.score, round.player2.score))
+            score1, score2 := round.getScores()
+            for _, p := range battle.getParticipants() {
+                box.Put(p, battleMgr.packer.PackScoreChanged(score1, score2))
+            }
+            battleMgr.putObservers(battle, battleMgr.packer.PackScoreChanged(score1, score2), box)
             return round.checkRoundFinished(box)
         }
         return NewErr(battleMgr, 61, "Player not found (sid=%d)", sid)
@@ -565,8 +944,11 @@ func (battleMgr *BatManager) thingTaken(sid Sid, thing Thing, box *MailBox) *Err
         Assert(round)
         err := round.setThingToPlayer(sid, thing, box)
         if err == nil {
-            box.Put(battle.detractor1.sid, battleMgr.packer.PackThingTaken(battle.detractor1.sid, sid, thing.getID()))
-            box.Put(battle.detractor2.sid, battleMgr.packer.PackThingTaken(battle.detractor2.sid, sid, thing.getID()))
+            for _, p := range battle.getParticipants() {
+                box.Put(p, battleMgr.packer.PackThingTaken(p, sid, thing.getID()))
+            }
+            battleMgr.putObservers(battle, battleMgr.packer.PackThingTaken(battle.detractor1.sid, sid, thing.getID()),
+                box)
         }
         return err
     }
@@ -586,20 +968,39 @@ func (battleMgr *BatManager) roundFinished(winnerSid Sid, box *MailBox) (err *Er
             Assert(detractor1, detractor2)
             sid1, sid2 := detractor1.sid, detractor2.sid
             score1, score2 := detractor1.score, detractor2.score
-            box.Put(sid1, battleMgr.packer.PackRoundFinished(sid1, winnerSid, score1, score2))
-            box.Put(sid2, battleMgr.packer.PackRoundFinished(sid2, winnerSid, score1, score2))
+            for _, p := range battle.getParticipants() { // teammates see the result from their leaders' point of view
+                if leader, ok := battle.getLeader(p); ok {
+                    box.Put(p, battleMgr.packer.PackRoundFinished(leader.sid, winnerSid, score1, score2))
+                }
+            }
+            battleMgr.putObservers(battle, battleMgr.packer.PackRoundFinished(sid1, winnerSid, score1, score2), box)
             if !gameOver {
                 var round *Round
                 round, err = battle.nextRound()
                 if err == nil {
+                    if battle.isPaused() { // the round may be finished just before the pause
+                        round.pause()
+                        battleMgr.environment.setPaused(sid1, true)
+                    }
                     err = battleMgr.startRound(round, box)
                 }
             } else {
                 var reward uint32
                 battle.stop()
                 battleMgr.Lock()
-                delete(battleMgr.battles, sid1)
-                delete(battleMgr.battles, sid2)
+                for _, sid := range battle.getParticipants() {
+                    delete(battleMgr.battles, sid)
+                }
+                for _, sid := range battle.getSpectators() {
+                    delete(battleMgr.spectators, sid)
+                }
+                if battle.mate1 == nil && battle.mate2 == nil { // no rematches for team battles
+                    offer := &rematchT{newDetractor(sid1, detractor1.character, detractor1.abilities),
+                        newDetractor(sid2, detractor2.character, detractor2.abilities), battle.mode, battle.quick,
+                        make(map[Sid]bool), 0, false}
+                    battleMgr.rematches[sid1] = offer // the previous offers (if any) will expire in their time
+                    battleMgr.rematches[sid2] = offer
+                }
                 battleMgr.Unlock()
                 if loser, ok := battle.getEnemy(winnerSid); ok {
                     reward, err = battleMgr.controller.GameOver(winnerSid, loser.sid, score1, score2, battle.quick, box)
@@ -608,6 +1009,24 @@ func (battleMgr *BatManager) roundFinished(winnerSid Sid, box *MailBox) (err *Er
                 }
                 box.Put(sid1, battleMgr.packer.PackGameOver(sid1, winnerSid, score1, score2, reward))
                 box.Put(sid2, battleMgr.packer.PackGameOver(sid2, winnerSid, score1, score2, reward))
+                if battle.mate1 != nil && battle.mate2 != nil { // teammates are rewarded as if they fought each other
+                    mateWinner, mateLoser := battle.mate1.sid, battle.mate2.sid
+                    if winnerSid == sid2 {
+                        mateWinner, mateLoser = mateLoser, mateWinner
+                    }
+                    mateReward, err2 := battleMgr.controller.GameOver(mateWinner, mateLoser, score1, score2,
+                        battle.quick, box)
+                    err = NewErrs(err, err2)
+                    mate1, mate2 := battle.mate1.sid, battle.mate2.sid
+                    box.Put(mate1, battleMgr.packer.PackGameOver(sid1, winnerSid, score1, score2, mateReward))
+                    box.Put(mate2, battleMgr.packer.PackGameOver(sid2, winnerSid, score1, score2, mateReward))
+                }
+                battleMgr.putObservers(battle, battleMgr.packer.PackGameOver(sid1, winnerSid, score1, score2, 0), box)
+                if battleMgr.replayDir != "" {
+                    go func() {
+                        Check(battle.replay.save(battleMgr.replayDir, battle.id))
+                    }()
+                }
             }
         }
         return
@@ -617,6 +1036,7 @@ func (battleMgr *BatManager) roundFinished(winnerSid Sid, box *MailBox) (err *Er
 
 // hurt is a callback on "Actor hurt" event.
 // IMPORTANT: for "Eaten by wolf" event please use eatenByWolf() method instead!
+// In team battles the clients receive the lives of the teams (see Round.getLives())
 // "sid" - Session ID of a wounded actor
 // "cause" - cause of hurt
 // "box" - MailBox to accumulate messages
@@ -626,10 +1046,16 @@ func (battleMgr *BatManager) hurt(sid Sid, cause hurtCause, box *MailBox) *Error
         Assert(round, round.player1, round.player2, battle.detractor1, battle.detractor2)
         isAlive, err := round.wound(sid)
         if err == nil {
-            sid1, sid2 := battle.detractor1.sid, battle.detractor2.sid
-            lives1, lives2 := round.player1.lives, round.player2.lives
-            box.Put(sid1, battleMgr.packer.PackWound(sid1, sid, byte(cause), lives1, lives2))
-            box.Put(sid2, battleMgr.packer.PackWound(sid2, sid, byte(cause), lives2, lives1))
+            sid1 := battle.detractor1.sid
+            lives1, lives2 := round.getLives()
+            for _, p := range battle.getParticipants() {
+                if leader, ok := battle.getLeader(p); ok && leader == battle.detractor1 {
+                    box.Put(p, battleMgr.packer.PackWound(p, sid, byte(cause), lives1, lives2))
+                } else {
+                    box.Put(p, battleMgr.packer.PackWound(p, sid, byte(cause), lives2, lives1))
+                }
+            }
+            battleMgr.putObservers(battle, battleMgr.packer.PackWound(sid1, sid, byte(cause), lives1, lives2), box)
             if isAlive {
                 round.restore(sid, box)
             } else {
@@ -672,28 +1098,34 @@ func (battleMgr *BatManager) eatenByWolf(sid Sid, actor Actor, box *MailBox) *Er
 // "box" - MailBox to accumulate messages
 func (battleMgr *BatManager) effectChanged(sid Sid, id effectT, added bool, objNumber byte, box *MailBox) *Error {
     if battle, ok := battleMgr.getBattle(sid); ok {
-        box.Put(battle.detractor1.sid, battleMgr.packer.PackEffectChanged(byte(id), added, objNumber))
-        box.Put(battle.detractor2.sid, battleMgr.packer.PackEffectChanged(byte(id), added, objNumber))
+        for _, p := range battle.getParticipants() {
+            box.Put(p, battleMgr.packer.PackEffectChanged(byte(id), added, objNumber))
+        }
+        battleMgr.putObservers(battle, battleMgr.packer.PackEffectChanged(byte(id), added, objNumber), box)
         return nil
     }
     return NewErr(battleMgr, 73, "Battle not found: sid=%d", sid)
 }
 
-// setEffectOnEnemy imposes effect (specified by effect ID) on a enemy of a player, specified by a given Session ID
+// setEffectOnEnemy imposes effect (specified by effect ID) on a enemy of a player, specified by a given Session ID.
+// In team battles the effect is imposed on both enemies, and never on the teammate (no friendly fire)
 // "box" - MailBox to accumulate messages
 func (battleMgr *BatManager) setEffectOnEnemy(sid Sid, id effectT, box *MailBox) *Error {
     if battle, ok := battleMgr.getBattle(sid); ok {
         round := battle.getRound()
         Assert(round)
         if enemy, ok := battle.getEnemy(sid); ok {
-            if player, ok := round.getPlayerBySid(enemy.sid); ok {
-                actor := player.actor
-                Assert(actor)
-                if !actor.hasSwagga(Sunglasses) {
-                    actor.setEffect(id, 1, nil) // only formality; in fact it's an empty effect on server-side
-                    return battleMgr.effectChanged(sid, id, true, actor.getNum(), box)
+            if team := round.getTeam(enemy.sid); len(team) > 0 {
+                var err *Error
+                for _, player := range team {
+                    actor := player.actor
+                    Assert(actor)
+                    if !actor.hasSwagga(Sunglasses) {
+                        actor.setEffect(id, 1, nil) // only formality; in fact it's an empty effect on server-side
+                        err = NewErrs(err, battleMgr.effectChanged(sid, id, true, actor.getNum(), box))
+                    }
                 }
-                return nil
+                return err
             }
             return NewErr(battleMgr, 74, "Player not found: sid=%d", sid)
         }
@@ -721,6 +1153,35 @@ func (battleMgr *BatManager) areAvailable(aggressor, defender Sid) (bool, *Error
     return true, nil
 }
 
+// expireRematches removes the rematch offers that have not been accepted in time and returns them; please call this
+// method only under the lock
+func (battleMgr *BatManager) expireRematches() (expired []*rematchT) {
+    seen := make(map[*rematchT]bool)
+    for _, offer := range battleMgr.rematches {
+        if !seen[offer] {
+            seen[offer] = true
+            offer.periods++
+            if offer.periods > rematchPeriods && !offer.accepting {
+                expired = append(expired, offer)
+            }
+        }
+    }
+    for _, offer := range expired {
+        battleMgr.deleteRematch(offer)
+    }
+    return
+}
+
+// deleteRematch removes a given rematch offer; please call this method only under the lock
+// "offer" - rematch offer
+func (battleMgr *BatManager) deleteRematch(offer *rematchT) {
+    for _, sid := range []Sid{offer.detractor1.sid, offer.detractor2.sid} {
+        if battleMgr.rematches[sid] == offer {
+            delete(battleMgr.rematches, sid)
+        }
+    }
+}
+
 // startRound begins a new round (it may be 1-st round of the battle, or just the next round after another)
 // "round" - round to start
 // "box" - MailBox to accumulate messages
@@ -730,7 +1191,7 @@ func (battleMgr *BatManager) startRound(round *Round, box *MailBox) *Error {
     base := round.field.raw
     sid1, sid2 := round.player1.sid, round.player2.sid
     char1, char2 := round.player1.actor.getCharacter(), round.player2.actor.getCharacter()
-    lives1, lives2 := round.player1.lives, round.player2.lives
+    lives1, lives2 := round.getLives()
     abilities1, err1 := round.getCurrentAbilities(sid1)
     abilities2, err2 := round.getCurrentAbilities(sid2)
     t := round.field.timeSec
@@ -740,12 +1201,75 @@ func (battleMgr *BatManager) startRound(round *Round, box *MailBox) *Error {
         box.Put(sid2, battleMgr.packer.PackRoundInfo(sid2, sid1, round.number, t, char1, char2, lives2, lives1, fname))
         box.Put(sid1, battleMgr.packer.PackFullState(base))
         box.Put(sid2, battleMgr.packer.PackFullState(base))
+        if battle, ok := battleMgr.getBattle(sid1); ok {
+            if round.number == 0 {
+                for _, sid := range battle.getParticipants() {
+                    box.Put(sid, battleMgr.packer.PackBattleInfo(battle.id))
+                }
+            }
+            battleMgr.putObservers(battle, battleMgr.packer.PackRoundInfo(sid1, sid1, round.number, t, char1, char2,
+                lives1, lives2, fname), box)
+            battleMgr.putObservers(battle, battleMgr.packer.PackFullState(base), box)
+        }
         box.Put(sid1, battleMgr.packer.PackAbilityList(abilities1))
         box.Put(sid2, battleMgr.packer.PackAbilityList(abilities2))
+        if round.mate1 != nil && round.mate2 != nil {
+            return battleMgr.startRoundForMates(round, box)
+        }
     }
     return NewErrs(err1, err2)
 }
 
+// startRoundForMates sends TEAM INFO to all the participants of a team battle, and sends the round info to the
+// teammates (from their leaders' point of view); it should be called only by startRound()
+// "round" - round to start
+// "box" - MailBox to accumulate messages
+func (battleMgr *BatManager) startRoundForMates(round *Round, box *MailBox) *Error {
+    Assert(round, round.field, round.player1, round.player2, round.mate1, round.mate2)
+
+    player1, player2, mate1, mate2 := round.player1, round.player2, round.mate1, round.mate2
+    Assert(player1.actor, player2.actor, mate1.actor, mate2.actor)
+    base := round.field.raw
+    sid1, sid2 := player1.sid, player2.sid
+    char1, char2 := player1.actor.getCharacter(), player2.actor.getCharacter()
+    char3, char4 := mate1.actor.getCharacter(), mate2.actor.getCharacter()
+    lives1, lives2 := round.getLives()
+    abilities3, err3 := round.getCurrentAbilities(mate1.sid)
+    abilities4, err4 := round.getCurrentAbilities(mate2.sid)
+    t := round.field.timeSec
+    fname := strings.TrimSuffix(round.levelName, filepath.Ext(round.levelName))
+    if err3 == nil && err4 == nil {
+        box.Put(mate1.sid, battleMgr.packer.PackRoundInfo(sid1, sid1, round.number, t, char1, char2, lives1, lives2,
+            fname))
+        box.Put(mate2.sid, battleMgr.packer.PackRoundInfo(sid2, sid1, round.number, t, char1, char2, lives2, lives1,
+            fname))
+        box.Put(mate1.sid, battleMgr.packer.PackFullState(base))
+        box.Put(mate2.sid, battleMgr.packer.PackFullState(base))
+        box.Put(sid1, battleMgr.packer.PackTeamInfo(player1.actor.getID(), char3))
+        box.Put(sid2, battleMgr.packer.PackTeamInfo(player2.actor.getID(), char4))
+        box.Put(mate1.sid, battleMgr.packer.PackTeamInfo(mate1.actor.getID(), char1))
+        box.Put(mate2.sid, battleMgr.packer.PackTeamInfo(mate2.actor.getID(), char2))
+        box.Put(mate1.sid, battleMgr.packer.PackAbilityList(abilities3))
+        box.Put(mate2.sid, battleMgr.packer.PackAbilityList(abilities4))
+    }
+    return NewErrs(err3, err4)
+}
+
+// putObservers records a given message (from the Aggressor's point of view) to the replay of a given battle (if replays
+// are enabled), and puts it to all the spectators of the battle
+// "battle" - battle
+// "msg" - message
+// "box" - MailBox to accumulate messages
+func (battleMgr *BatManager) putObservers(battle *Battle, msg []byte, box *MailBox) {
+    Assert(battle, battle.replay)
+    if battleMgr.replayDir != "" {
+        battle.replay.record(msg)
+    }
+    for _, sid := range battle.getSpectators() {
+        box.Put(sid, msg)
+    }
+}
+
 // deleteCall removes a call (Aggressor -> Defender) from the active calls queue.
 // Method will return error if there has been no thitherto registered calls by Aggressor
 // "aggressor" - Aggressor Session ID
@@ -766,9 +1290,15 @@ func (battleMgr *BatManager) deleteCall(aggressor, defender Sid) *Error {
 }
 
 // getCurrentField returns a reference to a current battlefield.
-// Session ID is needed only to lookup the battle and may be a SID of any participants.
+// Session ID is needed only to lookup the battle and may be a SID of any participants (or spectators).
 func (battleMgr *BatManager) getCurrentField(sid Sid) (*Field, *Error) {
-    if battle, ok := battleMgr.getBattle(sid); ok {
+    battle, ok := battleMgr.getBattle(sid)
+    if !ok {
+        battleMgr.RLock()
+        battle, ok = battleMgr.spectators[sid]
+        battleMgr.RUnlock()
+    }
+    if ok {
         round := battle.curRound
         Assert(round)
         return round.field, nil
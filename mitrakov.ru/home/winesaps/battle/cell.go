@@ -7,20 +7,24 @@ import . "mitrakov.ru/home/winesaps/utils" // nolint
 // Cell is a single cell that may contain objects like actors, wolves, things, food, ropes, ladders and so on.
 type Cell struct {
     sync.RWMutex // to protect objects List
-    xy           byte
+    xy           uint16
     bottom       IObject
     objects      list.List //List[*Object]
 }
 
+// NumberedObjects and UnnumberedObjects are object IDs that Cell.append() creates with and without a sequential
+// number respectively (0x00 is an empty cell); unlisted IDs are ignored by the battlefield (1.4.0+)
+var NumberedObjects, UnnumberedObjects = getObjectTables()
+
 // newCell creates a new instance of Cell. Please do not create a Cell directly.
-// "xy" - coordinate of a cell (0-254)
+// "xy" - coordinate of a cell (0-254 on a standard 51x5 field)
 // "value" - binary string (2 higher bytes for bottom, lower 6 bytes - for an object (please note that with this
 // binary string you can create no more than 1 object, but in general a cell can hold a lot of objects;
 // consider addObject() method))
 // "objNum" - external incrementing function to numerate objects (made as function, not as a value, because the
 // numbers must be unique across the battlefield).
 // nolint: gocyclo
-func newCell(xy, value byte, objNum func() byte) *Cell {
+func newCell(xy uint16, value byte, objNum func() byte) *Cell {
     res := &Cell{xy: xy}
 
     switch value >> 6 {
@@ -40,7 +44,7 @@ func newCell(xy, value byte, objNum func() byte) *Cell {
 // "objNum" - external incrementing function to numerate objects
 // nolint: gocyclo
 func (cell *Cell) append(objNum func() byte, id byte) {
-    // ATTENTION! When modify this function don't forget to also modify aimanager.go
+    // ATTENTION! When modify this function don't forget to also modify ai/manager.go
     Assert(cell)
     
     var obj IObject // ONLY VIA INTERFACE! this is for type safety!
@@ -91,6 +95,14 @@ func (cell *Cell) append(objNum func() byte, id byte) {
         obj = newFoodActor1(objNum(), cell)
     case 0x17:
         obj = newFoodActor2(objNum(), cell)
+    case 0x18:
+        obj = newActor3(objNum(), cell)
+    case 0x19:
+        obj = newActor4(objNum(), cell)
+    case 0x1A:
+        obj = newEntry3(cell)
+    case 0x1B:
+        obj = newEntry4(cell)
     case 0x20:
         obj = newUmbrellaThing(objNum(), cell)
     case 0x21:
@@ -139,6 +151,19 @@ func (cell *Cell) append(objNum func() byte, id byte) {
     }
 }
 
+// getObjectTables calls append() for all possible object IDs to find out which of them are known and numbered
+func getObjectTables() (numbered, unnumbered map[byte]bool) {
+    numbered, unnumbered = map[byte]bool{}, map[byte]bool{0x00: true}
+    for id := byte(0x01); id <= 0x3F; id++ {
+        cell := &Cell{}
+        cell.append(func() byte { numbered[id] = true; return 1 }, id)
+        if !numbered[id] && cell.objects.Len() > 0 {
+            unnumbered[id] = true
+        }
+    }
+    return
+}
+
 // addObject places a given object inside the cell
 func (cell *Cell) addObject(obj Movable) {
     Assert(obj)
@@ -3,7 +3,7 @@ package battle
 import "mitrakov.ru/home/winesaps/sid"
 
 // Detractor is an "abstract global" participant of a battle; it is still neither a player, not an actor.
-// There can be exactly 2 instances per Battle
+// There can be exactly 2 instances per Battle (4 instances for team battles)
 type Detractor struct {
     sid       sid.Sid
     character byte
@@ -3,7 +3,6 @@ package battle
 import "log"
 import "time"
 import "sync"
-import "math/rand"
 import . "mitrakov.ru/home/winesaps/sid"   // nolint
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 
@@ -12,6 +11,7 @@ import . "mitrakov.ru/home/winesaps/utils" // nolint
 type Environment struct {
     sync.RWMutex
     fields map[Sid]*Field
+    paused map[Sid]bool // battlefields that are not processed till resumed (1.4.0+)
     stop   chan bool
 }
 
@@ -22,13 +22,17 @@ const voodooDistance = 3
 
 // newEnvironment creates a new instance of Environment. Please do not create the Environment directly.
 // "battleManager" - reference to IBattleManager
-func newEnvironment(battleManager IBattleManager) *Environment {
-    Assert(battleManager)
+// "clock" - time source for the ticks
+func newEnvironment(battleManager IBattleManager, clock Clock) *Environment {
+    Assert(battleManager, clock)
     
-    env := &Environment{fields: make(map[Sid]*Field)}
-    env.stop = RunDaemon("env", tickDelay, func() {
+    env := &Environment{fields: make(map[Sid]*Field), paused: make(map[Sid]bool)}
+    env.stop = clock.RunDaemon("env", tickDelay, func() {
         env.RLock()
         for sid, field := range env.fields {
+            if env.paused[sid] {
+                continue
+            }
             env.RUnlock()
             box := NewMailBox()
             wolves := field.getWolves()
@@ -77,10 +81,27 @@ func (env* Environment) removeField(sid1, sid2 Sid) {
     env.Lock()
     delete(env.fields, sid1)
     delete(env.fields, sid2)
+    delete(env.paused, sid1)
+    delete(env.paused, sid2)
     env.Unlock()
     log.Println("Field removed for SIDs:", sid1, sid2)
 }
 
+// setPaused pauses (or resumes) processing of a battlefield by a given Session ID (e.g. wolves stop moving)
+// "sid" - Session ID, used as a key in addField()
+// "paused" - TRUE to pause, FALSE to resume
+func (env* Environment) setPaused(sid Sid, paused bool) {
+    Assert(env.paused)
+
+    env.Lock()
+    if paused {
+        env.paused[sid] = true
+    } else {
+        delete(env.paused, sid)
+    }
+    env.Unlock()
+}
+
 // close shuts Environment down and releases all seized resources
 func (env* Environment) close() {
     Assert(env.stop)
@@ -111,14 +132,14 @@ func stepWolf(sid Sid, field *Field, wolf *Wolf, battleManager IBattleManager, b
         wolf.curDir *= -1
         err0 = battleManager.effectChanged(sid, effAfraid, true, wolf.getNum(), box)
     }
-    if cell.hasLadderTop() && rand.Intn(2) == 0 && !wolf.justUsedLadder {
-        _, err1 = field.move(sid, wolf, int(cell.xy)+Width, box)
+    if cell.hasLadderTop() && field.rnd.Intn(2) == 0 && !wolf.justUsedLadder {
+        _, err1 = field.move(sid, wolf, int(cell.xy)+field.width, box)
         wolf.justUsedLadder = true
-    } else if cell.hasLadderBottom() && rand.Intn(2) == 0 && !wolf.justUsedLadder {
-        _, err1 = field.move(sid, wolf, int(cell.xy)-Width, box)
+    } else if cell.hasLadderBottom() && field.rnd.Intn(2) == 0 && !wolf.justUsedLadder {
+        _, err1 = field.move(sid, wolf, int(cell.xy)-field.width, box)
         wolf.justUsedLadder = true
-    } else if cell.hasRopeLine() && rand.Intn(2) == 0 {
-        _, err1 = field.move(sid, wolf, int(cell.xy)-Width, box)
+    } else if cell.hasRopeLine() && field.rnd.Intn(2) == 0 {
+        _, err1 = field.move(sid, wolf, int(cell.xy)-field.width, box)
     } else {
         var success bool
         success, err1 = field.move(sid, wolf, int(cell.xy)+wolf.curDir, box)
@@ -6,7 +6,7 @@ import "container/list"
 import . "mitrakov.ru/home/winesaps/sid"   // nolint
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 
-// battlefield dimensions
+// default battlefield dimensions (since 1.4.0 a level may declare its own dimensions in a header, see ParseHeader())
 const (
     // Width is count of cells in horizontal direction
     Width  = 51
@@ -14,6 +14,13 @@ const (
     Height = 5
 )
 
+// headerMarker is the first byte of a level header (0xFF cannot be a cell, because there is no object with ID 0x3F)
+const headerMarker = 0xFF
+// nowhere is xy of an object that is not located on the battlefield (e.g. eaten food or a thing taken by an actor)
+const nowhere = 0xFFFF
+// MaxObjNum is max count of numbered objects on a level (object numbers take 1 byte in messages, even on big maps)
+const MaxObjNum = 0xFF
+
 // characters
 const (
     Rabbit = iota + 1
@@ -24,7 +31,7 @@ const (
 
 // CharactersCount is total number of characters
 const CharactersCount = Cat
-// roundTime is a standard round duration, in sec.
+// roundTime is a standard round duration, in sec. (default for the predefined game modes, see GameMode)
 const roundTime = 90  // see note#5
 
 // effect type
@@ -43,33 +50,37 @@ const antidoteEffect = 10
 // length of mines detection for Detectors, in cells (if an actor takes Detector all mines in N cells will be detonated)
 const detectionLength = 8
 
-// Field expresses a single battle field with 2 actors and N wolves (N ≥ 0)
+// Field expresses a single battle field with 2 actors (4 actors for team battles) and N wolves (N ≥ 0)
 type Field struct {
     sync.Mutex
     battleManager    IBattleManager
-    cells            [Width * Height]*Cell
+    cells            []*Cell
+    width            int                   // count of cells in horizontal direction (1.4.0+)
+    height           int                   // count of cells in vertical direction (1.4.0+)
+    offset           int                   // offset of the level map in raw data (length of the header) (1.4.0+)
+    wide             bool                  // TRUE if xy takes 2 bytes (see IsWide()) (1.4.0+)
     raw              []byte
-    movablesDump     map[Movable]byte      // please don't rely upon this map! it's only dump to restore state (1.3.0+)
+    movablesDump     map[Movable]uint16    // please don't rely upon this map! it's only dump to restore state (1.3.0+)
     movablesDumpLock sync.Mutex            // locker for movablesDump (do not use self-mutex, it may cause dead-locks)
     curObjNum        byte                  // objects incrementing counter
     cellLock         sync.Mutex            // extra lock on addObj/removeObj logical operation (1.3.5+)
     timeSec          byte
+    rnd              *Rand                 // random generator of the round (1.4.0+)
 }
 
 // newField creates a new instance of Field. Please do not create a Field directly.
 // Note that a "Round" corresponds to a "Field" as 1:1
 // "battleMgr" - reference to IBattleManager
 // "levelname" - level filename
+// "level" - level raw bytearray, captured on the battle start (NULL if the level has not been found)
+// "timeSec" - round duration, in sec. (a level may override it by section 3)
+// "rnd" - random generator of the round
 // nolint: gocyclo
-func newField(battleMgr IBattleManager, levelname string) (*Field, *Error) {
-    Assert(battleMgr)
+func newField(battleMgr IBattleManager, levelname string, level []byte, timeSec byte, rnd *Rand) (*Field, *Error) {
+    Assert(battleMgr, rnd)
     var err *Error
 
-    // getting level raw bytearray
-    reader := battleMgr.getFileReader()
-    Assert(reader)
-    level, ok := reader.GetByName(levelname)
-    if !ok {
+    if len(level) == 0 {
         err = NewErr(&Field{}, 90, "Level not found: %s", levelname)
     }
 
@@ -79,25 +90,38 @@ func newField(battleMgr IBattleManager, levelname string) (*Field, *Error) {
 
     // parsing
     if err == nil {
-        if len(raw) >= Width*Height {
-            res := &Field{battleManager: battleMgr, raw: raw, movablesDump: make(map[Movable]byte), timeSec: roundTime}
+        width, height, offset := ParseHeader(raw)
+        size := width * height
+        if size > 0 && len(raw) >= offset+size {
+            res := &Field{battleManager: battleMgr, cells: make([]*Cell, size), width: width, height: height,
+                offset: offset, wide: IsWide(width, height), raw: raw, movablesDump: make(map[Movable]uint16),
+                timeSec: timeSec, rnd: rnd}
             battleMgr.IncFieldRefs()
             runtime.SetFinalizer(res, func(*Field) {battleMgr.DecFieldRefs()})
             // parse level map
-            for i := 0; i < Width*Height; i++ {
-                res.cells[i] = newCell(byte(i), raw[i], func() byte { res.curObjNum++; return res.curObjNum })
+            objects := 0
+            for i := 0; i < size; i++ {
+                res.cells[i] = newCell(uint16(i), raw[offset+i], func() byte {
+                    objects++
+                    res.curObjNum++
+                    return res.curObjNum
+                })
+            }
+            if objects > MaxObjNum {
+                return nil, NewErr(res, 94, "Too many objects (%d); must be <= %d", objects, MaxObjNum)
             }
             // parse additional sections
-            for j := Width * Height; j+1 < len(raw); j += 2 {
+            xySize := TernaryInt(res.wide, 2, 1)
+            for j := offset + size; j+1 < len(raw); j += 2 {
                 sectionCode := raw[j]
                 sectionLen := int(raw[j+1])
                 switch sectionCode {
-                case 1: // parse additional level objects
+                case 1: // parse additional level objects (num, id, xy), where xy takes 1 or 2 bytes
                     startK := j + 2
-                    for k := startK; k+2 < startK+sectionLen && k+2 < len(raw); k += 3 {
+                    for k := startK; k+1+xySize < startK+sectionLen && k+1+xySize < len(raw); k += 2 + xySize {
                         num := raw[k]
                         id := raw[k+1]
-                        xy := raw[k+2]
+                        xy := GetXy(raw[k+2:], res.wide)
                         if int(xy) < len(res.cells) {
                             if num > res.curObjNum {
                                 res.cells[xy].append(func() byte { return num }, id)
@@ -116,6 +140,13 @@ func newField(battleMgr IBattleManager, levelname string) (*Field, *Error) {
                 }
                 j += sectionLen
             }
+            // randomize wolves' directions (cells are iterated in order, so that the result depends only on the seed)
+            wolves := res.getWolves()
+            for j := wolves.Front(); j != nil; j = j.Next() {
+                if wolf, ok := j.Value.(*Wolf); ok {
+                    wolf.setRandomDir(rnd)
+                }
+            }
             return res, nil
         }
         return nil, NewErr(new(Field), 93, "Incorrect field file length")
@@ -123,6 +154,53 @@ func newField(battleMgr IBattleManager, levelname string) (*Field, *Error) {
     return nil, err
 }
 
+// ParseHeader returns dimensions of a given level and offset of its map. Since 1.4.0 a level may start with a header
+// section: marker (0xFF), section length (≥ 2), width, height; levels without a header are 51x5.
+// "level" - level raw bytearray
+func ParseHeader(level []byte) (width, height, offset int) {
+    if len(level) > 3 && level[0] == headerMarker && level[1] >= 2 {
+        return int(level[2]), int(level[3]), int(level[1]) + 2
+    }
+    return Width, Height, 0
+}
+
+// HasHeader checks whether a given level starts with a header section (see ParseHeader()); such levels may have any
+// dimensions, so they are supported only by the clients that negotiate big maps on sign in (1.4.0+)
+func HasHeader(level []byte) bool {
+    _, _, offset := ParseHeader(level)
+    return offset > 0
+}
+
+// IsWide checks whether xy on a battlefield of given dimensions takes 2 bytes (big-endian) in level sections and
+// messages, instead of 1 byte; it's so for the fields with more than 255 cells, because 0xFF is reserved for "nowhere"
+func IsWide(width, height int) bool {
+    return width*height > 0xFF
+}
+
+// GetXy reads xy from a given bytearray (1 or 2 bytes, see IsWide()); 0xFF is converted to "nowhere" (0xFFFF)
+func GetXy(data []byte, wide bool) uint16 {
+    if wide {
+        return uint16(data[0])<<8 | uint16(data[1])
+    }
+    if data[0] == 0xFF {
+        return nowhere
+    }
+    return uint16(data[0])
+}
+
+// IsTeamLevel checks whether a given level is intended for team battles (2 vs. 2), i.e. it contains Actor3 and Actor4;
+// such levels are not used in ordinary battles, and vice versa (since 1.4.0)
+// "level" - level raw bytearray
+func IsTeamLevel(level []byte) bool {
+    width, height, offset := ParseHeader(level)
+    for i := offset; i < offset+width*height && i < len(level); i++ {
+        if level[i]&0x3F == 0x18 { // Actor3
+            return true
+        }
+    }
+    return false
+}
+
 // getNextNum is a function to incr. current object number. It's important because all objects must have unique numbers
 func (field *Field) getNextNum() byte {
     field.curObjNum++
@@ -133,12 +211,12 @@ func (field *Field) getNextNum() byte {
 // is instantaneous, like teleportation or respawning after being hurt; otherwise set "reset" to FALSE
 // "sid" - Session ID of initiator of the action
 // "box" - MailBox to accumulate messages
-func (field *Field) objChanged(sid Sid, obj Movable, xy byte, reset bool, box *MailBox) *Error {
+func (field *Field) objChanged(sid Sid, obj Movable, xy uint16, reset bool, box *MailBox) *Error {
     Assert(field.movablesDump, field.battleManager, obj)
     field.movablesDumpLock.Lock()
     field.movablesDump[obj] = xy
     field.movablesDumpLock.Unlock()
-    return field.battleManager.objChanged(sid, obj.getNum(), obj.getID(), xy, reset, box)
+    return field.battleManager.objChanged(sid, obj.getNum(), obj.getID(), xy, field.wide, reset, box)
 }
 
 // objChanged is called when a new object "obj" is arises (e.g. an actor established an umbrella or buries a mine)
@@ -149,7 +227,7 @@ func (field *Field) objAppended(sid Sid, obj Movable, box *MailBox) *Error {
     field.movablesDumpLock.Lock()
     field.movablesDump[obj] = obj.getCell().xy
     field.movablesDumpLock.Unlock()
-    return field.battleManager.objAppended(sid, obj, box)
+    return field.battleManager.objAppended(sid, obj, field.wide, box)
 }
 
 // isMoveUpPossible checks whether moving up from a given cell is possible (e.g. there is a LadderBottom)
@@ -186,8 +264,9 @@ func (field *Field) move(sid Sid, obj Movable, idxTo int, box *MailBox) (success
 func (field *Field) moveSync(sid Sid, obj Movable, idxTo int, box *MailBox) (success bool, err *Error) {
     Assert(obj, obj.getCell())
 
-    if 0 <= idxTo && idxTo < Width*Height {
-        idx := byte(idxTo)
+    if 0 <= idxTo && idxTo < len(field.cells) {
+        idx := uint16(idxTo)
+        width := field.width
         oldCell := obj.getCell()
         newCell, err := field.getCell(idx)
         if err == nil {
@@ -198,7 +277,7 @@ func (field *Field) moveSync(sid Sid, obj Movable, idxTo int, box *MailBox) (suc
                 return false, nil
             }
             // climb a rope
-            if h == -Width && oldCell.hasRopeLine() {
+            if h == -width && oldCell.hasRopeLine() {
                 err = field.relocate(sid, oldCell, newCell, obj, false, box)
                 return true, err
             }
@@ -210,18 +289,18 @@ func (field *Field) moveSync(sid Sid, obj Movable, idxTo int, box *MailBox) (suc
             }
             // sink through the floor
             if oldCell.bottom != nil {
-                if h == Width && !oldCell.hasLadderTop() {
+                if h == width && !oldCell.hasLadderTop() {
                     return false, nil
                 }
-                if h == -Width && !oldCell.hasLadderBottom() {
+                if h == -width && !oldCell.hasLadderBottom() {
                     return false, nil
                 }
             }
             // left-right edges
-            if (oldCell.xy+1)%Width == 0 && (h > 0 && h < Width) { // if right edge
+            if (int(oldCell.xy)+1)%width == 0 && (h > 0 && h < width) { // if right edge
                 return false, nil
             }
-            if oldCell.xy%Width == 0 && (h < 0 && h > -Width) { // if left edge
+            if int(oldCell.xy)%width == 0 && (h < 0 && h > -width) { // if left edge
                 return false, nil
             }
             
@@ -232,7 +311,7 @@ func (field *Field) moveSync(sid Sid, obj Movable, idxTo int, box *MailBox) (suc
                 return true, err
             }
             // else nothing underfoot: fall down!
-            return field.moveSync(sid, obj, idxTo+Width, box)
+            return field.moveSync(sid, obj, idxTo+width, box)
         }
         return false, err
     }
@@ -240,7 +319,7 @@ func (field *Field) moveSync(sid Sid, obj Movable, idxTo int, box *MailBox) (suc
 }
 
 // getCell returns a cell by its index; please ALWAYS call this method instead of direct accessing the internal array
-func (field *Field) getCell(idx byte) (*Cell, *Error) {
+func (field *Field) getCell(idx uint16) (*Cell, *Error) {
     if int(idx) < len(field.cells) {
         return field.cells[idx], nil
     }
@@ -275,6 +354,34 @@ func (field *Field) getActor2() (*Actor2, bool) {
     return nil, false
 }
 
+// getActor3 returns Actor3 on the battlefield (it exists only on the levels for team battles)
+func (field *Field) getActor3() (*Actor3, bool) {
+    for _, c := range field.cells {
+        c.Lock()
+        defer c.Unlock()
+        for j := c.objects.Front(); j != nil; j = j.Next() {
+            if res, ok := j.Value.(*Actor3); ok {
+                return res, true
+            }
+        }
+    }
+    return nil, false
+}
+
+// getActor4 returns Actor4 on the battlefield (it exists only on the levels for team battles)
+func (field *Field) getActor4() (*Actor4, bool) {
+    for _, c := range field.cells {
+        c.Lock()
+        defer c.Unlock()
+        for j := c.objects.Front(); j != nil; j = j.Next() {
+            if res, ok := j.Value.(*Actor4); ok {
+                return res, true
+            }
+        }
+    }
+    return nil, false
+}
+
 // getWolves returns a list of Wolves on the battlefield
 func (field *Field) getWolves() (res list.List) {
     for _, c := range field.cells {
@@ -303,7 +410,7 @@ func (field *Field) getFavouriteFoodList() (res list.List) {
     return
 }
 
-// getEntryByActor returns a proper entry point for a given actor (i.e. Entry1 for Actor1 or Entry2 for Actor2)
+// getEntryByActor returns a proper entry point for a given actor (i.e. Entry1 for Actor1, Entry2 for Actor2 and so on)
 func (field *Field) getEntryByActor(actor Actor) (Entry, bool) {
     for _, c := range field.cells {
         c.Lock()
@@ -319,6 +426,16 @@ func (field *Field) getEntryByActor(actor Actor) (Entry, bool) {
                     return res, true
                 }
             }
+            if _, ok := actor.(*Actor3); ok {
+                if res, ok := j.Value.(*Entry3); ok {
+                    return res, true
+                }
+            }
+            if _, ok := actor.(*Actor4); ok {
+                if res, ok := j.Value.(*Entry4); ok {
+                    return res, true
+                }
+            }
         }
     }
     return nil, false
@@ -385,6 +502,9 @@ func (field *Field) useThing(sid Sid, actor Actor, thing Thing, box *MailBox) *E
 
     // emplace object
     emplaced := thing.emplace(field.getNextNum(), myCell)
+    if mine, ok := emplaced.(*Mine); ok {
+        mine.owner = actor // the owner is needed to avoid friendly fire in team battles
+    }
     err1 := field.objAppended(sid, emplaced, box)
     _, err2 := field.move(sid, emplaced, int(cell.xy), box)
 
@@ -413,35 +533,41 @@ func (field *Field) relocate(sid Sid, oldCell, newCell *Cell, obj Movable, reset
     
     err := field.objChanged(sid, obj, newCell.xy, reset, box)
     if err == nil && !reset { // when reset == true, no need to check cell (since 1.3.9)
-        return field.checkCell(sid, newCell, box)
+        return field.checkCell(sid, newCell, obj, box)
     }
     return err
 }
 
 // checkCell checks a given cell for any events after relocating objects, like consuming food, taking things and so on.
 // "sid" - Session ID of initiator of this action
+// "obj" - relocated object; if it's an Actor, the cell is checked for this very Actor (in team battles 2 actors may
+// share the same cell)
 // "box" - MailBox to accumulate messages
 // nolint: gocyclo
-func (field *Field) checkCell(sid Sid, cell *Cell, box *MailBox) (err *Error) {
+func (field *Field) checkCell(sid Sid, cell *Cell, obj Movable, box *MailBox) (err *Error) {
     Assert(cell, field.battleManager)
 
-    if actor, ok := cell.hasActor(); ok {
+    actor, ok := obj.(Actor)
+    if !ok {
+        actor, ok = cell.hasActor()
+    }
+    if ok {
         // ==== 1. Checks that DO NOT return (e.g. items can be collected simultaneously) ===
         if food, ok := cell.hasFood(); ok && !isPoison(actor, food) {
             cell.removeObject(food)
-            err1 := field.objChanged(sid, food, 0xFF, true, box)
+            err1 := field.objChanged(sid, food, nowhere, true, box)
             err2 := field.battleManager.foodEaten(sid, box)
             err = NewErrs(err, err1, err2)
         }
         if thing, ok := cell.hasThing(); ok {
             cell.removeObject(thing)
-            err1 := field.objChanged(sid, thing, 0xFF, true, box)
+            err1 := field.objChanged(sid, thing, nowhere, true, box)
             err2 := field.battleManager.thingTaken(sid, thing, box)
             err = NewErrs(err, err1, err2)
         }
         if beam, ok := cell.hasBeam(); ok {
             cell.removeObject(beam)
-            err1 := field.objChanged(sid, beam, 0xFF, true, box)
+            err1 := field.objChanged(sid, beam, nowhere, true, box)
             err2 := field.createBeamChunks(sid, cell, actor.isDirectedToRight(), box)
             err = NewErrs(err, err1, err2)
         }
@@ -452,19 +578,19 @@ func (field *Field) checkCell(sid Sid, cell *Cell, box *MailBox) (err *Error) {
                 field.battleManager.onEvent(futureBox, futureErr)
             })
             cell.removeObject(antidote)
-            err1 := field.objChanged(sid, antidote, 0xFF, true, box)
+            err1 := field.objChanged(sid, antidote, nowhere, true, box)
             err2 := field.battleManager.effectChanged(sid, effAntidote, true, actor.getNum(), box)
             err = NewErrs(err, err1, err2)
         }
         if bang, ok := cell.hasFlashbang(); ok {
             cell.removeObject(bang)
-            err1 := field.objChanged(sid, bang, 0xFF, true, box)
+            err1 := field.objChanged(sid, bang, nowhere, true, box)
             err2 := field.battleManager.setEffectOnEnemy(sid, effDazzle, box)
             err = NewErrs(err, err1, err2)
         }
         if detector, ok := cell.hasDetector(); ok {
             cell.removeObject(detector)
-            err1 := field.objChanged(sid, detector, 0xFF, true, box)
+            err1 := field.objChanged(sid, detector, nowhere, true, box)
             err2 := field.detectMines(sid, cell, actor.isDirectedToRight(), detectionLength, box)
             err = NewErrs(err, err1, err2)
         }
@@ -472,8 +598,8 @@ func (field *Field) checkCell(sid Sid, cell *Cell, box *MailBox) (err *Error) {
         // teleport case (please note, that teleport RETURNS to save from mines, water, etc.)
         if teleport, ok := cell.hasTeleport(); ok {
             cell.removeObject(teleport)
-            err1 := field.objChanged(sid, teleport, 0xFF, true, box)
-            newXy := getMirrorXy(cell.xy)
+            err1 := field.objChanged(sid, teleport, nowhere, true, box)
+            newXy := field.getMirrorXy(cell.xy)
             newCell, err2 := field.getCellForTeleportation(newXy)
             if err2 == nil {
                 err2 = field.relocate(sid, actor.getCell(), newCell, actor, true, box)
@@ -482,7 +608,7 @@ func (field *Field) checkCell(sid Sid, cell *Cell, box *MailBox) (err *Error) {
         }
         if food, ok := cell.hasFood(); ok && isPoison(actor, food) {
             cell.removeObject(food)
-            err1 := field.objChanged(sid, food, 0xFF, true, box)
+            err1 := field.objChanged(sid, food, nowhere, true, box)
             if actor.hasEffect(effAntidote) {
                 err2 := field.battleManager.foodEaten(sid, box)
                 err = NewErrs(err, err1, err2) // no return here (we should check mines, waterfalls and so on)
@@ -492,12 +618,12 @@ func (field *Field) checkCell(sid Sid, cell *Cell, box *MailBox) (err *Error) {
             }
         }
         if mine, ok := cell.hasMine(); ok && !cell.hasBeamChunk() && !actor.hasSwagga(SapperShoes) {
-            if !actor.hasEffect(effAttention) {
+            if !actor.hasEffect(effAttention) && !areTeammates(actor, mine.owner) { // no friendly fire in team battles
                 // thanks to this condition the actor can ONCE step onto the mine immediately upon it burried; but in
                 // theory the condition allows the enemy to avoid explosion (if it's stepCount = mine.stepCount+1)
                 // so let's consider it as a feature
                 cell.removeObject(mine)
-                err1 := field.objChanged(sid, mine, 0xFF, true, box)
+                err1 := field.objChanged(sid, mine, nowhere, true, box)
                 err2 := field.battleManager.hurt(sid, exploded, box)
                 return NewErrs(err, err1, err2)
             }
@@ -520,15 +646,15 @@ func (field *Field) checkCell(sid Sid, cell *Cell, box *MailBox) (err *Error) {
 // it may return NULL, e.g. if "curCell" is on the edge
 func (field *Field) getCellByDirection(curCell *Cell, toRight bool) (cell *Cell) {
     Assert(curCell)
-    xy := curCell.xy
+    xy := int(curCell.xy)
 
     if toRight {
-        if (xy+1)%Width == 0 {
+        if (xy+1)%field.width == 0 {
             return nil
         }
         cell = field.cells[xy+1]
     } else {
-        if xy%Width == 0 {
+        if xy%field.width == 0 {
             return nil
         }
         cell = field.cells[xy-1]
@@ -583,7 +709,7 @@ func (field *Field) detectMines(sid Sid, cell *Cell, toRight bool, n int, box *M
     if cell != nil && n >= 0 {
         if mine, ok := cell.hasMine(); ok {
             cell.removeObject(mine)
-            err = field.objChanged(sid, mine, 0xFF, true, box)
+            err = field.objChanged(sid, mine, nowhere, true, box)
         }
         if err == nil {
             nextCell := field.getCellByDirection(cell, toRight)
@@ -617,7 +743,8 @@ func (field *Field) replaceFavouriteFood(actor1, actor2 Actor) {
             cell.addObject(food)
 
             // also fix raw field data for sending to clients
-            field.raw[cell.xy] = (field.raw[cell.xy] & 0xC0) | food.getID()
+            idx := field.offset + int(cell.xy)
+            field.raw[idx] = (field.raw[idx] & 0xC0) | food.getID()
         }
     }
 }
@@ -644,14 +771,15 @@ func (field *Field) createFavouriteFood(actor Actor, num byte, cell *Cell) Food
 }
 
 // getCellForTeleportation finds and returns a cell for teleporting from a given cell
-// newXy - new location (0-255) to check
-func (field *Field) getCellForTeleportation(newXy byte) (newCell *Cell, err *Error) {
+// newXy - new location to check
+func (field *Field) getCellForTeleportation(newXy uint16) (newCell *Cell, err *Error) {
+    width, height := field.width, field.height
     var f func(int, *Cell) (*Cell, *Error)
     f = func(xy int, cell *Cell) (*Cell, *Error) {
         if xy > 0 {
-	        if nc, er := field.getCell(byte(xy)); er == nil {
+	        if nc, er := field.getCell(uint16(xy)); er == nil {
                 if nc.hasBlock() || nc.hasWaterInside() {
-	                return f(xy - Width, nc)
+	                return f(xy - width, nc)
                 }
                 return nc, er
 	        }
@@ -660,12 +788,12 @@ func (field *Field) getCellForTeleportation(newXy byte) (newCell *Cell, err *Err
     }
 
     // 1) avoid teleportation to underground (not all levels support underground)
-    if newXy / Width == Height-1 {
-        newXy -= Width
+    if int(newXy) / width == height-1 && height > 1 {
+        newXy -= uint16(width)
     }
     // 2) avoid teleportation INSIDE the block/water (upon water surface is still allowed)
     if newCell, err = field.getCell(newXy); err == nil && (newCell.hasBlock() || newCell.hasWaterInside()) {
-        indexToSearch := int(newXy % Width + (Height - 2) * Width)
+        indexToSearch := int(newXy) % width + (height - 2) * width
         return f(indexToSearch, newCell)
     }
     return
@@ -673,20 +801,26 @@ func (field *Field) getCellForTeleportation(newXy byte) (newCell *Cell, err *Err
 
 // dumpMovables creates a binary dump of all Movable objects on the battlefield in internal format.
 // this method is primarily written to support "Restore state" feature, introduced in 1.3.0
+// since 1.4.0 xy takes 2 bytes on wide battlefields (see IsWide())
 func (field *Field) dumpMovables() []byte {
     Assert(field.movablesDump)
     
-    field.Lock()
-    res := make([]byte, 3 * len(field.movablesDump))
+    field.movablesDumpLock.Lock() // the map is changed under this lock (see objChanged(), objAppended())
+    xySize := TernaryInt(field.wide, 2, 1)
+    res := make([]byte, (2 + xySize) * len(field.movablesDump))
     
     var i int
     for obj, xy := range field.movablesDump {
         res[i] = obj.getNum()
         res[i+1] = obj.getID()
-        res[i+2] = xy
-        i+=3        
+        if field.wide {
+            res[i+2], res[i+3] = byte(xy >> 8), byte(xy)
+        } else {
+            res[i+2] = byte(xy)
+        }
+        i += 2 + xySize
     }
-    field.Unlock()
+    field.movablesDumpLock.Unlock()
     return res
 }
 
@@ -709,6 +843,25 @@ func isPoison(actor Actor, food Food) bool {
     return true
 }
 
+// areTeammates checks whether 2 given actors are different actors of the same team (Actor1 + Actor3 or Actor2 + Actor4)
+func areTeammates(actor1, actor2 Actor) bool {
+    switch actor1.(type) {
+    case *Actor1:
+        _, ok := actor2.(*Actor3)
+        return ok
+    case *Actor3:
+        _, ok := actor2.(*Actor1)
+        return ok
+    case *Actor2:
+        _, ok := actor2.(*Actor4)
+        return ok
+    case *Actor4:
+        _, ok := actor2.(*Actor2)
+        return ok
+    }
+    return false
+}
+
 // isPoisonForRabbit checks if given food is poison for Rabbits
 func isPoisonForRabbit(food Food) bool {
     // can eat apples, pears and CARROTS
@@ -769,12 +922,12 @@ func isPoisonForCat(food Food) bool {
     return false
 }
 
-// getMirrorXy returns coordinates, "mirrored" to a given "xy"; e.g. for xy=0 it will return xy=254
-func getMirrorXy(xy byte) byte {
-    x0, y0 := xy % Width, xy / Width
-    x := x0 + 2*(Width/2 - x0)
-    y := y0 + 2*(Height/2 - y0)
-    return y*Width + x
+// getMirrorXy returns coordinates, "mirrored" to a given "xy"; e.g. for xy=0 it will return xy=254 (on 51x5 field)
+func (field *Field) getMirrorXy(xy uint16) uint16 {
+    x0, y0 := int(xy) % field.width, int(xy) / field.width
+    x := field.width-1 - x0
+    y := field.height-1 - y0
+    return uint16(y*field.width + x)
 }
 
 // note#4 (@mitrakov, 2017-04-14): earlier I used a "level" slice as "raw" data; but as soon as "Favourite Food" feature
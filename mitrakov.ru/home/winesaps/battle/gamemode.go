@@ -0,0 +1,79 @@
+package battle
+
+import "strconv"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// GameMode is a named set of battle rules (count of rounds, lives, round duration and so on); game modes may be
+// defined in the config, so that new modes (e.g. "Blitz" or "Marathon") don't require any code changes (1.4.0+)
+type GameMode struct {
+    Name       string
+    Wins       byte // count of round wins to win the battle
+    Lives      byte // initial lives of a Player in each round
+    RoundTime  byte // round duration, in sec. (note that a level may specify its own round time, see newField())
+    WinPercent byte // share of the food on the level (in %) that a Player must eat to win the round ahead of time
+    MaxCalls   byte // max count of periods that an Aggressor waits for a Defender to accept the call (see "period")
+}
+
+// names of the predefined game modes
+const (
+    ClassicModeName  = "Classic"
+    TrainingModeName = "Training"
+)
+
+// GetGameModes returns the predefined game modes: "Classic" (default for all battles), "Training" (for single-player
+// levels), "Blitz" and "Marathon"; each call returns new instances, so that they can be safely modified by the caller
+func GetGameModes() map[string]*GameMode {
+    modes := []*GameMode{
+        {ClassicModeName, 3, 2, roundTime, 50, 20},
+        {TrainingModeName, 1, 2, roundTime, 50, 20},
+        {"Blitz", 3, 1, 45, 50, 20},
+        {"Marathon", 5, 3, 120, 75, 20},
+    }
+    res := make(map[string]*GameMode)
+    for _, mode := range modes {
+        res[mode.Name] = mode
+    }
+    return res
+}
+
+// ParseGameMode creates a new GameMode from a given set of properties (e.g. a section of the INI-file); possible keys
+// are: "wins", "lives", "round.time.sec", "win.percent" and "max.calls"; missing keys are taken from "base" mode
+// "name" - name of the game mode
+// "props" - properties (key-value pairs)
+// "base" - game mode to take missing properties from (non-NULL)
+func ParseGameMode(name string, props map[string]string, base *GameMode) (*GameMode, *Error) {
+    Assert(base)
+
+    res := *base
+    res.Name = name
+    fields := map[string]*byte{"wins": &res.Wins, "lives": &res.Lives, "round.time.sec": &res.RoundTime,
+        "win.percent": &res.WinPercent, "max.calls": &res.MaxCalls}
+    for key, value := range props {
+        field, ok := fields[key]
+        if !ok {
+            return nil, NewErr(&res, 122, "Unknown property %s (game mode %s)", key, name)
+        }
+        n, err := strconv.ParseUint(value, 10, 8)
+        if err != nil {
+            return nil, NewErr(&res, 122, "Incorrect property %s = %s (game mode %s)", key, value, name)
+        }
+        *field = byte(n)
+    }
+    if res.Wins == 0 || res.Wins > 100 || res.Lives == 0 || res.RoundTime == 0 || res.WinPercent == 0 ||
+        res.WinPercent > 100 || res.MaxCalls == 0 {
+        return nil, NewErr(&res, 123, "Incorrect game mode %s: %v", name, res)
+    }
+    return &res, nil
+}
+
+// GetRoundsMax returns max count of rounds in a battle, i.e. how many levels must be passed to Accept()
+func (mode *GameMode) GetRoundsMax() int {
+    return 2*int(mode.Wins) - 1
+}
+
+// isWinningScore checks whether a given score is enough to win the round ahead of time
+// "score" - current score of a Player (or a team)
+// "foodTotal" - total count of food on the level
+func (mode *GameMode) isWinningScore(score, foodTotal byte) bool {
+    return int(score)*100 > int(foodTotal)*int(mode.WinPercent)
+}
@@ -2,7 +2,6 @@ package battle
 
 import "fmt"
 import "sync"
-import "math/rand"
 import "container/list"
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 
@@ -382,9 +381,7 @@ type Wolf struct /*implements Animate*/ {
 // newWolf creates a new instance of Wolf with a given sequential number within a given cell
 func newWolf(num byte, cell *Cell) Animate {
     Assert(cell)
-    wolf := &Wolf{num: num, cell: cell, curDir: 1}
-    wolf.setRandomDir()
-    return wolf
+    return &Wolf{num: num, cell: cell, curDir: 1} // direction is randomized later by a Field (see setRandomDir())
 }
 
 // getID returns the ID of the object
@@ -410,8 +407,9 @@ func (wolf *Wolf) setCell(cell *Cell) {
 }
 
 // setRandomDir randomly assigns the direction of the Wolf (right or left)
-func (wolf *Wolf) setRandomDir() {
-    if rand.Intn(2) == 0 {
+// "rnd" - random generator of the round
+func (wolf *Wolf) setRandomDir(rnd *Rand) {
+    if rnd.Intn(2) == 0 {
         wolf.curDir = -1
     } else {
         wolf.curDir = 1
@@ -981,6 +979,300 @@ func (*FoodActor2) favouriteFoodInfo() string {
     return fmt.Sprintf("{FoodActor2}")
 }
 
+// Actor3 (ID=24) is an Actor for teammates of aggressors (team battles only, since 1.4.0)
+type Actor3 struct /*implements Actor*/ {
+    sync.RWMutex
+    num       byte
+    character byte
+    dirRight  bool
+    effects   map[effectT]*actorEffectT
+    cell      *Cell
+    swaggas   list.List // List[Swagga]
+}
+
+// newActor3 creates a new instance of Actor3 with a given sequential number within a given cell
+func newActor3(num byte, cell *Cell) Actor {
+    Assert(cell)
+    return &Actor3{num: num, dirRight: true, effects: make(map[effectT]*actorEffectT), cell: cell}
+}
+
+// getID returns the ID of the object
+func (*Actor3) getID() byte { return 0x18 }
+
+// getNum returns a unique incremental number of the Movable object on the battlefield (or 0 for non-Movable objects)
+func (actor *Actor3) getNum() byte {
+    return actor.num
+}
+
+// getCell returns the cell in which the object is placed
+func (actor *Actor3) getCell() *Cell {
+    actor.RLock()
+    defer actor.RUnlock()
+    return actor.cell
+}
+
+// setCell assigns a new cell for the object
+func (actor *Actor3) setCell(cell *Cell) {
+    actor.Lock()
+    actor.cell = cell
+    actor.Unlock()
+}
+
+// getCharacter returns a character of the Actor (Rabbit, Squirrel and so on)
+func (actor *Actor3) getCharacter() byte {
+    return actor.character
+}
+
+// setCharacter assigns a new character for the object (Rabbit, Squirrel and so on)
+func (actor *Actor3) setCharacter(character byte) {
+    actor.character = character
+}
+
+// isDirectedToRight checks if an Actor is faced right
+func (actor *Actor3) isDirectedToRight() bool {
+    return actor.dirRight
+}
+
+// setDirectionRight sets current direction of the Actor (TRUE - to right, FALSE = to left)
+func (actor *Actor3) setDirectionRight(toRight bool) {
+    actor.dirRight = toRight
+}
+
+// addStep increases internal steps counter of all the Actor's effects and calls corresponding callbacks if needed
+func (actor *Actor3) addStep() {
+    actor.RLock()
+    for k, v := range actor.effects {
+        actor.RUnlock()
+        if (v.steps > 0) {
+            v.steps--
+            if v.steps == 0 && v.callback != nil {
+                v.callback(k)
+            }
+        }
+        actor.RLock()
+    }
+    actor.RUnlock()
+}
+
+// setEffect adds a new effect with a given ID on the Actor that remains up to "steps" steps.
+// After effect is finished, callback will be called (callback may be NULL)
+func (actor *Actor3) setEffect(id effectT, steps byte, callback func(effectT)) {
+    actor.Lock()
+    actor.effects[id] = &actorEffectT{steps, callback}
+    actor.Unlock()
+}
+
+// hasEffect checks if the Actor has a [still active] effect with a given ID
+func (actor *Actor3) hasEffect(id effectT) bool {
+    actor.RLock()
+    defer actor.RUnlock()
+    if v, ok := actor.effects[id]; ok {
+        return v.steps > 0
+    }
+    return false
+}
+
+// addSwagga appends a new Swagga to the Actor
+func (actor *Actor3) addSwagga(s Swagga) {
+    actor.swaggas.PushBack(s)
+}
+
+// hasSwagga checks if the Actor has a given Swagga
+func (actor *Actor3) hasSwagga(s Swagga) bool {
+    for e := actor.swaggas.Front(); e != nil; e = e.Next() {
+        if v, ok := e.Value.(Swagga); ok {
+            if v == s {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// getSwaggas returns a list of all Swaggas of the Actor
+func (actor *Actor3) getSwaggas() list.List {
+    return actor.swaggas
+}
+
+// animateInfo is a "crutch" to make Animate interface differ from the others; please LMK if you know better solution!
+func (*Actor3) animateInfo() string {
+    return fmt.Sprintf("{Actor3}")
+}
+
+// Actor4 (ID=25) is an Actor for teammates of defenders (team battles only, since 1.4.0)
+type Actor4 struct /*implements Actor*/ {
+    sync.RWMutex
+    num       byte
+    character byte
+    dirRight  bool
+    effects   map[effectT]*actorEffectT
+    cell      *Cell
+    swaggas   list.List // List[Swagga]
+}
+
+// newActor4 creates a new instance of Actor4 with a given sequential number within a given cell
+func newActor4(num byte, cell *Cell) Actor {
+    Assert(cell)
+    return &Actor4{num: num, dirRight: false, effects: make(map[effectT]*actorEffectT), cell: cell}
+}
+
+// getID returns the ID of the object
+func (*Actor4) getID() byte { return 0x19 }
+
+// getNum returns a unique incremental number of the Movable object on the battlefield (or 0 for non-Movable objects)
+func (actor *Actor4) getNum() byte {
+    return actor.num
+}
+
+// getCell returns the cell in which the object is placed
+func (actor *Actor4) getCell() *Cell {
+    actor.RLock()
+    defer actor.RUnlock()
+    return actor.cell
+}
+
+// setCell assigns a new cell for the object
+func (actor *Actor4) setCell(cell *Cell) {
+    actor.Lock()
+    actor.cell = cell
+    actor.Unlock()
+}
+
+// getCharacter returns a character of the Actor (Rabbit, Squirrel and so on)
+func (actor *Actor4) getCharacter() byte {
+    return actor.character
+}
+
+// setCharacter assigns a new character for the object (Rabbit, Squirrel and so on)
+func (actor *Actor4) setCharacter(character byte) {
+    actor.character = character
+}
+
+// isDirectedToRight checks if an Actor is faced right
+func (actor *Actor4) isDirectedToRight() bool {
+    return actor.dirRight
+}
+
+// setDirectionRight sets current direction of the Actor (TRUE - to right, FALSE = to left)
+func (actor *Actor4) setDirectionRight(toRight bool) {
+    actor.dirRight = toRight
+}
+
+// addStep increases internal steps counter of all the Actor's effects and calls corresponding callbacks if needed
+func (actor *Actor4) addStep() {
+    actor.RLock()
+    for k, v := range actor.effects {
+        actor.RUnlock()
+        if (v.steps > 0) {
+            v.steps--
+            if v.steps == 0 && v.callback != nil {
+                v.callback(k)
+            }
+        }
+        actor.RLock()
+    }
+    actor.RUnlock()
+}
+
+// setEffect adds a new effect with a given ID on the Actor that remains up to "steps" steps.
+// After effect is finished, callback will be called (callback may be NULL)
+func (actor *Actor4) setEffect(id effectT, steps byte, callback func(effectT)) {
+    actor.Lock()
+    actor.effects[id] = &actorEffectT{steps, callback}
+    actor.Unlock()
+}
+
+// hasEffect checks if the Actor has a [still active] effect with a given ID
+func (actor *Actor4) hasEffect(id effectT) bool {
+    actor.RLock()
+    defer actor.RUnlock()
+    if v, ok := actor.effects[id]; ok {
+        return v.steps > 0
+    }
+    return false
+}
+
+// addSwagga appends a new Swagga to the Actor
+func (actor *Actor4) addSwagga(s Swagga) {
+    actor.swaggas.PushBack(s)
+}
+
+// hasSwagga checks if the Actor has a given Swagga
+func (actor *Actor4) hasSwagga(s Swagga) bool {
+    for e := actor.swaggas.Front(); e != nil; e = e.Next() {
+        if v, ok := e.Value.(Swagga); ok {
+            if v == s {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// getSwaggas returns a list of all Swaggas of the Actor
+func (actor *Actor4) getSwaggas() list.List {
+    return actor.swaggas
+}
+
+// animateInfo is a "crutch" to make Animate interface differ from the others; please LMK if you know better solution!
+func (*Actor4) animateInfo() string {
+    return fmt.Sprintf("{Actor4}")
+}
+
+// Entry3 (ID=26) is an entry point for Actor3
+type Entry3 struct {
+    cell *Cell
+}
+
+// newEntry3 creates a new instance of Entry3 within a given cell
+func newEntry3(cell *Cell) Entry {
+    Assert(cell)
+    return &Entry3{cell}
+}
+
+// getID returns the ID of the object
+func (*Entry3) getID() byte { return 0x1A }
+
+// getNum returns a unique incremental number of the Movable object on the battlefield (or 0 for non-Movable objects)
+func (*Entry3) getNum() byte { return 0 }
+
+// getCell returns the cell in which the object is placed
+func (entry3 *Entry3) getCell() *Cell {
+    return entry3.cell
+}
+
+// entryInfo is a "crutch" to make Entry interface differ from the others; please LMK if you know better solution!
+func (*Entry3) entryInfo() string {
+    return fmt.Sprintf("{Entry3}")
+}
+
+// Entry4 (ID=27) is an entry point for Actor4
+type Entry4 struct {
+    cell *Cell
+}
+
+// newEntry4 creates a new instance of Entry4 within a given cell
+func newEntry4(cell *Cell) Entry {
+    Assert(cell)
+    return &Entry4{cell}
+}
+
+// getID returns the ID of the object
+func (*Entry4) getID() byte { return 0x1B }
+
+// getNum returns a unique incremental number of the Movable object on the battlefield (or 0 for non-Movable objects)
+func (*Entry4) getNum() byte { return 0 }
+
+// getCell returns the cell in which the object is placed
+func (entry4 *Entry4) getCell() *Cell {
+    return entry4.cell
+}
+
+// entryInfo is a "crutch" to make Entry interface differ from the others; please LMK if you know better solution!
+func (*Entry4) entryInfo() string {
+    return fmt.Sprintf("{Entry4}")
+}
+
 // Thing is an interface for items, that can be picked up by Actors and then converted into actual handy objects on the
 // battlefield, e.g. an UmbrellaThing can be emplaced with an Umbrella to keep an Actor safe from Waterfalls.
 // The action of "emplacement" will consume a Thing
@@ -1316,14 +1608,15 @@ func (umbrella *Umbrella) emplacedInfo() string {
 // Mine (ID=41) is a object that explodes (by default) when Actors step on it. This causes lost of 1 live for Actors.
 // Note that taking this object by Actors will consume it
 type Mine struct {
-    num  byte
-    cell *Cell
+    num   byte
+    cell  *Cell
+    owner Actor // actor who buried the mine (NULL for the mines placed by a level) (1.4.0+)
 }
 
 // newMine creates a new instance of Mine with a given sequential number within a given cell
 func newMine(num byte, cell *Cell) Emplaced {
     Assert(cell)
-    return &Mine{num, cell}
+    return &Mine{num, cell, nil}
 }
 
 // getID returns the ID of the object
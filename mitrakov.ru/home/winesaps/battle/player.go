@@ -4,7 +4,7 @@ import "container/list"
 import "mitrakov.ru/home/winesaps/sid"
 
 // Player is a participant of a battle scoped to a single round (new round = new instance of Player).
-// There can be exactly 2 instances of Player per Round
+// There can be exactly 2 instances of Player per Round (4 instances for team battles)
 type Player struct {
     sid      sid.Sid
     score    byte
@@ -18,12 +18,13 @@ type Player struct {
 // "sid" - player's Session ID
 // "actor" - player's actor (an "Actor" corresponds to a "Player" as 1:1)
 // "skills" - player's skills
-func newPlayer(sid sid.Sid, actor Actor, skills []Skill) *Player {
+// "lives" - initial lives (see GameMode)
+func newPlayer(sid sid.Sid, actor Actor, skills []Skill, lives byte) *Player {
     list := list.List{}
     for _, skill := range skills {
         list.PushBack(skill)
     }
-    return &Player{sid, 0, 2, actor, nil, list}
+    return &Player{sid, 0, lives, actor, nil, list}
 }
 
 // setThing puts a new Thing into a pocket, replacing the existing Thing out (if any). The old Thing will be dropped
@@ -0,0 +1,109 @@
+package battle
+
+import "os"
+import "fmt"
+import "sync"
+import "time"
+import "bytes"
+import "io/ioutil"
+import "path/filepath"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// Replay is a record of all the events of a single battle from the Aggressor's point of view; it is kept in memory
+// while the battle is in progress, and saved to a file when the battle is over.
+// File format: "replayMagic" (4 bytes), version (1 byte), flags (1 byte, since version 2), then the records: [time
+// (4 bytes, msec since the battle start), length (2 bytes), message]...; all numbers are big-endian
+type Replay struct {
+    sync.Mutex
+    started time.Time
+    data    []byte
+}
+
+// ReplayEvent is a single recorded event
+type ReplayEvent struct {
+    Time time.Duration // time since the battle start
+    Msg  []byte        // message as it was sent to the Aggressor
+}
+
+// Replay file signature
+const replayMagic = "WSRP"
+// Replay file format version
+const replayVersion = 2
+// Replay flag: the battle has levels with a header (see HasHeader()), e.g. with more than 255 cells and 2-byte xy
+const replayBigMaps = 1
+// Replay file extension
+const replayExt = ".replay"
+
+// newReplay creates a new empty instance of Replay. Please do not create a Replay directly.
+// "bigMaps" - TRUE if the battle has levels with a header
+func newReplay(bigMaps bool) *Replay {
+    return &Replay{started: time.Now(), data: append([]byte(replayMagic), replayVersion,
+        Ternary(bigMaps, replayBigMaps, 0))}
+}
+
+// record appends a given message to the replay
+func (replay *Replay) record(msg []byte) {
+    t := uint32(time.Since(replay.started) / time.Millisecond)
+    replay.Lock()
+    replay.data = append(replay.data, byte(t>>24), byte(t>>16), byte(t>>8), byte(t), byte(len(msg)/256),
+        byte(len(msg)%256))
+    replay.data = append(replay.data, msg...)
+    replay.Unlock()
+}
+
+// save writes the replay to a given directory; the file name is "<id>.replay"
+// "dir" - directory (it will be created if doesn't exist)
+// "id" - battle ID
+func (replay *Replay) save(dir string, id uint64) *Error {
+    replay.Lock()
+    data := append([]byte{}, replay.data...)
+    replay.Unlock()
+
+    err := os.MkdirAll(dir, 0755)
+    if err == nil {
+        err = ioutil.WriteFile(getReplayPath(dir, id), data, 0644)
+    }
+    return NewErrFromError(replay, 100, err)
+}
+
+// loadReplay reads the replay of a battle with a given ID from a given directory; "bigMaps" is TRUE if the battle has
+// levels with a header (files of version 1 are treated as having no such levels)
+// "dir" - directory
+// "id" - battle ID
+func loadReplay(dir string, id uint64) (events []ReplayEvent, bigMaps bool, err *Error) {
+    data, er := ioutil.ReadFile(getReplayPath(dir, id))
+    if er != nil {
+        return nil, false, NewErrFromError(&Replay{}, 101, er)
+    }
+    header := len(replayMagic) + 1
+    if len(data) < header || !bytes.Equal(data[:len(replayMagic)], []byte(replayMagic)) ||
+        data[header-1] == 0 || data[header-1] > replayVersion {
+        return nil, false, NewErr(&Replay{}, 102, "Incorrect replay file (id=%d)", id)
+    }
+    if data[header-1] >= 2 {
+        if len(data) <= header {
+            return nil, false, NewErr(&Replay{}, 102, "Replay file is truncated (id=%d)", id)
+        }
+        bigMaps = data[header]&replayBigMaps != 0
+        header++
+    }
+    for i := header; i < len(data); {
+        if i+6 > len(data) {
+            return nil, false, NewErr(&Replay{}, 102, "Replay file is truncated (id=%d)", id)
+        }
+        t := uint(data[i])<<24 | uint(data[i+1])<<16 | uint(data[i+2])<<8 | uint(data[i+3])
+        size := int(data[i+4])*256 + int(data[i+5])
+        i += 6
+        if i+size > len(data) {
+            return nil, false, NewErr(&Replay{}, 102, "Replay file is truncated (id=%d)", id)
+        }
+        events = append(events, ReplayEvent{time.Duration(t) * time.Millisecond, data[i : i+size]})
+        i += size
+    }
+    return
+}
+
+// getReplayPath returns a path to a replay file of a battle with a given ID
+func getReplayPath(dir string, id uint64) string {
+    return filepath.Join(dir, fmt.Sprintf("%d%s", id, replayExt))
+}
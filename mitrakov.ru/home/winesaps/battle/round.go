@@ -1,5 +1,6 @@
 package battle
 
+import "sync"
 import "time"
 import "runtime"
 import . "mitrakov.ru/home/winesaps/sid"   // nolint
@@ -11,12 +12,19 @@ type Round struct {
     TryMutex
     number        byte
     foodTotal     byte
+    mode          *GameMode // rules of the battle (1.4.0+)
     battleManager IBattleManager
     player1       *Player
     player2       *Player
+    mate1         *Player // teammate of player1 (NULL for ordinary battles) (1.4.0+)
+    mate2         *Player // teammate of player2 (NULL for ordinary battles) (1.4.0+)
     field         *Field
     levelName     string
     stop          chan bool
+    rnd           *Rand
+    timerMutex    sync.Mutex    // protects "stop", "deadline" and "timeLeft" (1.4.0+)
+    deadline      time.Time     // time when the round timer fires (1.4.0+)
+    timeLeft      time.Duration // time left on the round timer while the Round is paused (1.4.0+)
 }
 
 // newRound creates a new instance of Round. Please do not create a Round directly.
@@ -26,19 +34,25 @@ type Round struct {
 // "char2" - defender's character (Rabbit, Squirrel, etc.)
 // "number" - round number (zero based)
 // "levelname" - level filename
+// "level" - level raw bytearray (see Battle.levels)
 // "skills1" - aggressor's skills
 // "skills2" - defender's skills
 // "swaggas1" - aggressor's swaggas
 // "swaggas2" - defender's swaggas
+// "team1" - aggressor's teammate (NULL for ordinary battles)
+// "team2" - defender's teammate (NULL for ordinary battles)
+// "mode" - game mode (rules of the battle)
+// "rnd" - random generator for the round (wolves, etc.)
 // "batMgr" - reference to IBattleManager
-func newRound(aggressor, defender Sid, char1, char2, number byte, levelname string, skills1,
-    skills2 []Skill, swaggas1, swaggas2 []Swagga, batMgr IBattleManager) (*Round, *Error) {
-    Assert(batMgr)
+func newRound(aggressor, defender Sid, char1, char2, number byte, levelname string, level []byte, skills1,
+    skills2 []Skill, swaggas1, swaggas2 []Swagga, team1, team2 *Detractor, mode *GameMode, rnd *Rand,
+    batMgr IBattleManager) (*Round, *Error) {
+    Assert(mode, batMgr, rnd)
     
     env := batMgr.getEnvironment()
     Assert(env)
 
-    field, err := newField(batMgr, levelname)
+    field, err := newField(batMgr, levelname, level, mode.RoundTime, rnd)
     if err == nil {
         env.addField(aggressor, field)
         actor1, ok1 := field.getActor1()
@@ -53,13 +67,28 @@ func newRound(aggressor, defender Sid, char1, char2, number byte, levelname stri
                 actor2.addSwagga(s)
             }
             field.replaceFavouriteFood(actor1, actor2)
-            player1 := newPlayer(aggressor, actor1, skills1)
-            player2 := newPlayer(defender, actor2, skills2)
+            player1 := newPlayer(aggressor, actor1, skills1, mode.Lives)
+            player2 := newPlayer(defender, actor2, skills2, mode.Lives)
+            var mate1, mate2 *Player
+            if team1 != nil && team2 != nil {
+                actor3, ok3 := field.getActor3()
+                actor4, ok4 := field.getActor4()
+                if !ok3 || !ok4 {
+                    env.removeField(aggressor, defender)
+                    return nil, NewErr(new(Round), 104, "No teammates' actors found (level %s)", levelname)
+                }
+                mate1 = newMate(team1, actor3, mode.Lives)
+                mate2 = newMate(team2, actor4, mode.Lives)
+            }
             food := field.getFoodCount()
-            res := &Round{TryMutex{}, number, food, batMgr, player1, player2, field, levelname, nil}
+            res := &Round{TryMutex{}, number, food, mode, batMgr, player1, player2, mate1, mate2, field, levelname,
+                nil, rnd, sync.Mutex{}, time.Time{}, 0}
             batMgr.IncRoundRefs()
             runtime.SetFinalizer(res, func(*Round) {batMgr.DecRoundRefs()})
-            res.stop = RunTask("round_timer", time.Duration(field.timeSec) * time.Second, func() {
+            t := time.Duration(field.timeSec) * time.Second
+            clock := batMgr.getClock()
+            res.deadline = clock.Now().Add(t)
+            res.stop = clock.RunTask("round_timer", t, func() {
                 res.timeOut()
             })
             return res, nil
@@ -69,7 +98,37 @@ func newRound(aggressor, defender Sid, char1, char2, number byte, levelname stri
     return nil, err
 }
 
-// getPlayerBySid returns one of 2 Players, involved in the Round, by a given Session ID (or NULL, if no Player
+// newMate creates a Player for a teammate with a given Actor (Actor3 or Actor4) in a team battle
+// "mate" - teammate
+// "actor" - teammate's actor
+// "lives" - initial lives
+func newMate(mate *Detractor, actor Actor, lives byte) *Player {
+    Assert(mate, actor)
+
+    skills, swaggas := extractAbilities(mate.abilities, mate.character)
+    actor.setCharacter(mate.character)
+    for _, s := range swaggas {
+        actor.addSwagga(s)
+    }
+    return newPlayer(mate.sid, actor, skills, lives)
+}
+
+// getTimeLeft returns time left till the end of the Round, in seconds (rounded up)
+func (round *Round) getTimeLeft() byte {
+    round.timerMutex.Lock()
+    left := round.timeLeft // non-zero only while the Round is paused
+    if left == 0 {
+        left = round.deadline.Sub(round.battleManager.getClock().Now())
+    }
+    round.timerMutex.Unlock()
+
+    if left <= 0 {
+        return 0
+    }
+    return byte(Min(uint((left+time.Second-1)/time.Second), 0xFF))
+}
+
+// getPlayerBySid returns one of Players, involved in the Round, by a given Session ID (or NULL, if no Player
 // corresponds to the given Session ID)
 func (round *Round) getPlayerBySid(sid Sid) (*Player, bool) {
     Assert(round.player1, round.player2)
@@ -80,10 +139,16 @@ func (round *Round) getPlayerBySid(sid Sid) (*Player, bool) {
     if round.player2.sid == sid {
         return round.player2, true
     }
+    if round.mate1 != nil && round.mate1.sid == sid {
+        return round.mate1, true
+    }
+    if round.mate2 != nil && round.mate2.sid == sid {
+        return round.mate2, true
+    }
     return nil, false
 }
 
-// getPlayerByActor returns one of 2 Players, involved in the Round, by a given Actor (or NULL, if no Player
+// getPlayerByActor returns one of Players, involved in the Round, by a given Actor (or NULL, if no Player
 // corresponds to the given Actor)
 func (round *Round) getPlayerByActor(actor Actor) (*Player, bool) {
     Assert(actor, round.player1, round.player2)
@@ -94,18 +159,71 @@ func (round *Round) getPlayerByActor(actor Actor) (*Player, bool) {
     if round.player2.actor == actor {
         return round.player2, true
     }
+    if round.mate1 != nil && round.mate1.actor == actor {
+        return round.mate1, true
+    }
+    if round.mate2 != nil && round.mate2.actor == actor {
+        return round.mate2, true
+    }
     return nil, false
 }
 
+// getTeam returns all the Players of the team of a Player with a given Session ID (i.e. the Player itself and its
+// teammate, if any); the leader goes first
+func (round *Round) getTeam(sid Sid) (res []*Player) {
+    Assert(round.player1, round.player2)
+
+    if player, ok := round.getPlayerBySid(sid); ok {
+        if player == round.player1 || player == round.mate1 {
+            res = append(res, round.player1)
+            if round.mate1 != nil {
+                res = append(res, round.mate1)
+            }
+        } else {
+            res = append(res, round.player2)
+            if round.mate2 != nil {
+                res = append(res, round.mate2)
+            }
+        }
+    }
+    return
+}
+
+// getScores returns current scores of the aggressor's team and the defender's team (in team battles the score is
+// shared by the teammates)
+func (round *Round) getScores() (score1, score2 byte) {
+    for _, player := range round.getTeam(round.player1.sid) {
+        score1 += player.score
+    }
+    for _, player := range round.getTeam(round.player2.sid) {
+        score2 += player.score
+    }
+    return
+}
+
+// getLives returns current lives of the aggressor's team and the defender's team; in team battles it's the lives of
+// the weakest teammate, because the team loses the round as soon as any of teammates loses all the lives
+func (round *Round) getLives() (lives1, lives2 byte) {
+    lives1, lives2 = round.player1.lives, round.player2.lives
+    if round.mate1 != nil && round.mate1.lives < lives1 {
+        lives1 = round.mate1.lives
+    }
+    if round.mate2 != nil && round.mate2.lives < lives2 {
+        lives2 = round.mate2.lives
+    }
+    return
+}
+
 // checkRoundFinished checks whether the Round finished by analysing current food count
 // "box" - MailBox to accumulate messages
 func (round *Round) checkRoundFinished(box *MailBox) (err *Error) {
     Assert(round.player1, round.player2, round.battleManager)
 
     round.OnlyOne(func() {
-        if round.player1.score > round.foodTotal/2 {
+        score1, score2 := round.getScores()
+        if round.mode.isWinningScore(score1, round.foodTotal) {
             err = round.battleManager.roundFinished(round.player1.sid, box)
-        } else if round.player2.score > round.foodTotal/2 {
+        } else if round.mode.isWinningScore(score2, round.foodTotal) {
             err = round.battleManager.roundFinished(round.player2.sid, box)
         } else if round.field.getFoodCount() == 0 {
             err = round.finishRoundForced(box)
@@ -126,20 +244,60 @@ func (round *Round) timeOut() {
     return
 }
 
+// pause stops the round timer and keeps the time left, so that the Round could be continued later (see resume())
+func (round *Round) pause() {
+    round.timerMutex.Lock()
+    defer round.timerMutex.Unlock()
+
+    if round.timeLeft == 0 {
+        round.timeLeft = round.deadline.Sub(round.battleManager.getClock().Now())
+        if round.timeLeft < time.Second { // the timer may have already fired; anyway give the players a second
+            round.timeLeft = time.Second
+        }
+        round.stop <- true
+        round.stop = make(chan bool, 1) // nobody listens to this channel, it's just to make stopTimer() work
+    }
+}
+
+// resume restarts the round timer (paused by pause()) with the time left
+func (round *Round) resume() {
+    round.timerMutex.Lock()
+    defer round.timerMutex.Unlock()
+
+    if round.timeLeft > 0 {
+        clock := round.battleManager.getClock()
+        round.deadline = clock.Now().Add(round.timeLeft)
+        round.stop = clock.RunTask("round_timer", round.timeLeft, func() {
+            round.timeOut()
+        })
+        round.timeLeft = 0
+    }
+}
+
+// stopTimer stops the round timer (if the Round is paused, the timer has been already stopped)
+func (round *Round) stopTimer() {
+    round.timerMutex.Lock()
+    defer round.timerMutex.Unlock()
+    round.stop <- true
+}
+
 // finishRoundForced forcefully shuts the Round down without checking current food count.
 // By default the winner is determined by the following algorithm:
 // 1) check score (who has more - wins the Round)
 // 2) if scores are equal, check lives (who has more - wins the Round)
 // 3) if scores and lives are equal, the defender wins
+// For team battles the scores and lives of the teams are compared (see getScores() and getLives())
 // "box" - MailBox to accumulate messages
 func (round *Round) finishRoundForced(box *MailBox) (err *Error) {
     Assert(round.player1, round.player2, round.battleManager)
-    if round.player1.score > round.player2.score {
+    score1, score2 := round.getScores()
+    lives1, lives2 := round.getLives()
+    if score1 > score2 {
         return round.battleManager.roundFinished(round.player1.sid, box)
-    } else if round.player2.score > round.player1.score {
+    } else if score2 > score1 {
         return round.battleManager.roundFinished(round.player2.sid, box)
     } else { // draw: let's check who has more lives
-        if (round.player1.lives > round.player2.lives) {
+        if (lives1 > lives2) {
             return round.battleManager.roundFinished(round.player1.sid, box)
         }
         // note: if draw and lives are equals let's suppose the defender (player2) wins
@@ -163,17 +321,17 @@ func (round *Round) move(sid Sid, direction moveDirection, box *MailBox) *Error
         delta := 0
         switch (direction) {
             case moveLeftDown:
-                delta = TernaryInt(field.isMoveDownPossible(cell), Width, -1)
+                delta = TernaryInt(field.isMoveDownPossible(cell), field.width, -1)
             case moveLeft:
                 delta = -1
             case moveLeftUp:
-                delta = TernaryInt(field.isMoveUpPossible(cell), -Width, -1)
+                delta = TernaryInt(field.isMoveUpPossible(cell), -field.width, -1)
             case moveRightDown:
-                delta = TernaryInt(field.isMoveDownPossible(cell), Width, 1)
+                delta = TernaryInt(field.isMoveDownPossible(cell), field.width, 1)
             case moveRight:
                 delta = 1
             case moveRightUp:
-                delta = TernaryInt(field.isMoveUpPossible(cell), -Width, 1)
+                delta = TernaryInt(field.isMoveUpPossible(cell), -field.width, 1)
             default:
         }
         
@@ -199,7 +357,7 @@ func (round *Round) move(sid Sid, direction moveDirection, box *MailBox) *Error
 
 // wound reaves 1 live from a Player with a given Session ID. If the Player has extra lives, it returns TRUE, and the
 // Actor will be respawned at the Entry Point. If the lives counter = 0, it returns FALSE, which means the Round is
-// over, and the Player lost the Round
+// over, and the Player (with its team, if any) lost the Round
 func (round *Round) wound(sid Sid) (isAlive bool, err *Error) {
     if player, ok := round.getPlayerBySid(sid); ok {
         player.lives--
@@ -267,7 +425,7 @@ func (round *Round) useSkill(sid Sid, skillID byte, box *MailBox) (Thing, *Error
         if skill := player.getSkill(skillID); skill != nil {
             thing := skill.apply(round.field.getNextNum())
             if thing != nil {
-                err1 := round.battleManager.objAppended(sid, thing, box)
+                err1 := round.battleManager.objAppended(sid, thing, round.field.wide, box)
                 err2 := round.setThingToPlayer(sid, thing, box)
                 return thing, NewErrs(err1, err2)
             }
@@ -0,0 +1,109 @@
+// Simulate is a headless tool for level balancing: it runs AI-vs-AI battles in-process (with no network and DB) and
+// reports per-level and per-character statistics: win rates, round durations, food eaten, wolf deaths and poisonings.
+// Battles run in virtual time: round timers, Environment ticks and AI steps are driven by a VirtualClock, that jumps
+// to the next scheduled action instead of waiting for it, so round durations are reported in game time.
+// Usage: simulate [-levels levels] [-battles 1000] [-parallel 500] [-mode Classic] [-seed 0]
+package main
+
+import "os"
+import "fmt"
+import "log"
+import "flag"
+import "sync"
+import "time"
+import "mitrakov.ru/home/winesaps/ai"
+import "mitrakov.ru/home/winesaps/battle"
+import . "mitrakov.ru/home/winesaps/sid"   // nolint
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+import "mitrakov.ru/home/winesaps/filereader"
+import "mitrakov.ru/home/winesaps/validator"
+
+// Buffer size (in bytes) for reading level files (the same as on the server)
+const levelBufSiz = 128 * 1024
+
+// Entry Point
+func main() {
+    levelsDir := flag.String("levels", "levels", "directory with level files")
+    battles := flag.Uint("battles", 1000, "total count of battles")
+    parallel := flag.Uint("parallel", 500, "count of battles played simultaneously")
+    modeName := flag.String("mode", battle.ClassicModeName, "game mode (Classic, Blitz, Marathon)")
+    seed := flag.Int64("seed", 0, "seed of the first battle (each next battle uses seed+1); 0 means random seed")
+    flag.Parse()
+    mode, ok := battle.GetGameModes()[*modeName]
+    if *parallel == 0 || *parallel > 16000 || !ok {
+        flag.Usage()
+        os.Exit(2)
+    }
+    if *seed == 0 {
+        *seed = NewSeed()
+    }
+    log.Println("Simulation started; seed:", *seed)
+
+    reader, err := filereader.NewFileReader(*levelsDir, "level", levelBufSiz, validator.Filter)
+    if err != nil {
+        log.Fatal(err)
+    }
+    clock := NewVirtualClock(time.Now())
+    sim := newSimulator(clock)
+    sim.battleManager = battle.NewBattleManager(reader, new(packer), sim, "", 0, clock)
+    sim.aiManager = ai.NewAiManager(sim, sim.battleManager, clock)
+    stop := make(chan bool)
+    go func() { // all the scheduled actions are performed by this goroutine
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+                clock.Step()
+            }
+        }
+    }()
+
+    // every slot is a pair of Session IDs for a battle; a slot is reused after its battle is over
+    slots := make(chan Sid, *parallel)
+    for i := uint(0); i < *parallel; i++ {
+        slots <- Sid(2*i + 1)
+    }
+    wg := sync.WaitGroup{}
+    for i := uint(0); i < *battles; i++ {
+        sid := <-slots
+        wg.Add(1)
+        go func(sid Sid, seed int64) {
+            defer wg.Done()
+            levels, err := getLevels(reader, NewRand(seed), mode.GetRoundsMax())
+            if err == nil {
+                err = sim.run(sid, sid+1, levels, mode, seed)
+            }
+            Check(err)
+            slots <- sid
+        }(sid, *seed+int64(i))
+        if (i+1)%100 == 0 {
+            log.Println("Battles started:", i+1)
+        }
+    }
+    wg.Wait()
+    stop <- true
+
+    sim.aiManager.Close()
+    sim.battleManager.Close()
+    fmt.Print(sim.report())
+}
+
+// getLevels returns "count" random level names (the same way as the server does); levels for team battles are skipped,
+// because AI cannot play team battles
+func getLevels(reader *filereader.FileReader, rnd *Rand, count int) (levels []string, err *Error) {
+    excepts := []string{"tutorial.level", "training.level"}
+    for _, name := range reader.GetNames() {
+        if level, ok := reader.GetByName(name); ok && battle.IsTeamLevel(level) {
+            excepts = append(excepts, name)
+        }
+    }
+    levels = make([]string, count)
+    for i := range levels {
+        levels[i], err = reader.GetRandomExcept(rnd, excepts...)
+        if err != nil {
+            return
+        }
+    }
+    return
+}
@@ -0,0 +1,146 @@
+package main
+
+import . "mitrakov.ru/home/winesaps/sid"   // nolint
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// packer is a battle.IPacker implementation for the simulator. Messages have the same format as the server sends to
+// clients (see Server API Doc), because AI players and the statistics collector parse them exactly as clients do.
+// Messages for calls are not used in the simulator and contain only a command code.
+type packer byte /*implements battle.IPacker*/
+
+// Server API codes of the messages used by the simulator (see Server API Doc)
+const (
+    cmdCall           = 7
+    cmdStopCall       = 10
+    cmdFullState      = 16
+    cmdRoundInfo      = 17
+    cmdAbilityList    = 18
+    cmdStateChanged   = 23
+    cmdScoreChanged   = 24
+    cmdEffectChanged  = 25
+    cmdPlayerWounded  = 26
+    cmdThingTaken     = 27
+    cmdObjectAppended = 28
+    cmdFinished       = 29
+    cmdRestoreState   = 30
+    cmdTeamInfo       = 47
+    cmdRematchOffered = 49
+    cmdBattlePaused   = 50
+    cmdBattleResumed  = 51
+    cmdBattleInfo     = 52
+)
+
+// PackCall packs the message for "CALL" command (7)
+func (packer) PackCall(aggressor Sid, aggressorName string) []byte {
+    return []byte{cmdCall}
+}
+
+// PackStopCallRejected packs the message for "STOP CALL" command (10)
+func (packer) PackStopCallRejected(cowardName string) []byte {
+    return []byte{cmdStopCall}
+}
+
+// PackStopCallMissed packs the message for "STOP CALL" command (10)
+func (packer) PackStopCallMissed(aggressorName string) []byte {
+    return []byte{cmdStopCall}
+}
+
+// PackStopCallExpired packs the message for "STOP CALL" command (10)
+func (packer) PackStopCallExpired(defenderName string) []byte {
+    return []byte{cmdStopCall}
+}
+
+// PackFullState packs the message for "FULL STATE" command (16)
+func (packer) PackFullState(state []byte) []byte {
+    return append([]byte{cmdFullState}, state...)
+}
+
+// PackRestoreState packs the message for "RESTORE STATE" command (30)
+func (packer) PackRestoreState(dump []byte) []byte {
+    return append([]byte{cmdRestoreState, 0}, dump...)
+}
+
+// PackRoundInfo packs the message for "ROUND INFO" command (17)
+func (packer) PackRoundInfo(sid, aggressor Sid, num, t, char1, char2, myLives, enemyLives byte, fname string) []byte {
+    meAggressor := Ternary(sid == aggressor, 1, 0)
+    return append([]byte{cmdRoundInfo, num, t, meAggressor, char1, char2, myLives, enemyLives}, fname...)
+}
+
+// PackTeamInfo packs the message for "TEAM INFO" command (47)
+func (packer) PackTeamInfo(actorID, mateChar byte) []byte {
+    return []byte{cmdTeamInfo, actorID, mateChar}
+}
+
+// PackAbilityList packs the message for "ABILITY LIST" command (18)
+func (packer) PackAbilityList(abilities []byte) []byte {
+    return append([]byte{cmdAbilityList, byte(len(abilities))}, abilities...)
+}
+
+// PackStateChanged packs the message for "STATE CHANGED" command (23)
+func (packer) PackStateChanged(objNum, objID byte, xy uint16, wide, reset bool) []byte {
+    return append(append([]byte{cmdStateChanged, objNum, objID}, packXy(xy, wide)...), Ternary(reset, 1, 0))
+}
+
+// PackScoreChanged packs the message for "SCORE CHANGED" command (24)
+func (packer) PackScoreChanged(score1, score2 byte) []byte {
+    return []byte{cmdScoreChanged, score1, score2}
+}
+
+// PackEffectChanged packs the message for "EFFECT CHANGED" command (25)
+func (packer) PackEffectChanged(effID byte, added bool, objNumber byte) []byte {
+    return []byte{cmdEffectChanged, effID, Ternary(added, 1, 0), objNumber}
+}
+
+// PackWound packs the message for "PLAYER WOUNDED" command (26)
+func (packer) PackWound(sid, woundSid Sid, cause, myLives, enemyLives byte) []byte {
+    return []byte{cmdPlayerWounded, Ternary(sid == woundSid, 1, 0), cause, myLives, enemyLives}
+}
+
+// PackThingTaken packs the message for "THING TAKEN" command (27)
+func (packer) PackThingTaken(sid, ownerSid Sid, thingID byte) []byte {
+    return []byte{cmdThingTaken, Ternary(sid == ownerSid, 1, 0), thingID}
+}
+
+// PackObjectAppended packs the message for "OBJECT APPENDED" command (28)
+func (packer) PackObjectAppended(id, objNum byte, xy uint16, wide bool) []byte {
+    return append([]byte{cmdObjectAppended, id, objNum}, packXy(xy, wide)...)
+}
+
+// PackRoundFinished packs the message for "FINISHED" command (29) with the parameter "GAME OVER" = 0
+func (packer) PackRoundFinished(sid, winnerSid Sid, totalScore1, totalScore2 byte) []byte {
+    return []byte{cmdFinished, 0, Ternary(sid == winnerSid, 1, 0), totalScore1, totalScore2}
+}
+
+// PackGameOver packs the message for "FINISHED" command (29) with the parameter "GAME OVER" = 1 (reward is omitted)
+func (packer) PackGameOver(sid, winnerSid Sid, totalScore1, totalScore2 byte, reward uint32) []byte {
+    return []byte{cmdFinished, 1, Ternary(sid == winnerSid, 1, 0), totalScore1, totalScore2}
+}
+
+// PackRematchOffered packs the message for "REMATCH OFFERED" command (49)
+func (packer) PackRematchOffered() []byte {
+    return []byte{cmdRematchOffered}
+}
+
+// PackBattlePaused packs the message for "BATTLE PAUSED" command (50)
+func (packer) PackBattlePaused(graceSec byte) []byte {
+    return []byte{cmdBattlePaused, graceSec}
+}
+
+// PackBattleResumed packs the message for "BATTLE RESUMED" command (51)
+func (packer) PackBattleResumed() []byte {
+    return []byte{cmdBattleResumed}
+}
+
+// PackBattleInfo packs the message for "BATTLE INFO" command (52)
+func (packer) PackBattleInfo(id uint64) []byte {
+    return []byte{cmdBattleInfo, byte(id >> 56), byte(id >> 48), byte(id >> 40), byte(id >> 32), byte(id >> 24),
+        byte(id >> 16), byte(id >> 8), byte(id)}
+}
+
+// packXy converts "xy" into 2 bytes for wide fields, or 1 byte otherwise
+func packXy(xy uint16, wide bool) []byte {
+    if wide {
+        return []byte{byte(xy >> 8), byte(xy)}
+    }
+    return []byte{byte(xy)}
+}
@@ -0,0 +1,242 @@
+package main
+
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+import "mitrakov.ru/home/winesaps/ai"
+import "mitrakov.ru/home/winesaps/battle"
+import . "mitrakov.ru/home/winesaps/sid"   // nolint
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// statT is accumulated statistics of a single character on a single level (or in total)
+type statT struct {
+    played     uint          // rounds (or battles) played
+    wins       uint          // rounds (or battles) won
+    food       uint          // food eaten
+    wolfDeaths uint          // times devoured by wolves
+    poisonings uint          // times poisoned
+    duration   time.Duration // total duration of rounds
+}
+
+// battleT is a state of a single battle in progress, observed from the Aggressor's point of view
+type battleT struct {
+    char1, char2   byte
+    level          string
+    started        time.Time
+    score1, score2 byte
+    wolfDeaths     [2]uint
+    poisonings     [2]uint
+    done           chan bool
+}
+
+// simulator runs AI-vs-AI battles and collects statistics from the messages that the battles emit.
+// It implements battle.IController instead of the server Controller.
+type simulator struct {
+    sync.Mutex
+    aiManager     *ai.AiManager
+    battleManager battle.IBattleManager
+    clock         Clock // time source shared with the battles (see VirtualClock)
+    battles       map[Sid]*battleT           // Aggressor's Session ID -> battle in progress
+    levels        map[string]map[byte]*statT // level name -> character -> statistics per round
+    chars         map[byte]*statT            // character -> statistics per battle
+}
+
+// wound causes (see "hurtCause" in the battle package)
+const (
+    causePoisoned = 0
+    causeDevoured = 3
+)
+
+// character names for the report
+var charNames = map[byte]string{battle.Rabbit: "Rabbit", battle.Hedgehog: "Hedgehog", battle.Squirrel: "Squirrel",
+    battle.Cat: "Cat"}
+
+// newSimulator creates a new simulator. Please do not create a simulator directly.
+// "clock" - time source shared with the battles
+func newSimulator(clock Clock) *simulator {
+    return &simulator{clock: clock, battles: make(map[Sid]*battleT), levels: make(map[string]map[byte]*statT),
+        chars: make(map[byte]*statT)}
+}
+
+// Event is a handler for battle.IController interface; it collects the statistics and passes messages to AI players
+func (sim *simulator) Event(box *MailBox, err *Error) {
+    Assert(box, sim.aiManager)
+    Check(err)
+    for _, sid := range box.GetSids() {
+        sim.collect(sid, box.Pick(sid))
+        sim.aiManager.HandleEvent(sid, box)
+    }
+}
+
+// GameOver is a handler for battle.IController interface (the result itself is taken from "FINISHED" message)
+func (sim *simulator) GameOver(winnerSid, loserSid Sid, score1, score2 byte, quickBattle bool,
+    box *MailBox) (uint32, *Error) {
+    sim.aiManager.RemoveAi(winnerSid)
+    sim.aiManager.RemoveAi(loserSid)
+    return 0, nil
+}
+
+// RematchExpired is a handler for battle.IController interface (the simulator doesn't use rematches)
+func (sim *simulator) RematchExpired(sid1, sid2 Sid) {}
+
+// run plays a single battle between 2 AI players and blocks till the battle is over
+// "sid1" - Session ID for the Aggressor
+// "sid2" - Session ID for the Defender
+// "levels" - level names (see GameMode.GetRoundsMax())
+// "mode" - game mode
+// "seed" - seed of the battle
+func (sim *simulator) run(sid1, sid2 Sid, levels []string, mode *battle.GameMode, seed int64) *Error {
+    Assert(sim.aiManager, sim.battleManager)
+
+    rnd := NewRand(seed)
+    char1 := byte(rnd.Intn(battle.CharactersCount) + 1)
+    char2 := byte(rnd.Intn(battle.CharactersCount) + 1)
+    b := &battleT{char1: char1, char2: char2, done: make(chan bool, 1)}
+    sim.Lock()
+    sim.battles[sid1] = b
+    sim.Unlock()
+    sim.aiManager.AddNewAi(sid1, char1, true, 50, rnd.Fork())
+    sim.aiManager.AddNewAi(sid2, char2, false, 50, rnd.Fork())
+
+    box, err := sim.battleManager.Accept(sid1, sid2, char1, char2, []byte{}, []byte{}, levels, mode, true, false, seed)
+    if err == nil {
+        sim.Event(box, nil)
+        <-b.done
+    } else {
+        sim.aiManager.RemoveAi(sid1)
+        sim.aiManager.RemoveAi(sid2)
+    }
+    sim.Lock()
+    delete(sim.battles, sid1)
+    sim.Unlock()
+    return err
+}
+
+// collect parses the messages addressed to a given Session ID and updates the statistics, if it is the Aggressor of
+// one of the battles in progress
+// nolint: gocyclo
+func (sim *simulator) collect(sid Sid, messages [][]byte) {
+    sim.Lock()
+    defer sim.Unlock()
+    b, ok := sim.battles[sid]
+    if !ok {
+        return
+    }
+    for _, msg := range messages {
+        switch {
+        case len(msg) > 8 && msg[0] == cmdRoundInfo:
+            b.level = string(msg[8:])
+            b.started = sim.clock.Now()
+            b.score1, b.score2 = 0, 0
+            b.wolfDeaths, b.poisonings = [2]uint{}, [2]uint{}
+        case len(msg) > 2 && msg[0] == cmdScoreChanged:
+            b.score1, b.score2 = msg[1], msg[2]
+        case len(msg) > 2 && msg[0] == cmdPlayerWounded:
+            i := TernaryInt(msg[1] == 1, 0, 1) // msg[1] = 1 if the Aggressor is wounded
+            switch msg[2] {
+            case causeDevoured:
+                b.wolfDeaths[i]++
+            case causePoisoned:
+                b.poisonings[i]++
+            }
+        case len(msg) > 2 && msg[0] == cmdFinished && msg[1] == 0:
+            sim.roundFinished(b, msg[2] == 1)
+        case len(msg) > 2 && msg[0] == cmdFinished && msg[1] == 1:
+            sim.battleFinished(b, msg[2] == 1)
+            b.done <- true
+        }
+    }
+}
+
+// roundFinished adds the results of the current round of a given battle to the statistics (must be called under lock)
+// "aggressorWon" - TRUE if the Aggressor has won the round
+func (sim *simulator) roundFinished(b *battleT, aggressorWon bool) {
+    d := sim.clock.Now().Sub(b.started)
+    chars := [2]byte{b.char1, b.char2}
+    scores := [2]byte{b.score1, b.score2}
+    won := [2]bool{aggressorWon, !aggressorWon}
+
+    if _, ok := sim.levels[b.level]; !ok {
+        sim.levels[b.level] = make(map[byte]*statT)
+    }
+    for i, char := range chars {
+        stat := getStat(sim.levels[b.level], char)
+        stat.played++
+        if won[i] {
+            stat.wins++
+        }
+        stat.food += uint(scores[i])
+        stat.wolfDeaths += b.wolfDeaths[i]
+        stat.poisonings += b.poisonings[i]
+        stat.duration += d
+    }
+}
+
+// battleFinished adds the result of a given battle to the statistics (must be called under lock)
+// "aggressorWon" - TRUE if the Aggressor has won the battle
+func (sim *simulator) battleFinished(b *battleT, aggressorWon bool) {
+    stat1, stat2 := getStat(sim.chars, b.char1), getStat(sim.chars, b.char2)
+    stat1.played++
+    stat2.played++
+    if aggressorWon {
+        stat1.wins++
+    } else {
+        stat2.wins++
+    }
+}
+
+// report returns the statistics as a human readable text
+func (sim *simulator) report() string {
+    sim.Lock()
+    defer sim.Unlock()
+
+    res := fmt.Sprintf("%-10s %8s %8s\n", "CHARACTER", "BATTLES", "WIN %")
+    for _, char := range sortedChars(sim.chars) {
+        stat := sim.chars[char]
+        res += fmt.Sprintf("%-10s %8d %8.1f\n", charNames[char], stat.played, percent(stat.wins, stat.played))
+    }
+    levels := make([]string, 0, len(sim.levels))
+    for level := range sim.levels {
+        levels = append(levels, level)
+    }
+    sort.Strings(levels)
+    for _, level := range levels {
+        res += fmt.Sprintf("\n%s\n%-10s %8s %8s %8s %8s %8s %8s\n", level, "CHARACTER", "ROUNDS", "WIN %", "TIME, s",
+            "FOOD", "WOLVES", "POISON")
+        for _, char := range sortedChars(sim.levels[level]) {
+            stat := sim.levels[level][char]
+            n := float64(stat.played)
+            res += fmt.Sprintf("%-10s %8d %8.1f %8.1f %8.2f %8.2f %8.2f\n", charNames[char], stat.played,
+                percent(stat.wins, stat.played), stat.duration.Seconds()/n, float64(stat.food)/n,
+                float64(stat.wolfDeaths)/n, float64(stat.poisonings)/n)
+        }
+    }
+    return res
+}
+
+// getStat returns statistics for a given character from a given map (a new item is created if necessary)
+func getStat(stats map[byte]*statT, char byte) *statT {
+    if _, ok := stats[char]; !ok {
+        stats[char] = new(statT)
+    }
+    return stats[char]
+}
+
+// sortedChars returns the characters of a given map in ascending order
+func sortedChars(stats map[byte]*statT) []byte {
+    res := make([]byte, 0, len(stats))
+    for char := range stats {
+        res = append(res, char)
+    }
+    sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+    return res
+}
+
+// percent returns "x" as a percentage of "total"
+func percent(x, total uint) float64 {
+    if total > 0 {
+        return 100 * float64(x) / float64(total)
+    }
+    return 0
+}
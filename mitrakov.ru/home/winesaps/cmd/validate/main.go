@@ -0,0 +1,79 @@
+// Validate is a command line linter for level files: it checks every ".level" file for structural errors (length,
+// object numbers and coordinates, actors, sections) and reachability of food from all the entries (unreachable food is
+// an error, unless the level is known to rely on things like beams or teleports).
+// Exit code is 1 if at least one level has errors (warnings don't affect the exit code).
+// Usage: validate [file.level|directory]... (by default "levels" directory is checked)
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "strings"
+import "io/ioutil"
+import "path/filepath"
+import "mitrakov.ru/home/winesaps/validator"
+
+// level file extension
+const levelExt = ".level"
+
+// Entry Point
+func main() {
+    flag.Parse()
+    paths := flag.Args()
+    if len(paths) == 0 {
+        paths = []string{"levels"}
+    }
+
+    failed := false
+    for _, path := range paths {
+        files, err := getFiles(path)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(2)
+        }
+        for _, file := range files {
+            if !check(file) {
+                failed = true
+            }
+        }
+    }
+    if failed {
+        os.Exit(1)
+    }
+}
+
+// getFiles returns a given path if it's a file, or all the level files within a given path if it's a directory
+func getFiles(path string) ([]string, error) {
+    info, err := os.Stat(path)
+    if err != nil || !info.IsDir() {
+        return []string{path}, err
+    }
+    var res []string
+    entries, err := ioutil.ReadDir(path)
+    for _, entry := range entries {
+        if !entry.IsDir() && strings.HasSuffix(entry.Name(), levelExt) {
+            res = append(res, filepath.Join(path, entry.Name()))
+        }
+    }
+    return res, err
+}
+
+// check validates a given level file, prints all the problems found and returns FALSE if the level has errors
+func check(file string) bool {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        fmt.Printf("%s: ERROR: %s\n", file, err)
+        return false
+    }
+    errs, warnings := validator.Validate(file, data)
+    for _, e := range errs {
+        fmt.Printf("%s: ERROR: %s\n", file, e)
+    }
+    for _, w := range warnings {
+        fmt.Printf("%s: WARNING: %s\n", file, w)
+    }
+    if len(errs) == 0 && len(warnings) == 0 {
+        fmt.Printf("%s: OK\n", file)
+    }
+    return len(errs) == 0
+}
@@ -2,7 +2,8 @@
 package main
 
 import "log"
-import "math/rand"
+import "time"
+import "mitrakov.ru/home/winesaps/ai"
 import "mitrakov.ru/home/winesaps/user"
 import . "mitrakov.ru/home/winesaps/sid"      // nolint
 import "mitrakov.ru/home/winesaps/battle"
@@ -20,10 +21,14 @@ type Controller struct /*implements battle.IController*/ {
     server        network.IServer
     reader        *filereader.FileReader
     tokenManager  *TokenManager
-    aiManager     *AiManager
+    aiManager     *ai.AiManager
     fakeSidStore  *FakeSidStore
+    gameMode      *battle.GameMode // rules for the battles against AI (1.4.0+)
 }
 
+// polling interval to check whether all the battles are finished (on server shutdown)
+const drainPeriod = time.Second
+
 // NewController creates a new Controller. Please do not create a Controller directly.
 // "usrMgr" - reference to an IUserManager
 // "batMgr" - reference to an IBattleManager
@@ -32,10 +37,12 @@ type Controller struct /*implements battle.IController*/ {
 // "tokenMgr" - reference to a TokenManager
 // "aiMgr" - reference to an AiManager
 // "fakeSs" - reference to a FakeSidStore
+// "gameMode" - rules for the battles against AI
 func NewController(usrMgr user.IUserManager, batMgr battle.IBattleManager, server network.IServer,
-    reader *filereader.FileReader, tokenMgr *TokenManager, aiMgr *AiManager, fakeSs *FakeSidStore) *Controller {
-    Assert(usrMgr, batMgr, server, reader, tokenMgr, aiMgr, fakeSs)
-    return &Controller{usrMgr, batMgr, server, reader, tokenMgr, aiMgr, fakeSs}
+    reader *filereader.FileReader, tokenMgr *TokenManager, aiMgr *ai.AiManager, fakeSs *FakeSidStore,
+    gameMode *battle.GameMode) *Controller {
+    Assert(usrMgr, batMgr, server, reader, tokenMgr, aiMgr, fakeSs, gameMode)
+    return &Controller{usrMgr, batMgr, server, reader, tokenMgr, aiMgr, fakeSs, gameMode}
 }
 
 // Event is a common handler for user.IController and battle.IController interfaces.
@@ -46,15 +53,18 @@ func (ctrl *Controller) Event(box *MailBox, err *Error) {
     Check(err)
     for _, sid := range box.GetSids() {
         if ctrl.fakeSidStore.contains(sid) {
-            ctrl.aiManager.handleEvent(sid, box)
-        } else if token, ok := ctrl.tokenManager.GetToken(sid); ok {
-            box.SetPrefix(sid, pack(sid, token, 0))
+            ctrl.aiManager.HandleEvent(sid, box)
+        } else if token, wide, ok := ctrl.tokenManager.GetToken(sid); ok {
+            box.SetPrefix(sid, pack(sid, token, withTokenWidth(0, wide)))
+        } else {
+            box.Remove(sid) // a client cannot parse a message without a token
         }
     }
     ctrl.server.SendAll(box)
 }
 
-// GameOver is a handler for "Game Finished" event of battle.IController interface
+// GameOver is a handler for "Game Finished" event of battle.IController interface. Since 1.4.0 AI players are not
+// removed here, because they may be reused for a rematch (see RematchExpired())
 // "winnerSid" - winner Session ID
 // "loserSid" - loser Session ID
 // "score1" - total score 1
@@ -62,44 +72,53 @@ func (ctrl *Controller) Event(box *MailBox, err *Error) {
 // "quickBattle" - quick battle marker (true for QuickBattle mode, false for PvP mode)
 func (ctrl *Controller) GameOver(winnerSid, loserSid Sid, score1, score2 byte, quickBattle bool,
     box *MailBox) (res uint32, err *Error) {
-    Assert(ctrl.userManager, ctrl.fakeSidStore, ctrl.aiManager)
-    res, err = ctrl.userManager.RewardUsers(winnerSid, loserSid, score1, score2, quickBattle, box)
-    if ctrl.fakeSidStore.contains(winnerSid) {
-        ctrl.aiManager.removeAi(winnerSid)
-        ctrl.fakeSidStore.freeIfContains(winnerSid)
-    }
-    if ctrl.fakeSidStore.contains(loserSid) {
-        ctrl.aiManager.removeAi(loserSid)
-        ctrl.fakeSidStore.freeIfContains(loserSid)
+    Assert(ctrl.userManager)
+    return ctrl.userManager.RewardUsers(winnerSid, loserSid, score1, score2, quickBattle, box)
+}
+
+// RematchExpired is a handler for "Rematch Expired" event of battle.IController interface: the participants of a
+// finished battle haven't agreed to a rematch in time, so AI players (if any) are removed
+// @since 1.4.0
+// "sid1" - Session ID of the Aggressor of the finished battle
+// "sid2" - Session ID of the Defender of the finished battle
+func (ctrl *Controller) RematchExpired(sid1, sid2 Sid) {
+    Assert(ctrl.fakeSidStore, ctrl.aiManager)
+    for _, sid := range []Sid{sid1, sid2} {
+        if ctrl.fakeSidStore.contains(sid) {
+            ctrl.aiManager.RemoveAi(sid)
+            ctrl.fakeSidStore.freeIfContains(sid)
+        }
     }
-    return
 }
 
 // attackAi initiates a new battle "User vs. AI"
 // "sid" - user's Session ID
-func (ctrl *Controller) attackAi(sid Sid) {
+// "strength" - strength of the AI (see ai.AiManager.AddNewAi())
+func (ctrl *Controller) attackAi(sid Sid, strength byte) {
     Assert(ctrl.battleManager, ctrl.userManager)
 
     if aggressor, ok := ctrl.userManager.GetUserBySid(sid); ok {
         abilities, err := ctrl.userManager.GetUserAbilities(aggressor)
         if err == nil {
+            seed := NewSeed()
+            rnd := NewRand(seed)
             var levels []string
-            levels, err = getLevels(ctrl.reader, 5)
+            levels, err = getLevels(ctrl.reader, rnd, ctrl.gameMode.GetRoundsMax(), aggressor.BigMaps, false)
             if err == nil {
                 var aiSid Sid
                 aiSid, err = ctrl.fakeSidStore.getFakeSid()
                 if err == nil {
                     var box *MailBox
                     char1 := aggressor.Character
-                    char2 := byte(rand.Intn(battle.CharactersCount) + 1)
-                    ctrl.aiManager.addNewAi(aiSid, char2)
+                    char2 := byte(rnd.Intn(battle.CharactersCount) + 1)
+                    ctrl.aiManager.AddNewAi(aiSid, char2, false, strength, rnd.Fork())
                     box, err = ctrl.battleManager.Accept(sid, aiSid, char1, char2, abilities, make([]byte, 0),
-                        levels, 3, true, false)
-                    box.Put(sid, append([]byte{byte(enemyName)}, getName()...))
+                        levels, ctrl.gameMode, true, false, seed)
+                    box.Put(sid, append([]byte{byte(enemyName)}, getName(rnd)...))
                     ctrl.Event(box, err)
                     // IMPORTANT! if smth goes wrong => we must free fake SID
                     if err != nil {
-                        ctrl.aiManager.removeAi(aiSid)
+                        ctrl.aiManager.RemoveAi(aiSid)
                         ctrl.fakeSidStore.freeIfContains(aiSid)
                     }
                 }
@@ -111,10 +130,98 @@ func (ctrl *Controller) attackAi(sid Sid) {
     }
 }
 
+// quickBattle starts a quick battle between 2 users, paired by Matchmaker; if something goes wrong, both users receive
+// an error as a response to their "ATTACK" commands
+// @since 1.4.0
+// "aggressorSid" - Session ID of the Aggressor
+// "defenderSid" - Session ID of the Defender
+func (ctrl *Controller) quickBattle(aggressorSid, defenderSid Sid) {
+    Assert(ctrl.battleManager, ctrl.userManager)
+
+    errCode := byte(errEnemyNotFound)
+    aggressor, ok1 := ctrl.userManager.GetUserBySid(aggressorSid)
+    defender, ok2 := ctrl.userManager.GetUserBySid(defenderSid)
+    if ok1 && ok2 {
+        seed := NewSeed()
+        levels, err := getLevels(ctrl.reader, NewRand(seed), ctrl.gameMode.GetRoundsMax(),
+            aggressor.BigMaps && defender.BigMaps, false)
+        if err == nil {
+            abilities1, err1 := ctrl.userManager.GetUserAbilities(aggressor)
+            abilities2, err2 := ctrl.userManager.GetUserAbilities(defender)
+            err = NewErrs(err1, err2)
+            if err == nil {
+                char1, char2 := aggressor.Character, defender.Character
+                box, err1 := ctrl.battleManager.Accept(aggressorSid, defenderSid, char1, char2, abilities1,
+                    abilities2, levels, ctrl.gameMode, true, false, seed)
+                err2 := ctrl.userManager.Accept(aggressor, defender)
+                err = NewErrs(err1, err2)
+                if err == nil {
+                    box.Put(aggressorSid, append([]byte{byte(enemyName)}, defender.Name...))
+                    box.Put(defenderSid, append([]byte{byte(enemyName)}, aggressor.Name...))
+                    ctrl.Event(box, nil)
+                    return
+                }
+            }
+        }
+        Check(err)
+        errCode = GetErrorCode(err)
+    } else {
+        log.Println("ERROR: Enemy not found", aggressorSid, defenderSid)
+    }
+    box := NewMailBox()
+    box.Put(aggressorSid, []byte{byte(attack), errCode})
+    box.Put(defenderSid, []byte{byte(attack), errCode})
+    ctrl.Event(box, nil)
+}
+
+// teamExpired is a handler for the event of TeamRoom, when the users haven't been teamed up on time
+// @since 1.4.0
+// "sids" - Session IDs of the expired users
+func (ctrl *Controller) teamExpired(sids []Sid) {
+    box := NewMailBox()
+    for _, sid := range sids {
+        box.Put(sid, []byte{byte(teamBattle), errEnemyNotFound})
+    }
+    ctrl.Event(box, nil)
+}
+
+// waitForBattles blocks the execution till all the current battles are finished or a given timeout expires. Returns
+// FALSE on time out
+// "timeout" - max time to wait
+func (ctrl *Controller) waitForBattles(timeout time.Duration) bool {
+    Assert(ctrl.battleManager)
+
+    deadline := time.Now().Add(timeout)
+    for n := ctrl.battleManager.GetBattlesCount(); n > 0; n = ctrl.battleManager.GetBattlesCount() {
+        if time.Now().After(deadline) {
+            log.Println("Time is out;", n, "battles are still in progress")
+            return false
+        }
+        log.Println("Waiting for", n, "battles to finish...")
+        time.Sleep(drainPeriod)
+    }
+    return true
+}
+
+// notifyAll sends a given message to all connected users
+// "msg" - message (without sid/token/flags prefix)
+func (ctrl *Controller) notifyAll(msg []byte) {
+    Assert(ctrl.server, ctrl.userManager)
+
+    box := NewMailBox()
+    for _, sid := range ctrl.server.GetSids() {
+        if _, ok := ctrl.userManager.GetUserBySid(sid); ok {
+            box.Put(sid, msg)
+        }
+    }
+    ctrl.Event(box, nil)
+}
+
 // getName returns a random name for AI
-func getName() string {
+// "rnd" - random generator
+func getName(rnd *Rand) string {
     names := []string{"Tom", "Bob", "Tim", "Fox", "Bro", "Man", "Pal", "Ace", "Ada", "Amy", "Ash", "Eve", "Eva", "Roy", 
         "Ray", "Lee", "Rex", "Rob", "Ron", "Tod", "Leo", "Van", "Fon", "Vin", "Wat", "Zak", "Mac", "Gus", "Ian", "Ira", 
         "Kim", "Joe"}
-    return names[rand.Intn(len(names))]
+    return names[rnd.Intn(len(names))]
 }
@@ -48,7 +48,7 @@ func (dbMgr *DbManager) AddUser(name, email, hash, salt, promocode string) *Erro
 // "id" - user ID
 func (dbMgr *DbManager) GetUserByID(id uint64) (*user.User, *Error) {
     sql := "SELECT user_id, name, email, auth_type, auth_data, salt, promocode, `character`+0," +
-        " gems, trust_points, last_enemy, agent_info, last_login FROM user WHERE user_id=?"
+        " gems, trust_points, skill_rating, last_enemy, agent_info, last_login FROM user WHERE user_id=?"
     return dbMgr.getUserBySQL(sql, id)
 }
 
@@ -56,7 +56,7 @@ func (dbMgr *DbManager) GetUserByID(id uint64) (*user.User, *Error) {
 // "name" - user name
 func (dbMgr *DbManager) GetUserByName(name string) (*user.User, *Error) {
     sql := "SELECT user_id, name, email, auth_type, auth_data, salt, promocode, `character`+0," +
-        " gems, trust_points, last_enemy, agent_info, last_login FROM user WHERE name=?"
+        " gems, trust_points, skill_rating, last_enemy, agent_info, last_login FROM user WHERE name=?"
     return dbMgr.getUserBySQL(sql, name)
 }
 
@@ -64,7 +64,7 @@ func (dbMgr *DbManager) GetUserByName(name string) (*user.User, *Error) {
 // "number" - user position in DB table
 func (dbMgr *DbManager) GetUserByNumber(number uint) (*user.User, *Error) {
     sql := "SELECT user_id, name, email, auth_type, auth_data, salt, promocode, `character`+0," +
-        " gems, trust_points, last_enemy, agent_info, last_login FROM user LIMIT ?, 1"
+        " gems, trust_points, skill_rating, last_enemy, agent_info, last_login FROM user LIMIT ?, 1"
     return dbMgr.getUserBySQL(sql, number-1)
 }
 
@@ -145,6 +145,19 @@ func (dbMgr *DbManager) RegisterLoss(ratingType byte, userID uint64, scoreDiff b
     return NewErrFromError(dbMgr, 210, err)
 }
 
+// SetSkillRating assigns a new skill rating (Elo) to a given user
+// "userID" - user ID
+// "skillRating" - new skill rating
+func (dbMgr *DbManager) SetSkillRating(userID uint64, skillRating uint32) *Error {
+    Assert(dbMgr.db)
+    stmt, err := dbMgr.db.Prepare("UPDATE user SET skill_rating=? WHERE user_id=?")
+    if err == nil {
+        _, err = stmt.Exec(skillRating, userID)
+        Check(stmt.Close())
+    }
+    return NewErrFromError(dbMgr, 237, err)
+}
+
 // RewardUser gives a user some gems and trustPoints (see documentation to learn what "trustPoints" are)
 // "userID" - user ID
 // "gems" - reward, in gems
@@ -290,6 +303,42 @@ func (dbMgr *DbManager) GetRating(userID uint64, ratingType, limit byte) ([]byte
     return res, NewErrFromError(dbMgr, 217, err)
 }
 
+// GetSkillRating returns Top N Ranking by skill rating for a given user. Only users who have played at least one
+// battle are ranked. The rows have the same format as in GetRating(), but score difference is replaced with the skill
+// rating
+// "userID" - user ID
+// "limit" - data sample limit
+func (dbMgr *DbManager) GetSkillRating(userID uint64, limit byte) ([]byte, *Error) {
+    Assert(dbMgr.db)
+    res := []byte{}
+    stmt, err := dbMgr.db.Prepare("(SELECT name, wins, losses, skill_rating FROM rating JOIN user USING(user_id) " +
+        "WHERE type = ? ORDER BY skill_rating DESC, wins DESC LIMIT ?) " +
+        "UNION (SELECT name, wins, losses, skill_rating FROM rating JOIN user USING(user_id) " +
+        "WHERE user_id = ? AND type = ?)")
+    if err == nil {
+        defer stmt.Close()
+        var rows *sql.Rows
+        rows, err = stmt.Query(dbRatingGeneral, limit, userID, dbRatingGeneral)
+        if err == nil {
+            for rows.Next() {
+                var name string
+                var wins, losses, skill uint32
+                err = rows.Scan(&name, &wins, &losses, &skill)
+                if err == nil {
+                    res = append(res, []byte(name)...)
+                    res = append(res, 0) // 0 is a terminating NULL
+                    res = append(res, byte(wins >> 24), byte(wins >> 16), byte(wins >> 8), byte(wins))
+                    res = append(res, byte(losses >> 24), byte(losses >> 16), byte(losses >> 8), byte(losses))
+                    res = append(res, byte(skill >> 24), byte(skill >> 16), byte(skill >> 8), byte(skill))
+                } else {
+                    return res, NewErrFromError(dbMgr, 238, err) // this return is necessary because it's in a loop
+                }
+            }
+        }
+    }
+    return res, NewErrFromError(dbMgr, 239, err)
+}
+
 // GetBestUsers returns Top N Ranking of a given ratingType (ratingGeneral or ratingWeekly)
 // "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
 // "limit" - data sample limit
@@ -531,15 +580,16 @@ func (dbMgr *DbManager) getUserBySQL(query string, arg interface{}) (*user.User,
         var character byte
         var gems uint32
         var tp uint32
+        var skill uint32
         var lastEnemy sql.NullInt64
         var agentInfo string
         var lastLogin time.Time
 
-        err = row.Scan(&userID, &name, &email, &authType, &authData, &salt, &promo, &character, &gems, &tp, &lastEnemy, 
-            &agentInfo, &lastLogin)
+        err = row.Scan(&userID, &name, &email, &authType, &authData, &salt, &promo, &character, &gems, &tp, &skill,
+            &lastEnemy, &agentInfo, &lastLogin)
         if err == nil {
-            return &user.User{Character: character, Gems: gems, TrustPoints: tp, Name: name, Email: email, 
-                AuthType: authType, AuthData: authData, Salt: salt, Promocode: promo, ID: userID,
+            return &user.User{Character: character, Gems: gems, TrustPoints: tp, SkillRating: skill, Name: name,
+                Email: email, AuthType: authType, AuthData: authData, Salt: salt, Promocode: promo, ID: userID,
                 LastEnemy: uint64(lastEnemy.Int64), AgentInfo: agentInfo, LastLogin: Convert(lastLogin), 
                 LastActive: time.Now()}, nil
         }
@@ -2,59 +2,95 @@ package filereader
 
 import "os"
 import "fmt"
+import "log"
+import "sync"
 import "strings"
 import "io/ioutil"
-import "math/rand"
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 
 // FileReader is a component that reads files from disk and stores them in memory as a bytearray.
+// Since 1.4.0 the files may be reloaded without restart (see Reload()).
 // This component is independent.
 type FileReader struct {
-    files map[string][]byte // no lock required (immutable map)
+    sync.RWMutex
+    files     map[string][]byte // the map is immutable: Reload() replaces it as a whole
+    names     []string          // file names sorted (to make random choice reproducible, as map order is random)
+    path      string
+    extension string
+    bufSiz    uint
+    filter    func(name string, data []byte) bool
 }
 
 // NewFileReader creates a new FileReader. Please do not create a FileReader directly.
 // "path" - a directory to read all files from, filtered by "extension" ("path" may be relative).
 // "bufSiz" - maximum size of a file, in bytes (if this value is too small, a bytearray can be truncated)
-// Example: NewFileReader("descriptions/texts", "txt", 2048)
-func NewFileReader(path, extension string, bufSiz uint) (*FileReader, *Error) {
-    res := &FileReader{make(map[string][]byte)}
-    
-    // load all the level files to memory
-    files, err := ioutil.ReadDir(path)
-    if err == nil {
-        for _, f := range files {
-            if strings.HasSuffix(f.Name(), extension) {
-                data, err := res.readFile(fmt.Sprintf("%s/%s", path, f.Name()), bufSiz)
-                if err == nil {
-                    res.files[f.Name()] = data
-                } else {
-                    return res, err
-                }
-            }
-        }
+// "filter" - function to decide whether a file should be loaded (files rejected by the filter are skipped); may be NIL
+// Example: NewFileReader("descriptions/texts", "txt", 2048, nil)
+func NewFileReader(path, extension string, bufSiz uint, filter func(name string, data []byte) bool) (*FileReader,
+    *Error) {
+    res := &FileReader{path: path, extension: extension, bufSiz: bufSiz, filter: filter}
+
+    // load all the level files to memory (files rejected by the filter are just skipped, unlike Reload())
+    files, names, _, err := res.load()
+    res.files, res.names = files, names
+    return res, err
+}
+
+// Reload reads all the files from disk again and replaces the loaded ones at once. The new files are validated first:
+// if any file cannot be read or is rejected by the filter (see NewFileReader()), or no files found, then the loaded
+// files are kept intact and the error is returned. Since the old files are never modified, those who got them earlier
+// (e.g. current battles) are not affected.
+// Returns count of files loaded
+// @since 1.4.0
+func (reader *FileReader) Reload() (int, *Error) {
+    files, names, rejected, err := reader.load()
+    if err != nil {
+        return 0, err
+    }
+    if len(rejected) > 0 {
+        return 0, NewErr(reader, 25, "Files rejected by the filter: %v", rejected)
     }
-    return res, NewErrFromError(res, 20, err)
+    if len(files) == 0 {
+        return 0, NewErr(reader, 26, "No files found in %s", reader.path)
+    }
+    reader.Lock()
+    reader.files, reader.names = files, names
+    reader.Unlock()
+    log.Println(len(files), "files reloaded from", reader.path)
+    return len(files), nil
 }
 
 // GetByName returns file content by a given file name
 func (reader *FileReader) GetByName(name string) (res []byte, ok bool) {
-    res, ok = reader.files[name]
+    files, _ := reader.get()
+    res, ok = files[name]
     return
 }
 
+// GetNames returns names of all the loaded files sorted by name
+func (reader *FileReader) GetNames() []string {
+    _, names := reader.get()
+    return append([]string{}, names...)
+}
+
 // GetRandomExcept returns a random file name from the list of loaded files, except specified as "excepts" parameter.
-func (reader *FileReader) GetRandomExcept(excepts ...string) (string, *Error) {
+// "rnd" - random generator (the same seed gives the same result)
+func (reader *FileReader) GetRandomExcept(rnd *Rand, excepts ...string) (string, *Error) {
+    Assert(rnd)
+
+    files, names := reader.get()
     exceptMap := make(map[string]bool)
     for _, except := range excepts {
-        exceptMap[except] = true
+        if _, ok := files[except]; ok { // a file may be absent (e.g. rejected by a filter)
+            exceptMap[except] = true
+        }
     }
-    n := len(reader.files) - len(exceptMap)
+    n := len(files) - len(exceptMap)
 
     if n > 0 {
-        r := rand.Intn(n)
+        r := rnd.Intn(n)
         i := 0
-        for name := range reader.files {
+        for _, name := range names {
             if _, ok := exceptMap[name]; !ok {
                 if i == r {
                     return name, nil
@@ -67,18 +103,52 @@ func (reader *FileReader) GetRandomExcept(excepts ...string) (string, *Error) {
 }
 
 // GetRandomAmong returns a random file name from the list of loaded files, that also is present in "among" parameter.
-func (reader *FileReader) GetRandomAmong(among ...string) (string, *Error) {
+// "rnd" - random generator (the same seed gives the same result)
+func (reader *FileReader) GetRandomAmong(rnd *Rand, among ...string) (string, *Error) {
+    Assert(rnd)
     if len(among) > 0 {
-        r := rand.Intn(len(among))
+        r := rnd.Intn(len(among))
         res := among[r]
-        if _, ok := reader.files[res]; ok {
+        if _, ok := reader.GetByName(res); ok {
             return res, nil
         }
-        return "", NewErr(reader, 22, "File not found", res)
+        return "", NewErr(reader, 22, "File not found: %s", res)
     }
     return "", NewErr(reader, 23, "Incorrect arg length")
 }
 
+// get returns current files and their names (they are replaced as a whole on Reload(), so they are consistent)
+func (reader *FileReader) get() (map[string][]byte, []string) {
+    reader.RLock()
+    defer reader.RUnlock()
+    return reader.files, reader.names
+}
+
+// load is an internal function to read all the files from disk; it returns the files accepted by the filter, their
+// names (sorted), and the names of files rejected by the filter
+func (reader *FileReader) load() (files map[string][]byte, names, rejected []string, e *Error) {
+    files = make(map[string][]byte)
+    entries, err := ioutil.ReadDir(reader.path)
+    if err == nil {
+        for _, f := range entries {
+            if strings.HasSuffix(f.Name(), reader.extension) {
+                data, err := reader.readFile(fmt.Sprintf("%s/%s", reader.path, f.Name()), reader.bufSiz)
+                if err == nil {
+                    if reader.filter != nil && !reader.filter(f.Name(), data) {
+                        rejected = append(rejected, f.Name())
+                        continue
+                    }
+                    files[f.Name()] = data
+                    names = append(names, f.Name()) // ReadDir returns entries sorted by name
+                } else {
+                    return files, names, rejected, err
+                }
+            }
+        }
+    }
+    return files, names, rejected, NewErrFromError(reader, 20, err)
+}
+
 // readFile is an internal function to read a file with a given file name as a bytearray.
 // "filename" - file name
 // "bufSiz" - maximum size of a file, in bytes (if this value is too small, a bytearray can be truncated)
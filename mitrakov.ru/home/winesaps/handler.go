@@ -2,12 +2,14 @@
 package main
 
 import "log"
+import "sync"
 import "time"
 import "bytes"
 import "strings"
 import "strconv"
 import "runtime"
-import "math/rand"
+import "sync/atomic"
+import "mitrakov.ru/home/winesaps/ai"
 import "mitrakov.ru/home/winesaps/user"
 import "mitrakov.ru/home/winesaps/battle"
 import "mitrakov.ru/home/winesaps/network"
@@ -23,13 +25,19 @@ type Handler struct /*implements network.IHandler*/ {
     server           network.IServer
     reader           *filereader.FileReader
     tokenManager     *TokenManager
-    aiManager        *AiManager
+    aiManager        *ai.AiManager
     fakeSidStore     *FakeSidStore
-    room             *WaitingRoom
+    matchmaker       *Matchmaker
+    teamRoom         *TeamRoom
+    antiCheat        *AntiCheat
     statistics       *Statistics
-    serverStop       bool
+    gameMode         *battle.GameMode // rules for all the battles (1.4.0+)
+    trainingMode     *battle.GameMode // rules for single-player levels (1.4.0+)
+    serverStop       int32 // 1 if new battles are rejected (accessed atomically)
     minClientVersion uint
     curClientVersion uint
+    replayMutex      sync.Mutex
+    replays          map[Sid]chan bool // users watching replays -> channels to stop the playback (1.4.0+)
 }
 
 // Command according to Server API Doc
@@ -80,6 +88,17 @@ const ( // nolint
     checkPurchase       // 39
     getClientVersion    // 40
     changePassword      // 41
+    battleList          // 42
+    watchBattle         // 43
+    unwatchBattle       // 44
+    replay              // 45
+    teamBattle          // 46
+    teamInfo            // 47
+    rematch             // 48
+    rematchOffered      // 49
+    battlePaused        // 50
+    battleResumed       // 51
+    battleInfo          // 52
 )
 
 // "REQUEST STATISTICS" Server API Command
@@ -131,8 +150,22 @@ const noErr = 0
 const minPasswordLen = 8
 // Offset for arguments in incoming bytearray: 10 bytes: sid (2b), token (4b), flags, msgLength (2b), cmdCode
 const argsOffset = 10
-// Pagination for a list of friends (in case a user has a lot of friends)
+// Length of a common prefix of a message: sid (2b), token (4b), flags
+const prefixLen = 7
+// Message flag: the token is 64-bit wide, and its lowest 4 bytes follow the flags (since v1.4.0)
+const flagWideToken = 2
+// Message flag in SignIn/SignUp: the client asks for SwUDP authenticated mode and appends its public key (since v1.4.0)
+const flagAuth = 4
+// Message flag in SignIn/SignUp: the client supports levels with a header, including the ones with more than 255 cells
+// and 2-byte xy (since v1.4.0)
+const flagBigMaps = 8
+// Max count of commands in a single incoming message
+const maxCommands = 16
+// Pagination for a list of friends (in case a user has a lot of friends); since v1.4.0 it is used only for the clients
+// that cannot receive large messages (SwUDP v1.2)
 const friendListFragment = 25
+// Max count of battles in "BATTLE LIST" response for the clients that cannot receive large messages (SwUDP v1.2)
+const battleListMax = 10
 
 // newHandler creates a new Handler. Please do not create a Handler directly.
 // "usrMgr" - reference to an IUserManager
@@ -142,81 +175,160 @@ const friendListFragment = 25
 // "tokenMgr" - reference to a TokenManager
 // "aiMgr" - reference to an AiManager
 // "fakeSs" - reference to a FakeSidStore
-// "room" - reference to a WaitingRoom
+// "matchmaker" - reference to a Matchmaker
+// "teamRoom" - reference to a TeamRoom
+// "antiCheat" - reference to an AntiCheat
 // "stat" - Statistics module (for monitoring only)
+// "gameMode" - rules for all the battles, except for single-player levels
+// "trainingMode" - rules for single-player levels
 // "minClientVersion" - minimal supported client version expressed as an uint32 (e.g. "1.2.3" = 1 << 16 | 2 << 8 | 3)
 // "curClientVersion" - current client version expressed as an uint32 (e.g. "1.2.3" = 1 << 16 | 2 << 8 | 3)
 func newHandler(usrMgr user.IUserManager, battleMgr battle.IBattleManager, server network.IServer, 
-    reader *filereader.FileReader, tokenMgr *TokenManager, aiMgr *AiManager, fakeSs *FakeSidStore, room *WaitingRoom, 
-    stat *Statistics, minClientVersion, curClientVersion uint) *Handler {
-    Assert(usrMgr, battleMgr, server, reader, tokenMgr, aiMgr, fakeSs, room, stat)
-    return &Handler{usrMgr, battleMgr, server, reader, tokenMgr, aiMgr, fakeSs, room, stat, false, minClientVersion, 
-        curClientVersion}
+    reader *filereader.FileReader, tokenMgr *TokenManager, aiMgr *ai.AiManager, fakeSs *FakeSidStore,
+    matchmaker *Matchmaker, teamRoom *TeamRoom, antiCheat *AntiCheat, stat *Statistics,
+    gameMode, trainingMode *battle.GameMode, minClientVersion, curClientVersion uint) *Handler {
+    Assert(usrMgr, battleMgr, server, reader, tokenMgr, aiMgr, fakeSs, matchmaker, teamRoom, antiCheat, stat, gameMode,
+        trainingMode)
+    return &Handler{usrMgr, battleMgr, server, reader, tokenMgr, aiMgr, fakeSs, matchmaker, teamRoom, antiCheat,
+        stat, gameMode, trainingMode, 0, minClientVersion, curClientVersion, sync.Mutex{},
+        make(map[Sid]chan bool)}
 }
 
-// Handle is a main handler method for network.ISidHandler interface
+// Handle is a main handler method for network.ISidHandler interface. Since v1.4.0 a message may contain several
+// commands, each prefixed by its length (just like outbound messages in a MailBox); in this case the commands are
+// processed in order, and all the responses are batched into a single message
 // "array" - incoming message
+// "authSupported" - TRUE, if a client's transport supports authenticated mode (otherwise "flagAuth" is ignored)
+func (handler *Handler) Handle(array []byte, authSupported bool) (Sid, []byte) {
+    sid, token, flags, n, ok := parsePrefix(array)
+    if !ok || len(array) < n+argsOffset-prefixLen {
+        return handler.handle(array, authSupported)
+    }
+    commands, ok := splitCommands(array[n:])
+    if !ok || len(commands) < 2 {
+        // legacy clients may send an inconsistent length, so handle it as a whole
+        return handler.handle(array, authSupported)
+    }
+    batchFlags := flags | 1
+    if !authSupported {
+        batchFlags &^= flagAuth
+    }
+    if len(commands) > maxCommands {
+        return 0, packN(sid, token, batchFlags, 2, commands[0][0], errIncorrectLen)
+    }
+
+    resultSid := Sid(0)
+    box := NewMailBox()
+    for _, command := range commands {
+        msg := append(pack(sid, token, flags), byte(len(command)/256), byte(len(command)%256))
+        newSid, resp := handler.handle(append(msg, command...), authSupported)
+        if newSid > 0 {
+            resultSid = newSid
+        }
+        if respSid, respToken, _, m, ok := parsePrefix(resp); ok && len(resp) > m {
+            if newSid > 0 && respSid == newSid { // e.g. after SIGN IN the next commands must use new SID and token
+                sid, token = respSid, respToken
+            }
+            if responses, ok := splitCommands(resp[m:]); ok {
+                box.SetPrefix(0, pack(sid, token, batchFlags)) // not a response prefix (e.g. loopback has no "1" flag)
+                for _, response := range responses {
+                    box.Put(0, response)
+                }
+            }
+        }
+    }
+    if _, msgs := box.Flush(); len(msgs) > 0 {
+        return resultSid, msgs[0]
+    }
+    return resultSid, nil
+}
+
+// Disconnected is a handler for network.ISidHandler interface: a user with a given Session ID has lost the connection,
+// so his/her current battle (if any) is paused till the user comes back with FULL STATE or RESTORE STATE command, and
+// the user leaves the matchmaking queues (if any)
+// @since 1.4.0
+// "sid" - user's Session ID
+func (handler *Handler) Disconnected(sid Sid) {
+    Assert(handler.battleManager, handler.matchmaker, handler.teamRoom)
+
+    handler.matchmaker.cancel(sid)
+    handler.teamRoom.cancel(sid)
+    handler.stopReplay(sid, nil)
+    box, err := handler.battleManager.Pause(sid)
+    if err == nil { // no logging: a user may be out of battles
+        handler.sendEvents(box)
+    }
+}
+
+// handle processes a single command
+// "array" - incoming message with a single command
+// "authSupported" - TRUE, if a client's transport supports authenticated mode (otherwise "flagAuth" is ignored)
 // nolint: gocyclo
-func (handler *Handler) Handle(array []byte) (Sid, []byte) {
+func (handler *Handler) handle(array []byte, authSupported bool) (Sid, []byte) {
     t0 := time.Now()
-    Assert(handler.userManager, handler.tokenManager)
+    Assert(handler.userManager, handler.tokenManager, handler.server)
 
-    if len(array) < argsOffset {
+    sid, token, flags, n, ok := parsePrefix(array)
+    if !ok || len(array) < n+argsOffset-prefixLen {
         return 0, []byte{0, 0, 0, 0, 0, 0, 1, byte(unspecError)}
     }
 
-    sidH := array[0]
-    sidL := array[1]
-    tokenA := array[2]
-    tokenB := array[3]
-    tokenC := array[4]
-    tokenD := array[5]
-    flags := array[6]
-    // msgLenH := array[7]         ignored (client is allowed to send single messages only)
-    // msgLenL := array[8]         ignored (client is allowed to send single messages only)
-    code := cmd(array[9])
-    sid := Sid(sidH)*256 + Sid(sidL)
-    token := uint32(tokenA)<<24 | uint32(tokenB)<<16 | uint32(tokenC)<<8 | uint32(tokenD)
+    // msgLenH := array[n]         ignored (multiple commands are split in Handle())
+    // msgLenL := array[n+1]       ignored (multiple commands are split in Handle())
+    code := cmd(array[n+2])
+    args := array[n+3:]
+    var peerKey []byte // client's public key for SwUDP authenticated mode (SIGN UP and SIGN IN only)
+    if flags&flagAuth != 0 {
+        if code == signUp || code == signIn {
+            args, peerKey = splitPublicKey(args)
+        }
+        if !authSupported {
+            flags &^= flagAuth // the key is cut off anyway, so that the other arguments are parsed as usual
+        }
+    }
 
     if usr, ok := handler.userManager.GetUserBySid(sid); ok {
-        if tok, ok := handler.tokenManager.GetToken(sid); ok && tok == token {
+        if handler.tokenManager.CheckToken(sid, token) {
+            if handler.server.CheckSid(sid) {
+                return 0, nil // drop the command silently (the limit is checked only for valid tokens)
+            }
             switch code {
             case signOut:
                 return sid, handler.signOut(usr, token, flags, code)
             case userInfo:
                 return sid, handler.userInfo(usr, token, flags, code)
             case attack:
-                return sid, handler.attack(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.attack(usr, token, flags, code, args)
             case accept:
-                return sid, handler.accept(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.accept(usr, token, flags, code, args)
             case reject:
-                return sid, handler.reject(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.reject(usr, token, flags, code, args)
             case cancelCall:
                 return sid, handler.cancelCall(sid, token, flags, code)
             case receiveLevel:
-                return sid, handler.receiveLevel(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.receiveLevel(usr, token, flags, code, args)
             case changeCharacter:
-                return sid, handler.changeCharacter(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.changeCharacter(usr, token, flags, code, args)
             case friendList:
-                return sid, handler.friendList(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.friendList(usr, token, flags, code, args)
             case addFriend:
-                return sid, handler.addFriend(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.addFriend(usr, token, flags, code, args)
             case removeFriend:
-                return sid, handler.removeFriend(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.removeFriend(usr, token, flags, code, args)
             case rangeOfProducts:
                 return sid, handler.rangeOfProducts(sid, token, flags, code)
             case buyProduct:
-                return sid, handler.buyProduct(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.buyProduct(usr, token, flags, code, args)
             case rating:
-                return sid, handler.getRating(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.getRating(usr, token, flags, code, args)
             case fullState: // since v1.3.0
                 return sid, handler.getCurrentField(sid, token, flags, code)
             case move:
-                return sid, handler.move(sid, token, flags, code, array[argsOffset:])
+                return sid, handler.move(sid, token, flags, code, args)
             case useThing:
                 return sid, handler.useThing(sid, token, flags, code)
             case useSkill:
-                return sid, handler.useSkill(sid, token, flags, code, array[argsOffset:])
+                return sid, handler.useSkill(sid, token, flags, code, args)
             case restoreState:
                 return sid, handler.restoreState(sid, token, flags, code)
             case giveUp:
@@ -224,28 +336,40 @@ func (handler *Handler) Handle(array []byte) (Sid, []byte) {
             case getSkuGems:
                 return sid, handler.getSkuGems(sid, token, flags, code)
             case checkPurchase:
-                return sid, handler.checkPurchase(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.checkPurchase(usr, token, flags, code, args)
             case getClientVersion:
                 return sid, handler.clientVersion(sid, token, flags, code)
             case changePassword:
-                return sid, handler.changePassword(usr, token, flags, code, array[argsOffset:])
+                return sid, handler.changePassword(usr, token, flags, code, args)
+            case battleList:
+                return sid, handler.battleList(usr, token, flags, code)
+            case watchBattle:
+                return sid, handler.watchBattle(usr, token, flags, code, args)
+            case unwatchBattle:
+                return sid, handler.unwatchBattle(usr, token, flags, code)
+            case replay:
+                return sid, handler.replay(usr, token, flags, code, args)
+            case teamBattle:
+                return sid, handler.teamBattle(usr, token, flags, code, args)
+            case rematch:
+                return sid, handler.rematch(usr, token, flags, code)
             }
         }
         return 0, packN(sid, token, flags|1, 2, byte(code), errIncorrectToken) // see note#1
     } else if sid == 0 {
         switch code {
         case signUp:
-            return handler.signUp(sid, token, flags, code, array[argsOffset:])
+            return handler.signUp(sid, token, flags, code, args, peerKey)
         case signIn:
-            return handler.signIn(sid, token, flags, code, array[argsOffset:])
+            return handler.signIn(sid, token, flags, code, args, peerKey)
         case checkPromocode:
-            return sid, handler.checkPromocode(sid, token, flags, code, array[argsOffset:])
+            return sid, handler.checkPromocode(sid, token, flags, code, args)
         case getClientVersion:
             return sid, handler.clientVersion(sid, token, flags, code)
         case statRequest:
             return sid, handler.getStatistics(sid, token, flags, code, t0)
         case callFunction:
-            return sid, handler.callFunction(sid, token, flags, code, array[argsOffset:])
+            return sid, handler.callFunction(sid, token, flags, code, args)
         case loopback:
             return sid, array
         }
@@ -258,11 +382,12 @@ func (handler *Handler) Handle(array []byte) (Sid, []byte) {
 
 // signUp is a handler for "SIGN UP" command (1)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) signUp(sid Sid, token uint32, flags byte, code cmd, usrData []byte) (Sid, []byte) {
+// "peerKey" - client's public key for SwUDP authenticated mode (may be NULL)
+func (handler *Handler) signUp(sid Sid, token uint64, flags byte, code cmd, usrData, peerKey []byte) (Sid, []byte) {
     Assert(handler.userManager, handler.tokenManager, handler.server)
 
     items := bytes.Split(usrData, []byte{0})
@@ -275,8 +400,13 @@ func (handler *Handler) signUp(sid Sid, token uint32, flags byte, code cmd, usrD
         if len(password) >= minPasswordLen { // additional check; in theory a client must send HEX md5-hash (32b)
             user, err := handler.userManager.SignUp(name, email, password, agentInfo, promocode)
             if err == nil {
-                newToken := handler.tokenManager.NewToken(user.Sid)
-                return user.Sid, packN(user.Sid, newToken, flags|1, 2, byte(code), noErr)
+                var newToken uint64
+                newToken, err = handler.tokenManager.NewToken(user.Sid, flags&flagWideToken != 0)
+                if err == nil {
+                    setBigMaps(user, flags)
+                    return user.Sid, handler.signedIn(user.Sid, newToken, flags, code, peerKey)
+                }
+                handler.userManager.SignOut(user)
             }
             Check(err)
             return sid, packN(sid, token, flags|1, 2, byte(code), getSignUpErrCode(err))
@@ -288,11 +418,12 @@ func (handler *Handler) signUp(sid Sid, token uint32, flags byte, code cmd, usrD
 
 // signIn is a handler for "SIGN IN" command (2)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) signIn(sid Sid, token uint32, flags byte, code cmd, usrData []byte) (Sid, []byte) {
+// "peerKey" - client's public key for SwUDP authenticated mode (may be NULL)
+func (handler *Handler) signIn(sid Sid, token uint64, flags byte, code cmd, usrData, peerKey []byte) (Sid, []byte) {
     Assert(handler.userManager, handler.tokenManager)
     if len(usrData) > 1 {
         authType := usrData[0]
@@ -305,14 +436,20 @@ func (handler *Handler) signIn(sid Sid, token uint32, flags byte, code cmd, usrD
                 agentInfo := string(items[2])
                 user, err, oldSid := handler.userManager.SignIn(name, password, agentInfo)
                 if err == nil {
-                    if oldSid > 0 { // if oldSid exists => send SignOut to him
+                    if oldSid > 0 { // if oldSid exists => send SignOut to him, and then revoke his token
                         box := NewMailBox()
                         box.Put(oldSid, []byte{byte(signOut), noErr})
                         handler.setPrefixes(box, oldSid, 0)
                         handler.server.SendAll(box)
+                        handler.tokenManager.RevokeToken(oldSid)
                     }
-                    newToken := handler.tokenManager.NewToken(user.Sid)
-                    return user.Sid, packN(user.Sid, newToken, flags|1, 2, byte(code), noErr)
+                    var newToken uint64 // a new token is issued on every sign in (e.g. after re-connection)
+                    newToken, err = handler.tokenManager.NewToken(user.Sid, flags&flagWideToken != 0)
+                    if err == nil {
+                        setBigMaps(user, flags)
+                        return user.Sid, handler.signedIn(user.Sid, newToken, flags, code, peerKey)
+                    }
+                    handler.userManager.SignOut(user)
                 }
                 Check(err)
                 return sid, packN(sid, token, flags|1, 2, byte(code), GetErrorCode(err))
@@ -324,23 +461,49 @@ func (handler *Handler) signIn(sid Sid, token uint32, flags byte, code cmd, usrD
     return sid, packN(sid, token, flags|1, 2, byte(code), errIncorrectLen)
 }
 
+// signedIn builds a successful response for "SIGN UP" and "SIGN IN" commands; if a client asks for SwUDP
+// authenticated mode, a secret key is agreed with the client's public key, and the server's public key is appended to
+// the response (the secret key itself is never sent)
+// "sid" - new Session ID
+// "token" - new validation token
+// "flags" - message flags
+// "code" - command code
+// "peerKey" - client's public key for SwUDP authenticated mode (may be NULL)
+func (handler *Handler) signedIn(sid Sid, token uint64, flags byte, code cmd, peerKey []byte) []byte {
+    Assert(handler.server)
+
+    if flags&flagAuth != 0 {
+        publicKey, key, err := network.AgreeAuthKey(peerKey)
+        if err == nil {
+            handler.server.SetAuthKey(sid, key)
+            return append(packN(sid, token, flags|1, len(publicKey)+2, byte(code), noErr), publicKey...)
+        }
+        Check(err)
+    }
+    return packN(sid, token, (flags|1)&^flagAuth, 2, byte(code), noErr) // no key => no flag
+}
+
 // signOut is a handler for "SIGN OUT" command (3)
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) signOut(user *user.User, token uint32, flags byte, code cmd) (response []byte) {
-    Assert(user)
+func (handler *Handler) signOut(user *user.User, token uint64, flags byte, code cmd) (response []byte) {
+    Assert(user, handler.tokenManager, handler.battleManager, handler.matchmaker, handler.teamRoom)
+    handler.battleManager.Unwatch(user.Sid) // nolint (a user might not be a spectator)
+    handler.matchmaker.cancel(user.Sid)     // a user might be awaiting for a battle
+    handler.teamRoom.cancel(user.Sid)
     handler.userManager.SignOut(user)
+    handler.tokenManager.RevokeToken(user.Sid)
     return packN(user.Sid, token, flags|1, 2, byte(code), noErr)
 }
 
 // is a handler for "USER INFO" command (4)
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) userInfo(user *user.User, token uint32, flags byte, code cmd) (response []byte) {
+func (handler *Handler) userInfo(user *user.User, token uint64, flags byte, code cmd) (response []byte) {
     Assert(user, handler.userManager)
 
     info, err := handler.userManager.GetUserInfo(user)
@@ -353,11 +516,11 @@ func (handler *Handler) userInfo(user *user.User, token uint32, flags byte, code
 
 // changeCharacter is a handler for "CHANGE CHARACTER" command (5)
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) changeCharacter(user *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) changeCharacter(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     Assert(handler.userManager, user)
 
     if len(usrData) == 1 {
@@ -371,13 +534,13 @@ func (handler *Handler) changeCharacter(user *user.User, token uint32, flags byt
 
 // attack is a handler for "ATTACK" command (6)
 // "aggressor" - aggressor user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) attack(aggressor *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) attack(aggressor *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     if len(usrData) > 0 {
-        if !handler.serverStop {
+        if !handler.isServerStopping() {
             switch attackType(usrData[0]) {
             case attackByName:
                 return handler.attackByName(aggressor, token, flags, code, usrData)
@@ -395,17 +558,18 @@ func (handler *Handler) attack(aggressor *user.User, token uint32, flags byte, c
 
 // attackByName is a handler for "ATTACK" command (6) with a "ByName" argument
 // "aggressor" - aggressor user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) attackByName(aggressor *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) attackByName(aggressor *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     Assert(aggressor, handler.userManager, handler.battleManager, handler.server)
 
     if len(usrData) > 1 {
         name := string(usrData[1:])
         if victim, ok := handler.userManager.GetUserByName(name); ok {
-            box, err := handler.battleManager.Attack(aggressor.Sid, victim.Sid, aggressor.Name, victim.Name)
+            box, err := handler.battleManager.Attack(aggressor.Sid, victim.Sid, aggressor.Name, victim.Name,
+                handler.gameMode)
             if err == nil {
                 box.Put(aggressor.Sid, append([]byte{byte(code), noErr}, name...))
                 handler.setPrefixes(box, aggressor.Sid, flags)
@@ -423,14 +587,15 @@ func (handler *Handler) attackByName(aggressor *user.User, token uint32, flags b
 
 // attackLatest is a handler for "ATTACK" command (6) with a "Latest" argument
 // "aggressor" - aggressor user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) attackLatest(aggressor *user.User, token uint32, flags byte, code cmd) (response []byte) {
+func (handler *Handler) attackLatest(aggressor *user.User, token uint64, flags byte, code cmd) (response []byte) {
     Assert(aggressor, handler.userManager, handler.battleManager, handler.server)
 
     if victim, ok := handler.userManager.GetUserByID(aggressor.LastEnemy); ok {
-        box, err := handler.battleManager.Attack(aggressor.Sid, victim.Sid, aggressor.Name, victim.Name)
+        box, err := handler.battleManager.Attack(aggressor.Sid, victim.Sid, aggressor.Name, victim.Name,
+            handler.gameMode)
         if err == nil {
             box.Put(aggressor.Sid, append([]byte{byte(code), noErr}, victim.Name...))
             handler.setPrefixes(box, aggressor.Sid, flags)
@@ -446,15 +611,17 @@ func (handler *Handler) attackLatest(aggressor *user.User, token uint32, flags b
 
 // attackQuick is a handler for "ATTACK" command (6) with a "Random" argument
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) attackQuick(user *user.User, token uint32, flags byte, code cmd) (response []byte) {
-    Assert(user, handler.userManager, handler.battleManager, handler.server, handler.room)
+func (handler *Handler) attackQuick(user *user.User, token uint64, flags byte, code cmd) (response []byte) {
+    Assert(user, handler.userManager, handler.battleManager, handler.server, handler.matchmaker)
 
-    if enemySid, ok := handler.room.getPendingOrWait(user.Sid); ok {
+    if enemySid, ok := handler.matchmaker.getPendingOrWait(user); ok {
         if enemy, ok := handler.userManager.GetUserBySid(enemySid); ok {
-            levels, err := getLevels(handler.reader, 5)
+            seed := NewSeed()
+            levels, err := getLevels(handler.reader, NewRand(seed), handler.gameMode.GetRoundsMax(),
+                enemy.BigMaps && user.BigMaps, false)
             if err == nil {
                 abilities1, err1 := handler.userManager.GetUserAbilities(enemy)
                 abilities2, err2 := handler.userManager.GetUserAbilities(user)
@@ -462,7 +629,7 @@ func (handler *Handler) attackQuick(user *user.User, token uint32, flags byte, c
                 if err == nil {
                     char1, char2 := enemy.Character, user.Character
                     box, err1 := handler.battleManager.Accept(enemySid, user.Sid, char1, char2, abilities1, 
-                        abilities2, levels, 3, true, false)
+                        abilities2, levels, handler.gameMode, true, false, seed)
                     err2 := handler.userManager.Accept(enemy, user)
                     err = NewErrs(err1, err2)
                     if err == nil {
@@ -486,17 +653,19 @@ func (handler *Handler) attackQuick(user *user.User, token uint32, flags byte, c
 
 // accept is a handler for "ACCEPT" command (8)
 // "defender" - defender user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) accept(defender *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) accept(defender *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     Assert(defender, handler.userManager, handler.battleManager, handler.server)
 
     if len(usrData) == 2 {
         aggressorSid := Sid(usrData[0])*256 + Sid(usrData[1])
         if aggressor, ok := handler.userManager.GetUserBySid(aggressorSid); ok {
-            levels, err := getLevels(handler.reader, 5)
+            seed := NewSeed()
+            levels, err := getLevels(handler.reader, NewRand(seed), handler.gameMode.GetRoundsMax(),
+                aggressor.BigMaps && defender.BigMaps, false)
             if err == nil {
                 abilities1, err1 := handler.userManager.GetUserAbilities(aggressor)
                 abilities2, err2 := handler.userManager.GetUserAbilities(defender)
@@ -504,7 +673,7 @@ func (handler *Handler) accept(defender *user.User, token uint32, flags byte, co
                 if err == nil {
                     char1, char2 := aggressor.Character, defender.Character
                     box, err1 := handler.battleManager.Accept(aggressor.Sid, defender.Sid, char1, char2, 
-                        abilities1, abilities2, levels, 3, false, true)
+                        abilities1, abilities2, levels, handler.gameMode, false, true, seed)
                     err2 := handler.userManager.Accept(aggressor, defender)
                     err = NewErrs(err1, err2)
                     if err == nil {
@@ -526,11 +695,11 @@ func (handler *Handler) accept(defender *user.User, token uint32, flags byte, co
 
 // reject is a handler for "REJECT" command (9)
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) reject(user *user.User, token uint32, flags byte, code cmd, usrData []byte) (response []byte) {
+func (handler *Handler) reject(user *user.User, token uint64, flags byte, code cmd, usrData []byte) (response []byte) {
     Assert(user, handler.userManager, handler.battleManager, handler.server)
 
     if len(usrData) == 2 {
@@ -554,12 +723,15 @@ func (handler *Handler) reject(user *user.User, token uint32, flags byte, code c
 
 // cancelCall is a handler for "CANCEL CALL" command (11)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) cancelCall(sid Sid, token uint32, flags byte, code cmd) (response []byte) {
-    Assert(handler.battleManager, handler.server)
+func (handler *Handler) cancelCall(sid Sid, token uint64, flags byte, code cmd) (response []byte) {
+    Assert(handler.battleManager, handler.server, handler.teamRoom)
 
+    if handler.teamRoom.cancel(sid) || handler.matchmaker.cancel(sid) { // since 1.4.0 it also cancels awaiting
+        return packN(sid, token, flags|1, 2, byte(code), noErr)
+    }
     box, err := handler.battleManager.CancelCall(sid)
     if err == nil {
         box.Put(sid, []byte{byte(code), noErr})
@@ -571,20 +743,27 @@ func (handler *Handler) cancelCall(sid Sid, token uint32, flags byte, code cmd)
     return packN(sid, token, flags|1, 2, byte(code), GetErrorCode(err))
 }
 
-// receiveLevel is a handler for "RECEIVE LEVEL" command (12)
+// receiveLevel is a handler for "RECEIVE LEVEL" command (12); since 1.4.0 team levels and the levels with a header
+// (unless the client supports big maps) are rejected with "errIncorrectArg"
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) receiveLevel(user *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
-    Assert(user, handler.battleManager, handler.fakeSidStore, handler.server)
+func (handler *Handler) receiveLevel(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
+    Assert(user, handler.battleManager, handler.fakeSidStore, handler.reader, handler.server)
     
     if len(usrData) > 0 {
-        if !handler.serverStop {
+        if !handler.isServerStopping() {
             levelName := string(usrData)
+            if level, ok := handler.reader.GetByName(levelName); ok {
+                if (!user.BigMaps && battle.HasHeader(level)) || battle.IsTeamLevel(level) {
+                    return packN(user.Sid, token, flags|1, 2, byte(code), errIncorrectArg)
+                }
+            }
             abilities := make([]byte, 0)
-            enemyChar := byte(rand.Intn(3) + 1)
+            seed := NewSeed()
+            enemyChar := byte(NewRand(seed).Intn(3) + 1)
             if enemyChar == user.Character {
                 enemyChar = 4
             }
@@ -592,7 +771,7 @@ func (handler *Handler) receiveLevel(user *user.User, token uint32, flags byte,
             if err == nil {
                 var box *MailBox
                 box, err = handler.battleManager.Accept(user.Sid, fakeSid, user.Character, enemyChar, abilities, 
-                    abilities, []string{levelName}, 1, false, false)
+                    abilities, []string{levelName}, handler.trainingMode, false, false, seed)
                 if err == nil {
                     box.Put(user.Sid, []byte{byte(code), noErr})
                     handler.setPrefixes(box, user.Sid, flags)
@@ -609,16 +788,23 @@ func (handler *Handler) receiveLevel(user *user.User, token uint32, flags byte,
     return packN(user.Sid, token, flags|1, 2, byte(code), errIncorrectLen)
 }
 
-// rangeOfProducts is a handler for "RANGE OF PRODUCTS" command (13)
+// rangeOfProducts is a handler for "RANGE OF PRODUCTS" command (13); since 1.4.0 the products absent in the ability
+// registry (see battle.RegisterAbility()) are not shown
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) rangeOfProducts(sid Sid, token uint32, flags byte, code cmd) (response []byte) {
+func (handler *Handler) rangeOfProducts(sid Sid, token uint64, flags byte, code cmd) (response []byte) {
     Assert(handler.userManager)
 
-    array, err := handler.userManager.GetAllAbilities()
+    products, err := handler.userManager.GetAllAbilities()
     if err == nil {
+        array := make([]byte, 0, len(products))
+        for i := 0; i+2 < len(products); i += 3 { // id, days, gems
+            if _, ok := battle.GetAbility(products[i]); ok {
+                array = append(array, products[i:i+3]...)
+            }
+        }
         return append(packN(sid, token, flags|1, len(array)+2, byte(code), noErr), array...)
     }
     Check(err)
@@ -627,16 +813,19 @@ func (handler *Handler) rangeOfProducts(sid Sid, token uint32, flags byte, code
 
 // buyProduct is a handler for "BUY PRODUCT" command (14)
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) buyProduct(user *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) buyProduct(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     Assert(user, handler.userManager)
 
     if len(usrData) == 2 {
         product := usrData[0]
         days := usrData[1]
+        if _, ok := battle.GetAbility(product); !ok {
+            return packN(user.Sid, token, flags|1, 2, byte(code), errIncorrectArg)
+        }
         err := handler.userManager.BuyProduct(user, product, days)
         if err == nil {
             var info []byte
@@ -651,36 +840,47 @@ func (handler *Handler) buyProduct(user *user.User, token uint32, flags byte, co
     return packN(user.Sid, token, flags|1, 2, byte(code), errIncorrectLen)
 }
 
-// getCurrentField is a handler for "FULL STATE" command (16)
+// getCurrentField is a handler for "FULL STATE" command (16). Since 1.4.0 it also resumes the battle, if it has been
+// paused by disconnection of the client (see Disconnected())
 // @since 1.3.0
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) getCurrentField(sid Sid, token uint32, flags byte, code cmd) (response []byte) {
+func (handler *Handler) getCurrentField(sid Sid, token uint64, flags byte, code cmd) (response []byte) {
     Assert(handler.battleManager)
     base, err := handler.battleManager.GetFieldRaw(sid)
     Check(err)
+    if err == nil {
+        handler.resume(sid)
+    }
     result := packN(sid, token, flags|1, len(base)+1, byte(code)) // it doesn't contain err for backwards compatibility
     return append(result, base...)
 }
 
 // move is a handler for "MOVE" command (19)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) move(sid Sid, token uint32, flags byte, code cmd, usrData []byte) (response []byte) {
-    Assert(handler.battleManager, handler.server)
+func (handler *Handler) move(sid Sid, token uint64, flags byte, code cmd, usrData []byte) (response []byte) {
+    Assert(handler.battleManager, handler.server, handler.antiCheat)
 
     if len(usrData) == 1 {
         direction := usrData[0]
+        points, err := handler.antiCheat.checkMove(sid) // since 1.4.0 the movement rate is validated on the server
+        if points > 0 {
+            handler.suspect(sid, points)
+        }
+        if err != nil {
+            return packN(sid, token, flags|1, 2, byte(code), GetErrorCode(err)) // no logging: it might be a flood
+        }
         box, err := handler.battleManager.Move(sid, direction)
         if err == nil {
             for _, s := range box.GetSids() {
                 if handler.fakeSidStore.contains(s) {
-                    handler.aiManager.handleEvent(s, box)
+                    handler.aiManager.HandleEvent(s, box)
                 }
             }
             box.Put(sid, []byte{byte(code), noErr})
@@ -696,10 +896,10 @@ func (handler *Handler) move(sid Sid, token uint32, flags byte, code cmd, usrDat
 
 // useThing is a handler for "USE THING" command (20)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) useThing(sid Sid, token uint32, flags byte, code cmd) (response []byte) {
+func (handler *Handler) useThing(sid Sid, token uint64, flags byte, code cmd) (response []byte) {
     Assert(handler.battleManager, handler.server)
 
     box, err := handler.battleManager.UseThing(sid)
@@ -715,11 +915,11 @@ func (handler *Handler) useThing(sid Sid, token uint32, flags byte, code cmd) (r
 
 // useSkill is a handler for "USE SKILL" command (21)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) useSkill(sid Sid, token uint32, flags byte, code cmd, usrData []byte) (response []byte) {
+func (handler *Handler) useSkill(sid Sid, token uint64, flags byte, code cmd, usrData []byte) (response []byte) {
     Assert(handler.battleManager, handler.server)
 
     if len(usrData) == 1 {
@@ -739,10 +939,10 @@ func (handler *Handler) useSkill(sid Sid, token uint32, flags byte, code cmd, us
 
 // giveUp is a handler for "GIVE UP" command (22)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) giveUp(sid Sid, token uint32, flags byte, code cmd) (response []byte) {
+func (handler *Handler) giveUp(sid Sid, token uint64, flags byte, code cmd) (response []byte) {
     Assert(handler.battleManager, handler.fakeSidStore, handler.server)
 
     _, box, err := handler.battleManager.GiveUp(sid)
@@ -756,17 +956,19 @@ func (handler *Handler) giveUp(sid Sid, token uint32, flags byte, code cmd) (res
     return packN(sid, token, flags|1, 2, byte(code), GetErrorCode(err))
 }
 
-// restoreState is a handler for "RESTORE STATE" command (30)
+// restoreState is a handler for "RESTORE STATE" command (30). Since 1.4.0 it also resumes the battle, if it has been
+// paused by disconnection of the client (see Disconnected())
 // @since 1.3.0
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) restoreState(sid Sid, token uint32, flags byte, code cmd) (response []byte) {
+func (handler *Handler) restoreState(sid Sid, token uint64, flags byte, code cmd) (response []byte) {
     Assert(handler.battleManager)
     
     dump, err := handler.battleManager.GetMovablesDump(sid)
     if err == nil {
+        handler.resume(sid)
         return append(packN(sid, token, flags|1, len(dump)+2, byte(code), noErr), dump...)
     }
     Check(err)
@@ -775,11 +977,11 @@ func (handler *Handler) restoreState(sid Sid, token uint32, flags byte, code cmd
 
 // getRating is a handler for "RATING" command (32)
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) getRating(user *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) getRating(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     Assert(user, handler.userManager)
 
     if len(usrData) == 1 {
@@ -796,11 +998,11 @@ func (handler *Handler) getRating(user *user.User, token uint32, flags byte, cod
 
 // friendList is a handler for "FRIEND LIST" command (33)
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) friendList(user *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) friendList(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     Assert(user, handler.userManager, handler.server)
 
     // since 1.2.0 we additionally add statuses (1=offline, 2=online)
@@ -809,10 +1011,11 @@ func (handler *Handler) friendList(user *user.User, token uint32, flags byte, co
     characters, friends, err := handler.userManager.GetUserFriends(user)
     total := Min(uint(len(characters)), uint(len(friends)))
     if err == nil {
+        paging := !handler.server.SupportsLargeMessages(user.Sid)
         fragNumber := byte(1)
         res := []byte{}
         for i := uint(0); i < total; i++ {
-            if i > 0 && i%friendListFragment == 0 {
+            if paging && i > 0 && i%friendListFragment == 0 {
                 header := packN(user.Sid, token, flags|1, len(res)+3, byte(code), noErr, fragNumber)
                 handler.server.Send(user.Sid, append(header, res...)) // do NOT use MailBox here! It may cause overflow
                 fragNumber++
@@ -836,11 +1039,11 @@ func (handler *Handler) friendList(user *user.User, token uint32, flags byte, co
 
 // addFriend is a handler for "ADD FRIEND" command (34)
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) addFriend(user *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) addFriend(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     Assert(user, handler.userManager)
 
     if len(usrData) > 0 {
@@ -855,11 +1058,11 @@ func (handler *Handler) addFriend(user *user.User, token uint32, flags byte, cod
 
 // removeFriend is a handler for "REMOVE FRIEND" command (35)
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) removeFriend(user *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) removeFriend(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     Assert(user, handler.userManager)
 
     if len(usrData) > 0 {
@@ -874,11 +1077,11 @@ func (handler *Handler) removeFriend(user *user.User, token uint32, flags byte,
 
 // checkPromocode is a handler for "CHECK PROMOCODE" command (36)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) checkPromocode(sid Sid, token uint32, flags byte, code cmd, usrData []byte) (response []byte) {
+func (handler *Handler) checkPromocode(sid Sid, token uint64, flags byte, code cmd, usrData []byte) (response []byte) {
     Assert(handler.userManager)
 
     if len(usrData) > 0 {
@@ -892,10 +1095,10 @@ func (handler *Handler) checkPromocode(sid Sid, token uint32, flags byte, code c
 
 // getSkuGems is a handler for "GET SKU GEMS" command (38)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) getSkuGems(sid Sid, token uint32, flags byte, code cmd) (response []byte) {
+func (handler *Handler) getSkuGems(sid Sid, token uint64, flags byte, code cmd) (response []byte) {
     Assert(handler.userManager)
 
     data := []byte{}
@@ -912,11 +1115,11 @@ func (handler *Handler) getSkuGems(sid Sid, token uint32, flags byte, code cmd)
 
 // checkPurchase is a handler for "CHECK PURCHASE" command (39)
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) checkPurchase(user *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) checkPurchase(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     Assert(user, handler.userManager, handler.server)
 
     if len(usrData) > 2 {
@@ -945,10 +1148,10 @@ func (handler *Handler) checkPurchase(user *user.User, token uint32, flags byte,
 
 // clientVersion is a handler for "GET CLIENT VERSION" command (40)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
-func (handler *Handler) clientVersion(sid Sid, token uint32, flags byte, code cmd) (response []byte) {
+func (handler *Handler) clientVersion(sid Sid, token uint64, flags byte, code cmd) (response []byte) {
     a := byte((handler.minClientVersion >> 16) & 0xFF)
     b := byte((handler.minClientVersion >> 8) & 0xFF)
     c := byte((handler.minClientVersion & 0xFF))
@@ -961,11 +1164,11 @@ func (handler *Handler) clientVersion(sid Sid, token uint32, flags byte, code cm
 // changePassword is a handler for "CHANGE PASSWORD" command (41)
 // @since 1.2.0
 // "user" - user
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) changePassword(user *user.User, token uint32, flags byte, code cmd, usrData []byte) []byte {
+func (handler *Handler) changePassword(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
     Assert(handler.userManager)
     
     if len(usrData) > 2 {
@@ -981,38 +1184,367 @@ func (handler *Handler) changePassword(user *user.User, token uint32, flags byte
     return packN(user.Sid, token, flags|1, 2, byte(code), errIncorrectLen)
 }
 
+// battleList is a handler for "BATTLE LIST" command (42); it returns the names of participants of the battles that
+// can be watched (i.e. the battles between real users): [name1, 0, name2, 0]...
+// @since 1.4.0
+// "user" - user
+// "token" - client's validation token (32 or 64 bits)
+// "flags" - message flags
+// "code" - command code
+func (handler *Handler) battleList(user *user.User, token uint64, flags byte, code cmd) []byte {
+    Assert(user, handler.userManager, handler.battleManager, handler.server)
+
+    aggressors, defenders := handler.battleManager.GetBattles()
+    limit := TernaryInt(handler.server.SupportsLargeMessages(user.Sid), len(aggressors), battleListMax)
+    res := []byte{}
+    for i := 0; i < len(aggressors) && i < len(defenders) && limit > 0; i++ {
+        usr1, ok1 := handler.userManager.GetUserBySid(aggressors[i])
+        usr2, ok2 := handler.userManager.GetUserBySid(defenders[i])
+        if ok1 && ok2 {
+            res = append(res, usr1.Name...)
+            res = append(res, 0)
+            res = append(res, usr2.Name...)
+            res = append(res, 0)
+            limit--
+        }
+    }
+    return append(packN(user.Sid, token, flags|1, len(res)+2, byte(code), noErr), res...)
+}
+
+// watchBattle is a handler for "WATCH BATTLE" command (43); a user becomes a spectator of a battle of a given
+// participant and receives the battle events till the battle is over or "UNWATCH BATTLE" command is sent
+// @since 1.4.0
+// "user" - user
+// "token" - client's validation token (32 or 64 bits)
+// "flags" - message flags
+// "code" - command code
+// "usrData" - arbitrary user data of the message
+func (handler *Handler) watchBattle(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
+    Assert(user, handler.userManager, handler.battleManager, handler.server)
+
+    if len(usrData) > 0 {
+        name := string(usrData)
+        if participant, ok := handler.userManager.GetUserByName(name); ok {
+            box, err := handler.battleManager.Watch(user.Sid, participant.Sid, user.BigMaps)
+            if err == nil {
+                box.Put(user.Sid, append([]byte{byte(code), noErr}, name...))
+                handler.setPrefixes(box, user.Sid, flags)
+                handler.server.SendAll(box)
+                return nil
+            }
+            Check(err)
+            return packN(user.Sid, token, flags|1, 2, byte(code), GetErrorCode(err))
+        }
+        return packN(user.Sid, token, flags|1, 2, byte(code), errUserNotFound)
+    }
+    return packN(user.Sid, token, flags|1, 2, byte(code), errIncorrectLen)
+}
+
+// unwatchBattle is a handler for "UNWATCH BATTLE" command (44)
+// @since 1.4.0
+// "user" - user
+// "token" - client's validation token (32 or 64 bits)
+// "flags" - message flags
+// "code" - command code
+func (handler *Handler) unwatchBattle(user *user.User, token uint64, flags byte, code cmd) []byte {
+    Assert(user, handler.battleManager)
+
+    err := handler.battleManager.Unwatch(user.Sid)
+    Check(err)
+    return packN(user.Sid, token, flags|1, 2, byte(code), GetErrorCode(err))
+}
+
+// replay is a handler for "REPLAY" command (45); the events of a finished battle with a given ID (see "BATTLE INFO"
+// event) are streamed back to a user with their original timing, as if the battle was live. A user may watch only one
+// replay at a time (a new request stops the previous stream), and "REPLAY" without arguments stops the stream. The
+// stream is also interrupted if the user signs out or enters a battle (as a participant or a spectator)
+// @since 1.4.0
+// "user" - user
+// "token" - client's validation token (32 or 64 bits)
+// "flags" - message flags
+// "code" - command code
+// "usrData" - arbitrary user data of the message
+func (handler *Handler) replay(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
+    Assert(user, handler.battleManager)
+
+    if len(usrData) >= 8 {
+        var id uint64
+        for _, b := range usrData[:8] {
+            id = id<<8 | uint64(b)
+        }
+        events, err := handler.battleManager.GetReplay(id, user.BigMaps)
+        if err == nil {
+            go handler.playReplay(user.Sid, token, events, handler.startReplay(user.Sid))
+            return packN(user.Sid, token, flags|1, 2, byte(code), noErr)
+        }
+        Check(err)
+        return packN(user.Sid, token, flags|1, 2, byte(code), GetErrorCode(err))
+    }
+    if len(usrData) == 0 {
+        handler.stopReplay(user.Sid, nil)
+        return packN(user.Sid, token, flags|1, 2, byte(code), noErr)
+    }
+    return packN(user.Sid, token, flags|1, 2, byte(code), errNotEnoughArgs)
+}
+
+// startReplay registers a new replay stream for a user with a given Session ID (the previous one, if any, is stopped),
+// and returns a channel to stop it
+func (handler *Handler) startReplay(sid Sid) chan bool {
+    stop := make(chan bool)
+    handler.replayMutex.Lock()
+    if prev, ok := handler.replays[sid]; ok {
+        close(prev)
+    }
+    handler.replays[sid] = stop
+    handler.replayMutex.Unlock()
+    return stop
+}
+
+// stopReplay stops a replay stream of a user with a given Session ID
+// "sid" - user's Session ID
+// "stop" - channel of the stream to stop (pass NULL to stop any stream)
+func (handler *Handler) stopReplay(sid Sid, stop chan bool) {
+    handler.replayMutex.Lock()
+    if cur, ok := handler.replays[sid]; ok && (stop == nil || cur == stop) {
+        close(cur)
+        delete(handler.replays, sid)
+    }
+    handler.replayMutex.Unlock()
+}
+
+// playReplay sends given replay events to a user, keeping the time intervals between them (this method is blocking)
+// "sid" - user's Session ID
+// "token" - user's token at the moment of request (if it is revoked, the stream stops)
+// "events" - replay events
+// "stop" - channel to stop the playback (see startReplay())
+func (handler *Handler) playReplay(sid Sid, token uint64, events []battle.ReplayEvent, stop chan bool) {
+    Assert(handler.tokenManager, handler.battleManager, handler.server)
+    defer handler.stopReplay(sid, stop)
+
+    t0 := time.Now()
+    for _, event := range events {
+        timer := time.NewTimer(event.Time - time.Since(t0))
+        select {
+        case <-stop:
+            timer.Stop()
+            return
+        case <-timer.C:
+        }
+        if !handler.tokenManager.CheckToken(sid, token) {
+            return
+        }
+        if _, err := handler.battleManager.GetFieldRaw(sid); err == nil {
+            return // user is in a battle now
+        }
+        box := NewMailBox().Put(sid, event.Msg)
+        handler.server.SendAll(handler.setPrefixes(box, 0, 0))
+    }
+}
+
+// teamBattle is a handler for "TEAM BATTLE" command (46); a user waits for a team battle (2 vs. 2) either alone (no
+// arguments) or with a friend (argument is the friend's name; the friend must be online and send the same command with
+// the user's name). As soon as 2 teams are formed the battle starts; otherwise the user receives "errWaitForEnemy", and
+// if nobody is found on time, the user receives "errEnemyNotFound" (see Controller.teamExpired())
+// @since 1.4.0
+// "user" - user
+// "token" - client's validation token (32 or 64 bits)
+// "flags" - message flags
+// "code" - command code
+// "usrData" - arbitrary user data of the message
+func (handler *Handler) teamBattle(user *user.User, token uint64, flags byte, code cmd, usrData []byte) []byte {
+    Assert(user, handler.userManager, handler.teamRoom)
+
+    if handler.isServerStopping() {
+        return packN(user.Sid, token, flags|1, 2, byte(code), errServerGonnaStop)
+    }
+    friendSid := Sid(0)
+    if len(usrData) > 0 {
+        name := string(usrData)
+        _, friends, err := handler.userManager.GetUserFriends(user)
+        if err != nil {
+            Check(err)
+            return packN(user.Sid, token, flags|1, 2, byte(code), GetErrorCode(err))
+        }
+        isFriend := false
+        for _, friendName := range friends {
+            isFriend = isFriend || friendName == name
+        }
+        friend, ok := handler.userManager.GetUserByName(name)
+        if !ok || !isFriend {
+            log.Println("ERROR: Friend not found", name)
+            return packN(user.Sid, token, flags|1, 2, byte(code), errEnemyNotFound)
+        }
+        friendSid = friend.Sid
+    }
+    if team1, team2, ok := handler.teamRoom.join(user.Sid, friendSid); ok {
+        return handler.startTeamBattle(user.Sid, token, flags, code, team1, team2)
+    }
+    return packN(user.Sid, token, flags|1, 2, byte(code), errWaitForEnemy)
+}
+
+// rematch is a handler for "REMATCH" command (48); it is valid for a short time after an ordinary battle is over. As
+// soon as both participants have sent the command, a new battle starts with the same characters and abilities on new
+// levels, and both participants receive [48, 0]; until then the user receives "errWaitForEnemy", and the opponent
+// receives "REMATCH OFFERED" (49). AI opponents always agree to a rematch
+// @since 1.4.0
+// "user" - user
+// "token" - client's validation token (32 or 64 bits)
+// "flags" - message flags
+// "code" - command code
+func (handler *Handler) rematch(user *user.User, token uint64, flags byte, code cmd) []byte {
+    Assert(user, handler.userManager, handler.battleManager, handler.aiManager, handler.fakeSidStore, handler.server)
+
+    if handler.isServerStopping() {
+        return packN(user.Sid, token, flags|1, 2, byte(code), errServerGonnaStop)
+    }
+    enemySid, mode, ready, box, err := handler.battleManager.Rematch(user.Sid)
+    isAi := handler.fakeSidStore.contains(enemySid)
+    if err == nil && !ready && isAi {
+        _, mode, ready, _, err = handler.battleManager.Rematch(enemySid)
+    }
+    if err == nil && !ready {
+        handler.setPrefixes(box, user.Sid, flags)
+        handler.server.SendAll(box)
+        return packN(user.Sid, token, flags|1, 2, byte(code), errWaitForEnemy)
+    }
+    if err == nil {
+        bigMaps := user.BigMaps
+        if enemy, ok := handler.userManager.GetUserBySid(enemySid); ok {
+            bigMaps = bigMaps && enemy.BigMaps
+        }
+        seed := NewSeed()
+        rnd := NewRand(seed)
+        var levels []string
+        levels, err = getLevels(handler.reader, rnd, mode.GetRoundsMax(), bigMaps, false)
+        if err == nil {
+            if isAi {
+                handler.aiManager.RestartAi(enemySid, rnd.Fork())
+            }
+            box, err = handler.battleManager.AcceptRematch(user.Sid, levels, seed)
+            if err == nil {
+                box.Put(user.Sid, []byte{byte(code), noErr})
+                box.Put(enemySid, []byte{byte(code), noErr})
+                if isAi {
+                    handler.aiManager.HandleEvent(enemySid, box)
+                }
+                handler.setPrefixes(box, user.Sid, flags)
+                handler.server.SendAll(box)
+                return nil
+            }
+        }
+    }
+    Check(err)
+    return packN(user.Sid, token, flags|1, 2, byte(code), GetErrorCode(err))
+}
+
+// startTeamBattle starts a team battle for given teams, formed by TeamRoom; the other 3 users (who are waiting for the
+// result of their own "TEAM BATTLE" commands) receive the result as well
+// "sid" - Session ID of a user who has completed the teams
+// "token" - client's validation token (32 or 64 bits)
+// "flags" - message flags
+// "code" - command code
+// "team1" - Session IDs of the 1-st team (leader goes first)
+// "team2" - Session IDs of the 2-nd team (leader goes first)
+func (handler *Handler) startTeamBattle(sid Sid, token uint64, flags byte, code cmd, team1, team2 []Sid) []byte {
+    Assert(handler.userManager, handler.battleManager, handler.server, handler.reader)
+
+    sids := []Sid{team1[0], team2[0], team1[1], team2[1]} // aggressor, defender, aggressor's mate, defender's mate
+    errCode := byte(errEnemyNotFound)
+    users := make([]*user.User, 0, len(sids))
+    for _, s := range sids {
+        if usr, ok := handler.userManager.GetUserBySid(s); ok {
+            users = append(users, usr)
+        }
+    }
+    if len(users) == len(sids) {
+        seed := NewSeed()
+        bigMaps := true
+        abilities := make([][]byte, len(users))
+        var err *Error
+        for i, usr := range users {
+            var err1 *Error
+            abilities[i], err1 = handler.userManager.GetUserAbilities(usr)
+            err = NewErrs(err, err1)
+            bigMaps = bigMaps && usr.BigMaps
+        }
+        if err == nil {
+            var levels []string
+            levels, err = getLevels(handler.reader, NewRand(seed), handler.gameMode.GetRoundsMax(), bigMaps, true)
+            if err == nil {
+                var box *MailBox
+                agr, def, mate1, mate2 := users[0], users[1], users[2], users[3]
+                box, err = handler.battleManager.AcceptTeam(agr.Sid, def.Sid, mate1.Sid, mate2.Sid, agr.Character,
+                    def.Character, mate1.Character, mate2.Character, abilities[0], abilities[1], abilities[2],
+                    abilities[3], levels, handler.gameMode, true, seed)
+                if err == nil {
+                    box.Put(agr.Sid, append([]byte{byte(enemyName)}, def.Name...))
+                    box.Put(def.Sid, append([]byte{byte(enemyName)}, agr.Name...))
+                    box.Put(mate1.Sid, append([]byte{byte(enemyName)}, def.Name...))
+                    box.Put(mate2.Sid, append([]byte{byte(enemyName)}, agr.Name...))
+                    for _, s := range sids {
+                        box.Put(s, []byte{byte(code), noErr})
+                    }
+                    handler.setPrefixes(box, sid, flags)
+                    handler.server.SendAll(box)
+                    return nil
+                }
+            }
+        }
+        Check(err)
+        errCode = GetErrorCode(err)
+    } else {
+        log.Println("ERROR: Team members not found", sids)
+    }
+
+    box := NewMailBox()
+    for _, s := range sids {
+        if s != sid {
+            box.Put(s, []byte{byte(code), errCode})
+        }
+    }
+    handler.server.SendAll(handler.setPrefixes(box, 0, 0))
+    return packN(sid, token, flags|1, 2, byte(code), errCode)
+}
+
 // getStatistics is a handler for "STATISTICS" command (240)
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "t0" - start timestamp (to calculate elapsed time of the query)
-func (handler *Handler) getStatistics(sid Sid, token uint32, flags byte, code cmd, t0 time.Time) (response []byte) {
+func (handler *Handler) getStatistics(sid Sid, token uint64, flags byte, code cmd, t0 time.Time) (response []byte) {
     Assert(handler.statistics)
 
-    stats, err := handler.statistics.getStats(token, t0)
+    stats, err := handler.statistics.getStats(uint32(token), t0)
     Check(err)
     return append(packN(sid, token, flags|1, len(stats)+2, byte(code), GetErrorCode(err)), stats...)
 }
 
+// adminFunctions are Call Function codes that require a client to pass the Statistics token (1.4.0+)
+var adminFunctions = map[byte]bool{0x35: true, 0x36: true, 0x37: true, 0x38: true, 0x39: true}
+
 // callFunction is a handler for "CALL FUNCTION" command (241)
 // nolint: gocyclo
 // "sid" - client's Session ID
-// "token" - client's 32-bit validation token
+// "token" - client's validation token (32 or 64 bits)
 // "flags" - message flags
 // "code" - command code
 // "usrData" - arbitrary user data of the message
-func (handler *Handler) callFunction(sid Sid, token uint32, flags byte, code cmd, usrData []byte) []byte {
-    Assert(handler.userManager)
+func (handler *Handler) callFunction(sid Sid, token uint64, flags byte, code cmd, usrData []byte) []byte {
+    Assert(handler.userManager, handler.statistics)
 
     if len(usrData) > 0 {
         fnCode := usrData[0]
+        if adminFunctions[fnCode] && !handler.statistics.checkToken(uint32(token)) {
+            return packN(sid, token, flags|1, 2, byte(code), errIncorrectToken)
+        }
         switch fnCode {
         case 0x31: // '1' (kicks out a user by name)
             if len(usrData) > 1 {
                 name := string(usrData[1:])
                 if usr, ok := handler.userManager.GetUserByName(name); ok {
                     handler.userManager.SignOut(usr)
+                    handler.tokenManager.RevokeToken(usr.Sid)
                     return packN(sid, token, flags|1, 2, byte(code), noErr)
                 }
                 return packN(sid, token, flags|1, 2, byte(code), errUserNotFound)
@@ -1022,7 +1554,7 @@ func (handler *Handler) callFunction(sid Sid, token uint32, flags byte, code cmd
             runtime.GC()
             return packN(sid, token, flags|1, 2, byte(code), noErr)
         case 0x33: // '3' (soft stopping a server)
-            handler.serverStop = !handler.serverStop
+            handler.toggleServerStop()
             return packN(sid, token, flags|1, 2, byte(code), noErr)
         case 0x34: // '4' (get user by number)
             if len(usrData) > 1 {
@@ -1038,6 +1570,53 @@ func (handler *Handler) callFunction(sid Sid, token uint32, flags byte, code cmd
                 return packN(sid, token, flags|1, 2, byte(code), errIncorrectArg)
             }
             return packN(sid, token, flags|1, 2, byte(code), errIncorrectLen)
+        case 0x35: // '5' (get list of banned addresses: [address, 0, secondsLeft (4 bytes; 0xFFFFFFFF = forever)]...)
+            res := []byte{}
+            for addr, expire := range handler.server.GetBanned() {
+                left := uint32(0xFFFFFFFF)
+                if !expire.IsZero() {
+                    left = 0
+                    if expire.After(time.Now()) {
+                        left = uint32(time.Until(expire) / time.Second)
+                    }
+                }
+                res = append(res, addr...)
+                res = append(res, 0, byte(left >> 24), byte(left >> 16), byte(left >> 8), byte(left))
+            }
+            return append(packN(sid, token, flags|1, 2+len(res), byte(code), noErr), res...)
+        case 0x36: // '6' (unban an address)
+            if len(usrData) > 1 {
+                ok, err := handler.server.Unban(string(usrData[1:]))
+                if err == nil {
+                    return packN(sid, token, flags|1, 2, byte(code), Ternary(ok, noErr, errIncorrectArg))
+                }
+                return packN(sid, token, flags|1, 2, byte(code), GetErrorCode(err))
+            }
+            return packN(sid, token, flags|1, 2, byte(code), errIncorrectLen)
+        case 0x37: // '7' (get list of users flagged by AntiCheat: [name, 0, flagged (4 bytes; unix time)]...)
+            res := []byte{}
+            for name, t := range handler.antiCheat.getFlagged() {
+                ts := uint32(t.Unix())
+                res = append(res, name...)
+                res = append(res, 0, byte(ts >> 24), byte(ts >> 16), byte(ts >> 8), byte(ts))
+            }
+            return append(packN(sid, token, flags|1, 2+len(res), byte(code), noErr), res...)
+        case 0x38: // '8' (unflag a user)
+            if len(usrData) > 1 {
+                ok, err := handler.antiCheat.unflag(string(usrData[1:]))
+                if err == nil {
+                    return packN(sid, token, flags|1, 2, byte(code), Ternary(ok, noErr, errIncorrectArg))
+                }
+                return packN(sid, token, flags|1, 2, byte(code), GetErrorCode(err))
+            }
+            return packN(sid, token, flags|1, 2, byte(code), errIncorrectLen)
+        case 0x39: // '9' (reload level files without restart: [count of levels (2 bytes)])
+            n, err := handler.reader.Reload()
+            if err == nil {
+                return packN(sid, token, flags|1, 4, byte(code), noErr, byte(n/256), byte(n%256))
+            }
+            Check(err)
+            return packN(sid, token, flags|1, 2, byte(code), GetErrorCode(err))
         default:
             return packN(sid, token, flags|1, 2, byte(code), errFnCodeNotFound)
         }
@@ -1045,29 +1624,103 @@ func (handler *Handler) callFunction(sid Sid, token uint32, flags byte, code cmd
     return packN(sid, token, flags|1, 2, byte(code), errIncorrectLen)
 }
 
+// stopServer makes the Handler reject all new battles (with "errServerGonnaStop") and cancels a pending quick battle
+// request, if any; unlike "callFunction" 0x33, this cannot be undone
+func (handler *Handler) stopServer() {
+    Assert(handler.matchmaker)
+    atomic.StoreInt32(&handler.serverStop, 1)
+    handler.matchmaker.cancelAll()
+}
+
+// toggleServerStop switches the soft stopping mode on and off ("callFunction" 0x33)
+func (handler *Handler) toggleServerStop() {
+    for {
+        stop := atomic.LoadInt32(&handler.serverStop)
+        if atomic.CompareAndSwapInt32(&handler.serverStop, stop, 1-stop) {
+            return
+        }
+    }
+}
+
+// isServerStopping checks whether the Handler rejects all new battles (see "stopServer" and "callFunction" 0x33)
+func (handler *Handler) isServerStopping() bool {
+    return atomic.LoadInt32(&handler.serverStop) > 0
+}
+
 // =======================
 // === LOCAL FUNCTIONS ===
 // =======================
 
-// setPrefixes prepends ALL messages in the box with all required prefixes (sid, token, flags), and returns this box
-// "responseSid" - response Session ID
-// "box" - MailBox to set prefixes in
-// "flags" - message flags
+// suspect adds suspicion points to a user with a given Session ID (see AntiCheat), and applies the anti-cheat policy,
+// if necessary: for "forfeit" policy the user gives up the current battle
+// "sid" - user's Session ID
+// "points" - suspicion points
+func (handler *Handler) suspect(sid Sid, points uint) {
+    Assert(handler.userManager, handler.battleManager, handler.antiCheat)
+
+    if usr, ok := handler.userManager.GetUserBySid(sid); ok {
+        if policy, ok := handler.antiCheat.suspect(usr.Name, points); ok && policy == policyForfeit {
+            _, box, err := handler.battleManager.GiveUp(sid)
+            if err == nil {
+                handler.server.SendAll(handler.setPrefixes(box, 0, 0))
+            }
+            Check(err)
+        }
+    }
+}
+
+// resume resumes a battle of a user with a given Session ID, if it has been paused by disconnection of this user (see
+// Disconnected()); the only possible error is "Battle not found", that is normal for users who are not in a battle
+// "sid" - user's Session ID
+func (handler *Handler) resume(sid Sid) {
+    Assert(handler.battleManager)
+
+    box, err := handler.battleManager.Resume(sid)
+    if err == nil { // no logging: a user may be out of battles (e.g. a spectator)
+        handler.sendEvents(box)
+    }
+}
+
+// sendEvents sends all the messages from a given box (not responses); the messages addressed to AI players are handled
+// by AiManager
+// "box" - MailBox with the messages
+func (handler *Handler) sendEvents(box *MailBox) {
+    Assert(box, handler.fakeSidStore, handler.aiManager, handler.server)
+
+    for _, s := range box.GetSids() {
+        if handler.fakeSidStore.contains(s) {
+            handler.aiManager.HandleEvent(s, box)
+        }
+    }
+    handler.server.SendAll(handler.setPrefixes(box, 0, 0))
+}
+
+// setPrefixes prepends ALL messages in the box with all required prefixes (sid, token, flags), and returns this box;
+// messages for SIDs without a token (including AI, so please handle AI events before) are removed from the box
 func (handler *Handler) setPrefixes(box *MailBox, responseSid Sid, flags byte) *MailBox {
     Assert(box)
     
     for _, sid := range box.GetSids() {
-        if token, ok := handler.tokenManager.GetToken(sid); ok {
-            prefix := pack(sid, token, Ternary(sid == responseSid, flags|1, flags))
+        if token, wide, ok := handler.tokenManager.GetToken(sid); ok {
+            prefix := pack(sid, token, withTokenWidth(Ternary(sid == responseSid, flags|1, flags), wide))
             box.SetPrefix(sid, prefix)
+        } else {
+            box.Remove(sid) // a client cannot parse a message without a token (e.g. a user has signed out)
         }
     }
     return box
 }
 
-// pack converts "sid", "token" and "flags" into a bytearray
-func pack(sid Sid, token uint32, flags byte) []byte {
-    return []byte{HighSid(sid), LowSid(sid), TokenA(token), TokenB(token), TokenC(token), TokenD(token), flags}
+// pack converts "sid", "token" and "flags" into a bytearray; if "flags" contain "flagWideToken", the lowest 4 bytes of
+// the token are appended after the flags
+func pack(sid Sid, token uint64, flags byte) []byte {
+    if flags&flagWideToken != 0 {
+        hi, lo := uint32(token>>32), uint32(token)
+        return []byte{HighSid(sid), LowSid(sid), TokenA(hi), TokenB(hi), TokenC(hi), TokenD(hi), flags, TokenA(lo),
+            TokenB(lo), TokenC(lo), TokenD(lo)}
+    }
+    lo := uint32(token)
+    return []byte{HighSid(sid), LowSid(sid), TokenA(lo), TokenB(lo), TokenC(lo), TokenD(lo), flags}
 }
 
 // packN converts "sid", "token", "flags" and extra arbitrary data ("args") into a bytearray
@@ -1075,12 +1728,69 @@ func pack(sid Sid, token uint32, flags byte) []byte {
 //
 // name := "Tommy"
 // append(packN(sid, token, flags, len(name)+3, byte('a'), byte('a'), byte('a')), name...) // note "len(name)+3"
-func packN(sid Sid, token uint32, flags byte, size int, args ...byte) []byte {
-    res := []byte{HighSid(sid), LowSid(sid), TokenA(token), TokenB(token), TokenC(token), TokenD(token), flags, 
-        byte(size/256), byte(size%256)}
+func packN(sid Sid, token uint64, flags byte, size int, args ...byte) []byte {
+    res := append(pack(sid, token, flags), byte(size/256), byte(size%256))
     return append(res, args...)
 }
 
+// parsePrefix extracts sid, token and flags from a given message; "n" is the length of the prefix (7 bytes for 32-bit
+// tokens and 11 bytes for 64-bit ones). Returns FALSE if the message is too short
+func parsePrefix(array []byte) (sid Sid, token uint64, flags byte, n int, ok bool) {
+    if len(array) < prefixLen {
+        return
+    }
+    sid = Sid(array[0])*256 + Sid(array[1])
+    token = uint64(array[2])<<24 | uint64(array[3])<<16 | uint64(array[4])<<8 | uint64(array[5])
+    flags = array[6]
+    n = prefixLen
+    if flags&flagWideToken != 0 {
+        if len(array) < prefixLen+4 {
+            return
+        }
+        token = token<<32 | uint64(array[7])<<24 | uint64(array[8])<<16 | uint64(array[9])<<8 | uint64(array[10])
+        n += 4
+    }
+    return sid, token, flags, n, true
+}
+
+// splitPublicKey cuts off a client's public key for SwUDP authenticated mode, appended to the arguments of "SIGN UP"
+// and "SIGN IN" commands; returns the arguments without the key, and the key itself (NULL if the arguments are too
+// short)
+// "usrData" - arbitrary user data of the message
+func splitPublicKey(usrData []byte) ([]byte, []byte) {
+    if len(usrData) >= network.AuthPublicKeyLen {
+        n := len(usrData) - network.AuthPublicKeyLen
+        return usrData[:n], usrData[n:]
+    }
+    return usrData, nil
+}
+
+// withTokenWidth returns given "flags" with "flagWideToken" set or cleared according to "wide"
+func withTokenWidth(flags byte, wide bool) byte {
+    if wide {
+        return flags | flagWideToken
+    }
+    return flags &^ flagWideToken
+}
+
+// splitCommands splits a given data into a list of length-prefixed commands (2 bytes for length, then the command).
+// Returns FALSE if the data is inconsistent (e.g. lengths don't match the total size), or contains an empty command
+// "data" - message without a prefix (sid, token, flags)
+func splitCommands(data []byte) (res [][]byte, ok bool) {
+    for i := 0; i < len(data); {
+        if i+2 >= len(data) {
+            return nil, false
+        }
+        size := int(data[i])*256 + int(data[i+1])
+        if size == 0 || i+2+size > len(data) {
+            return nil, false
+        }
+        res = append(res, data[i+2:i+2+size])
+        i += 2 + size
+    }
+    return res, len(res) > 0
+}
+
 // getSignUpErrCode converts SignUp error "err" into a byte code
 func getSignUpErrCode(err *Error) byte {
     Assert(err)
@@ -1096,16 +1806,37 @@ func getSignUpErrCode(err *Error) byte {
     return err.Code
 }
 
-// getLevels returns no more than "count" level names as a string array
+// setBigMaps stores whether a user's client supports levels with a header (negotiated by flagBigMaps)
+// "user" - user who has just signed in
+// "flags" - flags of SignIn/SignUp message
+func setBigMaps(user *user.User, flags byte) {
+    Assert(user)
+    user.Lock()
+    user.BigMaps = flags&flagBigMaps != 0
+    user.Unlock()
+}
+
+// getLevels returns no more than "count" level names as a string array, chosen by a given random generator
 // "reader" - instance of FileReader
 // "count" - count of level names
-func getLevels(reader *filereader.FileReader, count int) (levels []string, err *Error) {
-    Assert(reader)
-
+// "bigMaps" - TRUE if all the participants support levels with a header (see flagBigMaps)
+// "teams" - TRUE to return only levels for team battles (2 vs. 2), FALSE to return only levels for ordinary battles
+func getLevels(reader *filereader.FileReader, rnd *Rand, count int, bigMaps, teams bool) (levels []string,
+    err *Error) {
+    Assert(reader, rnd)
+
+    excepts := []string{"tutorial.level", "training.level"}
+    for _, name := range reader.GetNames() {
+        if level, ok := reader.GetByName(name); ok {
+            if (!bigMaps && battle.HasHeader(level)) || battle.IsTeamLevel(level) != teams {
+                excepts = append(excepts, name)
+            }
+        }
+    }
     levels = make([]string, count)
     for i := 0; i < len(levels); i++ {
         // note: since 1.3.8 we don't take wins count into account and return all [non-tutorial] levels for all users
-        levels[i], err = reader.GetRandomExcept("tutorial.level", "training.level")
+        levels[i], err = reader.GetRandomExcept(rnd, excepts...)
         if err != nil {
             return
         }
@@ -0,0 +1,312 @@
+package main
+
+import "os"
+import "time"
+import "bytes"
+import "testing"
+import "io/ioutil"
+import "path/filepath"
+import "mitrakov.ru/home/winesaps/user"
+import "mitrakov.ru/home/winesaps/battle"
+import "mitrakov.ru/home/winesaps/network"
+import "mitrakov.ru/home/winesaps/checker"
+import "mitrakov.ru/home/winesaps/filereader"
+import . "mitrakov.ru/home/winesaps/sid"   // nolint
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// newTestHandler creates a Handler enough to process the commands that don't require a user to sign in
+func newTestHandler() *Handler {
+    tokenMgr := NewTokenManager(time.Hour)
+    usrMgr := user.NewUserManager(new(TSidManager), tokenMgr, new(checker.SignatureChecker), NewMemDbManager(),
+        new(Packer), nil, "", map[string]uint32{}, map[int]uint32{}, 0)
+    return &Handler{userManager: usrMgr, tokenManager: tokenMgr, server: network.NewServer(nil, nil),
+        minClientVersion: 0x010203, curClientVersion: 0x010400}
+}
+
+// testControllerT is a stub for battle.IController that ignores all the events
+type testControllerT struct{}
+
+func (testControllerT) Event(*MailBox, *Error) {}
+func (testControllerT) RematchExpired(sid1, sid2 Sid) {}
+func (testControllerT) GameOver(winnerSid, loserSid Sid, score1, score2 byte, quickBattle bool,
+    box *MailBox) (uint32, *Error) {
+    return 0, nil
+}
+
+// TestSplitCommands checks splitting of length-prefixed commands
+func TestSplitCommands(t *testing.T) {
+    tests := []struct {
+        data     []byte
+        commands [][]byte
+        ok       bool
+    }{
+        {[]byte{0, 1, 40}, [][]byte{{40}}, true},
+        {[]byte{0, 1, 40, 0, 3, 242, 1, 2}, [][]byte{{40}, {242, 1, 2}}, true},
+        {[]byte{0, 2, 40}, nil, false},          // inconsistent length
+        {[]byte{0, 1, 40, 0}, nil, false},       // incomplete length
+        {[]byte{0, 1, 40, 0, 0, 0}, nil, false}, // zero length
+        {[]byte{0, 1}, nil, false},
+        {[]byte{}, nil, false},
+    }
+    for _, test := range tests {
+        commands, ok := splitCommands(test.data)
+        if ok != test.ok || len(commands) != len(test.commands) {
+            t.Errorf("splitCommands(%v) = %v, %v", test.data, commands, ok)
+            continue
+        }
+        for i := range commands {
+            if !bytes.Equal(commands[i], test.commands[i]) {
+                t.Errorf("splitCommands(%v): command %d is %v, expected %v", test.data, i, commands[i],
+                    test.commands[i])
+            }
+        }
+    }
+}
+
+// TestHandleBatch checks that all the responses to a batch of commands are delivered byte for byte
+func TestHandleBatch(t *testing.T) {
+    handler := newTestHandler()
+    defer handler.userManager.Close()
+
+    version := []byte{byte(getClientVersion), 1, 2, 3, 1, 4, 0}
+    tests := []struct {
+        request  []byte
+        response []byte
+    }{
+        { // single command (legacy)
+            []byte{0, 0, 0, 0, 0, 0, 0, 0, 1, byte(getClientVersion)},
+            append([]byte{0, 0, 0, 0, 0, 0, 1, 0, 7}, version...),
+        },
+        { // several commands
+            []byte{0, 0, 0, 0, 0, 0, 0, 0, 1, byte(getClientVersion), 0, 3, byte(loopback), 0xAA, 0xBB, 0, 1,
+                byte(getClientVersion)},
+            append(append([]byte{0, 0, 0, 0, 0, 0, 1, 0, 7}, version...), append([]byte{0, 3, byte(loopback), 0xAA,
+                0xBB, 0, 7}, version...)...),
+        },
+        { // several commands, the last one is loopback (the prefix must still be marked as a response)
+            []byte{0, 0, 0, 0, 0, 0, 0, 0, 1, byte(getClientVersion), 0, 2, byte(loopback), 0xCC},
+            append(append([]byte{0, 0, 0, 0, 0, 0, 1, 0, 7}, version...), 0, 2, byte(loopback), 0xCC),
+        },
+    }
+    for _, test := range tests {
+        sid, response := handler.Handle(test.request, true)
+        if sid != 0 || !bytes.Equal(response, test.response) {
+            t.Errorf("Handle(%v) = %v, expected %v", test.request, response, test.response)
+        }
+    }
+}
+
+// TestHandleBatchLimit checks that too many commands in a single message are rejected
+func TestHandleBatchLimit(t *testing.T) {
+    handler := newTestHandler()
+    defer handler.userManager.Close()
+
+    request := []byte{0, 0, 0, 0, 0, 0, 0}
+    for i := 0; i <= maxCommands; i++ {
+        request = append(request, 0, 1, byte(getClientVersion))
+    }
+    expected := []byte{0, 0, 0, 0, 0, 0, 1, 0, 2, byte(getClientVersion), errIncorrectLen}
+    if _, response := handler.Handle(request, true); !bytes.Equal(response, expected) {
+        t.Errorf("Handle() = %v, expected %v", response, expected)
+    }
+}
+
+// TestHandleBatchSignIn checks that the commands following SIGN IN in the same message use the new SID and token
+func TestHandleBatchSignIn(t *testing.T) {
+    handler := newTestHandler()
+    defer handler.userManager.Close()
+
+    password := "0123456789abcdef0123456789abcdef"
+    signUpArgs := []byte("Tommy\x00" + password + "\x00agent\x00tommy@example.com\x00")
+    request := append([]byte{0, 0, 0, 0, 0, 0, 0, 0, byte(len(signUpArgs) + 1), byte(signUp)}, signUpArgs...)
+    if sid, response := handler.Handle(request, true); sid == 0 {
+        t.Fatalf("Cannot sign up: %v", response)
+    }
+
+    signInArgs := []byte("\x01Tommy\x00" + password + "\x00agent")
+    request = append([]byte{0, 0, 0, 0, 0, 0, 0, 0, byte(len(signInArgs) + 1), byte(signIn)}, signInArgs...)
+    request = append(request, 0, 1, byte(userInfo))
+    sid, response := handler.Handle(request, true)
+    respSid, respToken, respFlags, n, ok := parsePrefix(response)
+    if sid == 0 || !ok || respSid != sid || respFlags != 1 || !handler.tokenManager.CheckToken(sid, respToken) {
+        t.Fatalf("Handle() = %d, %v; expected a new SID and token in the prefix", sid, response)
+    }
+    responses, ok := splitCommands(response[n:])
+    if !ok || len(responses) != 2 || !bytes.Equal(responses[0], []byte{byte(signIn), noErr}) {
+        t.Fatalf("Unexpected responses %v", responses)
+    }
+    if len(responses[1]) < 2 || responses[1][0] != byte(userInfo) || responses[1][1] != noErr {
+        t.Errorf("USER INFO is handled with a stale SID or token: %v", responses[1])
+    }
+}
+
+// TestSignInAuth checks that a client's public key is cut off the SIGN IN arguments, and the server's public key (never
+// the secret key) is returned only if the transport supports authenticated mode
+func TestSignInAuth(t *testing.T) {
+    handler := newTestHandler()
+    defer handler.userManager.Close()
+
+    password := "0123456789abcdef0123456789abcdef"
+    signUpArgs := []byte("Alice\x00" + password + "\x00agent\x00alice@example.com\x00")
+    request := append([]byte{0, 0, 0, 0, 0, 0, 0, 0, byte(len(signUpArgs) + 1), byte(signUp)}, signUpArgs...)
+    if sid, response := handler.Handle(request, true); sid == 0 {
+        t.Fatalf("Cannot sign up: %v", response)
+    }
+
+    peerKey := bytes.Repeat([]byte{9}, network.AuthPublicKeyLen)
+    peerKey[5] = 0 // SIGN IN fails if the key is not cut off, because the arguments are separated by zeros
+    signInArgs := append([]byte("\x01Alice\x00"+password+"\x00agent"), peerKey...)
+    for _, authSupported := range []bool{true, false} {
+        request = append([]byte{0, 0, 0, 0, 0, 0, flagAuth, 0, byte(len(signInArgs) + 1), byte(signIn)}, signInArgs...)
+        sid, response := handler.Handle(request, authSupported)
+        _, _, flags, n, ok := parsePrefix(response)
+        if sid == 0 || !ok || len(response) < n+4 || response[n+3] != noErr {
+            t.Fatalf("Handle(%v) = %d, %v", authSupported, sid, response)
+        }
+        expectedLen := 4
+        if authSupported {
+            expectedLen += network.AuthPublicKeyLen
+        }
+        if (flags&flagAuth != 0) != authSupported || len(response) != n+expectedLen {
+            t.Errorf("Handle(%v): unexpected response %v", authSupported, response)
+        }
+    }
+}
+
+// TestWatchBattle checks that a spectator joining in the middle of a round gets the current positions of the objects
+// (in RESTORE STATE format) rather than only the initial layout of the level, and the time left till the end of the round
+func TestWatchBattle(t *testing.T) {
+    reader, err := filereader.NewFileReader("levels", "level", levelBufSiz, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    clock := NewVirtualClock(time.Now())
+    batMgr := battle.NewBattleManager(reader, new(Packer), new(testControllerT), "", 0, clock)
+    defer batMgr.Close()
+
+    mode := battle.GetGameModes()[battle.ClassicModeName]
+    levels := []string{"small_village.level", "small_village.level", "small_village.level"}
+    if _, err = batMgr.Accept(1, 2, battle.Rabbit, battle.Cat, []byte{}, []byte{}, levels, mode, true, false, 1);
+        err != nil {
+        t.Fatal(err)
+    }
+    const moveLeft, moveRight = 1, 4
+    for _, direction := range []byte{moveRight, moveRight, moveRight, moveLeft} {
+        if _, err = batMgr.Move(1, direction); err != nil {
+            t.Fatal(err)
+        }
+    }
+    xy, err := batMgr.GetActorXy(1, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    box, err := batMgr.Watch(3, 1, false)
+    msgs := box.Pick(3)
+    if err != nil || len(msgs) != 4 {
+        t.Fatalf("Watch() = %v, %v", msgs, err)
+    }
+    if msgs[0][0] != byte(roundInfo) || msgs[0][2] == 0 {
+        t.Errorf("Incorrect ROUND INFO: %v", msgs[0])
+    }
+    if msgs[1][0] != byte(fullState) || msgs[3][0] != byte(scoreChanged) {
+        t.Errorf("Incorrect FULL STATE or SCORE CHANGED: %v, %v", msgs[1], msgs[3])
+    }
+    restore := msgs[2]
+    if len(restore) < 2 || restore[0] != byte(restoreState) || restore[1] != noErr || (len(restore)-2)%3 != 0 {
+        t.Fatalf("Incorrect RESTORE STATE: %v", restore)
+    }
+    found := false
+    for i := 2; i < len(restore); i += 3 { // number, ID, xy
+        if restore[i+1] == 0x04 { // Actor1
+            found = uint16(restore[i+2]) == xy
+        }
+    }
+    if !found {
+        t.Errorf("RESTORE STATE %v has no current position of Actor1 (%d)", restore, xy)
+    }
+
+    // a spectator joining 3 seconds later must get the time left, not the full round time
+    start := clock.Now()
+    for clock.Now().Sub(start) < 3*time.Second && clock.Step() {
+    }
+    box, err = batMgr.Watch(4, 1, false)
+    later := box.Pick(4)
+    if err != nil || len(later) != 4 || later[0][1] != msgs[0][1] || later[0][2] != msgs[0][2]-3 {
+        t.Errorf("Watch() = %v, %v; expected %d seconds left", later, err, msgs[0][2]-3)
+    }
+}
+
+// TestLevelsWithHeader checks that the levels with a header are neither chosen for nor served to the clients that
+// don't support big maps, and that team levels are not served by "RECEIVE LEVEL"
+func TestLevelsWithHeader(t *testing.T) {
+    dir, er := ioutil.TempDir("", "levels")
+    if er != nil {
+        t.Fatal(er)
+    }
+    defer os.RemoveAll(dir)
+    plain, er := ioutil.ReadFile(filepath.Join("levels", "small_village.level"))
+    if er != nil {
+        t.Fatal(er)
+    }
+    team := append([]byte{}, plain...)
+    team[bytes.IndexByte(team, 0x40)] = 0x40 | 0x18 // Actor3
+    levels := map[string][]byte{"plain.level": plain, "team.level": team,
+        "header.level": append([]byte{0xFF, 2, battle.Width, battle.Height}, plain...)} // the same size as legacy ones
+    for name, level := range levels {
+        if er = ioutil.WriteFile(filepath.Join(dir, name), level, 0644); er != nil {
+            t.Fatal(er)
+        }
+    }
+    reader, err := filereader.NewFileReader(dir, "level", levelBufSiz, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, bigMaps := range []bool{false, true} {
+        names, err := getLevels(reader, NewRand(1), 20, bigMaps, false)
+        if err != nil {
+            t.Fatal(err)
+        }
+        found := map[string]bool{}
+        for _, name := range names {
+            found[name] = true
+        }
+        if !found["plain.level"] || found["team.level"] || found["header.level"] != bigMaps {
+            t.Errorf("getLevels(bigMaps = %v) = %v", bigMaps, names)
+        }
+    }
+
+    handler := newTestHandler()
+    defer handler.userManager.Close()
+    handler.reader = reader
+    handler.battleManager = battle.NewBattleManager(reader, new(Packer), new(testControllerT), "", 0, new(RealClock))
+    defer handler.battleManager.Close()
+    handler.fakeSidStore = NewFakeSidStore(new(TSidManager))
+    handler.trainingMode = battle.GetGameModes()[battle.TrainingModeName]
+
+    tests := []struct {
+        level    string
+        bigMaps  bool
+        rejected bool
+    }{
+        {"team.level", true, true},
+        {"header.level", false, true},
+        {"header.level", true, false},
+        {"plain.level", false, false},
+    }
+    for i, test := range tests {
+        usr := &user.User{Sid: Sid(i + 1), Character: battle.Rabbit, BigMaps: test.bigMaps}
+        response := handler.receiveLevel(usr, 0, 0, receiveLevel, []byte(test.level))
+        if rejected := response != nil; rejected != test.rejected {
+            t.Errorf("receiveLevel(%s, bigMaps = %v) = %v", test.level, test.bigMaps, response)
+        }
+    }
+
+    // only the spectators supporting big maps may watch a battle on the level with a header (Sid 3)
+    for _, bigMaps := range []bool{false, true} {
+        if _, err = handler.battleManager.Watch(10, 3, bigMaps); (err == nil) != bigMaps {
+            t.Errorf("Watch(bigMaps = %v) = %v", bigMaps, err)
+        }
+    }
+}
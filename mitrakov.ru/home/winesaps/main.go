@@ -3,22 +3,30 @@
 // See notes below for more details.
 package main
 
+import "os"
 import "log"
 import "fmt"
+import "time"
+import "syscall"
+import "os/signal"
 import "strconv"
+import "strings"
 import "net/http"
 import _ "net/http/pprof"
 import "github.com/vaughan0/go-ini"
 import "mitrakov.ru/home/winesaps/sid"
+import "mitrakov.ru/home/winesaps/ai"
 import "mitrakov.ru/home/winesaps/user"
 import "mitrakov.ru/home/winesaps/battle"
 import "mitrakov.ru/home/winesaps/network"
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 import "mitrakov.ru/home/winesaps/checker"
 import "mitrakov.ru/home/winesaps/filereader"
+import "mitrakov.ru/home/winesaps/validator"
 
-// Buffer size (in bytes) for reading level files; the most files are 258 bytes long, but they might be larger
-const levelBufSiz = 512
+// Buffer size (in bytes) for reading level files; the most files are 258 bytes long, but they might be larger (since
+// 1.4.0 a level may declare its dimensions up to 255x255)
+const levelBufSiz = 128 * 1024
 
 // Entry Point
 // nolint: gocyclo
@@ -29,7 +37,7 @@ func main() {
 
     go http.ListenAndServe(":8080", nil)
     log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-    log.Println("Winesaps server v1.3.11 (2018-09-29)")
+    log.Println("Winesaps server v1.4.0 (2026-10-16)")
     
     // ==========================================================================
     // READING INI-FILE
@@ -38,10 +46,18 @@ func main() {
     // scan INI-file (GENERAL)
     file, err := ini.LoadFile("settings.ini")
     Check(err)
-    pwd, ok := file.Get("GENERAL", "db.pwd")
+    dbBackend, ok := file.Get("GENERAL", "db.backend")
     if !ok {
+        dbBackend = "mysql" // for backward compatibility
+    }
+    pwd, ok := file.Get("GENERAL", "db.pwd")
+    if !ok && dbBackend == "mysql" {
         panic("Cannot find db password")
     }
+    dbPath, ok := file.Get("GENERAL", "db.path")
+    if !ok {
+        dbPath = "winesaps.db"
+    }
     localArg, ok := file.Get("GENERAL", "local.parameter")
     if !ok {
         panic("Cannot find db local parameter")
@@ -72,6 +88,45 @@ func main() {
     _, err = fmt.Sscanf(curVersionStr, "%d.%d.%d", &curVersionH, &curVersionM, &curVersionL)
     Check(err)
     curClientVersion := (uint(curVersionH) << 16) | (uint(curVersionM) << 8) | (uint(curVersionL))
+    shutdownTimeout := 60 * time.Second // max time to wait for battles to finish on SIGTERM/SIGINT
+    if str, ok := file.Get("GENERAL", "shutdown.timeout.sec"); ok {
+        sec, er := strconv.ParseUint(str, 10, 0)
+        Check(er)
+        shutdownTimeout = time.Duration(sec) * time.Second
+    }
+    tokenTTL := 24 * time.Hour // session token lifetime; after that a user has to sign in again
+    if str, ok := file.Get("GENERAL", "token.ttl.hours"); ok {
+        hours, er := strconv.ParseUint(str, 10, 0)
+        Check(er)
+        tokenTTL = time.Duration(hours) * time.Hour
+    }
+    disconnectGrace := 30 * time.Second // time a disconnected user has to come back to a battle (0 means "no pauses")
+    if str, ok := file.Get("GENERAL", "disconnect.grace.sec"); ok {
+        sec, er := strconv.ParseUint(str, 10, 0)
+        Check(er)
+        disconnectGrace = time.Duration(sec) * time.Second
+    }
+    replayDir, ok := file.Get("GENERAL", "replay.dir") // directory for battle replays ("" means "disabled")
+    if !ok {
+        replayDir = "replays"
+    }
+    bindAddr, _ := file.Get("GENERAL", "bind.address") // optional: "" means all interfaces, both IPv4 and IPv6
+    portMap := map[string]uint64{"ws.port": 0, "tcp.port": 0} // WebSocket and TCP are optional (0 means "disabled")
+    for name := range portMap {
+        if str, ok := file.Get("GENERAL", name); ok {
+            port, er := strconv.ParseUint(str, 10, 16)
+            Check(er)
+            portMap[name] = port
+        }
+    }
+    wsOrigins := []string{} // allowed origins of web pages (empty list means "same host only")
+    if str, ok := file.Get("GENERAL", "ws.origins"); ok {
+        for _, origin := range strings.Split(str, ",") {
+            if origin = strings.TrimSpace(origin); origin != "" {
+                wsOrigins = append(wsOrigins, origin)
+            }
+        }
+    }
     
     // scan INI-file (SKU)
     skuMap := make(map[string]uint32)
@@ -104,19 +159,90 @@ func main() {
         rewardMap[i] = uint32(gems)
     }
     
+    // scan INI-file (FLOOD); all the keys are optional
+    floodMap := map[string]uint64{"max.samples": 600, "max.conn.samples": 300, "max.sid.samples": 300,
+        "interval.sec": 10, "ban.min": 60, "ipv6.prefix": 64}
+    for name := range floodMap {
+        if str, ok := file.Get("FLOOD", name); ok {
+            value, er := strconv.ParseUint(str, 10, 0)
+            Check(er)
+            floodMap[name] = value
+        }
+    }
+    banFile, ok := file.Get("FLOOD", "ban.file")
+    if !ok {
+        banFile = "banned.json"
+    }
+
+    // scan INI-file (ANTICHEAT); all the keys are optional
+    cheatMap := map[string]uint64{"moves.per.sec": 8, "moves.burst": 5, "min.interval.ms": 20, "threshold": 30}
+    for name := range cheatMap {
+        if str, ok := file.Get("ANTICHEAT", name); ok {
+            value, er := strconv.ParseUint(str, 10, 0)
+            Check(er)
+            cheatMap[name] = value
+        }
+    }
+    cheatPolicyStr, ok := file.Get("ANTICHEAT", "policy")
+    if !ok {
+        cheatPolicyStr = "log"
+    }
+    cheatPolicy, ok := parseCheatPolicy(cheatPolicyStr)
+    if !ok {
+        panic("Unknown anti-cheat policy (possible values: log, flag, forfeit)")
+    }
+    flagFile, ok := file.Get("ANTICHEAT", "flag.file")
+    if !ok {
+        flagFile = "flagged.json"
+    }
+
+    // scan INI-file (MODE.*): every section "MODE.<name>" defines a game mode or overrides a predefined one (Classic,
+    // Training, Blitz, Marathon); missing keys are taken from "Classic" mode
+    gameModes := battle.GetGameModes()
+    for name, section := range file {
+        if strings.HasPrefix(name, "MODE.") {
+            mode, er := battle.ParseGameMode(strings.TrimPrefix(name, "MODE."), section,
+                gameModes[battle.ClassicModeName])
+            if er != nil {
+                panic(er)
+            }
+            gameModes[mode.Name] = mode
+        }
+    }
+    gameModeName, ok := file.Get("GENERAL", "game.mode")
+    if !ok {
+        gameModeName = battle.ClassicModeName
+    }
+    gameMode, ok := gameModes[gameModeName]
+    if !ok {
+        panic("Cannot find game mode " + gameModeName)
+    }
+    trainingMode := gameModes[battle.TrainingModeName]
+    log.Printf("Game mode: %+v", *gameMode)
+    
     // ==========================================================================
     // DEPENDENCY INJECTION (TODO: think of external tools)
     // ==========================================================================
 
     // DbManager
-    dbManager, err := NewDbManager("tommy", pwd)
+    var dbManager user.IDbManager
+    switch dbBackend {
+    case "mysql":
+        dbManager, err = NewDbManager("tommy", pwd)
+    case "sqlite":
+        dbManager, err = NewSqliteDbManager(dbPath)
+    case "memory":
+        dbManager = NewMemDbManager()
+    default:
+        panic("Unknown db backend (possible values: mysql, sqlite, memory)")
+    }
     Check(err)
 
     // SidManager
     sidManager := new(sid.TSidManager)
 
     // TokenManager
-    tokenManager := sid.NewTokenManager()
+    tokenManager := sid.NewTokenManager(tokenTTL)
     
     // Signature Checker
     publicKey = fmt.Sprintf("-----BEGIN PUBLIC KEY-----\n%s\n-----END PUBLIC KEY-----", publicKey)
@@ -127,68 +253,119 @@ func main() {
     fakeSidStore := NewFakeSidStore(sidManager)
 
     // FileReader
-    reader, err := filereader.NewFileReader("levels", "level", levelBufSiz)
+    reader, err := filereader.NewFileReader("levels", "level", levelBufSiz, validator.Filter)
+    Check(err)
+
+    // Flood Detector
+    floodDetector, err := network.NewSimpleDetector(uint(floodMap["max.samples"]), uint(floodMap["max.conn.samples"]),
+        uint(floodMap["max.sid.samples"]), time.Duration(floodMap["interval.sec"])*time.Second,
+        time.Duration(floodMap["ban.min"])*time.Minute, banFile, uint(floodMap["ipv6.prefix"]))
     Check(err)
 
     // Server
     server := network.NewServer(nil, nil)
 
+    // AntiCheat
+    antiCheat, err := NewAntiCheat(float64(cheatMap["moves.per.sec"]), float64(cheatMap["moves.burst"]),
+        time.Duration(cheatMap["min.interval.ms"])*time.Millisecond, uint(cheatMap["threshold"]), cheatPolicy, flagFile)
+    Check(err)
+
     // Packer
     packer := new(Packer)
 
     // UserManager
-    usrManager := user.NewUserManager(sidManager, checker, dbManager, packer, nil, localArg, skuMap, rewardMap, reward)
+    usrManager := user.NewUserManager(sidManager, tokenManager, checker, dbManager, packer, nil, localArg, skuMap, rewardMap, reward)
 
     // BattleManager
-    battleManager := battle.NewBattleManager(reader, packer, nil)
+    battleManager := battle.NewBattleManager(reader, packer, nil, replayDir, disconnectGrace, new(RealClock))
     
     // Ai
-    aiManager := NewAiManager(nil, battleManager)
+    aiManager := ai.NewAiManager(nil, battleManager, new(RealClock))
     
     // Controller
-    controller := NewController(usrManager, battleManager, server, reader, tokenManager, aiManager, fakeSidStore)
+    controller := NewController(usrManager, battleManager, server, reader, tokenManager, aiManager, fakeSidStore,
+        gameMode)
 
-    // Waiting Room
-    room := NewWaitingRoom(controller)
+    // Matchmaker
+    matchmaker := NewMatchmaker(controller)
+
+    // Team Room
+    teamRoom := NewTeamRoom(controller)
     
     // Statistics
     statistics := NewStatistics(uint32(statToken), sidManager, usrManager, battleManager, server, nil, fakeSidStore, 
-        room)
+        matchmaker)
 
     // Handler
-    handler := newHandler(usrManager, battleManager, server, reader, tokenManager, aiManager, fakeSidStore, room,
-        statistics, minClientVersion, curClientVersion)
+    handler := newHandler(usrManager, battleManager, server, reader, tokenManager, aiManager, fakeSidStore,
+        matchmaker, teamRoom, antiCheat, statistics, gameMode, trainingMode, minClientVersion, curClientVersion)
 
     // add cross references
     server.SetSidHandler(handler)
+    server.SetFloodDetector(floodDetector)
     usrManager.SetController(controller)
     battleManager.SetController(controller)
-    aiManager.setController(controller)
+    aiManager.SetController(controller)
 
     // ==========================================================================
     // STARTING SERVER
     // ==========================================================================
 
-    socket, err := server.Connect(33996)
+    socket, err := server.Connect(bindAddr, 33996)
     Check(err)
     protocol := network.NewSwUDP(socket, server)
     server.SetProtocol(protocol)
     statistics.setProtocol(protocol)
-    server.Start()
+    var wsProtocol, tcpProtocol network.IProtocol
+    if portMap["ws.port"] > 0 {
+        ws := network.NewWsProtocol(server, floodDetector, wsOrigins)
+        err = ws.Listen(bindAddr, uint16(portMap["ws.port"]))
+        Check(err)
+        wsProtocol = ws
+        server.AddProtocol(wsProtocol)
+    }
+    if portMap["tcp.port"] > 0 {
+        tcp := network.NewTCPProtocol(server, floodDetector)
+        err = tcp.Listen(bindAddr, uint16(portMap["tcp.port"]))
+        Check(err)
+        tcpProtocol = tcp
+        server.AddProtocol(tcpProtocol)
+    }
+    statistics.setTransports(wsProtocol, tcpProtocol)
+    go server.Start()
 
     // ==========================================================================
     // SHUTTING DOWN SERVER
     // ==========================================================================
 
-    aiManager.close()
-    room.close()
+    // wait for SIGTERM/SIGINT (e.g. on rolling deploy), then drain the battles, and only after that close everything
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+    log.Println("Signal received:", <-signals)
+    handler.stopServer()
+    controller.waitForBattles(shutdownTimeout)
+    controller.notifyAll([]byte{byte(unspecError), errServerGonnaStop})
+    time.Sleep(time.Second) // give the protocols a chance to deliver the notification
+
+    aiManager.Close()
+    matchmaker.close()
+    teamRoom.close()
+    antiCheat.close()
     usrManager.Close()
+    tokenManager.Close()
     battleManager.Close()
     protocol.Close()
+    if wsProtocol != nil {
+        wsProtocol.Close()
+    }
+    if tcpProtocol != nil {
+        tcpProtocol.Close()
+    }
     err = server.Close()
     Check(err)
     err = dbManager.Close()
     Check(err)
+    log.Println("Server shut down")
 }
 
 //
@@ -0,0 +1,246 @@
+package main
+
+import "sort"
+import "sync"
+import "time"
+import "sync/atomic"
+import "mitrakov.ru/home/winesaps/user"
+import . "mitrakov.ru/home/winesaps/sid"   // nolint
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// Matchmaker is a queue of users awaiting for a quick battle (since 1.4.0 it replaces single-slot WaitingRoom). Users
+// are paired by rating: at first the allowed rating difference is narrow ("ratingBand"), and it's getting wider the
+// longer a user waits. Users don't get the same opponent as in the previous battle (unless they both have waited for
+// a half of "maxWait"). If no opponent is found in "maxWait" seconds, an AI of matching strength is spawned.
+// This component is "dependent"
+type Matchmaker struct {
+    sync.Mutex
+    controller *Controller
+    queue      []*ticketT // in order of arrival
+    waits      []time.Duration // wait times of the last matched users (ring buffer, see "waitsMax")
+    waitsIdx   int
+    stop       chan bool
+    aiSpawned  uint32
+}
+
+// ticketT is a single user awaiting in the queue
+type ticketT struct {
+    sid       Sid
+    userID    uint64
+    lastEnemy uint64
+    rating    int
+    since     time.Time
+}
+
+// max wait time, in seconds (on time out an AI will be spawned)
+const maxWait = 15
+// allowed difference of ratings to pair users who have just joined the queue
+const ratingBand = 100
+// the allowed difference grows by this value every second of waiting
+const ratingBandStep = 25
+// rating of a newbie (see getRating())
+const ratingBase = user.DefaultSkillRating
+// count of the last wait times to calculate percentiles
+const waitsMax = 1000
+
+// NewMatchmaker creates a new Matchmaker. Please do not create a Matchmaker directly
+// "controller" - instance of Controller (non-NULL)
+func NewMatchmaker(controller *Controller) *Matchmaker {
+    Assert(controller)
+
+    mm := &Matchmaker{controller: controller, waits: make([]time.Duration, 0, waitsMax)}
+    mm.stop = RunDaemon("matchmaker", time.Second, mm.tick)
+    return mm
+}
+
+// getRating returns the rating of a given user to be used by Matchmaker (skill rating)
+func getRating(usr *user.User) int {
+    Assert(usr)
+    return int(usr.GetSkillRating())
+}
+
+// getPendingOrWait returns a suitable opponent for a battle, if it is awaiting in the queue (the opponent is removed
+// from the queue then), or puts a given user to the queue
+// "usr" - user
+func (mm *Matchmaker) getPendingOrWait(usr *user.User) (Sid, bool) {
+    Assert(usr)
+    mm.Lock()
+    defer mm.Unlock()
+
+    mm.remove(usr.Sid) // a user may have only 1 ticket
+    now := time.Now()
+    ticket := &ticketT{usr.Sid, usr.ID, usr.LastEnemy, getRating(usr), now}
+    best, bestDiff := -1, 0
+    for i, t := range mm.queue { // choose the closest rating
+        if diff := abs(t.rating - ticket.rating); suitable(ticket, t, now) && (best < 0 || diff < bestDiff) {
+            best, bestDiff = i, diff
+        }
+    }
+    if best >= 0 {
+        enemy := mm.queue[best]
+        mm.queue = append(mm.queue[:best], mm.queue[best+1:]...)
+        mm.addWait(now.Sub(enemy.since))
+        mm.addWait(0)
+        return enemy.sid, true
+    }
+    mm.queue = append(mm.queue, ticket)
+    return 0, false
+}
+
+// cancel removes a user from the queue, so that no battle will be started for that user; returns FALSE if the user
+// has not been found in the queue
+// "sid" - user's Session ID
+func (mm *Matchmaker) cancel(sid Sid) bool {
+    mm.Lock()
+    defer mm.Unlock()
+    return mm.remove(sid)
+}
+
+// cancelAll removes all the users from the queue (e.g. on server shutdown)
+func (mm *Matchmaker) cancelAll() {
+    mm.Lock()
+    defer mm.Unlock()
+    mm.queue = nil
+}
+
+// getSpawnedAiCount returns current count of spawned AIs
+func (mm *Matchmaker) getSpawnedAiCount() uint32 {
+    return atomic.LoadUint32(&mm.aiSpawned)
+}
+
+// getPendingCount returns current count of users awaiting in the queue
+func (mm *Matchmaker) getPendingCount() int {
+    mm.Lock()
+    defer mm.Unlock()
+    return len(mm.queue)
+}
+
+// getWaitPercentiles returns 50-th, 90-th and 99-th percentiles of wait time of the last matched users (including
+// the ones that got an AI)
+func (mm *Matchmaker) getWaitPercentiles() (p50, p90, p99 time.Duration) {
+    mm.Lock()
+    waits := make([]time.Duration, len(mm.waits))
+    copy(waits, mm.waits)
+    mm.Unlock()
+
+    if len(waits) > 0 {
+        sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+        n := len(waits) - 1
+        p50, p90, p99 = waits[n*50/100], waits[n*90/100], waits[n*99/100]
+    }
+    return
+}
+
+// close shuts Matchmaker down and releases all seized resources
+func (mm *Matchmaker) close() {
+    Assert(mm.stop)
+    mm.stop <- true
+}
+
+// tick pairs the users in the queue (as their rating bands get wider), and spawns AIs for the users who have waited
+// for too long; it is called every second
+func (mm *Matchmaker) tick() {
+    Assert(mm.controller)
+
+    var pairs [][2]Sid
+    var expired []*ticketT
+    now := time.Now()
+    mm.Lock()
+    queue := mm.queue[:0]
+    matched := make(map[*ticketT]bool)
+    for i, t1 := range mm.queue {
+        if matched[t1] {
+            continue
+        }
+        for _, t2 := range mm.queue[i+1:] {
+            if !matched[t2] && suitable(t1, t2, now) {
+                matched[t1], matched[t2] = true, true
+                pairs = append(pairs, [2]Sid{t1.sid, t2.sid}) // the one who waits longer is the Aggressor
+                mm.addWait(now.Sub(t1.since))
+                mm.addWait(now.Sub(t2.since))
+                break
+            }
+        }
+        if !matched[t1] {
+            if now.Sub(t1.since) >= maxWait*time.Second {
+                expired = append(expired, t1)
+                mm.addWait(now.Sub(t1.since))
+            } else {
+                queue = append(queue, t1)
+            }
+        }
+    }
+    mm.queue = queue
+    mm.Unlock()
+
+    for _, pair := range pairs {
+        mm.controller.quickBattle(pair[0], pair[1])
+    }
+    for _, t := range expired {
+        mm.controller.attackAi(t.sid, getAiStrength(t.rating))
+        atomic.AddUint32(&mm.aiSpawned, 1)
+    }
+}
+
+// remove removes a user from the queue and returns FALSE if the user has not been found; please call this method only
+// under the lock
+// "sid" - user's Session ID
+func (mm *Matchmaker) remove(sid Sid) (found bool) {
+    queue := mm.queue[:0]
+    for _, t := range mm.queue {
+        if t.sid == sid {
+            found = true
+        } else {
+            queue = append(queue, t)
+        }
+    }
+    mm.queue = queue
+    return
+}
+
+// addWait stores wait time of a matched user to calculate percentiles; please call this method only under the lock
+func (mm *Matchmaker) addWait(wait time.Duration) {
+    if len(mm.waits) < waitsMax {
+        mm.waits = append(mm.waits, wait)
+    } else {
+        mm.waits[mm.waitsIdx] = wait
+    }
+    mm.waitsIdx = (mm.waitsIdx + 1) % waitsMax
+}
+
+// suitable checks whether 2 given users can be paired at the moment: their ratings must be within the widest rating
+// band of them, and they must not have played with each other in the previous battle (unless they both have waited
+// for too long)
+func suitable(t1, t2 *ticketT, now time.Time) bool {
+    if t1.sid == t2.sid {
+        return false
+    }
+    wait1, wait2 := now.Sub(t1.since), now.Sub(t2.since)
+    if t1.lastEnemy == t2.userID || t2.lastEnemy == t1.userID {
+        if wait1 < maxWait*time.Second/2 || wait2 < maxWait*time.Second/2 {
+            return false
+        }
+    }
+    band := ratingBand + ratingBandStep*int(Max(uint(wait1/time.Second), uint(wait2/time.Second)))
+    return abs(t1.rating-t2.rating) <= band
+}
+
+// getAiStrength converts a rating of a user into the strength of an AI opponent (0-100, where 50 is a standard AI)
+func getAiStrength(rating int) byte {
+    strength := 50 * rating / ratingBase
+    if strength < 0 {
+        return 0
+    }
+    if strength > 100 {
+        return 100
+    }
+    return byte(strength)
+}
+
+// abs returns absolute value of a given integer
+func abs(x int) int {
+    if x < 0 {
+        return -x
+    }
+    return x
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+import "mitrakov.ru/home/winesaps/user"
+import . "mitrakov.ru/home/winesaps/sid" // nolint
+
+// TestMatchmakerPairing checks that users who have just joined the queue are paired by the closest rating within
+// "ratingBand", and that the previous opponents are not paired again
+func TestMatchmakerPairing(t *testing.T) {
+    mm := &Matchmaker{} // no daemon: tick() is not called
+
+    tests := []struct {
+        sid       Sid
+        id        uint64
+        lastEnemy uint64
+        rating    uint32
+        enemy     Sid // 0 if the user must be put to the queue
+    }{
+        {1, 101, 0, 1000, 0},
+        {2, 102, 0, 1500, 0},    // too far from #1
+        {3, 103, 0, 1090, 1},    // within the band
+        {4, 104, 105, 1450, 2},  // #2 is closer than #5 would be
+        {5, 105, 0, 1400, 0},
+        {6, 106, 105, 1400, 0},  // #5 was the previous opponent
+        {7, 107, 0, 1420, 5},    // #5 arrived before #6 and has the same rating difference
+        {8, 108, 0, 1390, 6},
+        {1, 101, 0, 1000, 0},    // the same user again
+        {9, 109, 0, 1000, 1},
+    }
+    for i, test := range tests {
+        usr := &user.User{Sid: test.sid, ID: test.id, LastEnemy: test.lastEnemy, SkillRating: test.rating}
+        enemy, ok := mm.getPendingOrWait(usr)
+        if enemy != test.enemy || ok != (test.enemy != 0) {
+            t.Errorf("%d: getPendingOrWait(%d) = %d, %v; expected %d", i, test.sid, enemy, ok, test.enemy)
+        }
+    }
+    if mm.getPendingCount() != 0 {
+        t.Errorf("Expected empty queue, got %d tickets", mm.getPendingCount())
+    }
+
+    // cancelled users are not paired
+    mm.getPendingOrWait(&user.User{Sid: 10, ID: 110, SkillRating: 1000})
+    if !mm.cancel(10) || mm.cancel(10) {
+        t.Errorf("cancel() must remove a user exactly once")
+    }
+    if enemy, ok := mm.getPendingOrWait(&user.User{Sid: 11, ID: 111, SkillRating: 1000}); ok {
+        t.Errorf("Cancelled user %d is paired", enemy)
+    }
+}
@@ -0,0 +1,735 @@
+// Copyright 2017-2018 Artem Mitrakov. All rights reserved.
+package main
+
+import "sort"
+import "sync"
+import "time"
+import "regexp"
+import "strings"
+import "database/sql"
+import "mitrakov.ru/home/winesaps/user"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// abilityT is a single record of the ability price list (see "ability" table in docs/db.sql)
+type abilityT struct {
+    id   byte
+    days byte
+    gems byte
+}
+
+// memRatingKeyT is a unique key of a rating record (see "position" key of "rating" table in docs/db.sql)
+type memRatingKeyT struct {
+    userID     uint64
+    ratingType byte
+}
+
+// memRatingT is a single rating record
+type memRatingT struct {
+    ratingID  uint64
+    userID    uint64
+    wins      uint32
+    losses    uint32
+    scoreDiff int
+}
+
+// memPromocodeT is a single record of promocode activation
+type memPromocodeT struct {
+    userID    uint64
+    inviterID uint64
+    used      bool
+}
+
+// memPaymentT is a single record of a payment transaction
+type memPaymentT struct {
+    userID  uint64
+    sku     string
+    stamp   time.Time
+    data    string
+    state   uint8
+    checked bool
+    gems    uint32
+}
+
+// MemDbManager is an implementation of user.IDbManager that keeps all the data in memory. It reproduces the
+// constraints, triggers and stored procedures of docs/db.sql, so it can be used instead of DbManager for development
+// and testing purposes. Please note that all the data get lost on restart!
+// This component is independent.
+type MemDbManager struct /*implements user.IDbManager*/ {
+    sync.RWMutex
+    lastUserID  uint64
+    lastRatID   uint64
+    users       map[uint64]*user.User
+    userIDs     []uint64                 // in order of insertion (like primary key order in MySQL)
+    names       map[string]uint64        // lowercase name -> userID (MySQL utf8 collation is case-insensitive)
+    abilities   map[uint64]map[byte]time.Time
+    ratings     map[memRatingKeyT]*memRatingT
+    friends     map[uint64][]uint64
+    promocodes  []*memPromocodeT
+    payments    map[string]*memPaymentT
+}
+
+// @mitrakov (2017-04-18): don't use ALL_CAPS const naming (gometalinter, stackoverflow.com/questions/22688906)
+
+// default trust points for a new user (see "trust_points" column of "user" table)
+const defaultTrustPoints = 20
+// default character (Rabbit) for a new user
+const defaultCharacter = 1
+// max value of "character" enum (Rabbit, Hedgehog, Squirrel, Cat)
+const maxCharacter = 4
+// "days" value that means 10 years (see "sp_buy" function)
+const daysForever = 0xFF
+
+// rating types as they are stored in DB (one-based "type" enum of "rating" table)
+const (
+    dbRatingGeneral = iota + 1
+    dbRatingWeekly
+)
+
+// nameRegexp is the same regular expression as in "sp_user" stored procedure
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_+\-$.]{4,}$`)
+
+// abilityPrices is a price list of all possible abilities (the same as the content of "ability" table)
+var abilityPrices = []abilityT{
+    {1, 1, 13}, {1, 3, 36}, {1, 7, 66},     // Snorkel
+    {2, 1, 12}, {2, 3, 32}, {2, 7, 60},     // ClimbingShoes
+    {3, 1, 13}, {3, 3, 34}, {3, 7, 64},     // SouthWester
+    {4, 1, 16}, {4, 3, 43}, {4, 7, 80},     // VoodooMask
+    {5, 1, 11}, {5, 3, 30}, {5, 7, 56},     // SapperShoes
+    {6, 1, 8}, {6, 3, 23}, {6, 7, 42},      // Sunglasses
+    {33, 1, 10}, {33, 3, 27}, {33, 7, 50},  // Miner
+    {34, 1, 10}, {34, 3, 26}, {34, 7, 48},  // Builder
+    {35, 1, 10}, {35, 3, 28}, {35, 7, 52},  // Shaman
+    {36, 1, 8}, {36, 3, 22}, {36, 7, 40},   // Grenadier
+    {37, 1, 14}, {37, 3, 39}, {37, 7, 72},  // TeleportMan
+    {18, 255, 120},                         // SpPack2
+}
+
+// NewMemDbManager creates a new instance of MemDbManager. Please do not create MemDbManager directly.
+func NewMemDbManager() *MemDbManager {
+    return &MemDbManager{
+        users:     make(map[uint64]*user.User),
+        names:     make(map[string]uint64),
+        abilities: make(map[uint64]map[byte]time.Time),
+        ratings:   make(map[memRatingKeyT]*memRatingT),
+        friends:   make(map[uint64][]uint64),
+        payments:  make(map[string]*memPaymentT),
+    }
+}
+
+// AddUser inserts a new user into DB
+// "name" - user name
+// "email" - user's e-mail
+// "hash" - hash of user's password
+// "salt" - salt
+// "promocode" - user's promo code
+func (dbMgr *MemDbManager) AddUser(name, email, hash, salt, promocode string) *Error {
+    Assert(dbMgr.users, dbMgr.names)
+    dbMgr.Lock()
+    defer dbMgr.Unlock()
+
+    err := NewErrs(checkLength(dbMgr, 201, "name", name, 32), checkLength(dbMgr, 201, "email", email, 64),
+        checkLength(dbMgr, 201, "auth_data", hash, 64), checkLength(dbMgr, 201, "salt", salt, 64),
+        checkLength(dbMgr, 201, "promocode", promocode, 8))
+    if err == nil {
+        if nameRegexp.MatchString(name) { // trigger "before_user_insert"
+            if _, ok := dbMgr.names[strings.ToLower(name)]; !ok {
+                dbMgr.lastUserID++
+                id := dbMgr.lastUserID
+                dbMgr.users[id] = &user.User{ID: id, Name: name, Email: email, AuthType: "Local", AuthData: hash,
+                    Salt: salt, Promocode: promocode, Character: defaultCharacter, TrustPoints: defaultTrustPoints,
+                    SkillRating: user.DefaultSkillRating, LastLogin: time.Now()}
+                dbMgr.userIDs = append(dbMgr.userIDs, id)
+                dbMgr.names[strings.ToLower(name)] = id
+                return nil
+            }
+            return NewErr(dbMgr, 201, "Duplicate entry '%s' for key 'name'", name)
+        }
+        return NewErr(dbMgr, 201, "Incorrect name length or format")
+    }
+    return err
+}
+
+// GetUserByID returns a user by ID
+// "id" - user ID
+func (dbMgr *MemDbManager) GetUserByID(id uint64) (*user.User, *Error) {
+    dbMgr.RLock()
+    defer dbMgr.RUnlock()
+    return dbMgr.copyUser(dbMgr.users[id])
+}
+
+// GetUserByName returns a user by name
+// "name" - user name
+func (dbMgr *MemDbManager) GetUserByName(name string) (*user.User, *Error) {
+    dbMgr.RLock()
+    defer dbMgr.RUnlock()
+    return dbMgr.copyUser(dbMgr.users[dbMgr.names[strings.ToLower(name)]])
+}
+
+// GetUserByNumber returns a user by order number according to how he/she is stored in DB
+// "number" - user position in DB table
+func (dbMgr *MemDbManager) GetUserByNumber(number uint) (*user.User, *Error) {
+    dbMgr.RLock()
+    defer dbMgr.RUnlock()
+    if 0 < number && number <= uint(len(dbMgr.userIDs)) {
+        return dbMgr.copyUser(dbMgr.users[dbMgr.userIDs[number-1]])
+    }
+    return dbMgr.copyUser(nil)
+}
+
+// GetAllAbilities return all possible abilities
+func (dbMgr *MemDbManager) GetAllAbilities() ([]byte, *Error) {
+    res := []byte{}
+    for _, ability := range abilityPrices {
+        res = append(res, ability.id, ability.days, ability.gems)
+    }
+    return res, nil
+}
+
+// SetLastEnemy assigns last enemy (enemyID) to a given user (userID)
+// "userID" - user ID
+// "enemyID" - user's enemy ID
+func (dbMgr *MemDbManager) SetLastEnemy(userID, enemyID uint64) *Error {
+    dbMgr.Lock()
+    if usr, ok := dbMgr.users[userID]; ok {
+        usr.LastEnemy = enemyID
+    }
+    dbMgr.Unlock()
+    return nil
+}
+
+// SetAgentInfo sets agent info (language, client version, OS, Android version, etc.) to a given user
+// "userID" - user ID
+// "agentInfo" - agent info
+func (dbMgr *MemDbManager) SetAgentInfo(userID uint64, agentInfo string) *Error {
+    if err := checkLength(dbMgr, 236, "agent_info", agentInfo, 64); err != nil {
+        return err
+    }
+    dbMgr.Lock()
+    if usr, ok := dbMgr.users[userID]; ok {
+        usr.AgentInfo = agentInfo
+    }
+    dbMgr.Unlock()
+    return nil
+}
+
+// RegisterWin inserts a new battle result (WIN) to the Rankings table
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+// "userID" - user ID
+// "scoreDiff" - score difference (abs[score1-score2])
+func (dbMgr *MemDbManager) RegisterWin(ratingType byte, userID uint64, scoreDiff byte) *Error {
+    return dbMgr.registerResult(209, ratingType, userID, 1, 0, int(scoreDiff))
+}
+
+// RegisterLoss inserts a new battle result (LOSS) to the Rankings table
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+// "userID" - user ID
+// "scoreDiff" - score difference (abs[score1-score2])
+func (dbMgr *MemDbManager) RegisterLoss(ratingType byte, userID uint64, scoreDiff byte) *Error {
+    return dbMgr.registerResult(210, ratingType, userID, 0, 1, -1*int(scoreDiff))
+}
+
+// SetSkillRating assigns a new skill rating (Elo) to a given user
+// "userID" - user ID
+// "skillRating" - new skill rating
+func (dbMgr *MemDbManager) SetSkillRating(userID uint64, skillRating uint32) *Error {
+    dbMgr.Lock()
+    if usr, ok := dbMgr.users[userID]; ok {
+        usr.SkillRating = skillRating
+    }
+    dbMgr.Unlock()
+    return nil
+}
+
+// RewardUser gives a user some gems and trustPoints (see documentation to learn what "trustPoints" are)
+// "userID" - user ID
+// "gems" - reward, in gems
+// "trustPoints" - trust points
+func (dbMgr *MemDbManager) RewardUser(userID uint64, gems, trustPoints uint32) *Error {
+    dbMgr.Lock()
+    if usr, ok := dbMgr.users[userID]; ok {
+        usr.Gems += gems
+        usr.TrustPoints += trustPoints
+    }
+    dbMgr.Unlock()
+    return nil
+}
+
+// ConsumeTrustPoints decrements "trustPoints" parameter of a user
+// "userID" - user ID
+// "trustPoints" - trust points to consume
+func (dbMgr *MemDbManager) ConsumeTrustPoints(userID uint64, trustPoints uint32) *Error {
+    dbMgr.Lock()
+    defer dbMgr.Unlock()
+    if usr, ok := dbMgr.users[userID]; ok {
+        if usr.TrustPoints < trustPoints { // column is unsigned
+            return NewErr(dbMgr, 235, "BIGINT UNSIGNED value is out of range")
+        }
+        usr.TrustPoints -= trustPoints
+    }
+    return nil
+}
+
+// ChangeUser updates the info about a user
+// "userID" - user ID
+// "email" - user e-mail
+// "hash" - hash of user's password
+// "character" - user's character
+func (dbMgr *MemDbManager) ChangeUser(userID uint64, email, hash string, character byte) *Error {
+    err := NewErrs(checkLength(dbMgr, 212, "email", email, 64), checkLength(dbMgr, 212, "auth_data", hash, 64))
+    if err == nil {
+        if 0 < character && character <= maxCharacter {
+            dbMgr.Lock()
+            if usr, ok := dbMgr.users[userID]; ok {
+                usr.Email = email
+                usr.AuthData = hash
+                usr.Character = character
+            }
+            dbMgr.Unlock()
+            return nil
+        }
+        return NewErr(dbMgr, 212, "Data truncated for column 'character' at row 1")
+    }
+    return err
+}
+
+// GetAbilities returns the abilities (list of IDs and list of expire timestamps) of a given user. It is guaranteed that
+// sizes of returned lists are equal
+// "userID" - user ID
+func (dbMgr *MemDbManager) GetAbilities(userID uint64) ([]byte, []time.Time, *Error) {
+    ids := []byte{}
+    expires := []time.Time{}
+    dbMgr.RLock()
+    for id, expire := range dbMgr.abilities[userID] {
+        ids = append(ids, id)
+        expires = append(expires, expire)
+    }
+    dbMgr.RUnlock()
+    return ids, expires, nil
+}
+
+// BuyProduct initiates purchasing a product (e.g. "Climbing Shoes" for 7 days) for a given user. This method repeats
+// the logic of "sp_buy" stored function.
+// "userID" - user ID
+// "code" - product code
+// "days" - duration, in days (please note that it's not arbitrary value, the "days" must be present in "ability" table)
+func (dbMgr *MemDbManager) BuyProduct(userID uint64, code, days byte) (cost uint32, error *Error) {
+    dbMgr.Lock()
+    defer dbMgr.Unlock()
+
+    for _, ability := range abilityPrices {
+        if ability.id == code && ability.days == days {
+            usr, ok := dbMgr.users[userID]
+            if ok && usr.Gems >= uint32(ability.gems) {
+                t := time.Duration(TernaryInt(days != daysForever, int(days), 3652)) * 24 * time.Hour
+                if _, ok := dbMgr.abilities[userID]; !ok {
+                    dbMgr.abilities[userID] = make(map[byte]time.Time)
+                }
+                if expire, ok := dbMgr.abilities[userID][code]; ok {
+                    dbMgr.abilities[userID][code] = expire.Add(t)
+                } else {
+                    dbMgr.abilities[userID][code] = time.Now().Add(t)
+                }
+                usr.Gems -= uint32(ability.gems)
+                return uint32(ability.gems), nil
+            }
+            return 0, NewErr(dbMgr, 215, "Insufficient gems")
+        }
+    }
+    return 0, NewErr(dbMgr, 215, "Incorrect product")
+}
+
+// GetWins returns count of wins from the Ranking table for a given user
+// @deprecated: not used since 1.3.8
+// "userID" - user ID
+func (dbMgr *MemDbManager) GetWins(userID uint64) (wins uint32, error *Error) {
+    dbMgr.RLock()
+    defer dbMgr.RUnlock()
+    if rating, ok := dbMgr.ratings[memRatingKeyT{userID, dbRatingGeneral}]; ok {
+        wins = rating.wins
+    }
+    return
+}
+
+// GetRating returns Ranking for a given user of a given ratingType (ratingGeneral or ratingWeekly). Please specify
+// limit to avoid performance issues (default is 10)
+// "userID" - user ID
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+// "limit" - data sample limit
+func (dbMgr *MemDbManager) GetRating(userID uint64, ratingType, limit byte) ([]byte, *Error) {
+    dbMgr.RLock()
+    defer dbMgr.RUnlock()
+
+    res := []byte{}
+    found := false
+    ratings := dbMgr.getSortedRatings(ratingType, limit)
+    if own, ok := dbMgr.ratings[memRatingKeyT{userID, ratingType}]; ok { // UNION with the user's own record
+        for _, rating := range ratings {
+            found = found || rating == own
+        }
+        if !found {
+            ratings = append(ratings, own)
+        }
+    }
+    for _, rating := range ratings {
+        res = append(res, []byte(dbMgr.users[rating.userID].Name)...)
+        res = append(res, 0) // 0 is a terminating NULL
+        res = append(res, byte(rating.wins >> 24), byte(rating.wins >> 16), byte(rating.wins >> 8), byte(rating.wins))
+        res = append(res, byte(rating.losses >> 24), byte(rating.losses >> 16), byte(rating.losses >> 8))
+        res = append(res, byte(rating.losses))
+        res = append(res, byte(rating.scoreDiff >> 24), byte(rating.scoreDiff >> 16), byte(rating.scoreDiff >> 8))
+        res = append(res, byte(rating.scoreDiff))
+    }
+    return res, nil
+}
+
+// GetSkillRating returns Top N Ranking by skill rating for a given user. Only users who have played at least one
+// battle are ranked. The rows have the same format as in GetRating(), but score difference is replaced with the skill
+// rating
+// "userID" - user ID
+// "limit" - data sample limit
+func (dbMgr *MemDbManager) GetSkillRating(userID uint64, limit byte) ([]byte, *Error) {
+    dbMgr.RLock()
+    defer dbMgr.RUnlock()
+
+    ratings := []*memRatingT{}
+    for k, v := range dbMgr.ratings {
+        if k.ratingType == dbRatingGeneral {
+            ratings = append(ratings, v)
+        }
+    }
+    sort.Slice(ratings, func(i, j int) bool {
+        a, b := ratings[i], ratings[j]
+        skillA, skillB := dbMgr.users[a.userID].SkillRating, dbMgr.users[b.userID].SkillRating
+        if skillA != skillB {
+            return skillA > skillB
+        }
+        if a.wins != b.wins {
+            return a.wins > b.wins
+        }
+        return a.ratingID < b.ratingID
+    })
+    n := int(limit)
+    for i, rating := range ratings { // UNION with the user's own record
+        if i >= n && rating.userID == userID {
+            ratings[n] = rating
+            n++
+            break
+        }
+    }
+    if len(ratings) > n {
+        ratings = ratings[:n]
+    }
+
+    res := []byte{}
+    for _, rating := range ratings {
+        skill := dbMgr.users[rating.userID].SkillRating
+        res = append(res, []byte(dbMgr.users[rating.userID].Name)...)
+        res = append(res, 0) // 0 is a terminating NULL
+        res = append(res, byte(rating.wins >> 24), byte(rating.wins >> 16), byte(rating.wins >> 8), byte(rating.wins))
+        res = append(res, byte(rating.losses >> 24), byte(rating.losses >> 16), byte(rating.losses >> 8))
+        res = append(res, byte(rating.losses))
+        res = append(res, byte(skill >> 24), byte(skill >> 16), byte(skill >> 8), byte(skill))
+    }
+    return res, nil
+}
+
+// GetBestUsers returns Top N Ranking of a given ratingType (ratingGeneral or ratingWeekly)
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+// "limit" - data sample limit
+func (dbMgr *MemDbManager) GetBestUsers(ratingType, limit byte) (ids []uint64, error *Error) {
+    dbMgr.RLock()
+    defer dbMgr.RUnlock()
+
+    res := []uint64{}
+    for _, rating := range dbMgr.getSortedRatings(ratingType, limit) {
+        res = append(res, rating.userID)
+    }
+    return res, nil
+}
+
+// ClearRating erases Ranking table of a given ratingType (ratingGeneral or ratingWeekly)
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+func (dbMgr *MemDbManager) ClearRating(ratingType byte) *Error {
+    dbMgr.Lock()
+    for k := range dbMgr.ratings {
+        if k.ratingType == ratingType {
+            delete(dbMgr.ratings, k)
+        }
+    }
+    dbMgr.Unlock()
+    return nil
+}
+
+// GetUserFriends returns friends (list of characters and list of names) of a given user. It is guaranteed that sizes of
+// returned lists are equal
+// "userID" - user ID
+func (dbMgr *MemDbManager) GetUserFriends(userID uint64) ([]byte, []string, *Error) {
+    res0 := []byte{}
+    res1 := []string{}
+    dbMgr.RLock()
+    for _, friendID := range dbMgr.friends[userID] {
+        if friend, ok := dbMgr.users[friendID]; ok {
+            res0 = append(res0, friend.Character)
+            res1 = append(res1, friend.Name)
+        }
+    }
+    dbMgr.RUnlock()
+    return res0, res1, nil
+}
+
+// AddFriend inserts a new friend for a given user. This method repeats the logic of "sp_friend" stored procedure.
+// "userID" - user ID
+// "name" - friend's name
+func (dbMgr *MemDbManager) AddFriend(userID uint64, name string) (character byte, e *Error) {
+    dbMgr.Lock()
+    defer dbMgr.Unlock()
+
+    if friendID, ok := dbMgr.names[strings.ToLower(name)]; ok {
+        if userID != friendID { // trigger "before_friend_insert"
+            if _, ok := dbMgr.users[userID]; ok {
+                for _, id := range dbMgr.friends[userID] {
+                    if id == friendID {
+                        return 0, NewErr(dbMgr, 223, "Duplicate entry '%d-%d' for key 'user_id'", userID, friendID)
+                    }
+                }
+                dbMgr.friends[userID] = append(dbMgr.friends[userID], friendID)
+                return dbMgr.users[friendID].Character, nil
+            }
+            return 0, NewErr(dbMgr, 223, "Cannot add or update a child row: a foreign key constraint fails")
+        }
+        return 0, NewErr(dbMgr, 223, "You cannot be friends with yourself")
+    }
+    return 0, NewErr(dbMgr, 223, "Column 'friend_user_id' cannot be null")
+}
+
+// RemoveFriend removes a friend (by the name) for a given user
+// "userID" - user ID
+// "name" - friend's name
+func (dbMgr *MemDbManager) RemoveFriend(userID uint64, name string) *Error {
+    dbMgr.Lock()
+    if friendID, ok := dbMgr.names[strings.ToLower(name)]; ok {
+        friends := dbMgr.friends[userID]
+        for i, id := range friends {
+            if id == friendID {
+                dbMgr.friends[userID] = append(friends[:i:i], friends[i+1:]...)
+                break
+            }
+        }
+    }
+    dbMgr.Unlock()
+    return nil
+}
+
+// ActivatePromocode activates promocode of a user specified by inviterID for a user specified by userID
+// "userID" - user ID
+// "inviterID" - user ID of inviter
+func (dbMgr *MemDbManager) ActivatePromocode(userID, inviterID uint64) *Error {
+    dbMgr.Lock()
+    defer dbMgr.Unlock()
+
+    _, ok1 := dbMgr.users[userID]
+    _, ok2 := dbMgr.users[inviterID]
+    if ok1 && ok2 {
+        for _, promocode := range dbMgr.promocodes {
+            if promocode.userID == userID && promocode.inviterID == inviterID {
+                return NewErr(dbMgr, 225, "Duplicate entry '%d-%d' for key 'friend_user'", userID, inviterID)
+            }
+        }
+        dbMgr.promocodes = append(dbMgr.promocodes, &memPromocodeT{userID: userID, inviterID: inviterID})
+        return nil
+    }
+    return NewErr(dbMgr, 225, "Cannot add or update a child row: a foreign key constraint fails")
+}
+
+// DeactivatePromocode de-activates promocode of a user specified by inviterID for a user specified by userID
+// "userID" - user ID
+// "inviterID" - user ID of inviter
+func (dbMgr *MemDbManager) DeactivatePromocode(userID, inviterID uint64) *Error {
+    dbMgr.Lock()
+    for _, promocode := range dbMgr.promocodes {
+        if promocode.userID == userID && promocode.inviterID == inviterID {
+            promocode.used = true
+        }
+    }
+    dbMgr.Unlock()
+    return nil
+}
+
+// PromocodeExists checks whether promocode exists for a given userID
+// "userID" - user ID
+func (dbMgr *MemDbManager) PromocodeExists(userID uint64) (inviterID uint64, exists bool, err *Error) {
+    dbMgr.RLock()
+    defer dbMgr.RUnlock()
+    for _, promocode := range dbMgr.promocodes {
+        if promocode.userID == userID && !promocode.used {
+            return promocode.inviterID, true, nil
+        }
+    }
+    return
+}
+
+// DeleteExpiredAbilities removes expired abilities. It is designed to be executed periodically
+func (dbMgr *MemDbManager) DeleteExpiredAbilities() (removedIds []uint64, error *Error) {
+    res := []uint64{}
+    now := time.Now()
+    dbMgr.Lock()
+    for userID, abilities := range dbMgr.abilities {
+        found := false
+        for id, expire := range abilities {
+            if expire.Before(now) {
+                delete(abilities, id)
+                found = true
+            }
+        }
+        if found {
+            res = append(res, userID)
+        }
+    }
+    dbMgr.Unlock()
+    return res, nil
+}
+
+// AddPayment inserts info about new purchase
+// "userID" - user ID
+// "orderID" - order ID (returned by a platform)
+// "sku" - stock keeping unit
+// "tsMsec" - timestamp of operation
+// "data" - raw data
+// "state" - status (0 = purchased, 1 = cancelled, 2 = refunded)
+func (dbMgr *MemDbManager) AddPayment(userID uint64, orderID, sku string, tsMsec int64, data string, state uint8) *Error {
+    err := NewErrs(checkLength(dbMgr, 230, "order_id", orderID, 64), checkLength(dbMgr, 230, "data", data, 200))
+    if err == nil {
+        dbMgr.Lock()
+        defer dbMgr.Unlock()
+        if _, ok := dbMgr.users[userID]; ok {
+            if _, ok := dbMgr.payments[orderID]; !ok {
+                t := time.Unix(tsMsec/1000, (tsMsec%1000)*1000000)
+                dbMgr.payments[orderID] = &memPaymentT{userID: userID, sku: sku, stamp: t, data: data, state: state}
+                return nil
+            }
+            return NewErr(dbMgr, 230, "Duplicate entry '%s' for key 'order_id'", orderID)
+        }
+        return NewErr(dbMgr, 230, "Cannot add or update a child row: a foreign key constraint fails")
+    }
+    return err
+}
+
+// SetPaymentChecked sets the payment, defined by orderID, as verified
+// "orderID" - order ID (returned by a platform)
+func (dbMgr *MemDbManager) SetPaymentChecked(orderID string) *Error {
+    dbMgr.Lock()
+    if payment, ok := dbMgr.payments[orderID]; ok {
+        payment.checked = true
+    }
+    dbMgr.Unlock()
+    return nil
+}
+
+// SetPaymentResult "finishes" payment transaction by adding gems for a successful purchase
+// "orderID" - order ID (returned by a platform)
+// "gems" - gems sold by the transaction
+func (dbMgr *MemDbManager) SetPaymentResult(orderID string, gems uint32) *Error {
+    dbMgr.Lock()
+    if payment, ok := dbMgr.payments[orderID]; ok {
+        payment.gems = gems
+    }
+    dbMgr.Unlock()
+    return nil
+}
+
+// Close does nothing, because there are no resources to release
+func (dbMgr *MemDbManager) Close() *Error {
+    return nil
+}
+
+// ===============================
+// ===    PRIVATE FUNCTIONS    ===
+// ===============================
+
+// copyUser returns a copy of a given user record, so that nobody could change the DB data bypassing this component.
+// Note that a caller must hold the lock
+// "usr" - user record (may be NULL)
+func (dbMgr *MemDbManager) copyUser(usr *user.User) (*user.User, *Error) {
+    if usr != nil {
+        return &user.User{Character: usr.Character, Gems: usr.Gems, TrustPoints: usr.TrustPoints,
+            SkillRating: usr.SkillRating, Name: usr.Name, Email: usr.Email, AuthType: usr.AuthType,
+            AuthData: usr.AuthData, Salt: usr.Salt, Promocode: usr.Promocode, ID: usr.ID, LastEnemy: usr.LastEnemy,
+            AgentInfo: usr.AgentInfo, LastLogin: usr.LastLogin, LastActive: time.Now()}, nil
+    }
+    return nil, NewErrFromError(dbMgr, 202, sql.ErrNoRows)
+}
+
+// registerResult inserts a new battle result to the Rankings table or updates the existing one (like MySQL "ON
+// DUPLICATE KEY UPDATE" clause does)
+// "code" - error code
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+// "userID" - user ID
+// "wins" - wins to add
+// "losses" - losses to add
+// "scoreDiff" - score difference to add (may be negative)
+func (dbMgr *MemDbManager) registerResult(code, ratingType byte, userID uint64, wins, losses uint32,
+    scoreDiff int) *Error {
+    if ratingType == dbRatingGeneral || ratingType == dbRatingWeekly {
+        dbMgr.Lock()
+        defer dbMgr.Unlock()
+        if _, ok := dbMgr.users[userID]; ok {
+            key := memRatingKeyT{userID, ratingType}
+            rating, ok := dbMgr.ratings[key]
+            if !ok {
+                dbMgr.lastRatID++
+                rating = &memRatingT{ratingID: dbMgr.lastRatID, userID: userID}
+                dbMgr.ratings[key] = rating
+            }
+            rating.wins += wins
+            rating.losses += losses
+            rating.scoreDiff += scoreDiff
+            return nil
+        }
+        return NewErr(dbMgr, code, "Cannot add or update a child row: a foreign key constraint fails")
+    }
+    return NewErr(dbMgr, code, "Data truncated for column 'type' at row 1")
+}
+
+// getSortedRatings returns Top N rating records of a given ratingType ordered by "victory_diff", "score_diff" and
+// "wins" (descending). Note that a caller must hold the lock
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+// "limit" - data sample limit
+func (dbMgr *MemDbManager) getSortedRatings(ratingType, limit byte) []*memRatingT {
+    res := []*memRatingT{}
+    for k, v := range dbMgr.ratings {
+        if k.ratingType == ratingType {
+            res = append(res, v)
+        }
+    }
+    sort.Slice(res, func(i, j int) bool {
+        a, b := res[i], res[j]
+        victoryDiffA, victoryDiffB := int64(a.wins) - int64(a.losses), int64(b.wins) - int64(b.losses)
+        if victoryDiffA != victoryDiffB {
+            return victoryDiffA > victoryDiffB
+        }
+        if a.scoreDiff != b.scoreDiff {
+            return a.scoreDiff > b.scoreDiff
+        }
+        if a.wins != b.wins {
+            return a.wins > b.wins
+        }
+        return a.ratingID < b.ratingID
+    })
+    if len(res) > int(limit) {
+        res = res[:limit]
+    }
+    return res
+}
+
+// checkLength emulates the MySQL strict mode that refuses too long strings
+// "who" - the owner component
+// "code" - error code
+// "column" - column name
+// "value" - string to check
+// "maxLen" - max length of a column, in characters
+func checkLength(who interface{}, code byte, column, value string, maxLen int) *Error {
+    if len([]rune(value)) > maxLen {
+        return NewErr(who, code, "Data too long for column '%s' at row 1", column)
+    }
+    return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import "bytes"
+import "testing"
+import "mitrakov.ru/home/winesaps/user"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// newTestDbManagers returns all the embedded DB backends, so that each test could check that they behave the same way
+// (MySQL-based DbManager requires a running server and is not tested here)
+func newTestDbManagers(t *testing.T) map[string]user.IDbManager {
+    sqlite, err := NewSqliteDbManager(":memory:")
+    if err != nil {
+        t.Fatalf("Cannot create SQLite DB: %v", err)
+    }
+    return map[string]user.IDbManager{"memory": NewMemDbManager(), "sqlite": sqlite}
+}
+
+// TestDbAddUser checks name/length validation and case-insensitive uniqueness of user names
+func TestDbAddUser(t *testing.T) {
+    tests := []struct {
+        name    string
+        email   string
+        success bool
+    }{
+        {"Tommy", "tommy@mail.com", true},
+        {"tommy", "other@mail.com", false}, // duplicate (names are case-insensitive)
+        {"Bob", "bob@mail.com", false},     // too short
+        {"Tom Sawyer", "tom@mail.com", false},
+        {"abcdefghijklmnopqrstuvwxyz0123456", "long@mail.com", false}, // 33 symbols
+        {"Huck_Finn", "huck@mail.com", true},
+    }
+    for backend, dbMgr := range newTestDbManagers(t) {
+        for _, test := range tests {
+            err := dbMgr.AddUser(test.name, test.email, "hash", "salt", "promo")
+            if (err == nil) != test.success {
+                t.Errorf("%s: AddUser(%q) returned %v, expected success = %v", backend, test.name, err, test.success)
+            }
+        }
+        usr, err := dbMgr.GetUserByName("TOMMY")
+        if err != nil || usr.Name != "Tommy" || usr.Email != "tommy@mail.com" {
+            t.Errorf("%s: GetUserByName returned %v, %v", backend, usr, err)
+        } else if usr.SkillRating != user.DefaultSkillRating || usr.TrustPoints != defaultTrustPoints {
+            t.Errorf("%s: wrong default values: %+v", backend, usr)
+        }
+        if _, err := dbMgr.GetUserByName("Nobody"); err == nil {
+            t.Errorf("%s: GetUserByName must fail for a non-existing user", backend)
+        }
+        Check(dbMgr.Close())
+    }
+}
+
+// TestDbRating checks that wins, losses and score differences are accumulated and serialized the same way
+func TestDbRating(t *testing.T) {
+    tests := []struct {
+        win       bool
+        scoreDiff byte
+    }{
+        {true, 3}, {true, 1}, {false, 2},
+    }
+    expected := []byte{'T', 'o', 'm', 'm', 'y', 0, 0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 2}
+    for backend, dbMgr := range newTestDbManagers(t) {
+        Check(dbMgr.AddUser("Tommy", "tommy@mail.com", "hash", "salt", ""))
+        usr, err := dbMgr.GetUserByName("Tommy")
+        if err != nil {
+            t.Fatalf("%s: %v", backend, err)
+        }
+        for _, test := range tests {
+            if test.win {
+                Check(dbMgr.RegisterWin(dbRatingGeneral, usr.ID, test.scoreDiff))
+            } else {
+                Check(dbMgr.RegisterLoss(dbRatingGeneral, usr.ID, test.scoreDiff))
+            }
+        }
+        rating, err := dbMgr.GetRating(usr.ID, dbRatingGeneral, 10)
+        if err != nil || !bytes.Equal(rating, expected) {
+            t.Errorf("%s: GetRating returned %v, %v; expected %v", backend, rating, err, expected)
+        }
+        Check(dbMgr.Close())
+    }
+}
+
+// TestDbBuyProduct checks the "sp_buy" logic: price list, insufficient gems and incorrect products
+func TestDbBuyProduct(t *testing.T) {
+    tests := []struct {
+        code    byte
+        days    byte
+        cost    uint32
+        success bool
+    }{
+        {1, 7, 66, true},
+        {2, 2, 0, false},  // incorrect duration
+        {99, 1, 0, false}, // incorrect product
+        {4, 7, 0, false},  // insufficient gems (100 - 66 < 80)
+        {6, 1, 8, true},
+    }
+    for backend, dbMgr := range newTestDbManagers(t) {
+        Check(dbMgr.AddUser("Tommy", "tommy@mail.com", "hash", "salt", ""))
+        usr, err := dbMgr.GetUserByName("Tommy")
+        if err != nil {
+            t.Fatalf("%s: %v", backend, err)
+        }
+        Check(dbMgr.RewardUser(usr.ID, 100, 0))
+        for _, test := range tests {
+            cost, err := dbMgr.BuyProduct(usr.ID, test.code, test.days)
+            if (err == nil) != test.success || cost != test.cost {
+                t.Errorf("%s: BuyProduct(%d, %d) returned %d, %v", backend, test.code, test.days, cost, err)
+            }
+        }
+        if usr, err = dbMgr.GetUserByID(usr.ID); err != nil || usr.Gems != 100-66-8 {
+            t.Errorf("%s: wrong gems after purchases: %v, %v", backend, usr, err)
+        }
+        if ids, expires, err := dbMgr.GetAbilities(usr.ID); err != nil || len(ids) != 2 || len(expires) != 2 {
+            t.Errorf("%s: GetAbilities returned %v, %v, %v", backend, ids, expires, err)
+        }
+        Check(dbMgr.Close())
+    }
+}
@@ -1,66 +1,262 @@
 // Package network Copyright 2017 mitrakov. All right are reserved. Governed by the BSD license
 package network
 
+import "os"
 import "fmt"
 import "log"
+import "net"
 import "time"
 import "sync"
+import "io/ioutil"
+import "encoding/json"
+import . "mitrakov.ru/home/winesaps/sid"   // nolint
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 
-// @mitrakov (2017-04-18): don't use ALL_CAPS const naming (gometalinter, stackoverflow.com/questions/22688906)
-
-// max count of packets to treat the behaviour as "suspicious" in the limits of "intervalSec" seconds
-const maxSamples = 60
-// interval of time to count the number of received packets; if it becomes > "maxSamples" => this is suspicious
-const intervalSec = 10
-
-// SimpleDetector is a primitive misbehaviour detector (flood, DoS, etc.)
+// SimpleDetector is a primitive misbehaviour detector (flood, DoS, etc.). It counts incoming datagrams per remote
+// address, incoming messages per connection (crcid) and commands per Session ID; addresses that exceed the limit get
+// banned (for "banDuration" or forever), whilst connections and SIDs are only throttled till the end of the current
+// interval (note that a SID must be checked only after its token is validated, because anyone may put an arbitrary SID
+// into a message).
+// The ban list is stored in a JSON file, so that it survives restarts. The file is written by the daemon at most once
+// per "interval", so that the receiving goroutines never wait for disk I/O.
+// IPv6 addresses are counted and banned by their prefix (e.g. /64), because a single subscriber usually owns the whole
+// prefix and might easily change the address within it.
 // This component is independent.
 type SimpleDetector struct /*implements IFloodDetector*/ {
     sync.Mutex
-    samples map[string]*sampleT
-    banned  map[string]bool
-}
-
-// NewSimpleDetector creates a new instance of a SimpleDetector. Please don't create a SimpleDetector manually.
-func NewSimpleDetector() IFloodDetector {
-    return &SimpleDetector{samples: make(map[string]*sampleT), banned: make(map[string]bool)}
+    maxSamples     uint
+    maxConnSamples uint
+    maxSidSamples  uint
+    interval       time.Duration
+    banDuration    time.Duration
+    banFile        string
+    v6Prefix       int
+    samples        map[string]*sampleT
+    connSamples    map[uint]*sampleT
+    sidSamples     map[Sid]*sampleT
+    banned         map[string]time.Time // address -> expire time (zero time means "banned forever")
+    dirty          bool                 // ban list is changed, but not saved yet
+    fileMutex      sync.Mutex           // to prevent the daemon and Close() from writing the file simultaneously
+    stop           chan bool
 }
 
 // sampleT is a helper structure to hold a counter and a base timestamp
 type sampleT struct {
-    cnt       int
+    cnt       uint
     timestamp time.Time
 }
 
+// NewSimpleDetector creates a new instance of a SimpleDetector. Please don't create a SimpleDetector manually.
+// "maxSamples" - max count of datagrams from a single address in the limits of "interval"; if exceeded => ban
+// "maxConnSamples" - max count of messages from a single connection in the limits of "interval"; if exceeded =>
+// throttle
+// "maxSidSamples" - max count of commands from a single Session ID in the limits of "interval"; if exceeded => throttle
+// "interval" - interval of time to count the number of received packets
+// "banDuration" - how long an address remains banned (pass 0 to ban forever)
+// "banFile" - path to a file to persist the ban list (pass "" to keep it in memory only)
+// "v6Prefix" - length of IPv6 prefix to identify a client (0-128, e.g. 64; pass 128 to use the whole address)
+func NewSimpleDetector(maxSamples, maxConnSamples, maxSidSamples uint, interval, banDuration time.Duration,
+    banFile string, v6Prefix uint) (IFloodDetector, *Error) {
+    flood := &SimpleDetector{maxSamples: maxSamples, maxConnSamples: maxConnSamples, maxSidSamples: maxSidSamples,
+        interval: interval, banDuration: banDuration, banFile: banFile, v6Prefix: int(Min(v6Prefix, 128)),
+        samples: make(map[string]*sampleT), connSamples: make(map[uint]*sampleT), sidSamples: make(map[Sid]*sampleT),
+        banned: make(map[string]time.Time)}
+    err := flood.load()
+    flood.stop = RunDaemon("flood", interval, flood.cleanUp)
+    return flood, err
+}
+
+// GetBanned returns all the banned addresses along with the expire times (zero time means "banned forever")
+func (flood *SimpleDetector) GetBanned() map[string]time.Time {
+    flood.Lock()
+    defer flood.Unlock()
+
+    res := make(map[string]time.Time)
+    for k, v := range flood.banned {
+        res[k] = v
+    }
+    return res
+}
+
+// Unban removes a given address from the ban list. Returns FALSE if the address is not banned
+// "addr" - address (IPv4 without a port, or IPv6 prefix like "2001:db8::/64")
+func (flood *SimpleDetector) Unban(addr string) (ok bool, err *Error) {
+    flood.Lock()
+    defer flood.Unlock()
+
+    if _, ok = flood.banned[addr]; ok {
+        delete(flood.banned, addr)
+        delete(flood.samples, addr)
+        log.Printf("Address %s unbanned\n", addr)
+        flood.dirty = true
+    }
+    return
+}
+
+// Close shuts SimpleDetector down and releases all seized resources; unsaved changes of the ban list are flushed
+func (flood *SimpleDetector) Close() {
+    Assert(flood.stop)
+    flood.stop <- true
+    Check(flood.save())
+}
+
 // checkBanned checks whether the address "addr" should be banned, or already banned. If it's okay, returns FALSE.
 func (flood *SimpleDetector) checkBanned(addr fmt.Stringer) bool {
     Assert(flood.samples, flood.banned)
-    key := addr.String()
-    
+    key := flood.getKey(addr)
+
     // protect our maps
     flood.Lock()
     defer flood.Unlock()
 
     // check if already banned
-    if _, ok := flood.banned[key]; ok {
-        return true
+    if expire, ok := flood.banned[key]; ok {
+        if expire.IsZero() || time.Now().Before(expire) {
+            return true
+        }
+        delete(flood.banned, key)
+        flood.dirty = true
     }
 
     // check if behaviour is suspicious
-    if s, ok := flood.samples[key]; ok {
-        s.cnt++
-        if time.Since(s.timestamp) > intervalSec*time.Second {
-            if s.cnt > maxSamples {
-                flood.banned[key] = true
-                log.Printf("Address %s banned as suspicious\n", addr)
-                return true
-            }
-            s.cnt = 0
-            s.timestamp = time.Now()
-        }
+    if s := getSample(flood.samples[key], flood.interval); s.cnt <= flood.maxSamples {
+        flood.samples[key] = s
     } else {
-        flood.samples[key] = &sampleT{0, time.Now()}
+        delete(flood.samples, key)
+        flood.banned[key] = time.Time{}
+        if flood.banDuration > 0 {
+            flood.banned[key] = time.Now().Add(flood.banDuration)
+        }
+        log.Printf("Address %s banned as suspicious\n", key)
+        flood.dirty = true
+        return true
     }
     return false
 }
+
+// checkConnection checks whether the messages from a given CryptoRandom Connection ID should be dropped. If it's okay,
+// returns FALSE.
+func (flood *SimpleDetector) checkConnection(crcid uint) bool {
+    Assert(flood.connSamples)
+
+    flood.Lock()
+    defer flood.Unlock()
+
+    s := getSample(flood.connSamples[crcid], flood.interval)
+    flood.connSamples[crcid] = s
+    if s.cnt == flood.maxConnSamples+1 { // log only once per interval
+        log.Printf("Connection %d exceeded the limit of %d messages\n", crcid, flood.maxConnSamples)
+    }
+    return s.cnt > flood.maxConnSamples
+}
+
+// checkSid checks whether the commands from a given Session ID should be dropped. If it's okay, returns FALSE.
+// Please note that a caller must validate the token first, otherwise a client might throttle someone else's SID
+func (flood *SimpleDetector) checkSid(sid Sid) bool {
+    Assert(flood.sidSamples)
+
+    flood.Lock()
+    defer flood.Unlock()
+
+    s := getSample(flood.sidSamples[sid], flood.interval)
+    flood.sidSamples[sid] = s
+    if s.cnt == flood.maxSidSamples+1 { // log only once per interval
+        log.Printf("Sid %d exceeded the limit of %d commands\n", sid, flood.maxSidSamples)
+    }
+    return s.cnt > flood.maxSidSamples
+}
+
+// cleanUp removes obsolete samples and expired bans (to avoid memory leaks) and saves the ban list if it's changed
+func (flood *SimpleDetector) cleanUp() {
+    flood.Lock()
+
+    for k, s := range flood.samples {
+        if time.Since(s.timestamp) > flood.interval {
+            delete(flood.samples, k)
+        }
+    }
+    for k, s := range flood.connSamples {
+        if time.Since(s.timestamp) > flood.interval {
+            delete(flood.connSamples, k)
+        }
+    }
+    for k, s := range flood.sidSamples {
+        if time.Since(s.timestamp) > flood.interval {
+            delete(flood.sidSamples, k)
+        }
+    }
+    for k, expire := range flood.banned {
+        if !expire.IsZero() && time.Now().After(expire) {
+            delete(flood.banned, k)
+            log.Printf("Ban for address %s expired\n", k)
+            flood.dirty = true
+        }
+    }
+    flood.Unlock()
+
+    Check(flood.save())
+}
+
+// load reads the ban list from the file (if the file doesn't exist, it is NOT an error)
+func (flood *SimpleDetector) load() *Error {
+    if flood.banFile != "" {
+        data, err := ioutil.ReadFile(flood.banFile)
+        if err == nil {
+            err = json.Unmarshal(data, &flood.banned)
+            log.Printf("%d banned addresses loaded\n", len(flood.banned))
+        } else if os.IsNotExist(err) {
+            err = nil
+        }
+        return NewErrFromError(flood, 17, err)
+    }
+    return nil
+}
+
+// save writes the ban list to the file, if it has been changed since the last save. Note that a caller must NOT hold
+// the lock (it is held only to copy the ban list, not while writing the file)
+func (flood *SimpleDetector) save() *Error {
+    if flood.banFile != "" {
+        flood.fileMutex.Lock() // must be acquired first, so that an older copy never overwrites a newer one
+        defer flood.fileMutex.Unlock()
+
+        flood.Lock()
+        if !flood.dirty {
+            flood.Unlock()
+            return nil
+        }
+        flood.dirty = false
+        data, err := json.Marshal(flood.banned)
+        flood.Unlock()
+
+        if err == nil {
+            err = WriteFileAtomic(flood.banFile, data)
+        }
+        return NewErrFromError(flood, 18, err)
+    }
+    return nil
+}
+
+// getSample returns a given sample with the counter incremented, or a brand new sample if the old one is out of date
+// "s" - sample (may be NULL)
+// "interval" - interval of time to count the number of received packets
+func getSample(s *sampleT, interval time.Duration) *sampleT {
+    if s == nil || time.Since(s.timestamp) > interval {
+        s = &sampleT{0, time.Now()}
+    }
+    s.cnt++
+    return s
+}
+
+// getKey returns the host part of a given address, so that a client cannot avoid the ban by changing the port; for
+// IPv6 addresses it returns the prefix in CIDR notation, e.g. "2001:db8:1:2::/64"
+func (flood *SimpleDetector) getKey(addr fmt.Stringer) string {
+    host := addr.String()
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    if ip := net.ParseIP(host); ip != nil && ip.To4() == nil && flood.v6Prefix < 128 {
+        mask := net.CIDRMask(flood.v6Prefix, 128)
+        return fmt.Sprintf("%s/%d", ip.Mask(mask), flood.v6Prefix)
+    }
+    return host
+}
@@ -0,0 +1,106 @@
+package network
+
+import "os"
+import "net"
+import "time"
+import "testing"
+import "io/ioutil"
+import "path/filepath"
+import . "mitrakov.ru/home/winesaps/sid" // nolint
+
+// TestFloodBan checks that an address gets banned after "maxSamples" datagrams, and that the ban list is written to the
+// file by the daemon rather than by a receiving goroutine
+func TestFloodBan(t *testing.T) {
+    dir, er := ioutil.TempDir("", "flood")
+    if er != nil {
+        t.Fatal(er)
+    }
+    defer os.RemoveAll(dir)
+    banFile := filepath.Join(dir, "banned.json")
+    detector, err := NewSimpleDetector(3, 100, 100, time.Hour, 0, banFile, 64)
+    if err != nil {
+        t.Fatal(err)
+    }
+    flood := detector.(*SimpleDetector)
+    defer flood.Close()
+
+    tests := []struct {
+        addr   string
+        banned bool
+    }{
+        {"10.0.0.1:1000", false},
+        {"10.0.0.1:1001", false},
+        {"10.0.0.2:1000", false},
+        {"10.0.0.1:1002", false},
+        {"10.0.0.1:1003", true}, // 4th datagram from the same host
+        {"10.0.0.1:1004", true},
+        {"[2001:db8::1]:1000", false},
+        {"[2001:db8::2]:1000", false},
+        {"[2001:db8::3]:1000", false},
+        {"[2001:db8::4]:1000", true}, // same /64 prefix
+        {"10.0.0.2:1001", false},
+    }
+    for _, test := range tests {
+        addr, _ := net.ResolveUDPAddr("udp", test.addr)
+        if banned := flood.checkBanned(addr); banned != test.banned {
+            t.Errorf("checkBanned(%s) = %v, expected %v", test.addr, banned, test.banned)
+        }
+    }
+    if _, err := ioutil.ReadFile(banFile); err == nil {
+        t.Errorf("Ban list must not be saved synchronously")
+    }
+    flood.cleanUp()
+    if data, err := ioutil.ReadFile(banFile); err != nil || len(data) == 0 {
+        t.Errorf("Ban list is not saved: %v", err)
+    }
+    if len(flood.GetBanned()) != 2 {
+        t.Errorf("Expected 2 banned addresses, got %v", flood.GetBanned())
+    }
+}
+
+// TestFloodConnection checks that connections are throttled independently
+func TestFloodConnection(t *testing.T) {
+    detector, err := NewSimpleDetector(100, 2, 100, time.Hour, 0, "", 64)
+    if err != nil {
+        t.Fatal(err)
+    }
+    flood := detector.(*SimpleDetector)
+    defer flood.Close()
+
+    tests := []struct {
+        crcid     uint
+        throttled bool
+    }{
+        {1, false}, {1, false}, {2, false}, {1, true}, {2, false}, {2, true}, {3, false},
+    }
+    for i, test := range tests {
+        if throttled := flood.checkConnection(test.crcid); throttled != test.throttled {
+            t.Errorf("%d: checkConnection(%d) = %v, expected %v", i, test.crcid, throttled, test.throttled)
+        }
+    }
+}
+
+// TestFloodSid checks that Session IDs are throttled independently of connections
+func TestFloodSid(t *testing.T) {
+    detector, err := NewSimpleDetector(100, 100, 2, time.Hour, 0, "", 64)
+    if err != nil {
+        t.Fatal(err)
+    }
+    flood := detector.(*SimpleDetector)
+    defer flood.Close()
+
+    tests := []struct {
+        sid       Sid
+        throttled bool
+    }{
+        {1, false}, {1, false}, {2, false}, {1, true}, {2, false}, {2, true}, {3, false},
+    }
+    for i, test := range tests {
+        if throttled := flood.checkSid(test.sid); throttled != test.throttled {
+            t.Errorf("%d: checkSid(%d) = %v, expected %v", i, test.sid, throttled, test.throttled)
+        }
+    }
+    if detector.checkConnection(1) {
+        t.Errorf("Connection must not be throttled by SID limits")
+    }
+}
@@ -12,24 +12,38 @@ import . "mitrakov.ru/home/winesaps/utils" // nolint
 
 // IServer is an interface to describe components that could send and receive messages
 type IServer interface {
-    Connect(port uint16) (*net.UDPConn, *Error)
+    Connect(host string, port uint16) (*net.UDPConn, *Error)
     Start()
     Send(sid Sid, data []byte) *Error
     SendAll(box *MailBox)
     GetRps() uint32
+    GetSids() []Sid
+    SupportsLargeMessages(sid Sid) bool
+    CheckSid(sid Sid) bool
+    SetAuthKey(sid Sid, key []byte)
     SetSidHandler(handler ISidHandler)
     SetProtocol(protocol IProtocol)
+    AddProtocol(protocol IProtocol)
+    SetFloodDetector(detector IFloodDetector)
+    GetBanned() map[string]time.Time
+    Unban(addr string) (bool, *Error)
     Close() *Error
 }
 
 // ISidHandler is an interface to handle incoming messages
 type ISidHandler interface {
-    Handle(array []byte) (sid Sid, response []byte)
+    Handle(array []byte, authSupported bool) (sid Sid, response []byte)
+    Disconnected(sid Sid)
 }
 
 // IFloodDetector is an interface to detect and ban suspicious addresses
 type IFloodDetector interface {
     checkBanned(addr fmt.Stringer) bool
+    checkConnection(crcid uint) bool
+    checkSid(sid Sid) bool
+    GetBanned() map[string]time.Time
+    Unban(addr string) (bool, *Error)
+    Close()
 }
 
 // Server is a component that could send and receive messages over a UDP socket.
@@ -39,11 +53,15 @@ type Server struct /*implements IServer, IHandler*/ {
     sync.RWMutex
     socket        *net.UDPConn
     clients       map[Sid]uint
+    keys          map[Sid][]byte // keys to be passed to a protocol as soon as a response to the client is sent
     handler       ISidHandler
     protocol      IProtocol
+    protocols     []IProtocol // additional transports (e.g. WebSocket), checked before the main protocol
+    detector      IFloodDetector
 
     stop          chan bool
     rps           uint32 // requests per second
+    closed        int32  // 1 if the Server is closed
 }
 
 // size (in bytes) to store Google Play json and signature (about 700b)
@@ -54,22 +72,25 @@ const bufSiz = 768
 // "protocol" - an additional protocol over UDP (may be NULL)
 func NewServer(handler ISidHandler, protocol IProtocol) *Server {
     // handler, protocol may be nil
-    return &Server{clients: make(map[Sid]uint), handler: handler, protocol: protocol}
+    return &Server{clients: make(map[Sid]uint), keys: make(map[Sid][]byte), handler: handler, protocol: protocol}
 }
 
-// Connect tries to bind the Server to a given port. This method doesn't block the execution.
-// Method throws error, if: 1) Cannot resolve UDPv4 address; 2) Cannot create a socket
-func (server *Server) Connect(port uint16) (*net.UDPConn, *Error) {
-    udpAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf(":%d", port))
+// Connect tries to bind the Server to a given address. This method doesn't block the execution.
+// Method throws error, if: 1) Cannot resolve UDP address; 2) Cannot create a socket
+// "host" - IPv4 or IPv6 address to bind to (pass "" to listen to all interfaces, both IPv4 and IPv6)
+// "port" - UDP port
+func (server *Server) Connect(host string, port uint16) (*net.UDPConn, *Error) {
+    addr := net.JoinHostPort(host, fmt.Sprint(port))
+    udpAddr, err := net.ResolveUDPAddr("udp", addr)
     if err == nil {
         server.socket, err = net.ListenUDP("udp", udpAddr)
     }
-    log.Println("Server connected to port", port)
+    log.Println("Server connected to", addr)
     return server.socket, NewErrFromError(server, 6, err)
 }
 
-// Start gets the Server started. This method BLOCKS the execution. Ensure the Connect() method is called before this.
-// Please note that all errors are handled inside the method (printed to log)
+// Start gets the Server started. This method BLOCKS the execution till the Server is closed. Ensure the Connect()
+// method is called before this. Please note that all errors are handled inside the method (printed to log)
 func (server *Server) Start() {
     Assert(server.socket)
     
@@ -83,6 +104,9 @@ func (server *Server) Start() {
         n, addr, err := server.socket.ReadFromUDP(buf)
         if err == nil {
             atomic.AddUint32(&curRps, 1)
+            if server.detector != nil && server.detector.checkBanned(addr) {
+                continue // drop the datagram silently
+            }
             msg := buf[0:n]
             if len(msg) > 5 {
                 log.Println(addr, "Recv: ", msg)
@@ -92,6 +116,9 @@ func (server *Server) Start() {
             } else {
                 log.Println("No protocol found. Since 2017-05-12 server must have a protocol")
             }
+        } else if atomic.LoadInt32(&server.closed) > 0 {
+            log.Println("Server stopped")
+            return
         } else {
             log.Println("ReadFromUDP", err) // don't return here {continue listening to a socket}
         }
@@ -136,6 +163,49 @@ func (server *Server) GetRps() (result uint32) {
     return
 }
 
+// GetSids returns Session IDs of all the clients that have ever sent something to the Server
+func (server *Server) GetSids() []Sid {
+    server.RLock()
+    defer server.RUnlock()
+
+    res := make([]Sid, 0, len(server.clients))
+    for sid := range server.clients {
+        res = append(res, sid)
+    }
+    return res
+}
+
+// SupportsLargeMessages checks whether a message larger than a single datagram may be sent to a client with a given
+// Session ID (e.g. the client supports SwUDP v1.3 fragmentation, or uses a stream transport)
+func (server *Server) SupportsLargeMessages(sid Sid) bool {
+    server.RLock()
+    defer server.RUnlock()
+    if crcid, ok := server.clients[sid]; ok {
+        if protocol := server.getProtocol(crcid); protocol != nil {
+            return protocol.SupportsLargeMessages(crcid)
+        }
+    }
+    return false
+}
+
+// CheckSid checks whether the commands from a given Session ID should be dropped by the flood detector. If it's okay,
+// returns FALSE. Please call it only after the token is validated
+// "sid" - client's Session ID
+func (server *Server) CheckSid(sid Sid) bool {
+    return server.detector != nil && server.detector.checkSid(sid)
+}
+
+// SetAuthKey asks a protocol to switch a connection of a client with a given Session ID to authenticated mode. The key
+// is assigned before the response (with the server's public key) is sent, but the protocol starts using it only when
+// the client confirms it, so that retransmissions of the response are still accepted by the client
+// "sid" - client's Session ID
+// "key" - secret key, agreed with a client (see AgreeAuthKey)
+func (server *Server) SetAuthKey(sid Sid, key []byte) {
+    server.Lock()
+    server.keys[sid] = key
+    server.Unlock()
+}
+
 // SetSidHandler assigns a new message handler for the Server. May be NULL
 func (server *Server) SetSidHandler(handler ISidHandler) {
     server.handler = handler
@@ -146,13 +216,49 @@ func (server *Server) SetProtocol(protocol IProtocol) {
     server.protocol = protocol
 }
 
-// Close shuts down the Server
+// AddProtocol adds an additional transport protocol (e.g. WebSocket). Responses to a client are sent via the protocol
+// the client is connected to; if none of additional protocols has such a client, the main protocol is used
+func (server *Server) AddProtocol(protocol IProtocol) {
+    Assert(protocol)
+    server.protocols = append(server.protocols, protocol)
+}
+
+// SetFloodDetector assigns a new misbehaviour detector for the Server. May be NULL
+func (server *Server) SetFloodDetector(detector IFloodDetector) {
+    server.detector = detector
+}
+
+// GetBanned returns all the addresses banned by the flood detector along with the expire times (zero time means
+// "banned forever")
+func (server *Server) GetBanned() map[string]time.Time {
+    if server.detector != nil {
+        return server.detector.GetBanned()
+    }
+    return map[string]time.Time{}
+}
+
+// Unban removes a given address from the ban list. Returns FALSE if the address is not banned
+// "addr" - address (IP without a port)
+func (server *Server) Unban(addr string) (bool, *Error) {
+    if server.detector != nil {
+        return server.detector.Unban(addr)
+    }
+    return false, nil
+}
+
+// Close shuts down the Server; the Start() method returns as soon as the socket is closed
 func (server *Server) Close() *Error {
+    atomic.StoreInt32(&server.closed, 1)
+    if server.stop != nil {
+        server.stop <- true
+    }
+    if server.detector != nil {
+        server.detector.Close()
+    }
     if server.socket != nil {
         err := server.socket.Close()
         return NewErrFromError(server, 8, err)
     }
-    // TODO maybe also stop listening?
     return nil
 }
 
@@ -161,24 +267,78 @@ func (server *Server) Close() *Error {
 func (server *Server) onReceived(crcid uint, msg []byte) /* implements IHandler */ {
     Assert(server.handler)
 
+    // check the limits for a given connection (SID is not checked, because a client may put any SID into a message)
+    if server.detector != nil && server.detector.checkConnection(crcid) {
+        return
+    }
+
     // handling
-    sid, resp := server.handler.Handle(msg)
+    protocol := server.getProtocol(crcid)
+    sid, resp := server.handler.Handle(msg, protocol != nil && protocol.SupportsAuth(crcid))
     if sid > 0 {
         server.Lock()
         server.clients[sid] = crcid
+        key, ok := server.keys[sid]
+        delete(server.keys, sid)
         server.Unlock()
+
+        // switch to authenticated mode, if requested
+        if ok && protocol != nil {
+            Check(protocol.SetAuthKey(crcid, key))
+        }
     }
     if len(resp) > 0 {
         Check(server.send(resp, crcid))
     }
 }
 
+// onConnectionFailed is called when a client with a given CryptoRandom Connection ID has lost the connection (e.g. it
+// doesn't acknowledge the messages anymore); the handler is notified for each Session ID bound to this connection
+func (server *Server) onConnectionFailed(crcid uint) /* implements IHandler */ {
+    if server.handler != nil {
+        var sids []Sid
+        server.RLock()
+        for sid, id := range server.clients {
+            if id == crcid {
+                sids = append(sids, sid)
+            }
+        }
+        server.RUnlock()
+        for _, sid := range sids {
+            server.handler.Disconnected(sid)
+        }
+    }
+}
+
+// isConnected checks whether a given CryptoRandom Connection ID is already bound to a client in any of the protocols
+func (server *Server) isConnected(crcid uint) bool /* implements IHandler */ {
+    if server.protocol != nil && server.protocol.HasConnection(crcid) {
+        return true
+    }
+    for _, protocol := range server.protocols {
+        if protocol.HasConnection(crcid) {
+            return true
+        }
+    }
+    return false
+}
+
 // send transmits given data to a client, expressed by a given CryptoRandom Connection ID
 func (server *Server) send(data []byte, crcid uint) *Error {
     Assert(server.socket)
 
-    if server.protocol != nil {
-        return server.protocol.Send(data, crcid)
+    if protocol := server.getProtocol(crcid); protocol != nil {
+        return protocol.Send(data, crcid)
     }
     return NewErr(server, 9, "No protocol found! Since 2017-05-12 server must have a protocol")
 }
+
+// getProtocol returns a protocol that a client with a given CryptoRandom Connection ID is connected to (may be NULL)
+func (server *Server) getProtocol(crcid uint) IProtocol {
+    for _, protocol := range server.protocols {
+        if protocol.HasConnection(crcid) {
+            return protocol
+        }
+    }
+    return server.protocol
+}
@@ -0,0 +1,225 @@
+// Package network Copyright 2017 mitrakov. All right are reserved. Governed by the BSD license
+package network
+
+import "net"
+import "log"
+import "sync"
+import "time"
+import "crypto/rand"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// streamT is a common part of the protocols over stream transports (TCP, WebSocket). Such transports already
+// guarantee delivery and order of messages, so the only thing we need is to bind a connection to a CryptoRandom
+// Connection ID (crcid), like SwUDP does: a client sends 4 arbitrary bytes in the first message (for compatibility
+// with SwUDP clients it's usually the client's crcid), the server replies with a crcid it has assigned to this
+// connection (4 bytes, big-endian), and since then every message is passed to IHandler as is.
+// Note that the server never uses a crcid proposed by a client, otherwise anyone could take over a crcid of another
+// client (even the one connected via SwUDP) and receive his/her messages.
+// This component is dependent on IHandler.
+type streamT struct {
+    sync.RWMutex
+    name     string
+    conns    map[uint]streamConnT
+    handler  IHandler
+    detector IFloodDetector
+}
+
+// streamConnT is a single stream connection, able to read and write whole messages
+type streamConnT interface {
+    read() ([]byte, error)
+    write(data []byte) error
+    SetReadDeadline(t time.Time) error
+    RemoteAddr() net.Addr
+    Close() error
+}
+
+// Timeout to write a single message to a stream connection
+const writeTimeout = 5 * time.Second
+
+// Max attempts to generate a unique CryptoRandom Connection ID
+const maxCrcidAttempts = 8
+
+// newStream creates a new instance of streamT. Please don't create a streamT manually.
+// "name" - transport name (for logging)
+// "handler" - listener for incoming messages
+// "detector" - misbehaviour detector (may be NULL)
+func newStream(name string, handler IHandler, detector IFloodDetector) streamT {
+    Assert(handler)
+    return streamT{name: name, conns: make(map[uint]streamConnT), handler: handler, detector: detector}
+}
+
+// Send sends a message
+// "data" - message
+// "crcid" - CryptoRandom Connection ID
+func (p *streamT) Send(data []byte, crcid uint) *Error {
+    p.RLock()
+    c, ok := p.conns[crcid]
+    p.RUnlock()
+    if ok {
+        log.Println(c.RemoteAddr(), "Send: ", data)
+        return NewErrFromError(p, 81, c.write(data))
+    }
+    return NewErr(p, 82, "%s connection not found for %d", p.name, crcid)
+}
+
+// OnReceived is not supported, because stream connections read their messages by themselves
+func (p *streamT) OnReceived(data []byte, addr *net.UDPAddr) *Error {
+    return NewErr(p, 83, "%s cannot accept UDP datagrams (%v)", p.name, addr)
+}
+
+// OnReceiverConnected is a callback on a new receiver connected event
+// "crcid" - CryptoRandom Connection ID
+// "addr" - always NULL for stream transports
+func (p *streamT) OnReceiverConnected(crcid uint, addr *net.UDPAddr) *Error {
+    log.Println(p.name, "receiver connected!", crcid)
+    return nil
+}
+
+// OnSenderConnected is a callback on a new sender connected event
+func (p *streamT) OnSenderConnected() {
+    log.Println(p.name, "sender connected!")
+}
+
+// ConnectionFailed is a callback on a connection failed event; the connection will be closed
+// "crcid" - CryptoRandom Connection ID
+func (p *streamT) ConnectionFailed(crcid uint) {
+    p.Lock()
+    c, ok := p.conns[crcid]
+    delete(p.conns, crcid)
+    cnt := len(p.conns)
+    p.Unlock()
+    if ok {
+        Check(NewErrFromError(p, 84, c.Close()))
+    }
+    log.Println(p.name, "connection failed! ", cnt, "connections left")
+    if ok {
+        go p.handler.onConnectionFailed(crcid)
+    }
+}
+
+// HasConnection checks whether a client with a given CryptoRandom Connection ID is connected via this transport
+func (p *streamT) HasConnection(crcid uint) bool {
+    p.RLock()
+    defer p.RUnlock()
+    _, ok := p.conns[crcid]
+    return ok
+}
+
+// SupportsLargeMessages always returns TRUE, because stream transports don't limit the size of a message
+func (p *streamT) SupportsLargeMessages(crcid uint) bool {
+    return true
+}
+
+// SupportsAuth always returns FALSE, because stream transports don't support authenticated mode
+func (p *streamT) SupportsAuth(crcid uint) bool {
+    return false
+}
+
+// SetAuthKey is not supported. Messages are not signed, so anyone who is able to modify the TCP stream (e.g. a proxy
+// or an attacker in the middle) can inject messages; use TLS (e.g. WebSocket behind HTTPS proxy) if you need this
+func (p *streamT) SetAuthKey(crcid uint, key []byte) *Error {
+    return NewErr(p, 88, "%s doesn't support authenticated mode (%d)", p.name, crcid)
+}
+
+// GetSendersCount returns current count of connections
+func (p *streamT) GetSendersCount() uint {
+    p.RLock()
+    defer p.RUnlock()
+    return uint(len(p.conns))
+}
+
+// GetReceiversCount returns current count of connections (each connection is both sender and receiver)
+func (p *streamT) GetReceiversCount() uint {
+    return p.GetSendersCount()
+}
+
+// === PRIVATE FUNCTIONS ===
+
+// serve reads the messages from a given connection till it's closed
+func (p *streamT) serve(c streamConnT) {
+    crcid, connected := uint(0), false
+    for {
+        // if a client doesn't respond more than "guardPeriod" then we kick it off (same as SwUDP Guard)
+        if err := c.SetReadDeadline(time.Now().Add(guardPeriod)); err != nil {
+            break
+        }
+        msg, err := c.read()
+        if err != nil {
+            break // closed by a client, timed out or too long message
+        }
+        if p.detector != nil && p.detector.checkBanned(c.RemoteAddr()) {
+            break
+        }
+        if msg == nil {
+            continue // e.g. WebSocket text frame
+        }
+        if connected {
+            if len(msg) > 0 {
+                log.Println(c.RemoteAddr(), "Recv: ", msg)
+                p.handler.onReceived(crcid, msg)
+            }
+        } else if len(msg) == 4 { // a crcid proposed by a client is ignored (see note above)
+            var err *Error
+            if crcid, err = p.connect(c); err != nil {
+                Check(err)
+                break
+            }
+            connected = true
+            id := []byte{byte(crcid >> 24), byte(crcid >> 16), byte(crcid >> 8), byte(crcid)}
+            Check(NewErrs(NewErrFromError(p, 81, c.write(id)), p.OnReceiverConnected(crcid, nil)))
+        } else {
+            break
+        }
+    }
+    p.disconnect(crcid, c)
+}
+
+// connect binds a connection to a new random CryptoRandom Connection ID which is not used by any protocol of the
+// server, and returns this crcid
+func (p *streamT) connect(c streamConnT) (uint, *Error) {
+    for i := 0; i < maxCrcidAttempts; i++ {
+        id := make([]byte, 4)
+        if _, err := rand.Read(id); err != nil {
+            return 0, NewErrFromError(p, 89, err)
+        }
+        crcid := (uint(id[0]) << 24) | (uint(id[1]) << 16) | (uint(id[2]) << 8) | uint(id[3])
+        if crcid == 0 || p.handler.isConnected(crcid) { // note that isConnected() takes our lock as well
+            continue
+        }
+        p.Lock()
+        _, ok := p.conns[crcid]
+        if !ok {
+            p.conns[crcid] = c
+        }
+        p.Unlock()
+        if !ok {
+            return crcid, nil
+        }
+    }
+    return 0, NewErr(p, 89, "Cannot assign a crcid for %s connection %v", p.name, c.RemoteAddr())
+}
+
+// disconnect closes a given connection and unbinds it from the CryptoRandom Connection ID (unless the crcid has been
+// already taken by a newer connection); the handler is notified only if the connection has been unbound
+func (p *streamT) disconnect(crcid uint, c streamConnT) {
+    p.Lock()
+    found := p.conns[crcid] == c
+    if found {
+        delete(p.conns, crcid)
+    }
+    p.Unlock()
+    c.Close() // nolint (connection might be already closed)
+    if found {
+        p.handler.onConnectionFailed(crcid)
+    }
+}
+
+// closeAll closes all the connections
+func (p *streamT) closeAll() {
+    p.Lock()
+    defer p.Unlock()
+    for crcid, c := range p.conns {
+        Check(NewErrFromError(p, 84, c.Close()))
+        delete(p.conns, crcid)
+    }
+}
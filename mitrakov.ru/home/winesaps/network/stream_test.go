@@ -0,0 +1,61 @@
+package network
+
+import "io"
+import "net"
+import "sync"
+import "bufio"
+import "testing"
+
+// testHandlerT is a stub for IHandler with a given set of crcids connected via other protocols
+type testHandlerT struct {
+    sync.Mutex
+    connected map[uint]bool
+}
+
+func (h *testHandlerT) onReceived(crcid uint, msg []byte) {}
+
+func (h *testHandlerT) onConnectionFailed(crcid uint) {}
+
+func (h *testHandlerT) isConnected(crcid uint) bool {
+    h.Lock()
+    defer h.Unlock()
+    return h.connected[crcid]
+}
+
+// TestStreamCrcid checks that a stream connection cannot take over a crcid proposed by a client
+func TestStreamCrcid(t *testing.T) {
+    victim := []byte{0x12, 0x34, 0x56, 0x78}
+    handler := &testHandlerT{connected: map[uint]bool{0x12345678: true}}
+    p := NewTCPProtocol(handler, nil)
+
+    tests := []struct {
+        proposed []byte
+    }{
+        {victim}, // crcid of a SwUDP client
+        {victim}, // the same crcid again (e.g. a page reloaded)
+        {[]byte{0, 0, 0, 1}},
+    }
+    assigned := map[uint]bool{}
+    for _, test := range tests {
+        server, client := net.Pipe()
+        go p.serve(&tcpConnT{Conn: server, reader: bufio.NewReaderSize(server, bufSiz)})
+
+        if _, err := client.Write(append([]byte{0, 4}, test.proposed...)); err != nil {
+            t.Fatal(err)
+        }
+        reply := make([]byte, 6)
+        if _, err := io.ReadFull(client, reply); err != nil {
+            t.Fatal(err)
+        }
+        crcid := (uint(reply[2]) << 24) | (uint(reply[3]) << 16) | (uint(reply[4]) << 8) | uint(reply[5])
+        if reply[0] != 0 || reply[1] != 4 || crcid == 0 || crcid == 0x12345678 || assigned[crcid] {
+            t.Errorf("Incorrect crcid assigned: %v", reply)
+        }
+        if !p.HasConnection(crcid) || p.HasConnection(0x12345678) {
+            t.Errorf("Connection %d is not bound", crcid)
+        }
+        assigned[crcid] = true
+        defer client.Close() // nolint
+    }
+    p.Close()
+}
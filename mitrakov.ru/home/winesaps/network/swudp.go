@@ -1,19 +1,31 @@
 // Package network Copyright 2017 mitrakov. All right are reserved. Governed by the BSD license
 package network
 
+import "io"
 import "net"
 import "log"
 import "sync"
 import "time"
+import "sync/atomic"
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/binary"
+import "golang.org/x/crypto/hkdf"
+import "golang.org/x/crypto/curve25519"
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 
-// IProtocol is an interface for network protocols that may be implemented over UDP
+// IProtocol is an interface for network protocols that may be implemented over UDP (or over another transport)
 type IProtocol interface {
     Send(data []byte, crcid uint) *Error
     OnReceived(data []byte, addr *net.UDPAddr) *Error
     OnSenderConnected()
     OnReceiverConnected(crcid uint, addr *net.UDPAddr) *Error
     ConnectionFailed(crcid uint)
+    HasConnection(crcid uint) bool
+    SupportsLargeMessages(crcid uint) bool
+    SupportsAuth(crcid uint) bool
+    SetAuthKey(crcid uint, key []byte) *Error
     GetSendersCount() uint
     GetReceiversCount() uint
     Close()
@@ -22,6 +34,8 @@ type IProtocol interface {
 // IHandler is an interface for receivers of IProtocol
 type IHandler interface {
     onReceived(crcid uint, msg []byte)
+    onConnectionFailed(crcid uint)
+    isConnected(crcid uint) bool
 }
 
 // =======================
@@ -29,13 +43,28 @@ type IHandler interface {
 // =======================
 
 // SwUDP is a "Simple Wrapper over UDP" protocol designed by @mitrakov to provide guaranteed delivery of messages.
-// See SwUDP v1.2 specification for more details
+// See SwUDP v1.2 specification for more details.
+// Since v1.3 SwUDP supports fragmentation: if a client sends "synFrag" byte in its SYN packet, then each payload is
+// prefixed with a fragment flag ("moreFragments" or "lastFragment"), and messages larger than "maxFragment" are split
+// into several packets. Since SwUDP preserves the order of packets, a receiver just concatenates fragments till the
+// last one. Clients sending "syn" packets with any other data still work according to v1.2.
+// Since v1.4 SwUDP supports authenticated mode: when a key is assigned to a connection (see SetAuthKey), a client is
+// expected to sign all its datagrams (including Acks and SYN): each datagram is suffixed with a counter ("ctrLen"
+// bytes, big-endian, must grow with every datagram) and a truncated HMAC-SHA256 ("macLen" bytes) of the datagram along
+// with the counter. As soon as the first signed datagram is received, the mode is switched on: since then all outgoing
+// datagrams are signed as well (including retransmissions), and incoming datagrams with a wrong or absent HMAC, or with
+// a counter seen before or older than "replayWindow" datagrams (i.e. replayed), are dropped; datagrams within the
+// window may arrive out of order. Connections without a key work as before.
+// The key itself is never sent over the wire: it is derived from X25519 key agreement (see AgreeAuthKey) by HKDF.
+// Note that the agreement is not authenticated, so the mode gives no confidentiality and protects against spoofing and
+// passive sniffing, but not against an active man-in-the-middle.
 type SwUDP struct /*implements IProtocol*/ {
     sync.RWMutex
     socket    *net.UDPConn
     senders   map[uint]*senderT
     receivers map[uint]*receiverT
     addresses map[uint]*net.UDPAddr
+    keys      map[uint]*authT
     handler   IHandler
     stop1     chan bool
     stop2     chan bool
@@ -55,6 +84,9 @@ const maxAttempts = 9
 const period = 10 * time.Millisecond
 // SwUDP Maximum of pending messages to store in receiver buffer in case of packet loss
 const maxPending = 5
+// SwUDP Maximum of packets sent but not acknowledged yet; other packets wait in the sender's queue, so that a remote
+// receiver never has "maxPending" packets pending, and IDs never wrap around the ring
+const window = maxPending
 // SwUDP Minimum threshold for Smoothed Round Trip Time, in ticks
 const minSRTT float32 = 2
 // SwUDP Default Smoothed Round Trip Time, in ticks
@@ -65,6 +97,33 @@ const maxSRTT float32 = 12.5
 const rc = 0.8
 // SwUDP Assurance coefficient
 const ac = 2.2
+// SwUDP v1.2 fake data for SYN packets
+const synLegacy = 0xFD
+// SwUDP v1.3 data for SYN packets (fragmentation supported)
+const synFrag = 0xFE
+// SwUDP v1.3 fragment flag: more fragments follow
+const moreFragments = 1
+// SwUDP v1.3 fragment flag: last (or the only) fragment of a message
+const lastFragment = 0
+// SwUDP v1.3 max size of a fragment, in bytes
+const maxFragment = 512
+// SwUDP v1.3 max size of a message, in bytes
+const maxMessage = 32 * maxFragment
+// SwUDP v1.3 maximum of pending fragments to store in receiver buffer in case of packet loss (a client may send all the
+// fragments of a message at once)
+const maxPendingFragments = maxMessage/maxFragment + 1
+// SwUDP v1.4 length of a truncated HMAC, in bytes
+const macLen = 8
+// SwUDP v1.4 length of a counter of signed datagrams, in bytes
+const ctrLen = 4
+// SwUDP v1.4 size of a replay window: how many datagrams before the newest one may still arrive out of order
+const replayWindow = 64
+// AuthPublicKeyLen is SwUDP v1.4 length of X25519 public keys, in bytes
+const AuthPublicKeyLen = 32
+// SwUDP v1.4 length of a secret key derived by HKDF, in bytes
+const authKeyLen = 16
+// SwUDP v1.4 HKDF context string
+const authInfo = "winesaps swudp v1.4"
 // Polling interval for SwUDP Guard (if a client doesn't respond more than "guardPeriod" then we kick it off)
 const guardPeriod = 10 * time.Minute
 
@@ -75,7 +134,7 @@ func NewSwUDP(socket *net.UDPConn, handler IHandler) IProtocol {
     Assert(socket, handler)
 
     res := &SwUDP{socket: socket, senders: make(map[uint]*senderT), receivers: make(map[uint]*receiverT), 
-        addresses: make(map[uint]*net.UDPAddr), handler: handler}
+        addresses: make(map[uint]*net.UDPAddr), keys: make(map[uint]*authT), handler: handler}
     res.stop1 = RunDaemon("swudp", period, func() {
         res.RLock()
         for _, s := range res.senders {
@@ -128,6 +187,12 @@ func (p *SwUDP) OnReceived(data []byte, addr *net.UDPAddr) *Error {
     if len(data) >= 5 {
         id := data[0]
         crcid := (uint(data[1]) << 24) | (uint(data[2]) << 16) | (uint(data[3]) << 8) | uint(data[4])
+
+        // verify HMAC (for authenticated connections only)
+        data, ok := p.authenticate(crcid, data)
+        if !ok {
+            return NewErr(p, 86, "Incorrect HMAC from %v (crcid %d)", addr, crcid)
+        }
     
         // remember the address
         p.Lock()
@@ -155,7 +220,7 @@ func (p *SwUDP) OnReceiverConnected(crcid uint, addr *net.UDPAddr) *Error {
     log.Println(addr, "Receiver connected!", crcid)
     sender := p.getSender(crcid)
     Assert(sender)
-    return sender.connect(crcid, addr)
+    return sender.connect(crcid, addr, p.SupportsLargeMessages(crcid))
 }
 
 // OnSenderConnected is a callback on a new sender connected event
@@ -169,9 +234,57 @@ func (p *SwUDP) ConnectionFailed(crcid uint) {
     p.Lock()
     delete(p.senders, crcid)
     delete(p.receivers, crcid)
+    delete(p.keys, crcid) // a client has to sign in again to get a new key
     s, r := len(p.senders), len(p.receivers)
     p.Unlock()
     log.Println("Connection failed! ", s, "senders and", r, " receivers left")
+    go p.handler.onConnectionFailed(crcid) // it may be called under the sender's lock, so let's use a goroutine
+}
+
+// HasConnection checks whether a client with a given CryptoRandom Connection ID has ever sent something to SwUDP
+func (p *SwUDP) HasConnection(crcid uint) bool {
+    p.RLock()
+    defer p.RUnlock()
+    _, ok := p.addresses[crcid]
+    return ok
+}
+
+// SupportsLargeMessages checks whether a client with a given CryptoRandom Connection ID supports fragmentation (v1.3)
+func (p *SwUDP) SupportsLargeMessages(crcid uint) bool {
+    p.RLock()
+    defer p.RUnlock()
+    if receiver, ok := p.receivers[crcid]; ok {
+        return atomic.LoadInt32(&receiver.fragmented) != 0 // receiver may be locked by the caller, see onMsg()
+    }
+    return false
+}
+
+// SupportsAuth always returns TRUE, because SwUDP supports authenticated mode since v1.4
+func (p *SwUDP) SupportsAuth(crcid uint) bool {
+    return true
+}
+
+// SetAuthKey assigns a key to a connection with a given CryptoRandom Connection ID; the connection is switched to
+// authenticated mode (SwUDP v1.4) as soon as the client signs a datagram with this key. Till then a previous key of
+// the connection (if any) is still in use
+// "crcid" - SwUDP CryptoRandom Connection ID
+// "key" - secret key, shared with a client
+func (p *SwUDP) SetAuthKey(crcid uint, key []byte) *Error {
+    if len(key) == 0 {
+        return NewErr(p, 87, "Empty key for %d", crcid)
+    }
+    p.Lock()
+    auth := &authT{key: key, previous: p.keys[crcid]}
+    p.keys[crcid] = auth
+    if sender, ok := p.senders[crcid]; ok {
+        sender.setAuth(auth)
+    }
+    if receiver, ok := p.receivers[crcid]; ok {
+        receiver.setAuth(auth)
+    }
+    p.Unlock()
+    log.Println("Authenticated mode requested for", crcid)
+    return nil
 }
 
 // GetSendersCount returns current count of Senders. This value might be inaccurate if some clients "fell off"
@@ -195,6 +308,29 @@ func (p *SwUDP) Close() {
     p.stop2 <- true
 }
 
+// authenticate verifies a signature of a given datagram and returns the datagram without the signature. Unsigned
+// datagrams are accepted only if the connection has no key, or the key is not confirmed by the client yet
+// "crcid" - SwUDP CryptoRandom Connection ID
+// "data" - datagram
+func (p *SwUDP) authenticate(crcid uint, data []byte) ([]byte, bool) {
+    p.RLock()
+    auth, ok := p.keys[crcid]
+    p.RUnlock()
+    if !ok {
+        return data, true
+    }
+    if payload, ok := auth.verify(data); ok {
+        return payload, true
+    }
+    if confirmed, previous := auth.getState(); !confirmed {
+        if previous == nil {
+            return data, true // a client hasn't received the key yet
+        }
+        return previous.verify(data)
+    }
+    return nil, false
+}
+
 // getSender returns a Sender by its CryptoRandom Connection ID. Note: DO NOT access "senders" array directly!
 func (p *SwUDP) getSender(crcid uint) *senderT {
     p.Lock()
@@ -203,7 +339,7 @@ func (p *SwUDP) getSender(crcid uint) *senderT {
         sender.lastTime = time.Now()
         return sender
     }
-    p.senders[crcid] = newSender(p.socket, p)
+    p.senders[crcid] = newSender(p.socket, p, p.keys[crcid])
     return p.senders[crcid]
 }
 
@@ -215,7 +351,7 @@ func (p *SwUDP) getReceiver(crcid uint) *receiverT {
         receiver.lastTime = time.Now()
         return receiver
     }
-    p.receivers[crcid] = newReceiver(p.socket, p.handler, p)
+    p.receivers[crcid] = newReceiver(p.socket, p.handler, p, p.keys[crcid])
     return p.receivers[crcid]
 }
 
@@ -223,6 +359,17 @@ func (p *SwUDP) getReceiver(crcid uint) *receiverT {
 // === COMMON TYPES ===
 // ====================
 
+// SwUDP v1.4 state of an authenticated connection
+type authT struct {
+    sync.Mutex
+    key       []byte
+    confirmed bool   // TRUE if a client has signed at least one datagram with the key
+    sent      uint32 // counter of signed outgoing datagrams
+    received  uint32 // counter of the newest incoming datagram
+    window    uint64 // bit "i" is set if a datagram with counter "received - i" has been received
+    previous  *authT // a key to be used till this one is confirmed (may be NULL)
+}
+
 // SwUDP item
 type itemT struct {
     ack        bool
@@ -244,10 +391,14 @@ type senderT struct {
     id          byte
     expectedAck byte
     connected   bool
+    fragmented  bool
     srtt        float32
     totalTicks  uint
     crcid       uint
     buffer      [n]*itemT
+    inFlight    int      // count of packets in the buffer
+    queue       []*itemT // packets waiting for the window (see "window")
+    auth        *authT
     socket      *net.UDPConn
     protocol    IProtocol
     lastTime    time.Time
@@ -256,52 +407,102 @@ type senderT struct {
 // newSender creates a new instance of senderT. Please don't create a senderT manually.
 // "socket" - standard UDP connection
 // "protocol" - back reference to IProtocol
-func newSender(socket *net.UDPConn, protocol IProtocol) *senderT {
+// "auth" - state to sign the datagrams (NULL for non-authenticated connections)
+func newSender(socket *net.UDPConn, protocol IProtocol, auth *authT) *senderT {
     Assert(socket, protocol)
-    return &senderT{socket: socket, protocol: protocol, lastTime: time.Now()}
+    return &senderT{socket: socket, protocol: protocol, auth: auth, lastTime: time.Now()}
+}
+
+// setAuth assigns a state to sign the datagrams (SwUDP v1.4)
+func (s *senderT) setAuth(auth *authT) {
+    s.Lock()
+    s.auth = auth
+    s.Unlock()
 }
 
 // connect connects to a remote SwUDP receiver
 // "crcID" - SwUDP CryptoRandom Connection ID
 // "addr" - UDP socket address
-func (s *senderT) connect(crcID uint, addr *net.UDPAddr) (err *Error) {
+// "fragmented" - TRUE if the remote side supports fragmentation (SwUDP v1.3)
+func (s *senderT) connect(crcID uint, addr *net.UDPAddr, fragmented bool) (err *Error) {
     s.Lock()
     s.crcid = crcID
+    s.fragmented = fragmented
     s.id = syn
     s.expectedAck = syn
     s.srtt = defaultSRTT
     s.totalTicks = 0
     s.connected = false
-    for j := range s.buffer {
-        s.buffer[j] = nil
-    }
-    msg := []byte{s.id, byte(s.crcid >> 24), byte(s.crcid >> 16), byte(s.crcid >> 8), byte(s.crcid), 0xFD} // fake data
+    s.clear()
+    msg := []byte{s.id, byte(s.crcid >> 24), byte(s.crcid >> 16), byte(s.crcid >> 8), byte(s.crcid),
+        Ternary(fragmented, synFrag, synLegacy)}
     s.buffer[s.id] = &itemT{msg: msg, addr: addr}
+    s.inFlight++
     log.Println(addr, "Send: ", msg)
-    _, er := s.socket.WriteToUDP(msg, addr)
+    _, er := s.socket.WriteToUDP(s.auth.sign(msg), addr)
     err = NewErrFromError(s, 12, er)
     s.Unlock()
     return
 }
 
-// send sends the given message to the remote SwUDP receiver
+// send sends the given message to the remote SwUDP receiver (split into fragments, if the receiver supports it). If
+// there are "window" packets not acknowledged yet, the message is queued and sent as soon as Acks arrive
 // "msg" - message
 // "addr" - UDP socket address
 func (s *senderT) send(msg []byte, addr *net.UDPAddr) *Error {
     if s.connected {
         s.Lock()
-        s.id = next(s.id)
-        data := append([]byte{s.id, byte(s.crcid >> 24), byte(s.crcid >> 16), byte(s.crcid >> 8), byte(s.crcid)},
-            msg...)
-        s.buffer[s.id] = &itemT{startRtt: s.totalTicks, msg: data, addr: addr}
-        s.Unlock()
-        log.Println(addr, "Send: ", data)
-        _, er := s.socket.WriteToUDP(data, addr)
-        return NewErrFromError(s, 13, er)
+        defer s.Unlock() // hold the lock till the last fragment, so that fragments of 2 messages don't interleave
+        if s.fragmented {
+            if len(msg) > maxMessage {
+                return NewErr(s, 19, "Message too long (%d bytes)", len(msg))
+            }
+            for ; len(msg) > maxFragment; msg = msg[maxFragment:] {
+                s.queue = append(s.queue, &itemT{msg: append([]byte{moreFragments}, msg[:maxFragment]...), addr: addr})
+            }
+            msg = append([]byte{lastFragment}, msg...)
+        }
+        s.queue = append(s.queue, &itemT{msg: msg, addr: addr})
+        return s.flush()
     }
     return NewErr(s, 14, "Not connected %v", addr)
 }
 
+// flush sends the queued packets while there are less than "window" packets not acknowledged. Please ensure the
+// context is synchronized!
+func (s *senderT) flush() (err *Error) {
+    for len(s.queue) > 0 && s.inFlight < window {
+        item := s.queue[0]
+        s.queue[0] = nil
+        s.queue = s.queue[1:]
+        err = NewErrs(err, s.sendPacket(item.msg, item.addr))
+    }
+    return
+}
+
+// clear removes all the packets from the buffer and the queue. Please ensure the context is synchronized!
+func (s *senderT) clear() {
+    for j := range s.buffer {
+        s.buffer[j] = nil
+    }
+    s.queue = nil
+    s.inFlight = 0
+}
+
+// sendPacket sends a single SwUDP packet. Please ensure the context is synchronized!
+// "payload" - packet payload
+// "addr" - UDP socket address
+func (s *senderT) sendPacket(payload []byte, addr *net.UDPAddr) *Error {
+    s.id = next(s.id)
+    s.inFlight++
+    data := append([]byte{s.id, byte(s.crcid >> 24), byte(s.crcid >> 16), byte(s.crcid >> 8), byte(s.crcid)},
+        payload...)
+    s.buffer[s.id] = &itemT{startRtt: s.totalTicks, msg: data, addr: addr}
+    log.Println(addr, "Send: ", data)
+    _, er := s.socket.WriteToUDP(s.auth.sign(data), addr)
+    return NewErrFromError(s, 13, er)
+}
+
 // onAck is a callback on Ack packet received
 // "ack" - Ack packet from the remote SwUDP receiver
 func (s *senderT) onAck(ack byte) {
@@ -320,11 +521,12 @@ func (s *senderT) onAck(ack byte) {
         s.protocol.OnSenderConnected()
     } else if ack == errAck {
         s.connected = false
-        for j := range s.buffer {
-            s.buffer[j] = nil
-        }
+        s.clear()
         s.protocol.ConnectionFailed(s.crcid)
     }
+    if s.connected {
+        Check(s.flush())
+    }
     s.Unlock()
 }
 
@@ -334,6 +536,7 @@ func (s *senderT) accept() {
     if s.buffer[s.expectedAck] != nil {
         if s.buffer[s.expectedAck].ack {
             s.buffer[s.expectedAck] = nil
+            s.inFlight--
             s.expectedAck = next(s.expectedAck)
             s.accept()
         }
@@ -350,9 +553,7 @@ func (s *senderT) trigger() {
     if s.buffer[i] != nil && !s.buffer[i].ack {
         if s.buffer[i].attempt > maxAttempts {
             s.connected = false
-            for j := range s.buffer {
-                s.buffer[j] = nil
-            }
+            s.clear()
             s.protocol.ConnectionFailed(s.crcid)
             return
         } else if s.buffer[i].ticks == s.buffer[i].nextRepeat {
@@ -360,7 +561,8 @@ func (s *senderT) trigger() {
             s.buffer[i].nextRepeat += uint(ac * s.srtt * float32(s.buffer[i].attempt))
             if s.buffer[i].attempt > 1 {
                 s.buffer[i].startRtt = s.totalTicks
-                _, er := s.socket.WriteToUDP(s.buffer[i].msg, s.buffer[i].addr) // msg already contains id and crcid
+                // msg already contains id and crcid, but it's signed again (the key or the counter might be changed)
+                _, er := s.socket.WriteToUDP(s.auth.sign(s.buffer[i].msg), s.buffer[i].addr)
                 Check(er)
             }
         }
@@ -375,10 +577,14 @@ func (s *senderT) trigger() {
 // SwUDP Receiver
 type receiverT struct {
     sync.Mutex
-    expected  byte
-    connected bool
-    pending   byte
+    expected   byte
+    connected  bool
+    fragmented int32 // 1 if the remote side supports fragmentation (atomic, see SupportsLargeMessages)
+    pending    byte
+    assembly   []byte
+    discarding bool
     buffer    [n]*itemT
+    auth      *authT
     socket    *net.UDPConn
     handler   IHandler
     protocol  IProtocol
@@ -389,9 +595,17 @@ type receiverT struct {
 // "socket" - standard UDP connection
 // "handler" - handler for incoming messages
 // "protocol" - back reference to IProtocol
-func newReceiver(socket *net.UDPConn, handler IHandler, protocol IProtocol) *receiverT {
+// "auth" - state to sign the Acks (NULL for non-authenticated connections)
+func newReceiver(socket *net.UDPConn, handler IHandler, protocol IProtocol, auth *authT) *receiverT {
     Assert(socket, handler, protocol)
-    return &receiverT{socket: socket, handler: handler, protocol: protocol, lastTime: time.Now()}
+    return &receiverT{socket: socket, handler: handler, protocol: protocol, auth: auth, lastTime: time.Now()}
+}
+
+// setAuth assigns a state to sign the Acks (SwUDP v1.4)
+func (r *receiverT) setAuth(auth *authT) {
+    r.Lock()
+    r.auth = auth
+    r.Unlock()
 }
 
 // onMsg is a callback on a new message received
@@ -403,25 +617,35 @@ func (r *receiverT) onMsg(id byte, crcid uint, msg []byte, addr *net.UDPAddr) (e
     r.Lock()
     ack := []byte{id, byte(crcid >> 24), byte(crcid >> 16), byte(crcid >> 8), byte(crcid)}
     if id == syn {
-        _, er1 := r.socket.WriteToUDP(ack, addr)
+        _, er1 := r.socket.WriteToUDP(r.auth.sign(ack), addr)
         for j := range r.buffer {
             r.buffer[j] = nil
         }
         r.expected = next(id)
         r.connected = true
+        atomic.StoreInt32(&r.fragmented, 0)
+        if len(msg) > 0 && msg[0] == synFrag {
+            atomic.StoreInt32(&r.fragmented, 1)
+        }
         r.pending = 0
+        r.assembly = nil
+        r.discarding = false
         er2 := r.protocol.OnReceiverConnected(crcid, addr)
         err = NewErrs(NewErrFromError(r, 15, er1), er2)
     } else if r.connected {
-        _, er := r.socket.WriteToUDP(ack, addr)
+        _, er := r.socket.WriteToUDP(r.auth.sign(ack), addr)
         err = NewErrFromError(r, 16, er)
         if id == r.expected {
-            r.handler.onReceived(crcid, msg)
+            r.deliver(crcid, msg)
             r.expected = next(id)
             r.pending = 0
             r.accept(crcid)
         } else if after(id, r.expected) {
-            if r.pending++; r.pending < maxPending {
+            limit := byte(maxPending)
+            if atomic.LoadInt32(&r.fragmented) != 0 {
+                limit = maxPendingFragments
+            }
+            if r.pending++; r.pending < limit {
                 r.buffer[id] = &itemT{msg: msg}
             } else {
                 r.connected = false
@@ -433,7 +657,7 @@ func (r *receiverT) onMsg(id byte, crcid uint, msg []byte, addr *net.UDPAddr) (e
         }
     } else {
         ack[0] = errAck
-        _, er := r.socket.WriteToUDP(ack, addr)
+        _, er := r.socket.WriteToUDP(r.auth.sign(ack), addr)
         err = NewErrFromError(r, 16, er)
     }
     r.Unlock()
@@ -444,13 +668,139 @@ func (r *receiverT) onMsg(id byte, crcid uint, msg []byte, addr *net.UDPAddr) (e
 // "crcid" - CryptoRandom Connection ID
 func (r *receiverT) accept(crcid uint) {
     if r.buffer[r.expected] != nil {
-        r.handler.onReceived(crcid, r.buffer[r.expected].msg)
+        r.deliver(crcid, r.buffer[r.expected].msg)
         r.buffer[r.expected] = nil
         r.expected = next(r.expected)
         r.accept(crcid)
     }
 }
 
+// deliver transmits a given payload to the handler; for SwUDP v1.3 it concatenates fragments till the last one
+// "crcid" - CryptoRandom Connection ID
+// "payload" - packet payload
+func (r *receiverT) deliver(crcid uint, payload []byte) {
+    if atomic.LoadInt32(&r.fragmented) == 0 {
+        r.handler.onReceived(crcid, payload)
+        return
+    }
+    if len(payload) > 0 {
+        if !r.discarding {
+            r.assembly = append(r.assembly, payload[1:]...)
+        }
+        if len(r.assembly) > maxMessage {
+            log.Println("Message too long, discarded", crcid)
+            r.assembly = nil
+            r.discarding = true // skip the rest of fragments
+        }
+        if payload[0] == lastFragment {
+            msg := r.assembly
+            r.assembly = nil
+            if !r.discarding {
+                r.handler.onReceived(crcid, msg)
+            }
+            r.discarding = false
+        }
+    }
+}
+
+// =============================
+// === SWUDP v1.4 FUNCTIONS ===
+// =============================
+
+// sign returns a copy of a given datagram suffixed with the next counter value and a truncated HMAC; if the key is not
+// confirmed by a client yet, the previous key is used. For non-authenticated connections returns the datagram as is
+// "data" - datagram to sign
+func (a *authT) sign(data []byte) []byte {
+    if a == nil {
+        return data
+    }
+    a.Lock()
+    if !a.confirmed {
+        a.Unlock()
+        return a.previous.sign(data)
+    }
+    a.sent++
+    res := append(append([]byte{}, data...), byte(a.sent >> 24), byte(a.sent >> 16), byte(a.sent >> 8), byte(a.sent))
+    a.Unlock()
+    return append(res, mac(a.key, res)...)
+}
+
+// verify checks HMAC and the counter of a given datagram, and returns the datagram without them; on success the key
+// gets confirmed. Since datagrams are handled concurrently, they may be verified out of order, so the counter is
+// checked against a sliding window of "replayWindow" recent counters rather than against the newest one
+// "data" - signed datagram
+func (a *authT) verify(data []byte) ([]byte, bool) {
+    if len(data) < 5+ctrLen+macLen {
+        return nil, false
+    }
+    signed := data[:len(data)-macLen]
+    if !hmac.Equal(data[len(data)-macLen:], mac(a.key, signed)) {
+        return nil, false
+    }
+    ctr := binary.BigEndian.Uint32(signed[len(signed)-ctrLen:])
+    a.Lock()
+    defer a.Unlock()
+    if ctr > a.received {
+        if shift := ctr - a.received; shift < replayWindow {
+            a.window = a.window<<shift | 1
+        } else {
+            a.window = 1
+        }
+        a.received = ctr
+    } else if diff := a.received - ctr; ctr > 0 && diff < replayWindow && a.window&(1<<diff) == 0 {
+        a.window |= 1 << diff
+    } else {
+        return nil, false // replayed or too old datagram
+    }
+    a.confirmed = true
+    a.previous = nil
+    return signed[:len(signed)-ctrLen], true
+}
+
+// getState returns whether the key is confirmed, and the previous key (may be NULL)
+func (a *authT) getState() (confirmed bool, previous *authT) {
+    a.Lock()
+    defer a.Unlock()
+    return a.confirmed, a.previous
+}
+
+// mac returns a truncated HMAC-SHA256 ("macLen" bytes) of given data
+// "key" - secret key
+// "data" - datagram to sign
+func mac(key, data []byte) []byte {
+    h := hmac.New(sha256.New, key)
+    h.Write(data) // nolint (hash.Hash never returns an error)
+    return h.Sum(nil)[:macLen]
+}
+
+// AgreeAuthKey performs SwUDP v1.4 key agreement: it generates an ephemeral X25519 key pair, computes a shared secret
+// with a given client's public key, and derives a secret key for SetAuthKey by HKDF-SHA256 (both public keys are used
+// as a salt). Returns the server's public key to be sent to the client, and the secret key that must never be sent
+// "peerKey" - client's public key ("AuthPublicKeyLen" bytes)
+func AgreeAuthKey(peerKey []byte) (publicKey, key []byte, err *Error) {
+    if len(peerKey) != AuthPublicKeyLen {
+        return nil, nil, NewErr(&SwUDP{}, 143, "Incorrect public key length %d", len(peerKey))
+    }
+    private := make([]byte, curve25519.ScalarSize)
+    if _, er := rand.Read(private); er != nil {
+        return nil, nil, NewErrFromError(&SwUDP{}, 143, er)
+    }
+    publicKey, er := curve25519.X25519(private, curve25519.Basepoint)
+    if er != nil {
+        return nil, nil, NewErrFromError(&SwUDP{}, 143, er)
+    }
+    shared, er := curve25519.X25519(private, peerKey) // fails for low-order points (e.g. all zeros)
+    if er != nil {
+        return nil, nil, NewErrFromError(&SwUDP{}, 143, er)
+    }
+    key = make([]byte, authKeyLen)
+    salt := append(append([]byte{}, peerKey...), publicKey...)
+    if _, er = io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(authInfo)), key); er != nil {
+        return nil, nil, NewErrFromError(&SwUDP{}, 143, er)
+    }
+    return publicKey, key, nil
+}
+
 // next returns the next SwUDP ID (number in range 2-255)
 // "n" - current SwUDP ID
 func next(n byte) byte {
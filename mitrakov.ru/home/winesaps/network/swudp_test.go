@@ -0,0 +1,319 @@
+package network
+
+import "io"
+import "net"
+import "time"
+import "bytes"
+import "testing"
+import "crypto/rand"
+import "crypto/sha256"
+import "golang.org/x/crypto/hkdf"
+import "golang.org/x/crypto/curve25519"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// swudpHandlerT is a stub for IHandler that passes all the received messages to a channel
+type swudpHandlerT struct {
+    received chan []byte
+    failed   chan uint
+}
+
+func (h *swudpHandlerT) onReceived(crcid uint, msg []byte) {
+    h.received <- append([]byte{}, msg...)
+}
+
+func (h *swudpHandlerT) onConnectionFailed(crcid uint) {
+    h.failed <- crcid
+}
+
+func (h *swudpHandlerT) isConnected(crcid uint) bool {
+    return false
+}
+
+// swudpClientT is a minimal SwUDP v1.3 client for tests
+type swudpClientT struct {
+    t      *testing.T
+    conn   *net.UDPConn
+    server *net.UDPAddr
+    crcid  []byte
+}
+
+// newSwUDPPair starts SwUDP on a local socket and connects a client with fragmentation support to it
+func newSwUDPPair(t *testing.T) (*SwUDP, *swudpHandlerT, *swudpClientT) {
+    socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    handler := &swudpHandlerT{received: make(chan []byte, 16), failed: make(chan uint, 16)}
+    p := NewSwUDP(socket, handler).(*SwUDP)
+    go func() {
+        buf := make([]byte, 2*maxFragment)
+        for {
+            k, addr, err := socket.ReadFromUDP(buf)
+            if err != nil {
+                return
+            }
+            Check(p.OnReceived(append([]byte{}, buf[:k]...), addr))
+        }
+    }()
+    client := &swudpClientT{t, conn, socket.LocalAddr().(*net.UDPAddr), []byte{0, 0, 0, 7}}
+
+    // SYN from the client => Ack and SYN from the server => Ack from the client
+    client.write(append([]byte{syn}, append(client.crcid, synFrag)...))
+    for synReceived := false; !synReceived; {
+        packet := client.read(time.Second)
+        synReceived = len(packet) > 5 && packet[0] == syn
+    }
+    client.write(append([]byte{syn}, client.crcid...))
+    time.Sleep(20 * time.Millisecond)
+    return p, handler, client
+}
+
+func (c *swudpClientT) write(packet []byte) {
+    if _, err := c.conn.WriteToUDP(packet, c.server); err != nil {
+        c.t.Fatal(err)
+    }
+}
+
+// read returns the next packet, or NULL on timeout
+func (c *swudpClientT) read(timeout time.Duration) []byte {
+    buf := make([]byte, 2*maxFragment)
+    if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+        c.t.Fatal(err)
+    }
+    k, _, err := c.conn.ReadFromUDP(buf)
+    if err != nil {
+        return nil
+    }
+    return buf[:k]
+}
+
+func (c *swudpClientT) close(p *SwUDP) {
+    p.Close()
+    Check(NewErrFromError(p, 0, p.socket.Close()))
+    Check(NewErrFromError(p, 0, c.conn.Close()))
+}
+
+// TestSwUDPFragmentation checks that large messages are split into fragments which are not sent beyond the window
+func TestSwUDPFragmentation(t *testing.T) {
+    p, _, client := newSwUDPPair(t)
+    defer client.close(p)
+
+    tests := []struct {
+        size      int
+        fragments int
+    }{
+        {1, 1},
+        {maxFragment, 1},
+        {maxFragment + 1, 2},
+        {3000, 6},
+        {maxMessage, maxMessage / maxFragment},
+    }
+    id := byte(syn)
+    for _, test := range tests {
+        msg := make([]byte, test.size)
+        for i := range msg {
+            msg[i] = byte(i * 7)
+        }
+        if err := p.Send(msg, 7); err != nil {
+            t.Fatal(err)
+        }
+
+        // read the packets without acknowledging them: only "window" packets must arrive
+        packets := map[byte][]byte{}
+        for packet := client.read(50 * time.Millisecond); packet != nil; packet = client.read(50 * time.Millisecond) {
+            packets[packet[0]] = packet
+        }
+        if len(packets) != int(Min(uint(test.fragments), window)) {
+            t.Errorf("Size %d: %d packets sent without Acks", test.size, len(packets))
+        }
+
+        // now acknowledge the packets as they arrive
+        assembly := []byte{}
+        for k := 0; k < test.fragments; k++ {
+            id = next(id)
+            packet, ok := packets[id]
+            for !ok {
+                packet = client.read(time.Second)
+                if packet == nil {
+                    t.Fatalf("Size %d: fragment %d not received", test.size, k)
+                }
+                packets[packet[0]] = packet
+                packet, ok = packets[id]
+            }
+            client.write(append([]byte{id}, client.crcid...))
+            last := k == test.fragments-1
+            if packet[5] != Ternary(last, lastFragment, moreFragments) {
+                t.Errorf("Size %d: fragment %d has incorrect flag %d", test.size, k, packet[5])
+            }
+            assembly = append(assembly, packet[6:]...)
+        }
+        if !bytes.Equal(assembly, msg) {
+            t.Errorf("Size %d: message is assembled incorrectly", test.size)
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+}
+
+// TestSwUDPReassembly checks that a message is reassembled even if the first fragment arrives after all the others
+func TestSwUDPReassembly(t *testing.T) {
+    p, handler, client := newSwUDPPair(t)
+    defer client.close(p)
+
+    tests := []struct {
+        fragments int
+        lost      int // index of a fragment to be sent last
+    }{
+        {1, 0},
+        {2, 0},
+        {5, 2},
+        {20, 0},
+        {maxMessage / maxFragment, 0},
+    }
+    id := byte(syn)
+    for _, test := range tests {
+        msg := []byte{}
+        packets := [][]byte{}
+        for k := 0; k < test.fragments; k++ {
+            id = next(id)
+            fragment := bytes.Repeat([]byte{byte(k)}, maxFragment)
+            msg = append(msg, fragment...)
+            flag := Ternary(k == test.fragments-1, lastFragment, moreFragments)
+            packets = append(packets, append(append([]byte{id}, client.crcid...), append([]byte{flag}, fragment...)...))
+        }
+        for k, packet := range packets {
+            if k != test.lost {
+                client.write(packet)
+            }
+        }
+        client.write(packets[test.lost])
+
+        select {
+        case received := <-handler.received:
+            if !bytes.Equal(received, msg) {
+                t.Errorf("%d fragments: message is assembled incorrectly", test.fragments)
+            }
+        case crcid := <-handler.failed:
+            t.Fatalf("%d fragments: connection %d failed", test.fragments, crcid)
+        case <-time.After(time.Second):
+            t.Fatalf("%d fragments: message not received", test.fragments)
+        }
+    }
+}
+
+// TestSwUDPAuth checks that the key is confirmed by the first signed datagram, and then unsigned, forged and replayed
+// datagrams are dropped
+func TestSwUDPAuth(t *testing.T) {
+    p, _, client := newSwUDPPair(t)
+    defer client.close(p)
+
+    key := []byte("0123456789abcdef")
+    signed := func(k []byte, ctr byte, data []byte) []byte {
+        res := append(append([]byte{}, data...), 0, 0, 0, ctr)
+        return append(res, mac(k, res)...)
+    }
+    data := []byte{9, 0, 0, 0, 7, 42}
+    forged := signed([]byte("wrong key"), 1, data)
+
+    tests := []struct {
+        datagram []byte
+        payload  []byte // NULL if the datagram must be dropped
+    }{
+        {data, data},     // the key is not confirmed yet
+        {forged, forged}, // treated as unsigned
+        {signed(key, 1, data), data},
+        {data, nil},
+        {signed(key, 1, data), nil}, // replay
+        {signed(key, 3, data), data},
+        {signed(key, 2, data), data}, // out of order, but within the replay window
+        {signed(key, 2, data), nil},
+        {signed([]byte("wrong key"), 4, data), nil},
+    }
+    Check(p.SetAuthKey(7, key))
+    for i, test := range tests {
+        payload, ok := p.authenticate(7, test.datagram)
+        if ok != (test.payload != nil) || !bytes.Equal(payload, test.payload) {
+            t.Errorf("%d: authenticate(%v) = %v, %v", i, test.datagram, payload, ok)
+        }
+    }
+
+    // outgoing datagrams are signed with a growing counter
+    p.RLock()
+    auth := p.keys[7]
+    p.RUnlock()
+    for ctr := byte(1); ctr < 4; ctr++ {
+        if res := auth.sign(data); !bytes.Equal(res, signed(key, ctr, data)) {
+            t.Errorf("sign() = %v, expected counter %d", res, ctr)
+        }
+    }
+
+    // a key is dropped along with the connection
+    p.ConnectionFailed(7)
+    if _, ok := p.authenticate(7, data); !ok {
+        t.Errorf("Key is not dropped on connection failure")
+    }
+}
+
+// TestSwUDPReplayWindow checks that signed datagrams may be verified out of order (as they are handled concurrently),
+// but each counter is accepted only once, and counters older than the window are dropped
+func TestSwUDPReplayWindow(t *testing.T) {
+    key := []byte("0123456789abcdef")
+    signed := func(ctr uint32) []byte {
+        res := []byte{9, 0, 0, 0, 7, 42, byte(ctr >> 24), byte(ctr >> 16), byte(ctr >> 8), byte(ctr)}
+        return append(res, mac(key, res)...)
+    }
+
+    auth := &authT{key: key}
+    tests := []struct {
+        ctr uint32
+        ok  bool
+    }{
+        {5, true}, {3, true}, {4, true}, {3, false}, {1, true}, {2, true}, {5, false}, {0, false},
+        {70, true}, {6, false}, {7, true}, {7, false}, {69, true}, {68, true}, {70, false},
+        {1000, true}, {999, true}, {936, false}, {937, true},
+    }
+    for i, test := range tests {
+        if _, ok := auth.verify(signed(test.ctr)); ok != test.ok {
+            t.Errorf("%d: verify(counter %d) = %v, expected %v", i, test.ctr, ok, test.ok)
+        }
+    }
+}
+
+// TestAgreeAuthKey checks that a client derives the same secret key from the server's public key, and that incorrect
+// public keys are rejected
+func TestAgreeAuthKey(t *testing.T) {
+    private := make([]byte, curve25519.ScalarSize)
+    if _, err := rand.Read(private); err != nil {
+        t.Fatal(err)
+    }
+    public, err := curve25519.X25519(private, curve25519.Basepoint)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    serverPublic, key, er := AgreeAuthKey(public)
+    if er != nil || len(serverPublic) != AuthPublicKeyLen || len(key) != authKeyLen {
+        t.Fatalf("AgreeAuthKey() = %v, %v, %v", serverPublic, key, er)
+    }
+    shared, err := curve25519.X25519(private, serverPublic)
+    if err != nil {
+        t.Fatal(err)
+    }
+    clientKey := make([]byte, authKeyLen)
+    salt := append(append([]byte{}, public...), serverPublic...)
+    if _, err = io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(authInfo)), clientKey); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(key, clientKey) {
+        t.Errorf("Keys differ: %v and %v", key, clientKey)
+    }
+
+    for _, peerKey := range [][]byte{nil, public[:31], make([]byte, AuthPublicKeyLen)} {
+        if _, _, er := AgreeAuthKey(peerKey); er == nil {
+            t.Errorf("AgreeAuthKey(%v) must fail", peerKey)
+        }
+    }
+}
@@ -0,0 +1,92 @@
+// Package network Copyright 2017 mitrakov. All right are reserved. Governed by the BSD license
+package network
+
+import "io"
+import "fmt"
+import "log"
+import "net"
+import "sync"
+import "time"
+import "bufio"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// TCPProtocol is a transport protocol over TCP for the clients behind networks that block UDP. Every message is
+// prefixed by its length (2 bytes, big-endian), just like messages in a MailBox. See streamT for more details.
+// This component is dependent on IHandler.
+type TCPProtocol struct /*implements IProtocol*/ {
+    streamT
+    listener net.Listener
+}
+
+// tcpConnT is a single TCP connection (writes must not interleave, so we need a lock)
+type tcpConnT struct /*implements streamConnT*/ {
+    sync.Mutex
+    net.Conn
+    reader *bufio.Reader
+}
+
+// NewTCPProtocol creates a new instance of TCPProtocol. Please don't create a TCPProtocol manually.
+// "handler" - listener for incoming messages
+// "detector" - misbehaviour detector (may be NULL)
+func NewTCPProtocol(handler IHandler, detector IFloodDetector) *TCPProtocol {
+    return &TCPProtocol{streamT: newStream("TCP", handler, detector)}
+}
+
+// Listen binds TCPProtocol to a given TCP address. This method doesn't block the execution.
+// "host" - IPv4 or IPv6 address to bind to (pass "" to listen to all interfaces)
+// "port" - TCP port to accept connections
+func (p *TCPProtocol) Listen(host string, port uint16) *Error {
+    var err error
+    p.listener, err = net.Listen("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+    if err == nil {
+        go func() {
+            for {
+                conn, er := p.listener.Accept()
+                if er != nil {
+                    log.Println("TCP server stopped", er)
+                    return
+                }
+                go p.serve(&tcpConnT{Conn: conn, reader: bufio.NewReaderSize(conn, bufSiz)})
+            }
+        }()
+        log.Println("TCP connected to port", port)
+    }
+    return NewErrFromError(p, 85, err)
+}
+
+// Close shuts TCPProtocol down and releases all seized resources
+func (p *TCPProtocol) Close() {
+    if p.listener != nil {
+        Check(NewErrFromError(p, 84, p.listener.Close()))
+    }
+    p.closeAll()
+}
+
+// read reads a single length-prefixed message; messages larger than "bufSiz" are considered as an error
+func (c *tcpConnT) read() ([]byte, error) {
+    header := make([]byte, 2)
+    if _, err := io.ReadFull(c.reader, header); err != nil {
+        return nil, err
+    }
+    size := int(header[0])*256 + int(header[1])
+    if size > bufSiz {
+        return nil, fmt.Errorf("message too long (%d bytes)", size)
+    }
+    msg := make([]byte, size)
+    _, err := io.ReadFull(c.reader, msg)
+    return msg, err
+}
+
+// write writes a length-prefixed message to the connection
+func (c *tcpConnT) write(data []byte) error {
+    if len(data) > 0xFFFF {
+        return fmt.Errorf("message too long (%d bytes)", len(data))
+    }
+    c.Lock()
+    defer c.Unlock()
+    err := c.SetWriteDeadline(time.Now().Add(writeTimeout))
+    if err == nil {
+        _, err = c.Write(append([]byte{byte(len(data) / 256), byte(len(data) % 256)}, data...))
+    }
+    return err
+}
@@ -0,0 +1,120 @@
+// Package network Copyright 2017 mitrakov. All right are reserved. Governed by the BSD license
+package network
+
+import "fmt"
+import "log"
+import "net"
+import "sync"
+import "time"
+import "strings"
+import "net/http"
+import "github.com/gorilla/websocket"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// WsProtocol is a transport protocol over WebSocket for web clients; every binary frame is a single message.
+// See streamT for more details.
+// This component is dependent on IHandler.
+type WsProtocol struct /*implements IProtocol*/ {
+    streamT
+    upgrader websocket.Upgrader
+    server   *http.Server
+}
+
+// wsConnT is a single WebSocket connection (gorilla/websocket doesn't allow concurrent writers, so we need a lock)
+type wsConnT struct /*implements streamConnT*/ {
+    sync.Mutex
+    *websocket.Conn
+}
+
+// HTTP path to accept WebSocket connections
+const wsPath = "/ws"
+
+// NewWsProtocol creates a new instance of WsProtocol. Please don't create a WsProtocol manually.
+// "handler" - listener for incoming messages
+// "detector" - misbehaviour detector (may be NULL)
+// "origins" - allowed origins of web pages, e.g. "https://winesaps.com" (if empty, only pages loaded from the same
+// host and non-browser clients are allowed)
+func NewWsProtocol(handler IHandler, detector IFloodDetector, origins []string) *WsProtocol {
+    upgrader := websocket.Upgrader{ReadBufferSize: bufSiz, WriteBufferSize: bufSiz}
+    if len(origins) > 0 {
+        upgrader.CheckOrigin = func(r *http.Request) bool {
+            return checkOrigin(r.Header.Get("Origin"), origins)
+        }
+    }
+    return &WsProtocol{streamT: newStream("WebSocket", handler, detector), upgrader: upgrader}
+}
+
+// Listen binds WsProtocol to a given TCP address. This method doesn't block the execution.
+// "host" - IPv4 or IPv6 address to bind to (pass "" to listen to all interfaces)
+// "port" - TCP port to accept WebSocket connections
+func (p *WsProtocol) Listen(host string, port uint16) *Error {
+    listener, err := net.Listen("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+    if err == nil {
+        mux := http.NewServeMux()
+        mux.HandleFunc(wsPath, p.accept)
+        p.server = &http.Server{Handler: mux}
+        go func() {
+            if er := p.server.Serve(listener); er != http.ErrServerClosed {
+                log.Println("WebSocket server stopped", er)
+            }
+        }()
+        log.Println("WebSocket connected to port", port)
+    }
+    return NewErrFromError(p, 80, err)
+}
+
+// Close shuts WsProtocol down and releases all seized resources
+func (p *WsProtocol) Close() {
+    if p.server != nil {
+        Check(NewErrFromError(p, 84, p.server.Close()))
+    }
+    p.closeAll()
+}
+
+// accept upgrades a given HTTP request to WebSocket and serves the connection till it's closed
+func (p *WsProtocol) accept(w http.ResponseWriter, r *http.Request) {
+    conn, err := p.upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        log.Println("WebSocket upgrade", err) // upgrader has already replied with an HTTP error
+        return
+    }
+    conn.SetReadLimit(bufSiz)
+    p.serve(&wsConnT{Conn: conn})
+}
+
+// read reads a single binary frame (for other frames returns NULL)
+func (c *wsConnT) read() ([]byte, error) {
+    kind, msg, err := c.ReadMessage()
+    if err == nil && kind != websocket.BinaryMessage {
+        return nil, nil
+    }
+    return msg, err
+}
+
+// write writes a binary frame to the connection
+func (c *wsConnT) write(data []byte) error {
+    c.Lock()
+    defer c.Unlock()
+    err := c.SetWriteDeadline(time.Now().Add(writeTimeout))
+    if err == nil {
+        err = c.WriteMessage(websocket.BinaryMessage, data)
+    }
+    return err
+}
+
+// checkOrigin checks whether a given Origin header is in the list of allowed origins. Requests without Origin header
+// are allowed, because they are not sent by browsers, so they cannot be forged by a malicious web page
+// "origin" - value of Origin header
+// "origins" - allowed origins
+func checkOrigin(origin string, origins []string) bool {
+    if origin == "" {
+        return true
+    }
+    for _, allowed := range origins {
+        if strings.EqualFold(origin, allowed) {
+            return true
+        }
+    }
+    log.Println("WebSocket origin not allowed:", origin)
+    return false
+}
@@ -0,0 +1,26 @@
+package network
+
+import "testing"
+
+// TestCheckOrigin checks the WebSocket origin allow-list
+func TestCheckOrigin(t *testing.T) {
+    origins := []string{"https://winesaps.com", "http://localhost:8080"}
+    tests := []struct {
+        origin  string
+        allowed bool
+    }{
+        {"", true}, // not a browser
+        {"https://winesaps.com", true},
+        {"HTTPS://WINESAPS.COM", true},
+        {"http://localhost:8080", true},
+        {"http://winesaps.com", false},
+        {"https://winesaps.com.evil.com", false},
+        {"http://localhost", false},
+        {"null", false},
+    }
+    for _, test := range tests {
+        if allowed := checkOrigin(test.origin, origins); allowed != test.allowed {
+            t.Errorf("checkOrigin(%q) = %v, expected %v", test.origin, allowed, test.allowed)
+        }
+    }
+}
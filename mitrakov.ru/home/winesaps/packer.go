@@ -42,6 +42,13 @@ func (Packer) PackFullState(state []byte) []byte {
     return append([]byte{byte(fullState)}, state...)
 }
 
+// PackRestoreState packs the message for "RESTORE STATE" command (30); it has the same format as the response to the
+// command, so that a spectator may apply it just like a participant does
+// "dump" - binary dump of all Movable objects changed since the round start
+func (Packer) PackRestoreState(dump []byte) []byte {
+    return append([]byte{byte(restoreState), noErr}, dump...)
+}
+
 // PackRoundInfo packs the message for "ROUND INFO" command (17)
 // "sid" - client's Session ID
 // "aggressor" - aggressor's Session ID (will be the same as "sid", if that user is the aggressor)
@@ -57,6 +64,13 @@ func (Packer) PackRoundInfo(sid, aggressor Sid, num, t, char1, char2, myLives, e
     return append([]byte{byte(roundInfo), num, t, meAggressor, char1, char2, myLives, enemyLives}, fname...)
 }
 
+// PackTeamInfo packs the message for "TEAM INFO" command (47); it is sent only in team battles after "ROUND INFO"
+// "actorID" - ID of the actor that the client controls (Actor1, Actor2, Actor3 or Actor4)
+// "mateChar" - character of the teammate
+func (Packer) PackTeamInfo(actorID, mateChar byte) []byte {
+    return []byte{byte(teamInfo), actorID, mateChar}
+}
+
 // PackAbilityList packs the message for "ABILITY LIST" command (18)
 // "abilities" - abilities of the user expressed as a byte array
 func (Packer) PackAbilityList(abilities []byte) []byte {
@@ -66,10 +80,12 @@ func (Packer) PackAbilityList(abilities []byte) []byte {
 // PackStateChanged packs the message for "STATE CHANGED" command (23)
 // "objNum" - global object number on the battle field
 // "objID" - object ID
-// "xy" - new location (0-255)
+// "xy" - new location (0xFF, or 0xFFFF for wide fields, if the object is removed from the battlefield)
+// "wide" - TRUE to pack xy in 2 bytes (for the fields with more than 255 cells, since v1.4.0)
 // "reset" - TRUE, if location has been changed instantaneously (wounded, teleportation, etc.), FALSE otherwise
-func (Packer) PackStateChanged(objNum, objID, xy byte, reset bool) []byte {
-    return []byte{byte(stateChanged), objNum, objID, xy, Ternary(reset, 1, 0)}
+func (Packer) PackStateChanged(objNum, objID byte, xy uint16, wide, reset bool) []byte {
+    res := append([]byte{byte(stateChanged), objNum, objID}, packXy(xy, wide)...)
+    return append(res, Ternary(reset, 1, 0))
 }
 
 // PackScoreChanged packs the message for "SCORE CHANGED" command (24)
@@ -109,8 +125,9 @@ func (Packer) PackThingTaken(sid, ownerSid Sid, thingID byte) []byte {
 // "id" - object ID
 // "objNum" - global object number on the battle field
 // "xy" - location of the new object
-func (Packer) PackObjectAppended(id, objNum, xy byte) []byte {
-    return []byte{byte(objectAppended), id, objNum, xy}
+// "wide" - TRUE to pack xy in 2 bytes (for the fields with more than 255 cells, since v1.4.0)
+func (Packer) PackObjectAppended(id, objNum byte, xy uint16, wide bool) []byte {
+    return append([]byte{byte(objectAppended), id, objNum}, packXy(xy, wide)...)
 }
 
 // PackRoundFinished packs the message for "FINISHED" command (29) with the parameter "GAME OVER" = 0
@@ -136,6 +153,31 @@ func (Packer) PackGameOver(sid, winnerSid Sid, totalScore1, totalScore2 byte, re
     return []byte{byte(finished), 1, 0, totalScore1, totalScore2}
 }
 
+// PackRematchOffered packs the message for "REMATCH OFFERED" command (49): the opponent of the finished battle wants
+// a rematch (see "REMATCH" command)
+func (Packer) PackRematchOffered() []byte {
+    return []byte{byte(rematchOffered)}
+}
+
+// PackBattlePaused packs the message for "BATTLE PAUSED" command (50): the opponent (or a teammate) has lost the
+// connection, and the battle is paused till he/she comes back
+// "graceSec" - time the disconnected participant has to come back (otherwise he/she loses the battle), in sec.
+func (Packer) PackBattlePaused(graceSec byte) []byte {
+    return []byte{byte(battlePaused), graceSec}
+}
+
+// PackBattleResumed packs the message for "BATTLE RESUMED" command (51): all the disconnected participants are back
+func (Packer) PackBattleResumed() []byte {
+    return []byte{byte(battleResumed)}
+}
+
+// PackBattleInfo packs the message for "BATTLE INFO" command (52); it is sent to the participants on the battle start
+// "id" - battle ID (it's required to request a replay of the battle, see "REPLAY" command)
+func (Packer) PackBattleInfo(id uint64) []byte {
+    return []byte{byte(battleInfo), byte(id >> 56), byte(id >> 48), byte(id >> 40), byte(id >> 32), byte(id >> 24),
+        byte(id >> 16), byte(id >> 8), byte(id)}
+}
+
 // =========================================
 // === user.IPacker method implementations ===
 // =========================================
@@ -155,3 +197,11 @@ func (Packer) PackPromocodeDone(inviter bool, name string, gems uint32) []byte {
     data := []byte{byte(promocodeDone), inv, byte(gems >> 24), byte(gems >> 16), byte(gems >> 8), byte(gems)}
     return append(data, name...)
 }
+
+// packXy converts "xy" into a bytearray: 2 bytes (big-endian) for wide fields, or 1 byte otherwise
+func packXy(xy uint16, wide bool) []byte {
+    if wide {
+        return []byte{byte(xy >> 8), byte(xy)}
+    }
+    return []byte{byte(xy)}
+}
@@ -1,22 +1,40 @@
 // Package sid Copyright 2017 mitrakov. All right are reserved. Governed by the BSD license
 package sid
 
+import "log"
 import "sync"
-import "math/rand"                         // token is not critical data so we may use math.rand instead of crypto.rand
+import "time"
+import "crypto/rand"
+import "encoding/binary"
 import . "mitrakov.ru/home/winesaps/utils" // nolint
 
-// TokenManager responsible for generating new tokens. Token is designed for validation purposes only (not for
-// security), because Session ID (2 bytes) is not enough to identify both user and its session.
-// E.g. if a client has been re-connected, a new token should be generated for him.
+// TokenManager responsible for generating new tokens. Session ID (2 bytes) is not enough to identify both user and
+// its session, so each message must also contain a token, issued on sign in.
+// Since v1.4.0 tokens are generated by a cryptographically secure generator, they expire after a given TTL of
+// inactivity (each successful check prolongs a token), may be revoked (e.g. on sign out), and newer clients may
+// negotiate 64-bit tokens instead of 32-bit ones.
 // This component is independent.
 type TokenManager struct {
     sync.RWMutex
-    tokens map[Sid]uint32
+    tokens map[Sid]*tokenT
+    ttl    time.Duration
+    now    func() time.Time // clock (may be replaced in tests)
+    stop   chan bool
+}
+
+// tokenT is a helper structure to store a token along with its properties
+type tokenT struct {
+    value   uint64 // for 32-bit tokens the highest 4 bytes are always 0
+    wide    bool
+    expires time.Time
 }
 
 // NewTokenManager creates a new instance of a TokenManager. Please don't create a TokenManager manually.
-func NewTokenManager() *TokenManager {
-    return &TokenManager{tokens: make(map[Sid]uint32)}
+// "ttl" - token lifetime since the last check; after that a user has to sign in again
+func NewTokenManager(ttl time.Duration) *TokenManager {
+    mgr := &TokenManager{tokens: make(map[Sid]*tokenT), ttl: ttl, now: time.Now}
+    mgr.stop = RunDaemon("token", time.Minute, mgr.cleanUp)
+    return mgr
 }
 
 // TokenA returns the highest byte of a token
@@ -39,23 +57,81 @@ func TokenD (token uint32) byte {
     return byte(token)
 }
 
-// NewToken generates a new randomly generated 32-bit token for a given SID (and stores it for the future reference)
-func (mgr *TokenManager) NewToken(sid Sid) (token uint32) {
+// NewToken generates a new random token for a given SID (and stores it for the future reference); a previous token
+// of this SID (if any) is no longer valid
+// "sid" - Session ID
+// "wide" - TRUE to generate a 64-bit token, FALSE to generate a 32-bit one
+func (mgr *TokenManager) NewToken(sid Sid, wide bool) (token uint64, err *Error) {
     Assert(mgr.tokens)
-    
-    token = rand.Uint32()
+
+    buf := make([]byte, 8)
+    if _, er := rand.Read(buf); er != nil {
+        return 0, NewErrFromError(mgr, 4, er)
+    }
+    token = binary.BigEndian.Uint64(buf)
+    if !wide {
+        token &= 0xFFFFFFFF
+    }
     mgr.Lock()
-    mgr.tokens[sid] = token
+    mgr.tokens[sid] = &tokenT{token, wide, mgr.now().Add(mgr.ttl)}
     mgr.Unlock()
     return
 }
 
-// GetToken returns a previously issued token by a given SID (if there are no match, returns "false")
-func (mgr *TokenManager) GetToken(sid Sid) (token uint32, ok bool) {
+// GetToken returns a previously issued token by a given SID along with its width (if there are no match, returns
+// "false"); it's intended to prepend outgoing messages, so please use CheckToken() to validate incoming ones
+func (mgr *TokenManager) GetToken(sid Sid) (token uint64, wide bool, ok bool) {
     Assert(mgr.tokens)
-    
+
     mgr.RLock()
-    token, ok = mgr.tokens[sid]
+    t, ok := mgr.tokens[sid]
     mgr.RUnlock()
+    if ok {
+        token, wide = t.value, t.wide
+    }
     return
 }
+
+// CheckToken checks whether a given token is valid for a given SID (i.e. issued, not expired and not revoked); a valid
+// token gets prolonged for another TTL
+// "sid" - Session ID
+// "token" - token received from a client (for 32-bit tokens the highest 4 bytes must be 0)
+func (mgr *TokenManager) CheckToken(sid Sid, token uint64) bool {
+    Assert(mgr.tokens)
+
+    mgr.Lock()
+    defer mgr.Unlock()
+    if t, ok := mgr.tokens[sid]; ok && t.value == token && mgr.now().Before(t.expires) {
+        t.expires = mgr.now().Add(mgr.ttl)
+        return true
+    }
+    return false
+}
+
+// RevokeToken makes a token of a given SID invalid (e.g. on sign out)
+func (mgr *TokenManager) RevokeToken(sid Sid) {
+    Assert(mgr.tokens)
+
+    mgr.Lock()
+    delete(mgr.tokens, sid)
+    mgr.Unlock()
+}
+
+// Close shuts TokenManager down and releases all seized resources
+func (mgr *TokenManager) Close() {
+    Assert(mgr.stop)
+    mgr.stop <- true
+}
+
+// cleanUp removes expired tokens (to avoid memory leaks)
+func (mgr *TokenManager) cleanUp() {
+    mgr.Lock()
+    defer mgr.Unlock()
+
+    for sid, t := range mgr.tokens {
+        if mgr.now().After(t.expires) {
+            delete(mgr.tokens, sid)
+            log.Println("Token expired for sid", sid)
+        }
+    }
+}
@@ -0,0 +1,78 @@
+package sid
+
+import "time"
+import "testing"
+
+// TestTokenExpiry checks that a token expires after TTL of inactivity, and each successful check prolongs it
+func TestTokenExpiry(t *testing.T) {
+    const ttl = time.Hour
+    mgr := NewTokenManager(ttl)
+    defer mgr.Close()
+    now := time.Now()
+    mgr.now = func() time.Time { return now }
+
+    token, err := mgr.NewToken(1, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        step  time.Duration
+        sid   Sid
+        token uint64
+        valid bool
+    }{
+        {0, 1, token, true},
+        {0, 2, token, false},    // another SID
+        {0, 1, token + 1, false}, // another token
+        {ttl * 2 / 3, 1, token, true},
+        {ttl * 2 / 3, 1, token, true}, // prolonged by the previous check
+        {ttl * 2 / 3, 1, token + 1, false},
+        {ttl * 2 / 3, 1, token, false}, // the failed check doesn't prolong the token
+    }
+    for i, test := range tests {
+        now = now.Add(test.step)
+        if valid := mgr.CheckToken(test.sid, test.token); valid != test.valid {
+            t.Errorf("%d: CheckToken(%d, %d) = %v, expected %v", i, test.sid, test.token, valid, test.valid)
+        }
+    }
+}
+
+// TestTokenWidth checks 32/64-bit tokens, re-issuing and revocation
+func TestTokenWidth(t *testing.T) {
+    mgr := NewTokenManager(time.Hour)
+    defer mgr.Close()
+
+    tests := []struct {
+        sid  Sid
+        wide bool
+    }{
+        {1, false}, {2, true}, {1, true}, {2, false},
+    }
+    for _, test := range tests {
+        old, _, _ := mgr.GetToken(test.sid)
+        token, err := mgr.NewToken(test.sid, test.wide)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !test.wide && token > 0xFFFFFFFF {
+            t.Errorf("32-bit token expected: %x", token)
+        }
+        if value, wide, ok := mgr.GetToken(test.sid); !ok || value != token || wide != test.wide {
+            t.Errorf("GetToken(%d) = %x, %v, %v", test.sid, value, wide, ok)
+        }
+        if old != token && mgr.CheckToken(test.sid, old) {
+            t.Errorf("Previous token of sid %d is still valid", test.sid)
+        }
+        if !mgr.CheckToken(test.sid, token) {
+            t.Errorf("Token of sid %d is not valid", test.sid)
+        }
+        mgr.RevokeToken(test.sid)
+        if mgr.CheckToken(test.sid, token) {
+            t.Errorf("Token of sid %d is valid after revocation", test.sid)
+        }
+        _, err = mgr.NewToken(test.sid, test.wide)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+}
@@ -0,0 +1,630 @@
+// Copyright 2017-2018 Artem Mitrakov. All rights reserved.
+package main
+
+import "fmt"
+import "time"
+import "strings"
+import "database/sql"
+import _ "github.com/mattn/go-sqlite3" // stackoverflow.com/questions/21220077
+import "mitrakov.ru/home/winesaps/user"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// A SqliteDbManager is an implementation of user.IDbManager based on embedded SQLite DBMS. It reproduces the schema,
+// triggers and stored procedures of docs/db.sql, so it can be used instead of DbManager when there is no MySQL
+// server around (e.g. on a developer's laptop)
+// This component is "dependent"
+type SqliteDbManager struct /*implements user.IDbManager*/ {
+    db *sql.DB
+}
+
+// sqliteSchema is a SQLite dialect of docs/db.sql. Enums are stored as their one-based indexes (so that "name+0"
+// becomes just "name"), and MySQL stored procedures are replaced with triggers (see also SqliteDbManager.BuyProduct)
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS user (
+  user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(32) NOT NULL COLLATE NOCASE UNIQUE CHECK(length(name) <= 32),
+  email VARCHAR(64) NOT NULL CHECK(length(email) <= 64),
+  auth_type VARCHAR(8) NOT NULL DEFAULT 'Local',
+  auth_data VARCHAR(64) NOT NULL DEFAULT '' CHECK(length(auth_data) <= 64),
+  salt VARCHAR(64) NOT NULL DEFAULT '' CHECK(length(salt) <= 64),
+  promocode VARCHAR(8) NOT NULL DEFAULT '' CHECK(length(promocode) <= 8),
+  character TINYINT NOT NULL DEFAULT 1 CHECK(character BETWEEN 1 AND 4),
+  gems INTEGER NOT NULL DEFAULT 0 CHECK(gems >= 0),
+  trust_points INTEGER NOT NULL DEFAULT 20 CHECK(trust_points >= 0),
+  skill_rating INTEGER NOT NULL DEFAULT 1500 CHECK(skill_rating >= 0),
+  last_enemy INTEGER DEFAULT NULL,
+  agent_info VARCHAR(64) NOT NULL DEFAULT '' CHECK(length(agent_info) <= 64),
+  last_login TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS ability (
+  ability_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TINYINT NOT NULL,
+  days TINYINT NOT NULL DEFAULT 1,
+  gems INTEGER NOT NULL DEFAULT 1,
+  UNIQUE(name, days)
+);
+CREATE TABLE IF NOT EXISTS user_ability (
+  user_ability_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES user(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+  name TINYINT NOT NULL,
+  expire TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE(user_id, name)
+);
+CREATE INDEX IF NOT EXISTS expire ON user_ability(expire);
+CREATE TABLE IF NOT EXISTS friend (
+  friend_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES user(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+  friend_user_id INTEGER NOT NULL REFERENCES user(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+  UNIQUE(user_id, friend_user_id)
+);
+CREATE TABLE IF NOT EXISTS rating (
+  rating_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES user(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+  type TINYINT NOT NULL DEFAULT 1 CHECK(type IN (1, 2)),
+  wins INTEGER NOT NULL DEFAULT 0,
+  losses INTEGER NOT NULL DEFAULT 0,
+  score_diff INTEGER NOT NULL DEFAULT 0,
+  UNIQUE(user_id, type)
+);
+CREATE TABLE IF NOT EXISTS promocode (
+  promocode_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES user(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+  inviter_user_id INTEGER NOT NULL REFERENCES user(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+  promo VARCHAR(8) NOT NULL DEFAULT 'Pending' CHECK(promo IN ('Pending', 'Used')),
+  UNIQUE(user_id, inviter_user_id)
+);
+CREATE TABLE IF NOT EXISTS payment (
+  payment_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES user(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+  order_id VARCHAR(64) NOT NULL UNIQUE CHECK(length(order_id) <= 64),
+  sku VARCHAR(16) NOT NULL DEFAULT 'gems_pack' CHECK(sku IN ('gems_pack_small', 'gems_pack', 'gems_pack_big')),
+  stamp TIMESTAMP NULL DEFAULT NULL,
+  data VARCHAR(200) NOT NULL DEFAULT '' CHECK(length(data) <= 200),
+  state TINYINT NOT NULL DEFAULT 0,
+  checked TINYINT NOT NULL DEFAULT 0,
+  gems INTEGER NOT NULL DEFAULT 0
+);
+CREATE TRIGGER IF NOT EXISTS before_user_insert BEFORE INSERT ON user
+  WHEN length(NEW.name) < 4 OR NEW.name GLOB '*[^a-zA-Z0-9_+$.-]*'
+  BEGIN SELECT RAISE(ABORT, 'Incorrect name length or format'); END;
+CREATE TRIGGER IF NOT EXISTS before_user_update BEFORE UPDATE ON user
+  WHEN length(NEW.name) < 4 OR NEW.name GLOB '*[^a-zA-Z0-9_+$.-]*'
+  BEGIN SELECT RAISE(ABORT, 'Incorrect name length or format'); END;
+CREATE TRIGGER IF NOT EXISTS before_friend_insert BEFORE INSERT ON friend
+  WHEN NEW.user_id = NEW.friend_user_id
+  BEGIN SELECT RAISE(ABORT, 'You cannot be friends with yourself'); END;
+CREATE TRIGGER IF NOT EXISTS before_friend_update BEFORE UPDATE ON friend
+  WHEN NEW.user_id = NEW.friend_user_id
+  BEGIN SELECT RAISE(ABORT, 'You cannot be friends with yourself'); END;
+`
+
+// sqliteMigrations upgrade the DB files created by the previous versions ("duplicate column" errors are ignored,
+// because a new DB file already has all the columns)
+var sqliteMigrations = []string{
+    "ALTER TABLE user ADD COLUMN skill_rating INTEGER NOT NULL DEFAULT 1500 CHECK(skill_rating >= 0)",
+}
+
+// sqliteUserColumns is a list of columns to scan a user record (see getUserBySQL)
+const sqliteUserColumns = "user_id, name, email, auth_type, auth_data, salt, promocode, character, gems, " +
+    "trust_points, skill_rating, last_enemy, agent_info, last_login"
+
+// sqliteRatingOrder is the same order as used by DbManager ("victory_diff" is not a stored column here)
+const sqliteRatingOrder = "wins - losses DESC, score_diff DESC, wins DESC, rating_id"
+
+// NewSqliteDbManager creates a new instance of SqliteDbManager. Please do not create SqliteDbManager directly.
+// The DB file gets created (and filled with the ability price list) if it doesn't exist yet.
+// "path" - path to a DB file (pass ":memory:" to keep the DB in memory)
+func NewSqliteDbManager(path string) (*SqliteDbManager, *Error) {
+    db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=1&_busy_timeout=5000", path))
+    if err == nil {
+        db.SetMaxOpenConns(1) // SQLite doesn't support concurrent writers anyway
+        _, err = db.Exec(sqliteSchema)
+        for i := 0; i < len(sqliteMigrations) && err == nil; i++ {
+            if _, e := db.Exec(sqliteMigrations[i]); e != nil && !strings.Contains(e.Error(), "duplicate column") {
+                err = e
+            }
+        }
+        for i := 0; i < len(abilityPrices) && err == nil; i++ {
+            ability := abilityPrices[i]
+            _, err = db.Exec("INSERT OR IGNORE INTO ability (name, days, gems) VALUES (?, ?, ?)", ability.id,
+                ability.days, ability.gems)
+        }
+        if err == nil {
+            return &SqliteDbManager{db}, nil
+        }
+        Check(db.Close())
+    }
+    return nil, NewErrFromError("SqliteDbManager", 200, err)
+}
+
+// AddUser inserts a new user into DB
+// "name" - user name
+// "email" - user's e-mail
+// "hash" - hash of user's password
+// "salt" - salt
+// "promocode" - user's promo code
+func (dbMgr *SqliteDbManager) AddUser(name, email, hash, salt, promocode string) *Error {
+    Assert(dbMgr.db)
+    query := "INSERT INTO user (name, email, auth_data, salt, promocode) VALUES (?, ?, ?, ?, ?)"
+    _, err := dbMgr.db.Exec(query, name, email, hash, salt, promocode)
+    if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+        // keep MySQL error text, because it's parsed by the Handler (see getSignUpErrCode)
+        return NewErr(dbMgr, 201, "Duplicate entry '%s' for key 'name'", name)
+    }
+    return NewErrFromError(dbMgr, 201, err)
+}
+
+// GetUserByID returns a user by ID
+// "id" - user ID
+func (dbMgr *SqliteDbManager) GetUserByID(id uint64) (*user.User, *Error) {
+    return dbMgr.getUserBySQL("SELECT "+sqliteUserColumns+" FROM user WHERE user_id=?", id)
+}
+
+// GetUserByName returns a user by name
+// "name" - user name
+func (dbMgr *SqliteDbManager) GetUserByName(name string) (*user.User, *Error) {
+    return dbMgr.getUserBySQL("SELECT "+sqliteUserColumns+" FROM user WHERE name=?", name)
+}
+
+// GetUserByNumber returns a user by order number according to how he/she is stored in DB
+// "number" - user position in DB table
+func (dbMgr *SqliteDbManager) GetUserByNumber(number uint) (*user.User, *Error) {
+    if number == 0 { // SQLite treats negative offsets as zero, whilst MySQL returns an error
+        return nil, NewErrFromError(dbMgr, 202, sql.ErrNoRows)
+    }
+    return dbMgr.getUserBySQL("SELECT "+sqliteUserColumns+" FROM user ORDER BY user_id LIMIT ?, 1", number-1)
+}
+
+// GetAllAbilities return all possible abilities
+func (dbMgr *SqliteDbManager) GetAllAbilities() ([]byte, *Error) {
+    Assert(dbMgr.db)
+    res := []byte{}
+    rows, err := dbMgr.db.Query("SELECT name, days, gems FROM ability ORDER BY ability_id")
+    if err == nil {
+        defer rows.Close()
+        for rows.Next() {
+            var id, days, cost byte
+            err = rows.Scan(&id, &days, &cost)
+            if err == nil {
+                res = append(res, id, days, cost)
+            } else {
+                return res, NewErrFromError(dbMgr, 206, err) // this return is necessary because it's in a loop
+            }
+        }
+    }
+    return res, NewErrFromError(dbMgr, 207, err)
+}
+
+// SetLastEnemy assigns last enemy (enemyID) to a given user (userID)
+// "userID" - user ID
+// "enemyID" - user's enemy ID
+func (dbMgr *SqliteDbManager) SetLastEnemy(userID, enemyID uint64) *Error {
+    Assert(dbMgr.db)
+    _, err := dbMgr.db.Exec("UPDATE user SET last_enemy=? WHERE user_id=?", enemyID, userID)
+    return NewErrFromError(dbMgr, 208, err)
+}
+
+// SetAgentInfo sets agent info (language, client version, OS, Android version, etc.) to a given user
+// "userID" - user ID
+// "agentInfo" - agent info
+func (dbMgr *SqliteDbManager) SetAgentInfo(userID uint64, agentInfo string) *Error {
+    Assert(dbMgr.db)
+    _, err := dbMgr.db.Exec("UPDATE user SET agent_info=? WHERE user_id=?", agentInfo, userID)
+    return NewErrFromError(dbMgr, 236, err)
+}
+
+// RegisterWin inserts a new battle result (WIN) to the Rankings table
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+// "userID" - user ID
+// "scoreDiff" - score difference (abs[score1-score2])
+func (dbMgr *SqliteDbManager) RegisterWin(ratingType byte, userID uint64, scoreDiff byte) *Error {
+    Assert(dbMgr.db)
+    _, err := dbMgr.db.Exec("INSERT INTO rating (user_id, type, wins, losses, score_diff) VALUES (?, ?, 1, 0, ?) " +
+        "ON CONFLICT(user_id, type) DO UPDATE SET wins = wins + 1, score_diff = score_diff + excluded.score_diff",
+        userID, ratingType, scoreDiff)
+    return NewErrFromError(dbMgr, 209, err)
+}
+
+// RegisterLoss inserts a new battle result (LOSS) to the Rankings table
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+// "userID" - user ID
+// "scoreDiff" - score difference (abs[score1-score2])
+func (dbMgr *SqliteDbManager) RegisterLoss(ratingType byte, userID uint64, scoreDiff byte) *Error {
+    Assert(dbMgr.db)
+    negateDiff := -1 * int(scoreDiff) // don't use "-scoreDiff": it produces numbers like 255 instead of -1
+    _, err := dbMgr.db.Exec("INSERT INTO rating (user_id, type, wins, losses, score_diff) VALUES (?, ?, 0, 1, ?) " +
+        "ON CONFLICT(user_id, type) DO UPDATE SET losses = losses + 1, score_diff = score_diff + excluded.score_diff",
+        userID, ratingType, negateDiff)
+    return NewErrFromError(dbMgr, 210, err)
+}
+
+// SetSkillRating assigns a new skill rating (Elo) to a given user
+// "userID" - user ID
+// "skillRating" - new skill rating
+func (dbMgr *SqliteDbManager) SetSkillRating(userID uint64, skillRating uint32) *Error {
+    Assert(dbMgr.db)
+    _, err := dbMgr.db.Exec("UPDATE user SET skill_rating=? WHERE user_id=?", skillRating, userID)
+    return NewErrFromError(dbMgr, 237, err)
+}
+
+// RewardUser gives a user some gems and trustPoints (see documentation to learn what "trustPoints" are)
+// "userID" - user ID
+// "gems" - reward, in gems
+// "trustPoints" - trust points
+func (dbMgr *SqliteDbManager) RewardUser(userID uint64, gems, trustPoints uint32) *Error {
+    Assert(dbMgr.db)
+    query := "UPDATE user SET gems = gems+?, trust_points = trust_points+? WHERE user_id=?"
+    _, err := dbMgr.db.Exec(query, gems, trustPoints, userID)
+    return NewErrFromError(dbMgr, 211, err)
+}
+
+// ConsumeTrustPoints decrements "trustPoints" parameter of a user
+// "userID" - user ID
+// "trustPoints" - trust points to consume
+func (dbMgr *SqliteDbManager) ConsumeTrustPoints(userID uint64, trustPoints uint32) *Error {
+    Assert(dbMgr.db)
+    _, err := dbMgr.db.Exec("UPDATE user SET trust_points = trust_points-? WHERE user_id=?", trustPoints, userID)
+    return NewErrFromError(dbMgr, 235, err)
+}
+
+// ChangeUser updates the info about a user
+// "userID" - user ID
+// "email" - user e-mail
+// "hash" - hash of user's password
+// "character" - user's character
+func (dbMgr *SqliteDbManager) ChangeUser(userID uint64, email, hash string, character byte) *Error {
+    Assert(dbMgr.db)
+    query := "UPDATE user SET email = ?, auth_data = ?, character = ? WHERE user_id = ?"
+    _, err := dbMgr.db.Exec(query, email, hash, character, userID)
+    return NewErrFromError(dbMgr, 212, err)
+}
+
+// GetAbilities returns the abilities (list of IDs and list of expire timestamps) of a given user. It is guaranteed that
+// sizes of returned lists are equal
+// "userID" - user ID
+func (dbMgr *SqliteDbManager) GetAbilities(userID uint64) ([]byte, []time.Time, *Error) {
+    Assert(dbMgr.db)
+    ids := []byte{}
+    expires := []time.Time{}
+    rows, err := dbMgr.db.Query("SELECT name, expire FROM user_ability WHERE user_id=?", userID)
+    if err == nil {
+        defer rows.Close()
+        for rows.Next() {
+            var id byte
+            var expire time.Time
+            err = rows.Scan(&id, &expire)
+            if err == nil {
+                ids = append(ids, id)
+                expires = append(expires, expire) // SQLite stores UTC, so there's no need to Convert()
+            } else {
+                return ids, expires, NewErrFromError(dbMgr, 213, err) // this return is necessary because of a loop
+            }
+        }
+    }
+    return ids, expires, NewErrFromError(dbMgr, 214, err)
+}
+
+// BuyProduct initiates purchasing a product (e.g. "Climbing Shoes" for 7 days) for a given user. This method repeats
+// the logic of "sp_buy" stored function within a single transaction.
+// "userID" - user ID
+// "code" - product code
+// "days" - duration, in days (please note that it's not arbitrary value, the "days" must be present in "ability" table)
+func (dbMgr *SqliteDbManager) BuyProduct(userID uint64, code, days byte) (cost uint32, error *Error) {
+    Assert(dbMgr.db)
+    tx, err := dbMgr.db.Begin()
+    if err == nil {
+        var myGems uint32
+        err = tx.QueryRow("SELECT gems FROM ability WHERE name = ? AND days = ?", code, days).Scan(&cost)
+        if err == nil {
+            err = tx.QueryRow("SELECT gems FROM user WHERE user_id = ?", userID).Scan(&myGems)
+            if err == nil || err == sql.ErrNoRows {
+                if myGems >= cost {
+                    t := fmt.Sprintf("+%d days", TernaryInt(days != daysForever, int(days), 3652))
+                    _, err = tx.Exec("INSERT INTO user_ability (user_id, name, expire) VALUES (?, ?, " +
+                        "datetime(CURRENT_TIMESTAMP, ?)) ON CONFLICT(user_id, name) DO UPDATE SET " +
+                        "expire = datetime(expire, ?)", userID, code, t, t)
+                    if err == nil {
+                        _, err = tx.Exec("UPDATE user SET gems = gems - ? WHERE user_id = ?", cost, userID)
+                        if err == nil {
+                            return cost, NewErrFromError(dbMgr, 215, tx.Commit())
+                        }
+                    }
+                } else {
+                    err = fmt.Errorf("Insufficient gems")
+                }
+            }
+        } else if err == sql.ErrNoRows {
+            err = fmt.Errorf("Incorrect product")
+        }
+        Check(NewErrFromError(dbMgr, 215, tx.Rollback()))
+    }
+    return 0, NewErrFromError(dbMgr, 215, err)
+}
+
+// GetWins returns count of wins from the Ranking table for a given user
+// @deprecated: not used since 1.3.8
+// "userID" - user ID
+func (dbMgr *SqliteDbManager) GetWins(userID uint64) (wins uint32, error *Error) {
+    Assert(dbMgr.db)
+    query := "SELECT IFNULL((SELECT wins FROM rating WHERE user_id = ? AND type = ?), 0) AS wins"
+    err := dbMgr.db.QueryRow(query, userID, dbRatingGeneral).Scan(&wins) // row is always != nil
+    return wins, NewErrFromError(dbMgr, 234, err)
+}
+
+// GetRating returns Ranking for a given user of a given ratingType (ratingGeneral or ratingWeekly). Please specify
+// limit to avoid performance issues (default is 10)
+// "userID" - user ID
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+// "limit" - data sample limit
+func (dbMgr *SqliteDbManager) GetRating(userID uint64, ratingType, limit byte) ([]byte, *Error) {
+    Assert(dbMgr.db)
+    res := []byte{}
+    // SQLite doesn't allow "(SELECT ... LIMIT) UNION (SELECT ...)", so here is the equivalent of DbManager's query
+    rows, err := dbMgr.db.Query("WITH top AS (SELECT * FROM rating WHERE type = ?1 ORDER BY " + sqliteRatingOrder +
+        " LIMIT ?2) SELECT name, wins, losses, score_diff FROM (SELECT 0 AS part, * FROM top UNION ALL SELECT 1, * " +
+        "FROM rating WHERE user_id = ?3 AND type = ?1 AND user_id NOT IN (SELECT user_id FROM top)) " +
+        "JOIN user USING(user_id) ORDER BY part, " + sqliteRatingOrder, ratingType, limit, userID)
+    if err == nil {
+        defer rows.Close()
+        for rows.Next() {
+            var name string
+            var wins, losses uint32
+            var scoreDiff int
+            err = rows.Scan(&name, &wins, &losses, &scoreDiff)
+            if err == nil {
+                res = append(res, []byte(name)...)
+                res = append(res, 0) // 0 is a terminating NULL
+                res = append(res, byte(wins >> 24), byte(wins >> 16), byte(wins >> 8), byte(wins))
+                res = append(res, byte(losses >> 24), byte(losses >> 16), byte(losses >> 8), byte(losses))
+                res = append(res, byte(scoreDiff >> 24), byte(scoreDiff >> 16), byte(scoreDiff >> 8), byte(scoreDiff))
+            } else {
+                return res, NewErrFromError(dbMgr, 216, err) // this return is necessary because it's in a loop
+            }
+        }
+    }
+    return res, NewErrFromError(dbMgr, 217, err)
+}
+
+// GetSkillRating returns Top N Ranking by skill rating for a given user. Only users who have played at least one
+// battle are ranked. The rows have the same format as in GetRating(), but score difference is replaced with the skill
+// rating
+// "userID" - user ID
+// "limit" - data sample limit
+func (dbMgr *SqliteDbManager) GetSkillRating(userID uint64, limit byte) ([]byte, *Error) {
+    Assert(dbMgr.db)
+    res := []byte{}
+    order := "skill_rating DESC, wins DESC, rating_id"
+    rows, err := dbMgr.db.Query("WITH ranked AS (SELECT rating.*, skill_rating, name FROM rating JOIN user " +
+        "USING(user_id) WHERE type = ?1), top AS (SELECT * FROM ranked ORDER BY " + order + " LIMIT ?2) " +
+        "SELECT name, wins, losses, skill_rating FROM (SELECT 0 AS part, * FROM top UNION ALL SELECT 1, * " +
+        "FROM ranked WHERE user_id = ?3 AND user_id NOT IN (SELECT user_id FROM top)) ORDER BY part, " + order,
+        dbRatingGeneral, limit, userID)
+    if err == nil {
+        defer rows.Close()
+        for rows.Next() {
+            var name string
+            var wins, losses, skill uint32
+            err = rows.Scan(&name, &wins, &losses, &skill)
+            if err == nil {
+                res = append(res, []byte(name)...)
+                res = append(res, 0) // 0 is a terminating NULL
+                res = append(res, byte(wins >> 24), byte(wins >> 16), byte(wins >> 8), byte(wins))
+                res = append(res, byte(losses >> 24), byte(losses >> 16), byte(losses >> 8), byte(losses))
+                res = append(res, byte(skill >> 24), byte(skill >> 16), byte(skill >> 8), byte(skill))
+            } else {
+                return res, NewErrFromError(dbMgr, 238, err) // this return is necessary because it's in a loop
+            }
+        }
+    }
+    return res, NewErrFromError(dbMgr, 239, err)
+}
+
+// GetBestUsers returns Top N Ranking of a given ratingType (ratingGeneral or ratingWeekly)
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+// "limit" - data sample limit
+func (dbMgr *SqliteDbManager) GetBestUsers(ratingType, limit byte) (ids []uint64, error *Error) {
+    Assert(dbMgr.db)
+    res := []uint64{}
+    query := "SELECT user_id FROM rating WHERE type = ? ORDER BY " + sqliteRatingOrder + " LIMIT ?"
+    rows, err := dbMgr.db.Query(query, ratingType, limit)
+    if err == nil {
+        defer rows.Close()
+        for rows.Next() {
+            var userID uint64
+            err = rows.Scan(&userID)
+            if err == nil {
+                res = append(res, userID)
+            } else {
+                return res, NewErrFromError(dbMgr, 218, err) // this return is necessary because it's in a loop
+            }
+        }
+    }
+    return res, NewErrFromError(dbMgr, 219, err)
+}
+
+// ClearRating erases Ranking table of a given ratingType (ratingGeneral or ratingWeekly)
+// "ratingType" - rating type (IMPORTANT: one-based, not zero-based)
+func (dbMgr *SqliteDbManager) ClearRating(ratingType byte) *Error {
+    Assert(dbMgr.db)
+    _, err := dbMgr.db.Exec("DELETE FROM rating WHERE type = ?", ratingType)
+    return NewErrFromError(dbMgr, 220, err)
+}
+
+// GetUserFriends returns friends (list of characters and list of names) of a given user. It is guaranteed that sizes of
+// returned lists are equal
+// "userID" - user ID
+func (dbMgr *SqliteDbManager) GetUserFriends(userID uint64) ([]byte, []string, *Error) {
+    Assert(dbMgr.db)
+    res0 := []byte{}
+    res1 := []string{}
+    rows, err := dbMgr.db.Query("SELECT character, name FROM friend JOIN user " +
+        "ON friend.friend_user_id = user.user_id WHERE friend.user_id = ? ORDER BY friend_id", userID)
+    if err == nil {
+        defer rows.Close()
+        for rows.Next() {
+            var character byte
+            var name string
+            err = rows.Scan(&character, &name)
+            if err == nil {
+                res0 = append(res0, character)
+                res1 = append(res1, name)
+            } else {
+                return res0, res1, NewErrFromError(dbMgr, 221, err) // return is necessary because it's in a loop
+            }
+        }
+    }
+    return res0, res1, NewErrFromError(dbMgr, 222, err)
+}
+
+// AddFriend inserts a new friend for a given user
+// "userID" - user ID
+// "name" - friend's name
+func (dbMgr *SqliteDbManager) AddFriend(userID uint64, name string) (character byte, e *Error) {
+    Assert(dbMgr.db)
+    query := "INSERT INTO friend (user_id, friend_user_id) VALUES (?, (SELECT user_id FROM user WHERE name = ?))"
+    _, err := dbMgr.db.Exec(query, userID, name)
+    if err == nil {
+        err = dbMgr.db.QueryRow("SELECT character FROM user WHERE name = ?", name).Scan(&character)
+    }
+    e = NewErrFromError(dbMgr, 223, err)
+    return
+}
+
+// RemoveFriend removes a friend (by the name) for a given user
+// "userID" - user ID
+// "name" - friend's name
+func (dbMgr *SqliteDbManager) RemoveFriend(userID uint64, name string) *Error {
+    Assert(dbMgr.db)
+    query := "DELETE FROM friend WHERE user_id = ? AND friend_user_id = (SELECT user_id FROM user WHERE name = ?)"
+    _, err := dbMgr.db.Exec(query, userID, name)
+    return NewErrFromError(dbMgr, 224, err)
+}
+
+// ActivatePromocode activates promocode of a user specified by inviterID for a user specified by userID
+// "userID" - user ID
+// "inviterID" - user ID of inviter
+func (dbMgr *SqliteDbManager) ActivatePromocode(userID, inviterID uint64) *Error {
+    Assert(dbMgr.db)
+    _, err := dbMgr.db.Exec("INSERT INTO promocode (user_id, inviter_user_id) VALUES (?, ?)", userID, inviterID)
+    return NewErrFromError(dbMgr, 225, err)
+}
+
+// DeactivatePromocode de-activates promocode of a user specified by inviterID for a user specified by userID
+// "userID" - user ID
+// "inviterID" - user ID of inviter
+func (dbMgr *SqliteDbManager) DeactivatePromocode(userID, inviterID uint64) *Error {
+    Assert(dbMgr.db)
+    query := "UPDATE promocode SET promo = 'Used' WHERE user_id = ? AND inviter_user_id = ?"
+    _, err := dbMgr.db.Exec(query, userID, inviterID)
+    return NewErrFromError(dbMgr, 226, err)
+}
+
+// PromocodeExists checks whether promocode exists for a given userID
+// "userID" - user ID
+func (dbMgr *SqliteDbManager) PromocodeExists(userID uint64) (inviterID uint64, exists bool, err *Error) {
+    Assert(dbMgr.db)
+    query := "SELECT inviter_user_id FROM promocode WHERE user_id = ? AND promo = 'Pending' ORDER BY promocode_id"
+    er := dbMgr.db.QueryRow(query, userID).Scan(&inviterID) // row is always != nil
+    exists = er == nil
+    if er != sql.ErrNoRows {
+        err = NewErrFromError(dbMgr, 227, er)
+    }
+    return
+}
+
+// DeleteExpiredAbilities removes expired abilities. It is designed to be executed periodically
+func (dbMgr *SqliteDbManager) DeleteExpiredAbilities() (removedIds []uint64, error *Error) {
+    Assert(dbMgr.db)
+    res := []uint64{}
+    rows, err := dbMgr.db.Query("SELECT DISTINCT(user_id) FROM user_ability WHERE expire < CURRENT_TIMESTAMP")
+    if err == nil {
+        for rows.Next() {
+            var id uint64
+            err = rows.Scan(&id)
+            if err == nil {
+                res = append(res, id)
+            } else {
+                Check(rows.Close())
+                return res, NewErrFromError(dbMgr, 228, err) // this return is necessary because it's in a loop
+            }
+        }
+        Check(rows.Close()) // close rows explicitly, because SQLite has only 1 connection (see NewSqliteDbManager)
+        _, err = dbMgr.db.Exec("DELETE FROM user_ability WHERE expire < CURRENT_TIMESTAMP")
+    }
+    return res, NewErrFromError(dbMgr, 229, err)
+}
+
+// AddPayment inserts info about new purchase
+// "userID" - user ID
+// "orderID" - order ID (returned by a platform)
+// "sku" - stock keeping unit
+// "tsMsec" - timestamp of operation
+// "data" - raw data
+// "state" - status (0 = purchased, 1 = cancelled, 2 = refunded)
+func (dbMgr *SqliteDbManager) AddPayment(userID uint64, orderID, sku string, tsMsec int64, data string,
+    state uint8) *Error {
+    Assert(dbMgr.db)
+    query := "INSERT INTO payment (user_id, order_id, sku, stamp, data, state) VALUES (?, ?, ?, ?, ?, ?)"
+    t := time.Unix(tsMsec/1000, (tsMsec%1000)*1000000).UTC().Format("2006-01-02 15:04:05")
+    _, err := dbMgr.db.Exec(query, userID, orderID, sku, t, data, state)
+    return NewErrFromError(dbMgr, 230, err)
+}
+
+// SetPaymentChecked sets the payment, defined by orderID, as verified
+// "orderID" - order ID (returned by a platform)
+func (dbMgr *SqliteDbManager) SetPaymentChecked(orderID string) *Error {
+    Assert(dbMgr.db)
+    _, err := dbMgr.db.Exec("UPDATE payment SET checked = 1 WHERE order_id = ?", orderID)
+    return NewErrFromError(dbMgr, 231, err)
+}
+
+// SetPaymentResult "finishes" payment transaction by adding gems for a successful purchase
+// "orderID" - order ID (returned by a platform)
+// "gems" - gems sold by the transaction
+func (dbMgr *SqliteDbManager) SetPaymentResult(orderID string, gems uint32) *Error {
+    Assert(dbMgr.db)
+    _, err := dbMgr.db.Exec("UPDATE payment SET gems = ? WHERE order_id = ?", gems, orderID)
+    return NewErrFromError(dbMgr, 232, err)
+}
+
+// Close shuts DB down and releases all seized resources
+func (dbMgr *SqliteDbManager) Close() *Error {
+    Assert(dbMgr.db)
+    err := dbMgr.db.Close()
+    return NewErrFromError(dbMgr, 233, err)
+}
+
+// ===============================
+// ===    PRIVATE FUNCTIONS    ===
+// ===============================
+
+// getUserBySql returns a user by given SQL (for internal usage only!)
+// "query" - sql query
+// "arg" - sql argument
+func (dbMgr *SqliteDbManager) getUserBySQL(query string, arg interface{}) (*user.User, *Error) {
+    Assert(dbMgr.db)
+    var userID uint64
+    var name string
+    var email string
+    var authType string
+    var authData string
+    var salt string
+    var promo string
+    var character byte
+    var gems uint32
+    var tp uint32
+    var skill uint32
+    var lastEnemy sql.NullInt64
+    var agentInfo string
+    var lastLogin time.Time
+
+    err := dbMgr.db.QueryRow(query, arg).Scan(&userID, &name, &email, &authType, &authData, &salt, &promo, &character,
+        &gems, &tp, &skill, &lastEnemy, &agentInfo, &lastLogin) // row is always != nil
+    if err == nil {
+        return &user.User{Character: character, Gems: gems, TrustPoints: tp, SkillRating: skill, Name: name,
+            Email: email, AuthType: authType, AuthData: authData, Salt: salt, Promocode: promo, ID: userID,
+            LastEnemy: uint64(lastEnemy.Int64), AgentInfo: agentInfo, LastLogin: lastLogin,
+            LastActive: time.Now()}, nil
+    }
+    return nil, NewErrFromError(dbMgr, 202, err)
+}
@@ -17,8 +17,10 @@ type Statistics struct {
     userManager   user.IUserManager
     server        network.IServer
     protocol      network.IProtocol
+    wsProtocol    network.IProtocol
+    tcpProtocol   network.IProtocol
     fakeSS        *FakeSidStore
-    room          *WaitingRoom
+    matchmaker    *Matchmaker
 }
 
 // Category Type expressed as a byte
@@ -46,6 +48,11 @@ const (
     catFieldRefsDown
     catCurrentEnvSize
     catWaitingCount
+    catWsConnections
+    catTCPConnections
+    catWaitP50Msec
+    catWaitP90Msec
+    catWaitP99Msec
 )
 
 // NewStatistics creates a new Statistics. Please do not create a Statistics directly
@@ -56,11 +63,12 @@ const (
 // "server" - reference to an IServer
 // "protocol" - reference to an IProtocol
 // "fakeSS" - reference to a FakeSidStore
-// "room" - reference to a WaitingRoom
+// "matchmaker" - reference to a Matchmaker
 func NewStatistics(token uint32, sidMgr *TSidManager, usrMgr user.IUserManager, battleMgr battle.IBattleManager, 
-        server network.IServer, protocol network.IProtocol, fakeSS *FakeSidStore, room *WaitingRoom) *Statistics {
+        server network.IServer, protocol network.IProtocol, fakeSS *FakeSidStore,
+        matchmaker *Matchmaker) *Statistics {
     // args may be NULL
-    return &Statistics{token, time.Now(), sidMgr, battleMgr, usrMgr, server, protocol, fakeSS, room}
+    return &Statistics{token, time.Now(), sidMgr, battleMgr, usrMgr, server, protocol, nil, nil, fakeSS, matchmaker}
 }
 
 // setSidManager assigns a non-NULL TSidManager for Statistics
@@ -87,6 +95,14 @@ func (stat *Statistics) setProtocol(protocol network.IProtocol) {
     stat.protocol = protocol
 }
 
+// setTransports assigns additional transport protocols for Statistics. Both may be NULL (if disabled)
+// "wsProtocol" - WebSocket protocol
+// "tcpProtocol" - TCP protocol
+func (stat *Statistics) setTransports(wsProtocol, tcpProtocol network.IProtocol) {
+    stat.wsProtocol = wsProtocol
+    stat.tcpProtocol = tcpProtocol
+}
+
 // getStats is the main function to retrieve current server state
 // "token" - client's token (must be equal to the server-side token)
 // "t0" - start time (to calculate approximate elapsed time of the response)
@@ -104,12 +120,18 @@ func (stat *Statistics) getStats(token uint32, t0 time.Time) ([]byte, *Error) {
         senders := Min(stat.protocol.GetSendersCount(), 65535)
         receivers := Min(stat.protocol.GetReceiversCount(), 65535)
         fakeSids := stat.fakeSS.getUsedSidsCount()
-        totalAi := Min(uint(stat.room.getSpawnedAiCount()), 65535)
+        totalAi := Min(uint(stat.matchmaker.getSpawnedAiCount()), 65535)
         batRefUp, batRefDown := stat.battleManager.GetBattleRefs()
         roundsRefUp, roundsRefDown := stat.battleManager.GetRoundRefs()
         fieldsRefUp, fieldsRefDown := stat.battleManager.GetFieldRefs()
         currentEnv := stat.battleManager.GetEnvironmentSize()
-        waiting := stat.room.getPendingCount()
+        waiting := stat.matchmaker.getPendingCount()
+        wsConns := getConnectionsCount(stat.wsProtocol)
+        tcpConns := getConnectionsCount(stat.tcpProtocol)
+        p50, p90, p99 := stat.matchmaker.getWaitPercentiles()
+        waitP50 := Min(uint(p50/time.Millisecond), 65535)
+        waitP90 := Min(uint(p90/time.Millisecond), 65535)
+        waitP99 := Min(uint(p99/time.Millisecond), 65535)
         msec := Min(uint(time.Since(t0)/time.Microsecond), 65535)
         return []byte{
             byte(catTimeElapsedMsec), byte(msec / 256),          byte(msec % 256),
@@ -131,7 +153,26 @@ func (stat *Statistics) getStats(token uint32, t0 time.Time) ([]byte, *Error) {
             byte(catFieldRefsUp),     byte(fieldsRefUp / 256),   byte(fieldsRefUp % 256),
             byte(catFieldRefsDown),   byte(fieldsRefDown / 256), byte(fieldsRefDown % 256),
             byte(catCurrentEnvSize),  byte(currentEnv / 256),    byte(currentEnv % 256),
-            byte(catWaitingCount),    byte(waiting / 256),       byte(waiting % 256)}, nil
+            byte(catWaitingCount),    byte(waiting / 256),       byte(waiting % 256),
+            byte(catWsConnections),   byte(wsConns / 256),       byte(wsConns % 256),
+            byte(catTCPConnections),  byte(tcpConns / 256),      byte(tcpConns % 256),
+            byte(catWaitP50Msec),     byte(waitP50 / 256),       byte(waitP50 % 256),
+            byte(catWaitP90Msec),     byte(waitP90 / 256),       byte(waitP90 % 256),
+            byte(catWaitP99Msec),     byte(waitP99 / 256),       byte(waitP99 % 256)}, nil
     }
     return []byte{}, NewErr(stat, 29, "Incorrect token %d != %d", token, stat.token)
 }
+
+// checkToken checks whether a given token is equal to the server-side token (it also authorizes admin functions)
+// "token" - client's token
+func (stat *Statistics) checkToken(token uint32) bool {
+    return token == stat.token
+}
+
+// getConnectionsCount returns current count of connections of a given stream transport (0 if the transport is NULL)
+func getConnectionsCount(protocol network.IProtocol) uint {
+    if protocol != nil {
+        return Min(protocol.GetReceiversCount(), 65535)
+    }
+    return 0
+}
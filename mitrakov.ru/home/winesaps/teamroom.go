@@ -0,0 +1,159 @@
+package main
+
+import "sync"
+import "time"
+import . "mitrakov.ru/home/winesaps/sid"   // nolint
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// TeamRoom is a component to form teams for team battles (2 vs. 2). A user may come either alone or with a friend:
+// 2 friends become a team as soon as both of them have named each other, whilst lone users are teamed up with each
+// other in order of arrival. Users that haven't been matched on time are removed from the room (there are no AI for
+// team battles).
+// This component is "dependent"
+type TeamRoom struct {
+    sync.Mutex
+    entries []*teamEntryT // in order of arrival
+    stop    chan bool
+}
+
+// teamEntryT is a single entry of a TeamRoom: a lone user, a user awaiting for a friend, or a ready team of 2 friends
+type teamEntryT struct {
+    sids    []Sid // 1 or 2 Session IDs
+    friend  Sid   // Session ID of a friend that the user is awaiting for (0 if none)
+    seconds int
+}
+
+// max wait time for team battles, in seconds
+const maxTeamWait = 30
+
+// NewTeamRoom creates a new TeamRoom. Please do not create a TeamRoom directly
+// "controller" - instance of Controller (non-NULL)
+func NewTeamRoom(controller *Controller) *TeamRoom {
+    Assert(controller)
+
+    room := new(TeamRoom)
+    room.stop = RunDaemon("teamroom", time.Second, func() {
+        var expired []Sid
+        room.Lock()
+        entries := room.entries[:0]
+        for _, entry := range room.entries {
+            entry.seconds--
+            if entry.seconds > 0 {
+                entries = append(entries, entry)
+            } else {
+                expired = append(expired, entry.sids...)
+            }
+        }
+        room.entries = entries
+        room.Unlock()
+        if len(expired) > 0 {
+            controller.teamExpired(expired)
+        }
+    })
+
+    return room
+}
+
+// join puts a user into the room and returns 2 teams (leaders go first), if a team battle can be started right now.
+// The user is removed from the room in the latter case, as well as the other 3 users.
+// "sid" - user's Session ID
+// "friend" - Session ID of a friend to play in the same team with (0 to play with anyone)
+func (room *TeamRoom) join(sid, friend Sid) (team1, team2 []Sid, ok bool) {
+    room.Lock()
+    defer room.Unlock()
+
+    room.remove(sid) // a user may have only 1 entry
+    if friend != 0 {
+        for _, entry := range room.entries {
+            if entry.friend == sid && len(entry.sids) == 1 && entry.sids[0] == friend {
+                entry.sids = append(entry.sids, sid)
+                entry.friend = 0
+                entry.seconds = maxTeamWait
+                return room.match()
+            }
+        }
+    }
+    room.entries = append(room.entries, &teamEntryT{[]Sid{sid}, friend, maxTeamWait})
+    return room.match()
+}
+
+// cancel removes a user from the room (if the user was a member of a team, the friend keeps awaiting for the user);
+// returns FALSE if the user has not been found in the room
+// "sid" - user's Session ID
+func (room *TeamRoom) cancel(sid Sid) bool {
+    room.Lock()
+    defer room.Unlock()
+    return room.remove(sid)
+}
+
+// getPendingCount returns current count of users awaiting in the room
+func (room *TeamRoom) getPendingCount() (res int) {
+    room.Lock()
+    defer room.Unlock()
+    for _, entry := range room.entries {
+        res += len(entry.sids)
+    }
+    return
+}
+
+// close shuts TeamRoom down and releases all seized resources
+func (room *TeamRoom) close() {
+    Assert(room.stop)
+    room.stop <- true
+}
+
+// remove removes a user from the room and returns FALSE if the user has not been found; please call this method only
+// under the lock
+// "sid" - user's Session ID
+func (room *TeamRoom) remove(sid Sid) (found bool) {
+    entries := room.entries[:0]
+    for _, entry := range room.entries {
+        switch {
+        case len(entry.sids) == 2 && entry.sids[0] == sid:
+            entry.sids, entry.friend, found = []Sid{entry.sids[1]}, sid, true
+        case len(entry.sids) == 2 && entry.sids[1] == sid:
+            entry.sids, entry.friend, found = []Sid{entry.sids[0]}, sid, true
+        case entry.sids[0] == sid:
+            found = true
+            continue
+        }
+        entries = append(entries, entry)
+    }
+    room.entries = entries
+    return
+}
+
+// match tries to form 2 teams from the entries in order of arrival, and removes the matched entries from the room;
+// please call this method only under the lock
+func (room *TeamRoom) match() (team1, team2 []Sid, ok bool) {
+    var teams [][]Sid
+    used := make(map[*teamEntryT]bool)
+    var lone *teamEntryT
+    for _, entry := range room.entries {
+        if entry.friend != 0 { // the user is still awaiting for a friend
+            continue
+        }
+        if len(entry.sids) == 2 {
+            teams = append(teams, entry.sids)
+            used[entry] = true
+        } else if lone == nil {
+            lone = entry
+        } else {
+            teams = append(teams, []Sid{lone.sids[0], entry.sids[0]})
+            used[lone] = true
+            used[entry] = true
+            lone = nil
+        }
+        if len(teams) == 2 {
+            entries := room.entries[:0]
+            for _, e := range room.entries {
+                if !used[e] {
+                    entries = append(entries, e)
+                }
+            }
+            room.entries = entries
+            return teams[0], teams[1], true
+        }
+    }
+    return nil, nil, false
+}
@@ -0,0 +1,34 @@
+package user
+
+import "math"
+
+// @mitrakov (2017-04-18): don't use ALL_CAPS const naming (gometalinter, stackoverflow.com/questions/22688906)
+
+// DefaultSkillRating is a skill rating of a newbie (see "skill_rating" column of "user" table)
+const DefaultSkillRating = 1500
+// minSkillRating is a floor for skill ratings, so that a user can never go below it
+const minSkillRating = 100
+// skillFactor is the Elo K-factor: max rating change per battle
+const skillFactor = 32
+// aiSkillDivisor reduces the K-factor for battles against AI (AI is not a real opponent, so such battles affect the
+// skill rating much less)
+const aiSkillDivisor = 4
+
+// getExpectedScore returns the expected score (probability to win, from 0 to 1) of a player against an opponent,
+// according to the Elo rating system
+// "rating" - skill rating of the player
+// "enemyRating" - skill rating of the opponent
+func getExpectedScore(rating, enemyRating uint32) float64 {
+    return 1 / (1 + math.Pow(10, (float64(enemyRating)-float64(rating))/400))
+}
+
+// calcSkillRatings returns new skill ratings of the winner and the loser
+// "winnerRating" - current skill rating of the winner
+// "loserRating" - current skill rating of the loser
+// "factor" - K-factor (see "skillFactor")
+func calcSkillRatings(winnerRating, loserRating uint32, factor float64) (newWinnerRating, newLoserRating uint32) {
+    delta := factor * (1 - getExpectedScore(winnerRating, loserRating))
+    newWinnerRating = uint32(math.Floor(float64(winnerRating) + delta + .5))
+    newLoserRating = uint32(math.Max(math.Floor(float64(loserRating) - delta + .5), minSkillRating))
+    return
+}
@@ -0,0 +1,26 @@
+package user
+
+import "testing"
+
+// TestCalcSkillRatings checks Elo rating changes, including the floor and the reduced K-factor for battles against AI
+func TestCalcSkillRatings(t *testing.T) {
+    tests := []struct {
+        winner, loser       uint32
+        factor              float64
+        newWinner, newLoser uint32
+    }{
+        {1500, 1500, skillFactor, 1516, 1484},
+        {1500, 1900, skillFactor, 1529, 1871}, // an underdog wins
+        {1900, 1500, skillFactor, 1903, 1497}, // a favourite wins
+        {110, 110, skillFactor, 126, minSkillRating},
+        {1500, 1500, skillFactor / aiSkillDivisor, 1504, 1496},
+        {DefaultSkillRating, 2700, skillFactor / aiSkillDivisor, 1508, 2692},
+    }
+    for _, test := range tests {
+        newWinner, newLoser := calcSkillRatings(test.winner, test.loser, test.factor)
+        if newWinner != test.newWinner || newLoser != test.newLoser {
+            t.Errorf("calcSkillRatings(%d, %d, %v) = %d, %d; expected %d, %d", test.winner, test.loser, test.factor,
+                newWinner, newLoser, test.newWinner, test.newLoser)
+        }
+    }
+}
@@ -11,6 +11,7 @@ type User struct {
     Sid         sid.Sid
     Gems        uint32
     TrustPoints uint32
+    SkillRating uint32 // Elo rating (1.4.0+)
     Name        string
     Email       string
     AuthType    string // ENUM: 'Local'
@@ -22,6 +23,7 @@ type User struct {
     LastEnemy   uint64
     LastLogin   time.Time
     LastActive  time.Time
+    BigMaps     bool // client supports levels with a header (negotiated on sign in, not stored in the DB)
 }
 
 // getLastActive is a thread-safe getter for LastActive attribute
@@ -31,6 +33,20 @@ func (user *User) getLastActive() time.Time {
     return user.LastActive
 }
 
+// GetSkillRating is a thread-safe getter for SkillRating attribute (1.4.0+)
+func (user *User) GetSkillRating() uint32 {
+    user.RLock()
+    defer user.RUnlock()
+    return user.SkillRating
+}
+
+// setSkillRating is a thread-safe setter for SkillRating attribute. Please note that this action does NOT affect the DB
+func (user *User) setSkillRating(skillRating uint32) {
+    user.Lock()
+    user.SkillRating = skillRating
+    user.Unlock()
+}
+
 // setLastActiveNow sets current time for LastActive attribute. Please note that this action does NOT affect the DB
 func (user *User) setLastActiveNow() {
     user.Lock()
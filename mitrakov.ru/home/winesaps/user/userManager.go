@@ -48,6 +48,7 @@ type IDbManager interface {
     GetAllAbilities() ([]byte, *Error)
     RegisterWin(ratingType byte, userID uint64, scoreDiff byte) *Error
     RegisterLoss(ratingType byte, userID uint64, scoreDiff byte) *Error
+    SetSkillRating(userID uint64, skillRating uint32) *Error
     RewardUser(userID uint64, gems, trustPoints uint32) *Error
     ConsumeTrustPoints(userID uint64, trustPoints uint32) *Error
     ChangeUser(userID uint64, email, hash string, character byte) *Error
@@ -57,6 +58,7 @@ type IDbManager interface {
     BuyProduct(userID uint64, code, days byte) (cost uint32, error *Error)
     GetWins(userID uint64) (uint32, *Error) // not used since 1.3.8
     GetRating(userID uint64, ratingType, limit byte) ([]byte, *Error)
+    GetSkillRating(userID uint64, limit byte) ([]byte, *Error)
     GetBestUsers(ratingType, limit byte) (ids []uint64, error *Error)
     ClearRating(ratingType byte) *Error
     GetUserFriends(userID uint64) ([]byte, []string, *Error)
@@ -115,6 +117,7 @@ const period = time.Minute
 const (
     ratingGeneral = iota
     ratingWeekly
+    ratingSkill // since 1.4.0 (it's not a DB "rating" type, see GetRating())
 )
 
 // UsrManager is an implementation of IUserManager.
@@ -127,6 +130,7 @@ type UsrManager struct {
     sidToUser     map[Sid]*User
     usersTotal    map[uint64]bool           // only for statistics "Total users"
     sidManager    *TSidManager
+    tokenManager  *TokenManager
     checker       *checker.SignatureChecker
     dbManager     IDbManager
     packer        IPacker
@@ -141,6 +145,7 @@ type UsrManager struct {
 // NewUserManager creates a new instance of UsrManager and returns a reference to IUserManager interface.
 // Please do not create a UsrManager directly.
 // "sidManager" - reference to a TSidManager
+// "tokenManager" - reference to a TokenManager
 // "checker" - reference to a SignatureChecker
 // "dbManager" - reference to a IDbManager
 // "packer" - reference to a IPacker
@@ -149,10 +154,10 @@ type UsrManager struct {
 // "skuGems" - map [SKU -> price], e.g. "Map('gems_pack' -> 50)" means that gems_pack costs 50 gems
 // "ratingRewards" - map [rating -> reward], e.g. "Map('rating.gold' -> 150)" means that a gold user will gain 150 gems
 // "promoReward" - std reward for activating promo code (in gems)
-func NewUserManager(sidManager *TSidManager, checker *checker.SignatureChecker, dbManager IDbManager, 
-        packer IPacker, controller IController, localArg string, skuGems map[string]uint32, 
+func NewUserManager(sidManager *TSidManager, tokenManager *TokenManager, checker *checker.SignatureChecker,
+        dbManager IDbManager, packer IPacker, controller IController, localArg string, skuGems map[string]uint32, 
         ratingRewards map[int]uint32, promoReward uint32) IUserManager {
-    Assert(sidManager, checker, dbManager, skuGems)
+    Assert(sidManager, tokenManager, checker, dbManager, skuGems)
 
     usrMgr := new(UsrManager)
     usrMgr.nameToUser = make(map[string]*User)
@@ -160,6 +165,7 @@ func NewUserManager(sidManager *TSidManager, checker *checker.SignatureChecker,
     usrMgr.sidToUser = make(map[Sid]*User)
     usrMgr.usersTotal = make(map[uint64]bool)
     usrMgr.sidManager = sidManager
+    usrMgr.tokenManager = tokenManager
     usrMgr.checker = checker
     usrMgr.dbManager = dbManager
     usrMgr.packer = packer
@@ -249,7 +255,7 @@ func (usrMgr *UsrManager) SignIn(name, password, agentInfo string) (user *User,
                 err = NewErr(usrMgr, 31, "Incorrect login/password")
             }
         } else {
-            err = NewErr(usrMgr, 32, "Incorrect user auth type (%d)", user.AuthType)
+            err = NewErr(usrMgr, 32, "Incorrect user auth type (%s)", user.AuthType)
         }
     }
     return
@@ -395,10 +401,12 @@ func (usrMgr *UsrManager) RewardUsers(winnerSid, loserSid Sid, score1, score2 by
     box *MailBox) (reward uint32, err *Error) {
 
     Assert(usrMgr.dbManager)
-    var err1, err2, err3, err4, err5, err6, err7, err8, err9 *Error
+    var err1, err2, err3, err4, err5, err6, err7, err8, err9, err10 *Error
 
     // 1. Register rating
     err1 = usrMgr.registerRating(winnerSid, loserSid, score1, score2)
+    // 1.1 Update skill rating
+    err10 = usrMgr.registerSkillRating(winnerSid, loserSid)
     // 2. Reward winner
     if user, ok := usrMgr.GetUserBySid(winnerSid); ok {
         if trust {
@@ -451,7 +459,7 @@ func (usrMgr *UsrManager) RewardUsers(winnerSid, loserSid Sid, score1, score2 by
         box.Put(winnerSid, usrMgr.packer.PackUserInfo(info))
     } // else NOT an error (it just might be AI)
     
-    err = NewErrs(err1, err2, err3, err4, err5, err6, err7, err9)
+    err = NewErrs(err1, err2, err3, err4, err5, err6, err7, err9, err10)
     return
 }
 
@@ -485,7 +493,7 @@ func (usrMgr *UsrManager) ChangePassword(user *User, oldPassword, newPassword st
         return err
     }
     
-    return NewErr(usrMgr, 33, "Cannot change password for", user.Name, "Old password incorrect")
+    return NewErr(usrMgr, 33, "Cannot change password for %s: old password incorrect", user.Name)
 }
 
 // GetAllAbilities returns a full list of abilities, present in DB
@@ -515,14 +523,17 @@ func (usrMgr *UsrManager) GetWins(user *User) (uint32, *Error) {
 }
 
 // GetRating returns "Top N" ranking by "ratingType" for a given user.
-// "ratingType" - rating type (ratingGeneral, ratingWeekly)
+// "ratingType" - rating type (ratingGeneral, ratingWeekly, ratingSkill)
 // The format of a single ranking row is the following (all numbers are big-endian):
 // - name (null-terminated string)
 // - wins (4 bytes)
 // - losses (4 bytes)
-// - score difference (4 bytes)
+// - score difference (4 bytes); for ratingSkill it's the skill rating instead
 func (usrMgr *UsrManager) GetRating(user *User, ratingType byte) ([]byte, *Error) {
     Assert(user, usrMgr.dbManager)
+    if ratingType == ratingSkill {
+        return usrMgr.dbManager.GetSkillRating(user.ID, ratingCount)
+    }
     return usrMgr.dbManager.GetRating(user.ID, ratingType+1, ratingCount) // +1 because DB needs values [1,2]
 }
 
@@ -605,7 +616,7 @@ func (usrMgr *UsrManager) CheckPayment(user *User, jsonStr, signature string) (g
                             box.Put(user.Sid, usrMgr.packer.PackUserInfo(info))
                         }
                     } else {
-                        err = NewErr(usrMgr, 36, "Gems not found for sku: ", payment.ProductId)
+                        err = NewErr(usrMgr, 36, "Gems not found for sku: %s", payment.ProductId)
                     }
                 }
             }
@@ -681,13 +692,16 @@ func (usrMgr *UsrManager) updateWeekRating() {
     }
 }
 
-// kickOutInactiveUsers kicks inactive users out after "maxInactivityMin" minutes of idleness.
-// This method may be polled periodically.
+// kickOutInactiveUsers kicks inactive users out after "maxInactivityMin" minutes of idleness (their tokens get
+// revoked as well). This method may be polled periodically.
 func (usrMgr *UsrManager) kickOutInactiveUsers() {
+    Assert(usrMgr.tokenManager)
+
     usrMgr.RLock()
     for _, user := range usrMgr.sidToUser {
         usrMgr.RUnlock()
         if time.Since(user.getLastActive()) > maxInactivityMin*time.Minute {
+            usrMgr.tokenManager.RevokeToken(user.Sid) // before SignOut, because the SID may be re-used right after it
             usrMgr.SignOut(user) // this affects our map, but in Go it's safe (stackoverflow.com/questions/23229975)
             // here might be "sender.Send('you kicked')", but it's irrational (in 99% a user is just out of network)
         }
@@ -715,3 +729,35 @@ func (usrMgr *UsrManager) registerRating(winnerSid, loserSid Sid, score1, score2
     } // else not an error (it might be AI)
     return NewErrs(err1, err2, err3, err4)
 }
+
+// registerSkillRating updates skill ratings (Elo) of the winner and the loser in DB. If one of them is AI, the AI is
+// considered to have the default skill rating, and the K-factor is reduced (see "aiSkillDivisor").
+// "winnerSid" - winner Session ID
+// "loserSid" - loser Session ID
+func (usrMgr *UsrManager) registerSkillRating(winnerSid, loserSid Sid) *Error {
+    var err1, err2 *Error
+    winner, ok1 := usrMgr.GetUserBySid(winnerSid)
+    loser, ok2 := usrMgr.GetUserBySid(loserSid)
+
+    switch {
+    case ok1 && ok2:
+        winnerRating, loserRating := calcSkillRatings(winner.GetSkillRating(), loser.GetSkillRating(), skillFactor)
+        if err1 = usrMgr.dbManager.SetSkillRating(winner.ID, winnerRating); err1 == nil {
+            winner.setSkillRating(winnerRating)
+        }
+        if err2 = usrMgr.dbManager.SetSkillRating(loser.ID, loserRating); err2 == nil {
+            loser.setSkillRating(loserRating)
+        }
+    case ok1: // the loser is AI
+        winnerRating, _ := calcSkillRatings(winner.GetSkillRating(), DefaultSkillRating, skillFactor/aiSkillDivisor)
+        if err1 = usrMgr.dbManager.SetSkillRating(winner.ID, winnerRating); err1 == nil {
+            winner.setSkillRating(winnerRating)
+        }
+    case ok2: // the winner is AI
+        _, loserRating := calcSkillRatings(DefaultSkillRating, loser.GetSkillRating(), skillFactor/aiSkillDivisor)
+        if err2 = usrMgr.dbManager.SetSkillRating(loser.ID, loserRating); err2 == nil {
+            loser.setSkillRating(loserRating)
+        }
+    }
+    return NewErrs(err1, err2)
+}
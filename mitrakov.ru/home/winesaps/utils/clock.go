@@ -0,0 +1,127 @@
+package utils
+
+import "log"
+import "sync"
+import "time"
+
+// Clock is a source of time for components that schedule periodic or delayed actions (see RunDaemon() and RunTask()).
+// The server uses RealClock, whilst simulations may use VirtualClock to run as fast as possible (1.4.0+)
+type Clock interface {
+    Now() time.Time
+    RunDaemon(name string, t time.Duration, f func()) chan bool
+    RunTask(name string, t time.Duration, f func()) chan bool
+}
+
+// RealClock is a Clock based on the system time
+type RealClock struct /*implements Clock*/ {}
+
+// VirtualClock is a Clock that doesn't tick by itself: the time jumps to the next scheduled action on each Step(), so
+// that the actions are performed in the same order as with RealClock, but without waiting.
+// Please note that actions are called synchronously by a goroutine that calls Step()
+type VirtualClock struct /*implements Clock*/ {
+    sync.Mutex
+    now     time.Time
+    actions []*actionT
+}
+
+// actionT is a helper structure to hold a scheduled action of VirtualClock
+type actionT struct {
+    at     time.Time
+    period time.Duration // 0 for tasks (i.e. the action is performed only once)
+    f      func()
+    stop   chan bool
+    done   bool // TRUE if a task has been already performed
+}
+
+// Now returns current system time
+func (RealClock) Now() time.Time {
+    return time.Now()
+}
+
+// RunDaemon runs a daemon with the system timer (see utils.RunDaemon())
+func (RealClock) RunDaemon(name string, t time.Duration, f func()) chan bool {
+    return RunDaemon(name, t, f)
+}
+
+// RunTask starts a task with the system timer (see utils.RunTask())
+func (RealClock) RunTask(name string, t time.Duration, f func()) chan bool {
+    return RunTask(name, t, f)
+}
+
+// NewVirtualClock creates a new instance of VirtualClock, that starts with a given time
+// "start" - initial time
+func NewVirtualClock(start time.Time) *VirtualClock {
+    return &VirtualClock{now: start}
+}
+
+// Now returns current virtual time
+func (clock *VirtualClock) Now() time.Time {
+    clock.Lock()
+    defer clock.Unlock()
+    return clock.now
+}
+
+// RunDaemon schedules a function "f" to be called periodically with intervals of "t" of virtual time.
+// Method returns a channel[Bool], so that the daemon can be stopped with "stopMyDaemon <- true"
+// "name" - name of a daemon [optional]
+func (clock *VirtualClock) RunDaemon(name string, t time.Duration, f func()) chan bool {
+    log.Println("Starting virtual daemon", name, "with period", t)
+    return clock.schedule(t, t, f)
+}
+
+// RunTask schedules a function "f" to be called once after "t" of virtual time.
+// Method returns a channel[Bool], so that the task can be stopped in advance with "stopMyTimer <- true"
+// "name" - name of a timer [optional]
+func (clock *VirtualClock) RunTask(name string, t time.Duration, f func()) chan bool {
+    log.Println("Starting virtual task", name, "with timeout", t)
+    return clock.schedule(t, 0, f)
+}
+
+// Step moves the virtual time to the nearest scheduled action and performs it. Returns FALSE if there are no actions
+// scheduled (then the time is not changed)
+func (clock *VirtualClock) Step() bool {
+    clock.Lock()
+    var next *actionT
+    actions := clock.actions[:0]
+    for _, action := range clock.actions {
+        if action.done {
+            continue
+        }
+        select {
+        case <-action.stop:
+            continue // stopped
+        default:
+        }
+        if next == nil || action.at.Before(next.at) {
+            next = action
+        }
+        actions = append(actions, action)
+    }
+    clock.actions = actions
+    if next == nil {
+        clock.Unlock()
+        return false
+    }
+    clock.now = next.at
+    if next.period > 0 {
+        next.at = next.at.Add(next.period)
+    } else {
+        next.done = true // a task is performed only once (it's removed on the next step)
+    }
+    clock.Unlock()
+
+    next.f() // an action may schedule other actions, so the lock must be released
+    return true
+}
+
+// schedule adds a new action
+// "t" - delay before the first call
+// "period" - interval between calls (pass 0 to call the function only once)
+// "f" - function to call
+func (clock *VirtualClock) schedule(t, period time.Duration, f func()) chan bool {
+    stop := make(chan bool, 1)
+    clock.Lock()
+    clock.actions = append(clock.actions, &actionT{clock.now.Add(t), period, f, stop, false})
+    clock.Unlock()
+    return stop
+}
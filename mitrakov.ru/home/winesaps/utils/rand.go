@@ -0,0 +1,44 @@
+package utils
+
+import "sync"
+import "time"
+import "math/rand"
+
+// Rand is a thread-safe pseudo-random generator with a known seed, so that a sequence of random numbers can be
+// reproduced (e.g. to replay a battle from a bug report). Please note that global "math/rand" functions should not be
+// used in the battle engine and AI.
+type Rand struct {
+    sync.Mutex
+    seed int64
+    rnd  *rand.Rand
+}
+
+// NewSeed returns a new seed for Rand (current time is used)
+func NewSeed() int64 {
+    return time.Now().UnixNano()
+}
+
+// NewRand creates a new instance of Rand with a given seed. Please do not create a Rand directly.
+func NewRand(seed int64) *Rand {
+    return &Rand{seed: seed, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Seed returns the seed which the generator was created with
+func (r *Rand) Seed() int64 {
+    return r.seed
+}
+
+// Intn returns a pseudo-random number in [0, n); "n" must be > 0
+func (r *Rand) Intn(n int) int {
+    r.Lock()
+    defer r.Unlock()
+    return r.rnd.Intn(n)
+}
+
+// Fork creates a new independent generator, seeded by the next number of this one; so that a tree of generators is
+// fully determined by the root seed, regardless of how intensively each of them is used
+func (r *Rand) Fork() *Rand {
+    r.Lock()
+    defer r.Unlock()
+    return NewRand(r.rnd.Int63())
+}
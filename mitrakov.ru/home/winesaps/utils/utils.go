@@ -1,7 +1,9 @@
 package utils
 
+import "os"
 import "fmt"
 import "time"
+import "io/ioutil"
 import "reflect"
 import "math/rand"
 import "encoding/base64"
@@ -115,3 +117,14 @@ func CheckPassword(hash, password, salt string) bool {
     // return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password + salt)) == nil
     return GetHash(password, salt) == hash
 }
+
+// WriteFileAtomic writes "data" to a temp file and renames it to a given "filename", so that a crash never leaves a
+// broken file (a reader sees either the old content or the new one)
+func WriteFileAtomic(filename string, data []byte) error {
+    tmp := filename + ".tmp"
+    err := ioutil.WriteFile(tmp, data, 0644)
+    if err == nil {
+        err = os.Rename(tmp, filename)
+    }
+    return err
+}
@@ -0,0 +1,174 @@
+package validator
+
+import "log"
+import "path/filepath"
+import "mitrakov.ru/home/winesaps/ai"
+import "mitrakov.ru/home/winesaps/battle"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// LevelValidator is a component that checks level files offline, so that broken levels are discovered before a battle
+// starts (the battle package finds such problems only in newField() and newRound())
+// This component is independent.
+type LevelValidator struct{}
+
+// levels whose food cannot be reached by walking, climbing and jumping only (i.e. without beams, teleports, etc.);
+// for these levels unreachable food is reported as a warning rather than an error
+var unreachableFoodAllowed = map[string]bool{"assembly_hall.level": true, "creepy_castle.level": true,
+    "dark_castle.level": true, "lumber_mill.level": true, "ruined_stronghold.level": true, "training.level": true,
+    "tranquil_country.level": true, "unassailable_fortress.level": true, "verdant_grass.level": true}
+
+// Validate checks a given level and returns all the errors (a level with errors must not be loaded) and warnings
+// "name" - level file name (may contain a path)
+// "level" - level raw bytearray
+// nolint: gocyclo
+func Validate(name string, level []byte) (errs, warnings []*Error) {
+    v := LevelValidator{}
+    width, height, offset := battle.ParseHeader(level)
+    gridSize := width * height
+    if len(level) > 0 && level[0] == 0xFF && (offset == 0 || gridSize == 0) { // 0xFF is a header marker
+        return append(errs, NewErr(v, 135, "Incorrect header (width=%d, height=%d)", width, height)), nil
+    }
+    if len(level) < offset+gridSize {
+        return append(errs, NewErr(v, 130, "Incorrect level length (%d); must be >= %d", len(level),
+            offset+gridSize)), nil
+    }
+    wide := battle.IsWide(width, height)
+    xySize := TernaryInt(wide, 2, 1)
+
+    // parse level map
+    positions := make(map[byte][]uint16) // object ID -> list of xy
+    curObjNum := 0
+    for i := 0; i < gridSize; i++ {
+        id := level[offset+i] & 0x3F
+        if battle.NumberedObjects[id] {
+            curObjNum++
+        } else if !battle.UnnumberedObjects[id] {
+            warnings = append(warnings, NewErr(v, 131, "Unknown object 0x%02X (xy=%d)", id, i))
+        }
+        positions[id] = append(positions[id], uint16(i))
+    }
+
+    if curObjNum > battle.MaxObjNum {
+        errs = append(errs, NewErr(v, 129, "Too many objects (%d); must be <= %d", curObjNum, battle.MaxObjNum))
+    }
+
+    // parse additional sections
+    nums := make(map[byte]bool)
+    for j := offset + gridSize; j < len(level); {
+        if j+1 >= len(level) {
+            errs = append(errs, NewErr(v, 135, "Truncated section header (offset=%d)", j))
+            break
+        }
+        code, size := level[j], int(level[j+1])
+        data := level[j+2:]
+        if size > len(data) {
+            errs = append(errs, NewErr(v, 135, "Section %d is truncated (offset=%d, len=%d)", code, j, size))
+            break
+        }
+        data = data[:size]
+        switch code {
+        case 1: // additional level objects (num, id, xy), where xy takes 2 bytes on wide levels
+            if size%(2+xySize) != 0 {
+                errs = append(errs, NewErr(v, 135, "Section 1 length (%d) must be a multiple of %d", size, 2+xySize))
+            }
+            for k := 0; k+1+xySize < size; k += 2 + xySize {
+                num, id, xy := data[k], data[k+1], battle.GetXy(data[k+2:], wide)
+                if int(num) <= curObjNum || nums[num] {
+                    errs = append(errs, NewErr(v, 132, "Incorrect obj num (%d); must be unique and > %d", num,
+                        curObjNum))
+                }
+                if int(xy) >= gridSize {
+                    errs = append(errs, NewErr(v, 133, "Incorrect xy (%d)", xy))
+                } else if battle.NumberedObjects[id] || battle.UnnumberedObjects[id] {
+                    positions[id] = append(positions[id], xy)
+                } else {
+                    warnings = append(warnings, NewErr(v, 131, "Unknown object 0x%02X in section 1 (xy=%d)", id, xy))
+                }
+                nums[num] = true
+            }
+        case 2: // style pack
+            if size != 1 {
+                errs = append(errs, NewErr(v, 135, "Section 2 length (%d) must be 1", size))
+            }
+        case 3: // round time
+            if size != 1 {
+                errs = append(errs, NewErr(v, 135, "Section 3 length (%d) must be 1", size))
+            } else if data[0] == 0 {
+                errs = append(errs, NewErr(v, 136, "Round time must be > 0"))
+            }
+        default:
+            errs = append(errs, NewErr(v, 135, "Unknown section %d (offset=%d)", code, j))
+        }
+        j += size + 2
+    }
+
+    // check actors and entries
+    for _, id := range []byte{0x04, 0x05} {
+        if n := len(positions[id]); n != 1 {
+            errs = append(errs, NewErr(v, 134, "Actor%d must be exactly 1 (found %d)", id-3, n))
+        }
+    }
+    entries := []byte{0x07, 0x08}
+    if n3, n4 := len(positions[0x18]), len(positions[0x19]); n3 > 0 || n4 > 0 { // level for team battles
+        if n3 != 1 || n4 != 1 {
+            errs = append(errs, NewErr(v, 134, "Actor3 and Actor4 must be exactly 1 (found %d and %d)", n3, n4))
+        }
+        entries = append(entries, 0x1A, 0x1B)
+    }
+    graph := ai.ParseLevel(level, 0) // the same graph that AI uses
+    reachable := make(map[byte]map[uint16]bool) // entry ID -> xy of all nodes reachable from the entry
+    for _, id := range entries {
+        if xys := positions[id]; len(xys) > 0 {
+            reachable[id] = graph.Reachable(xys[0])
+        } else {
+            warnings = append(warnings, NewErr(v, 138, "Entry%d not found", getEntryNumber(id)))
+        }
+    }
+
+    // check reachability of food from all the entries; since the graph doesn't take things (beams, teleports, etc.)
+    // into account, the levels that rely on things must be listed in "unreachableFoodAllowed"
+    foodCount := 0
+    for id := byte(0x10); id <= 0x17; id++ { // food IDs
+        foodCount += len(positions[id])
+        for _, entry := range entries {
+            for _, xy := range positions[id] {
+                if nodes, ok := reachable[entry]; ok && !nodes[xy] {
+                    err := NewErr(v, 137, "Food 0x%02X (xy=%d) is unreachable from Entry%d", id, xy,
+                        getEntryNumber(entry))
+                    if unreachableFoodAllowed[filepath.Base(name)] {
+                        warnings = append(warnings, err)
+                    } else {
+                        errs = append(errs, err)
+                    }
+                }
+            }
+        }
+    }
+    if foodCount == 0 {
+        warnings = append(warnings, NewErr(v, 139, "No food found"))
+    }
+    return
+}
+
+// getEntryNumber returns a number of an entry by its object ID (e.g. 1 for Entry1 (0x07) or 3 for Entry3 (0x1A))
+func getEntryNumber(id byte) int {
+    if id >= 0x1A {
+        return int(id) - 0x17
+    }
+    return int(id) - 6
+}
+
+// Filter is a filter for filereader.NewFileReader() that logs all the problems of a given level and rejects the level
+// if it has errors
+// "name" - level file name
+// "level" - level raw bytearray
+func Filter(name string, level []byte) bool {
+    errs, warnings := Validate(name, level)
+    for _, err := range errs {
+        log.Println("Level", name, "rejected:", err)
+    }
+    for _, warning := range warnings {
+        log.Println("Level", name, "warning:", warning)
+    }
+    return len(errs) == 0
+}
@@ -0,0 +1,91 @@
+package validator
+
+import "testing"
+import "io/ioutil"
+import "path/filepath"
+import "mitrakov.ru/home/winesaps/battle"
+import . "mitrakov.ru/home/winesaps/utils" // nolint
+
+// newLevel builds a level of given dimensions (pass 0 for a legacy 51x5 level without a header) with given objects
+// (xy -> object ID) and additional sections; all the cells have a Block at the bottom
+func newLevel(width, height int, objects map[int]byte, sections ...byte) []byte {
+    res := []byte{}
+    if width > 0 {
+        res = append(res, 0xFF, 2, byte(width), byte(height))
+    } else {
+        width, height = 51, 5
+    }
+    grid := make([]byte, width*height)
+    for xy := range grid {
+        grid[xy] = 0x40 | objects[xy]
+    }
+    return append(append(res, grid...), sections...)
+}
+
+// codes returns error codes of given errors
+func codes(errs []*Error) []byte {
+    res := []byte{}
+    for _, err := range errs {
+        res = append(res, GetErrorCode(err))
+    }
+    return res
+}
+
+// TestValidate checks that broken levels are rejected with proper error codes
+func TestValidate(t *testing.T) {
+    actors := map[int]byte{0: 0x04, 10: 0x05, 1: 0x07, 11: 0x08, 5: 0x10}
+    team := map[int]byte{0: 0x04, 10: 0x05, 20: 0x18, 30: 0x19, 5: 0x10}
+    crowded := map[int]byte{0: 0x04, 10: 0x05, 1: 0x07, 11: 0x08}
+    for xy := 20; xy < 20+battle.MaxObjNum; xy++ {
+        crowded[xy] = 0x06 // wolves
+    }
+    walled := map[int]byte{0: 0x04, 10: 0x05, 1: 0x07, 11: 0x08, 5: 0x10, 29: 0x01, 30: 0x10, 31: 0x01} // food inside walls
+
+    tests := []struct {
+        name  string
+        level []byte
+        errs  []byte
+    }{
+        {"valid", newLevel(0, 0, actors), []byte{}},
+        {"valid wide", newLevel(20, 20, actors, 1, 4, 4, 0x10, 0x00, 0x10), []byte{}},
+        {"truncated", newLevel(0, 0, actors)[:100], []byte{130}},
+        {"no actor2", newLevel(0, 0, map[int]byte{0: 0x04}), []byte{134}},
+        {"no mate", newLevel(0, 0, map[int]byte{0: 0x04, 10: 0x05, 20: 0x18}), []byte{134}},
+        {"team", newLevel(0, 0, team), []byte{}},
+        {"obj num", newLevel(0, 0, actors, 1, 3, 2, 0x10, 7), []byte{132}},
+        {"duplicate num", newLevel(0, 0, actors, 1, 6, 4, 0x10, 7, 4, 0x10, 8), []byte{132}},
+        {"xy", newLevel(20, 20, actors, 1, 4, 4, 0x10, 0x01, 0x90), []byte{133}},
+        {"section 1 length", newLevel(20, 20, actors, 1, 3, 3, 0x10, 7), []byte{135}},
+        {"round time", newLevel(0, 0, actors, 3, 1, 0), []byte{136}},
+        {"unknown section", newLevel(0, 0, actors, 9, 1, 0), []byte{135}},
+        {"truncated section", newLevel(0, 0, actors, 2, 5, 0), []byte{135}},
+        {"header", []byte{0xFF, 2, 0, 5}, []byte{135}},
+        {"too many objects", newLevel(20, 20, crowded), []byte{129}},
+        {"unreachable food", newLevel(0, 0, walled), []byte{137, 137}},
+        {"training.level", newLevel(0, 0, walled), []byte{}}, // unreachable food is allowed for this level
+    }
+    for _, test := range tests {
+        errs, _ := Validate(test.name, test.level)
+        if res := codes(errs); string(res) != string(test.errs) {
+            t.Errorf("%s: errors %v (%v), expected %v", test.name, res, errs, test.errs)
+        }
+    }
+}
+
+// TestValidateLevels checks that all the levels shipped with the server are valid, except for the known broken ones
+func TestValidateLevels(t *testing.T) {
+    broken := map[string]bool{"tutorial.level": true} // no Actor2
+    files, err := filepath.Glob(filepath.Join("..", "levels", "*.level"))
+    if err != nil || len(files) == 0 {
+        t.Fatalf("Levels not found: %v", err)
+    }
+    for _, file := range files {
+        level, err := ioutil.ReadFile(file)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if errs, _ := Validate(file, level); (len(errs) > 0) != broken[filepath.Base(file)] {
+            t.Errorf("%s: %v", filepath.Base(file), errs)
+        }
+    }
+}